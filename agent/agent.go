@@ -4,16 +4,20 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	toml "github.com/pelletier/go-toml"
 	"github.com/pelletier/go-toml/query"
 	"github.com/pkg/errors"
 	"github.com/stairlin/kargo/context"
 	"github.com/stairlin/kargo/log"
+	"github.com/stairlin/kargo/pkg/keytmpl"
+	"github.com/stairlin/kargo/pkg/unit"
 	"github.com/stairlin/kargo/plugin/notification"
 	"github.com/stairlin/kargo/plugin/process"
 	"github.com/stairlin/kargo/plugin/source"
 	"github.com/stairlin/kargo/plugin/storage"
+	"github.com/stairlin/kargo/spool"
 
 	// Load all plugins
 	_ "github.com/stairlin/kargo/plugin/notification/all"
@@ -27,45 +31,59 @@ type Agent struct {
 	Workdir string `toml:"workdir"`
 	Debug   bool   `toml:"debug"`
 	Silent  bool
+	// SpoolDir is the directory where backups are kept until they are
+	// uploaded (optional)
+	SpoolDir     string `toml:"spool_dir"`
+	SpoolSize    string `toml:"spool_size"`
+	SpoolRetries int    `toml:"spool_retries"`
+	// KeyTemplate is the template of backup keys (e.g. "{source}/{env}/{unix}"),
+	// and Labels are the values of its custom fields
+	KeyTemplate string            `toml:"key_template"`
+	Labels      map[string]string `toml:"labels"`
 
 	Source     source.Source
 	Processors []process.Processor
 	Storage    storage.Storage
 	Notifiers  []notification.Notifier
+
+	// Throttle and StorageThrottle enforce the bandwidth limits of the agent
+	// and of the storage
+	Throttle        *Throttle
+	StorageThrottle *Throttle
+	// Spool is nil when no spool directory is configured
+	Spool *spool.Spool
+	// Template is the parsed key template
+	Template *keytmpl.Template
+
+	stages []Stage
 }
 
 // Build returns a new Agent with all plugins loaded
 func Build(ctx *context.Context, configPath string) (*Agent, error) {
 	ctx.Info("Init...", log.String("config", configPath))
-	tree, err := toml.LoadFile(configPath)
+	tree, err := loadConfig(configPath)
 	if err != nil {
-		return nil, errors.Wrap(
-			err, fmt.Sprintf("cannot open config file: %s", configPath),
-		)
+		return nil, err
 	}
 
-	// Replace environment variables with their value
-	q, _ := query.Compile("$..")
-	results := q.Execute(tree)
-	for _, item := range results.Values() {
-		switch v := item.(type) {
-		case *toml.Tree:
-			for _, key := range v.Keys() {
-				v.Set(key, valueOf(v.Get(key)))
+	a, err := newAgent(tree)
+	if err != nil {
+		return nil, err
+	}
+	if a.SpoolDir != "" {
+		var size int64
+		if a.SpoolSize != "" {
+			b, err := unit.ParseByte(a.SpoolSize)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid spool size")
 			}
-		case []*toml.Tree:
-			for _, tree := range v {
-				for _, key := range tree.Keys() {
-					tree.Set(key, valueOf(tree.Get(key)))
-				}
+			if b < 0 {
+				return nil, errors.New("spool size must be positive")
 			}
+			size = int64(b)
 		}
-	}
-
-	a := &Agent{}
-	if conf, ok := tree.Get("agent").(*toml.Tree); ok {
-		if err := conf.Unmarshal(a); err != nil {
-			return nil, errors.Wrap(err, "cannot unmarshal agent config")
+		if a.Spool, err = spool.Open(a.SpoolDir, size); err != nil {
+			return nil, err
 		}
 	}
 	if ctx.Workdir == "" {
@@ -89,24 +107,22 @@ func Build(ctx *context.Context, configPath string) (*Agent, error) {
 				return nil, fmt.Errorf("cannot init <%s> %s", k, err)
 			}
 			a.Source = source
+			a.addStage(StageSource, k, conf.Get(k))
 		}
 	}
 
 	// Storage
 	if conf, ok := tree.Get("storage").(*toml.Tree); ok {
 		for _, k := range conf.Keys() {
-			storageCreator, ok := storage.Storages[k]
-			if !ok {
-				return nil, fmt.Errorf("storage <%s> does not exist", k)
-			}
-			storage := storageCreator()
-			if err := conf.Get(k).(*toml.Tree).Unmarshal(storage); err != nil {
-				return nil, fmt.Errorf("cannot unmarshal <%s> config", k)
-			}
-			if err := storage.Init(); err != nil {
-				return nil, fmt.Errorf("cannot init <%s> %s", k, err)
+			storage, err := buildStorage(k, conf.Get(k))
+			if err != nil {
+				return nil, err
 			}
 			a.Storage = storage
+			a.addStage(StageStorage, k, conf.Get(k))
+			if err := setLimits(a.StorageThrottle, conf.Get(k).(*toml.Tree)); err != nil {
+				return nil, fmt.Errorf("cannot set <%s> limits %s", k, err)
+			}
 		}
 	}
 
@@ -129,6 +145,7 @@ func Build(ctx *context.Context, configPath string) (*Agent, error) {
 				return nil, fmt.Errorf("cannot init <%s> %s", k, err)
 			}
 			a.Processors = append(a.Processors, proc)
+			a.addStage(StageProcessor, k, conf.Get(k))
 		}
 	}
 
@@ -155,12 +172,60 @@ func Build(ctx *context.Context, configPath string) (*Agent, error) {
 					return nil, fmt.Errorf("cannot init <%s>", k)
 				}
 				a.Notifiers = append(a.Notifiers, notifier)
+				a.addStage(StageNotifier, k, t)
 			}
 		}
 	}
 	return a, nil
 }
 
+// NewKey returns the key of a new backup created at t, built from the key
+// template
+func (a *Agent) NewKey(t time.Time) (string, error) {
+	key, err := a.Template.Execute(a.Source.Name(), t, a.Labels)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot build key")
+	}
+	return storage.CleanKey(key)
+}
+
+// Queue returns a queue which uploads the backups of the spool to the storage
+func (a *Agent) Queue() *spool.Queue {
+	q := spool.NewQueue(a.Spool, a.Storage)
+	if a.SpoolRetries > 0 {
+		q.Retries = a.SpoolRetries
+	}
+	q.Throttle = a.ThrottleUpload
+	return q
+}
+
+// BuildStorage returns an agent with the storage of the config file, along
+// with its limits and its key template, regardless of the other plugins it
+// contains
+func BuildStorage(ctx *context.Context, configPath string) (*Agent, error) {
+	ctx.Info("Init storage...", log.String("config", configPath))
+	tree, err := loadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	a, err := newAgent(tree)
+	if err != nil {
+		return nil, err
+	}
+	conf, ok := tree.Get("storage").(*toml.Tree)
+	if !ok || len(conf.Keys()) != 1 {
+		return nil, fmt.Errorf("config file %s requires one storage", configPath)
+	}
+	k := conf.Keys()[0]
+	if a.Storage, err = buildStorage(k, conf.Get(k)); err != nil {
+		return nil, err
+	}
+	if err := setLimits(a.StorageThrottle, conf.Get(k).(*toml.Tree)); err != nil {
+		return nil, fmt.Errorf("cannot set <%s> limits %s", k, err)
+	}
+	return a, nil
+}
+
 // Notify sends the notification n to all notifiers
 func (a *Agent) Notify(ctx *context.Context, n *notification.Notification) error {
 	if a.Silent {
@@ -178,6 +243,106 @@ func (a *Agent) Notify(ctx *context.Context, n *notification.Notification) error
 	return nil
 }
 
+// newAgent returns an agent configured with the agent table of tree, without
+// any plugin
+func newAgent(tree *toml.Tree) (*Agent, error) {
+	a := &Agent{}
+	conf, ok := tree.Get("agent").(*toml.Tree)
+	if ok {
+		if err := conf.Unmarshal(a); err != nil {
+			return nil, errors.Wrap(err, "cannot unmarshal agent config")
+		}
+	}
+
+	// Limits are set once the config is unmarshalled, since Unmarshal resets
+	// the throttles
+	a.Throttle = NewThrottle()
+	a.StorageThrottle = NewThrottle()
+	if ok {
+		if err := setLimits(a.Throttle, conf); err != nil {
+			return nil, errors.Wrap(err, "cannot set agent limits")
+		}
+	}
+	var err error
+	if a.Template, err = keytmpl.Parse(a.KeyTemplate); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// setLimits sets the limits of the config table conf to t
+func setLimits(t *Throttle, conf *toml.Tree) error {
+	var l Limits
+	if err := conf.Unmarshal(&l); err != nil {
+		return err
+	}
+	return t.Set(&l)
+}
+
+// buildStorage creates and initialises the storage k from its config
+func buildStorage(k string, v interface{}) (storage.Storage, error) {
+	storageCreator, ok := storage.Storages[k]
+	if !ok {
+		return nil, fmt.Errorf("storage <%s> does not exist", k)
+	}
+	conf, ok := v.(*toml.Tree)
+	if !ok {
+		return nil, fmt.Errorf("invalid <%s> config", k)
+	}
+	s := storageCreator()
+	if err := conf.Unmarshal(s); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal <%s> config", k)
+	}
+
+	// Build the storage on which a wrapper stores its data
+	if w, ok := s.(storage.Wrapper); ok {
+		backend, ok := conf.Get("backend").(*toml.Tree)
+		if !ok || len(backend.Keys()) != 1 {
+			return nil, fmt.Errorf("<%s> requires one backend storage", k)
+		}
+		name := backend.Keys()[0]
+		b, err := buildStorage(name, backend.Get(name))
+		if err != nil {
+			return nil, err
+		}
+		w.Wrap(b)
+	}
+
+	if err := s.Init(); err != nil {
+		return nil, fmt.Errorf("cannot init <%s> %s", k, err)
+	}
+	return s, nil
+}
+
+// loadConfig loads the config file, and replaces environment variables with
+// their value
+func loadConfig(configPath string) (*toml.Tree, error) {
+	tree, err := toml.LoadFile(configPath)
+	if err != nil {
+		return nil, errors.Wrap(
+			err, fmt.Sprintf("cannot open config file: %s", configPath),
+		)
+	}
+
+	q, _ := query.Compile("$..")
+	results := q.Execute(tree)
+	for _, item := range results.Values() {
+		switch v := item.(type) {
+		case *toml.Tree:
+			for _, key := range v.Keys() {
+				v.Set(key, valueOf(v.Get(key)))
+			}
+		case []*toml.Tree:
+			for _, tree := range v {
+				for _, key := range tree.Keys() {
+					tree.Set(key, valueOf(tree.Get(key)))
+				}
+			}
+		}
+	}
+	return tree, nil
+}
+
 const prefix = "$"
 
 // valueOf extracts the environment variable(s) from v
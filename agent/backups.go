@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/plugin/storage"
+)
+
+// maxClockSkew is how far ahead of the clock of storages the clock of hosts
+// which create backups may be
+const maxClockSkew = time.Minute
+
+// Backup is a backup of the storage
+type Backup struct {
+	os.FileInfo
+	// Time is the creation time of the backup. Unlike the modification time,
+	// it does not change when backups are copied to another storage.
+	Time time.Time
+}
+
+// BackupTime returns the creation time of the backup f. It is read from the
+// metadata of the storage, or else from the key template, and falls back on
+// the modification time.
+func (a *Agent) BackupTime(f os.FileInfo) time.Time {
+	if i, ok := f.(storage.TimeInfo); ok {
+		if t := i.CreatedAt(); !t.IsZero() {
+			return t
+		}
+	}
+	if fields, ok := a.Template.Match(f.Name()); ok {
+		if t, ok := a.Template.Time(fields); ok {
+			return t
+		}
+	}
+	return f.ModTime()
+}
+
+// hasBackupTime returns whether the creation time of backups may differ from
+// their modification time, i.e. when the storage keeps it in its metadata or
+// when keys hold it
+func (a *Agent) hasBackupTime() bool {
+	_, ok := a.Storage.(storage.MetaPusher)
+	return ok || (a.Template != nil && a.Template.HasTime())
+}
+
+// Backups walks the backups of the storage, most recent first. Unlike
+// Storage.Walk, the time range and the limit of filter apply to the creation
+// time of backups.
+func (a *Agent) Backups(
+	ctx *context.Context,
+	filter storage.WalkFilter,
+	fn func(b *Backup) error,
+) error {
+	if filter.To == 0 {
+		filter.To = math.MaxInt64
+	}
+	if !a.hasBackupTime() {
+		// The creation time of backups is their modification time, so the
+		// storage filters them
+		var walkErr error
+		a.Storage.Walk(ctx, &filter, func(key string, f os.FileInfo, err error) error {
+			if err == nil {
+				err = fn(&Backup{FileInfo: f, Time: f.ModTime()})
+			}
+			walkErr = err
+			return err
+		})
+		return walkErr
+	}
+
+	// The storage filters on modification time, so backups are sorted and
+	// filtered here when their creation time may differ. Backups are created
+	// before they are pushed, so walking them from the most recently modified
+	// stops once no older one can be selected.
+	from, to, limit := filter.From, filter.To, filter.Limit
+	filter.From, filter.To, filter.Limit = 0, math.MaxInt64, 0
+
+	var infos []os.FileInfo
+	var walkErr error
+	a.Storage.Walk(ctx, &filter, func(key string, f os.FileInfo, err error) error {
+		if err != nil {
+			walkErr = err
+			return err
+		}
+		infos = append(infos, f)
+		return nil
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+
+	var backups []*Backup
+	for _, f := range infos {
+		latest := f.ModTime().Add(maxClockSkew)
+		if latest.UnixNano() < from {
+			break
+		}
+		if limit > 0 && uint(len(backups)) >= limit {
+			sortBackups(backups)
+			backups = backups[:limit]
+			if !backups[limit-1].Time.Before(latest) {
+				break
+			}
+		}
+
+		b, err := a.backup(ctx, f)
+		if errors.Cause(err) == storage.ErrKeyNotFound {
+			// The key has been deleted since it was listed
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if t := b.Time.UnixNano(); t < from || t > to {
+			continue
+		}
+		backups = append(backups, b)
+	}
+
+	sortBackups(backups)
+	if limit > 0 && uint(len(backups)) > limit {
+		backups = backups[:limit]
+	}
+	for _, b := range backups {
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backup returns the backup of the listed key f. Listings of some storages
+// omit the metadata of keys (e.g. S3), so it is read from the info of the
+// key when the creation time is missing.
+func (a *Agent) backup(ctx *context.Context, f os.FileInfo) (*Backup, error) {
+	_, pusher := a.Storage.(storage.MetaPusher)
+	if i, ok := f.(storage.TimeInfo); pusher && ok && i.CreatedAt().IsZero() {
+		info, err := a.Storage.Info(ctx, f.Name())
+		if err != nil {
+			return nil, err
+		}
+		f = info
+	}
+	return &Backup{FileInfo: f, Time: a.BackupTime(f)}, nil
+}
+
+// sortBackups sorts backups from the most recently created
+func sortBackups(backups []*Backup) {
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].Time.After(backups[j].Time)
+	})
+}
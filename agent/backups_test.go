@@ -0,0 +1,213 @@
+package agent_test
+
+import (
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stairlin/kargo/agent"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/pkg/keytmpl"
+	"github.com/stairlin/kargo/plugin/storage"
+	"github.com/stairlin/kargo/plugin/storage/memory"
+)
+
+func TestBackups(t *testing.T) {
+	store := &filterStore{Store: &memory.Store{Bucket: "agent-backups"}}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, key := range []string{"db-1500000000", "db-1600000000", "db-1400000000"} {
+		if err := store.Push(ctx, key, strings.NewReader("foo")); err != nil {
+			t.Fatal("Error pushing data to storage", err)
+		}
+	}
+	filter := storage.WalkFilter{
+		From:  time.Unix(1450000000, 0).UnixNano(),
+		Limit: 1,
+	}
+
+	// Keys hold the creation time of backups, so the storage walks them all
+	a := newAgent(t, store, "{source}-{unix}")
+	if got := backups(t, a, filter); got != "db-1600000000" {
+		t.Errorf("expect backups db-1600000000, but got %s", got)
+	}
+	if store.filter.From != 0 || store.filter.To != math.MaxInt64 || store.filter.Limit != 0 {
+		t.Errorf("expect the storage to walk every key, but got %+v", store.filter)
+	}
+
+	// Otherwise, the storage filters backups
+	a = newAgent(t, store, "{source}-{env}")
+	filter.From = time.Now().Add(-time.Hour).UnixNano()
+	if got := backups(t, a, filter); got != "db-1400000000" {
+		t.Errorf("expect backups db-1400000000, but got %s", got)
+	}
+	if store.filter.From != filter.From || store.filter.To != math.MaxInt64 ||
+		store.filter.Limit != 1 {
+		t.Errorf("expect the storage to filter keys, but got %+v", store.filter)
+	}
+}
+
+func TestBackupsMeta(t *testing.T) {
+	store := &metaStore{
+		Store:    &memory.Store{Bucket: "agent-backups-meta"},
+		modified: map[string]time.Time{},
+	}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	now := time.Now()
+	for _, b := range []struct {
+		key               string
+		created, modified time.Duration
+	}{
+		// a has been copied, so its modification time is the most recent
+		{key: "a", created: -48 * time.Hour, modified: 0},
+		{key: "b", created: -2 * time.Hour, modified: -2 * time.Hour},
+		{key: "c", created: -3 * time.Hour, modified: -3 * time.Hour},
+		{key: "d", created: -4 * time.Hour, modified: -4 * time.Hour},
+	} {
+		meta := &storage.Meta{CreatedAt: now.Add(b.created)}
+		if err := store.PushMeta(ctx, b.key, strings.NewReader("foo"), meta); err != nil {
+			t.Fatal("Error pushing data to storage", err)
+		}
+		store.modified[b.key] = now.Add(b.modified)
+	}
+	a := newAgent(t, store, "{source}")
+
+	// Listings omit creation times, so keys are read until no older backup
+	// can be selected
+	tests := []struct {
+		filter storage.WalkFilter
+		expect string
+		infos  int
+	}{
+		{filter: storage.WalkFilter{}, expect: "b,c,d,a", infos: 4},
+		{filter: storage.WalkFilter{Limit: 1}, expect: "b", infos: 2},
+		{
+			filter: storage.WalkFilter{From: now.Add(-150 * time.Minute).UnixNano()},
+			expect: "b",
+			infos:  2,
+		},
+		{
+			filter: storage.WalkFilter{To: now.Add(-24 * time.Hour).UnixNano()},
+			expect: "a",
+			infos:  4,
+		},
+	}
+	for i, test := range tests {
+		store.infos = 0
+		if got := backups(t, a, test.filter); got != test.expect {
+			t.Errorf("%d: expect backups %s, but got %s", i, test.expect, got)
+		}
+		if store.infos != test.infos {
+			t.Errorf("%d: expect %d infos, but got %d", i, test.infos, store.infos)
+		}
+	}
+}
+
+func newAgent(t *testing.T, s storage.Storage, template string) *agent.Agent {
+	tmpl, err := keytmpl.Parse(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &agent.Agent{Storage: s, Template: tmpl}
+}
+
+// backups returns the keys of the backups selected by filter
+func backups(t *testing.T, a *agent.Agent, filter storage.WalkFilter) string {
+	var keys []string
+	err := a.Backups(context.Background(), filter, func(b *agent.Backup) error {
+		keys = append(keys, b.Name())
+		return nil
+	})
+	if err != nil {
+		t.Fatal("cannot walk backups", err)
+	}
+	return strings.Join(keys, ",")
+}
+
+// filterStore records the filter of the last walk
+type filterStore struct {
+	*memory.Store
+
+	filter storage.WalkFilter
+}
+
+func (s *filterStore) Walk(
+	ctx *context.Context,
+	filter *storage.WalkFilter,
+	walkFn func(key string, f os.FileInfo, err error) error,
+) {
+	s.filter = *filter
+	s.Store.Walk(ctx, filter, walkFn)
+}
+
+// metaStore keeps the creation time of keys, which its listings omit like S3
+type metaStore struct {
+	*memory.Store
+
+	mu       sync.Mutex
+	created  map[string]time.Time
+	modified map[string]time.Time
+	infos    int
+}
+
+func (s *metaStore) PushMeta(
+	ctx *context.Context, key string, r io.Reader, meta *storage.Meta,
+) error {
+	if err := s.Store.Push(ctx, key, r); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.created == nil {
+		s.created = map[string]time.Time{}
+	}
+	s.created[key] = meta.CreatedAt
+	return nil
+}
+
+func (s *metaStore) Info(ctx *context.Context, key string) (os.FileInfo, error) {
+	f, err := s.Store.Info(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.infos++
+	return &metaInfo{FileInfo: f, modTime: s.modified[key], createdAt: s.created[key]}, nil
+}
+
+func (s *metaStore) Walk(
+	ctx *context.Context,
+	filter *storage.WalkFilter,
+	walkFn func(key string, f os.FileInfo, err error) error,
+) {
+	s.Store.Walk(ctx, filter, func(key string, f os.FileInfo, err error) error {
+		if err != nil {
+			return walkFn(key, f, err)
+		}
+		s.mu.Lock()
+		modTime := s.modified[key]
+		s.mu.Unlock()
+		return walkFn(key, &metaInfo{FileInfo: f, modTime: modTime}, nil)
+	})
+}
+
+// metaInfo is the info of a key of metaStore
+type metaInfo struct {
+	os.FileInfo
+
+	modTime   time.Time
+	createdAt time.Time
+}
+
+func (i *metaInfo) ModTime() time.Time   { return i.modTime }
+func (i *metaInfo) CreatedAt() time.Time { return i.createdAt }
@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"net/url"
+	"regexp"
+	"sort"
+
+	toml "github.com/pelletier/go-toml"
+)
+
+// Plugin types of a pipeline, in the order data flows through them
+const (
+	StageSource    = "source"
+	StageProcessor = "processor"
+	StageStorage   = "storage"
+	StageNotifier  = "notifier"
+)
+
+var stageOrder = map[string]int{
+	StageSource:    0,
+	StageProcessor: 1,
+	StageStorage:   2,
+	StageNotifier:  3,
+}
+
+// redacted replaces the value of secrets
+const redacted = "[redacted]"
+
+// secretRegexp matches the config keys whose value is redacted. It is broad
+// on purpose (e.g. key_shares, account_key, passphrase_file), since leaking a
+// secret is worse than hiding a harmless value.
+var secretRegexp = regexp.MustCompile(
+	`(?i)key|secret|token|password|passphrase|share|credential|connection_string|headers`,
+)
+
+// Stage is a plugin of the pipeline of an agent
+type Stage struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+	// Config is the config of the plugin, with environment variables resolved
+	// and secrets redacted
+	Config map[string]interface{} `json:"config,omitempty"`
+}
+
+// Pipeline returns the plugins of the agent, in the order data flows through
+// them during a backup, followed by the notifiers
+func (a *Agent) Pipeline() []Stage {
+	stages := make([]Stage, len(a.stages))
+	copy(stages, a.stages)
+	sort.SliceStable(stages, func(i, j int) bool {
+		return stageOrder[stages[i].Type] < stageOrder[stages[j].Type]
+	})
+	return stages
+}
+
+// addStage records the plugin name of type typ, and its config conf
+func (a *Agent) addStage(typ, name string, conf interface{}) {
+	s := Stage{Type: typ, Name: name}
+	if t, ok := conf.(*toml.Tree); ok {
+		s.Config = Redact(t.ToMap())
+	}
+	a.stages = append(a.stages, s)
+}
+
+// Redact replaces the secrets of plugin config m, and the credentials of URLs
+func Redact(m map[string]interface{}) map[string]interface{} {
+	for k, v := range m {
+		switch {
+		case secretRegexp.MatchString(k):
+			m[k] = redacted
+		case k == "url":
+			if s, ok := v.(string); ok {
+				m[k] = redactURL(s)
+			}
+		default:
+			m[k] = redactValue(v)
+		}
+	}
+	return m
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return Redact(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+	case []map[string]interface{}:
+		for i := range v {
+			v[i] = Redact(v[i])
+		}
+	}
+	return v
+}
+
+// redactURL keeps the scheme and the host of s. The rest of URLs often holds
+// tokens (e.g. webhooks).
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return redacted
+	}
+	if u.User == nil && u.Path == "" && u.RawQuery == "" {
+		return s
+	}
+	return u.Scheme + "://" + u.Host + "/" + redacted
+}
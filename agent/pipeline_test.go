@@ -0,0 +1,130 @@
+package agent_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	toml "github.com/pelletier/go-toml"
+	"github.com/stairlin/kargo/agent"
+)
+
+// secretFields are the config fields of plugins which hold secrets
+var secretFields = map[string]bool{
+	"account_key":       true,
+	"connection_string": true,
+	"headers":           true,
+	"key":               true,
+	"key_shares":        true,
+	"keys":              true,
+	"passphrase":        true,
+	"password":          true,
+	"private_key":       true,
+	"sas_token":         true,
+	"secret":            true,
+	"token":             true,
+}
+
+var tomlBlock = regexp.MustCompile("(?s)```toml\n(.*?)```")
+
+// TestRedactDocumentedConfigs redacts the config examples of every plugin
+// README, and checks that no secret is left
+func TestRedactDocumentedConfigs(t *testing.T) {
+	t.Parallel()
+
+	files, err := filepath.Glob("../plugin/*/*/README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("expect plugin READMEs")
+	}
+
+	var plugins int
+	for _, file := range append(files, "../README.md") {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range tomlBlock.FindAllSubmatch(data, -1) {
+			tree, err := toml.LoadBytes(m[1])
+			if err != nil {
+				t.Errorf("%s: cannot parse example: %s", file, err)
+				continue
+			}
+			for _, typ := range []string{"source", "storage", "processors", "notifiers"} {
+				sub, ok := tree.Get(typ).(*toml.Tree)
+				if !ok {
+					continue
+				}
+				for _, name := range sub.Keys() {
+					conf, ok := sub.Get(name).(*toml.Tree)
+					if !ok {
+						continue
+					}
+					plugins++
+					where := file + ": " + typ + "." + name
+					checkRedacted(t, where, agent.Redact(conf.ToMap()))
+				}
+			}
+		}
+	}
+	if plugins == 0 {
+		t.Fatal("expect documented plugin configs")
+	}
+}
+
+func TestRedact(t *testing.T) {
+	t.Parallel()
+
+	conf := agent.Redact(map[string]interface{}{
+		"bucket":      "backups",
+		"data_shards": int64(10),
+		"key_shares":  []interface{}{"share-1", "share-2"},
+		"url":         "https://hooks.example.com/services/T00/B00/XXX",
+		"servers": []map[string]interface{}{
+			{"host": "example.com", "password": "hunter2"},
+		},
+	})
+	if conf["bucket"] != "backups" || conf["data_shards"] != int64(10) {
+		t.Errorf("expect harmless fields to be kept, but got %v", conf)
+	}
+	if conf["key_shares"] != "[redacted]" {
+		t.Errorf("expect key_shares to be redacted, but got %v", conf["key_shares"])
+	}
+	if conf["url"] != "https://hooks.example.com/[redacted]" {
+		t.Errorf("expect URL path to be redacted, but got %v", conf["url"])
+	}
+	servers := conf["servers"].([]map[string]interface{})
+	if servers[0]["password"] != "[redacted]" || servers[0]["host"] != "example.com" {
+		t.Errorf("expect nested password to be redacted, but got %v", servers[0])
+	}
+}
+
+// checkRedacted fails when a secret field of conf, or of its nested tables,
+// is not redacted
+func checkRedacted(t *testing.T, where string, conf map[string]interface{}) {
+	for k, v := range conf {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if secretFields[k] {
+				t.Errorf("%s: expect %s to be redacted, but got %v", where, k, v)
+			}
+			checkRedacted(t, where, v)
+		case []map[string]interface{}:
+			for _, m := range v {
+				checkRedacted(t, where, m)
+			}
+		default:
+			if secretFields[k] && v != "[redacted]" {
+				t.Errorf("%s: expect %s to be redacted, but got %v", where, k, v)
+			}
+			if s, ok := v.(string); ok && k == "url" &&
+				strings.Count(strings.TrimPrefix(s, "https://"), "/") > 1 {
+				t.Errorf("%s: expect URL path to be redacted, but got %s", where, s)
+			}
+		}
+	}
+}
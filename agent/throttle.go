@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/pkg/throttle"
+	"github.com/stairlin/kargo/pkg/unit"
+)
+
+// Limits are the bandwidth limits of transfers with the storage, in bytes per
+// second (e.g. "20 MB"). They are set in the agent table, and in the table of
+// the storage.
+type Limits struct {
+	Upload   string        `toml:"upload_limit"`
+	Download string        `toml:"download_limit"`
+	Windows  []LimitWindow `toml:"limit_windows"`
+}
+
+// LimitWindow overrides limits during a time of day (e.g. "08:00-18:00").
+// Limits which are not set keep their value, and "0 B" lifts them.
+type LimitWindow struct {
+	Window   string `toml:"window"`
+	Upload   string `toml:"upload_limit"`
+	Download string `toml:"download_limit"`
+}
+
+// Throttle enforces the limits of a config table
+type Throttle struct {
+	Upload   *throttle.Limiter
+	Download *throttle.Limiter
+}
+
+// NewThrottle returns a throttle without limits
+func NewThrottle() *Throttle {
+	return &Throttle{
+		Upload:   throttle.NewLimiter(0),
+		Download: throttle.NewLimiter(0),
+	}
+}
+
+// Set replaces the limits of t. It can be called while data is being
+// transferred, and the new limits apply straight away.
+func (t *Throttle) Set(l *Limits) error {
+	upload, err := parseLimit(l.Upload)
+	if err != nil {
+		return errors.Wrap(err, "invalid upload limit")
+	}
+	download, err := parseLimit(l.Download)
+	if err != nil {
+		return errors.Wrap(err, "invalid download limit")
+	}
+
+	var uploadWindows, downloadWindows []throttle.Window
+	for _, w := range l.Windows {
+		if w.Upload != "" {
+			rate, err := parseLimit(w.Upload)
+			if err != nil {
+				return errors.Wrapf(err, "invalid upload limit of window %s", w.Window)
+			}
+			window, err := throttle.ParseWindow(w.Window, rate)
+			if err != nil {
+				return err
+			}
+			uploadWindows = append(uploadWindows, window)
+		}
+		if w.Download != "" {
+			rate, err := parseLimit(w.Download)
+			if err != nil {
+				return errors.Wrapf(err, "invalid download limit of window %s", w.Window)
+			}
+			window, err := throttle.ParseWindow(w.Window, rate)
+			if err != nil {
+				return err
+			}
+			downloadWindows = append(downloadWindows, window)
+		}
+	}
+
+	t.Upload.SetRate(upload)
+	t.Upload.SetWindows(uploadWindows)
+	t.Download.SetRate(download)
+	t.Download.SetWindows(downloadWindows)
+	return nil
+}
+
+// ThrottleUpload limits the bandwidth of data pushed to the storage. Both
+// the limits of the agent and of the storage apply.
+func (a *Agent) ThrottleUpload(ctx *context.Context, r io.ReadCloser) io.ReadCloser {
+	for _, t := range []*Throttle{a.Throttle, a.StorageThrottle} {
+		if t != nil {
+			r = throttle.NewReadCloser(ctx, r, t.Upload)
+		}
+	}
+	return r
+}
+
+// ThrottleDownload limits the bandwidth of data pulled from the storage. Both
+// the limits of the agent and of the storage apply.
+func (a *Agent) ThrottleDownload(ctx *context.Context, r io.ReadCloser) io.ReadCloser {
+	for _, t := range []*Throttle{a.Throttle, a.StorageThrottle} {
+		if t != nil {
+			r = throttle.NewReadCloser(ctx, r, t.Download)
+		}
+	}
+	return r
+}
+
+// parseLimit parses a limit in bytes per second. An empty limit is unlimited.
+func parseLimit(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	b, err := unit.ParseByte(s)
+	if err != nil {
+		return 0, err
+	}
+	if b < 0 {
+		return 0, errors.New("limit must be positive")
+	}
+	return int64(b), nil
+}
@@ -15,15 +15,16 @@
 package cmd
 
 import (
-	"errors"
 	"fmt"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/stairlin/kargo/agent"
 	"github.com/stairlin/kargo/context"
 	"github.com/stairlin/kargo/log"
 	"github.com/stairlin/kargo/plugin/notification"
+	"github.com/stairlin/kargo/plugin/storage"
 )
 
 var (
@@ -36,87 +37,117 @@ var backupCmd = &cobra.Command{
 	Use:   "backup",
 	Short: "Create a backup of the source, process it, and then store it",
 	Long:  ``,
-	Run: func(cmd *cobra.Command, args []string) {
-		// Build context
-		ctx := context.Background()
-		ctx.Workdir = workdir
-		defer ctx.Cleanup()
+	RunE: run(func(ctx *context.Context, cmd *cobra.Command, args []string, s *summary) error {
+		if key != "" {
+			var err error
+			if key, err = storage.CleanKey(key); err != nil {
+				return usageError(err)
+			}
+		}
 
 		// Build agent
 		agent, err := agent.Build(ctx, configPath)
 		if err != nil {
-			ctx.Error("Failed to build agent", log.Error(err))
-			return
+			return configError(errors.Wrap(err, "cannot build agent"))
 		}
 		agent.Silent = silent
 
-		var notified bool
-		defer func() {
-			if notified {
-				return
-			}
-			ctx.Warn("Sending unknown failure notification...")
-			n := notification.Notification{
-				Type:      notification.Failure,
-				Operation: notification.Backup,
-				StartTime: ctx.StartTime,
-				EndTime:   time.Now(),
-				Error:     errors.New("unknown failure"),
-			}
-			for _, notifier := range agent.Notifiers {
-				if err := notifier.Send(ctx, n); err != nil {
-					ctx.Error("Failed to send notification", log.Error(err))
-				}
+		if key == "" {
+			if key, err = agent.NewKey(ctx.StartTime); err != nil {
+				return configError(err)
 			}
-		}()
+		}
+		ctx.Key = key
 
-		// Backup data
-		ctx.Info("Backing up data...")
-		data, err := agent.Source.Backup(ctx)
+		err = backup(ctx, agent, key)
+		if exitCode(ctx, err) == exitPending {
+			// The pending notification has been sent already
+			return err
+		}
 		if err != nil {
-			ctx.Error("Failed to backup data", log.Error(err))
-			return
+			notifyFailure(ctx, agent, notification.Backup, err)
+			return err
+		}
+		return nil
+	}),
+}
+
+// backup backs up the source of a to key, and notifies its success
+func backup(ctx *context.Context, a *agent.Agent, key string) error {
+	// Backup data
+	ctx.Info("Backing up data...")
+	data, err := a.Source.Backup(ctx)
+	if err != nil {
+		return sourceError(errors.Wrap(err, "cannot backup data"))
+	}
+	ctx.AddCloser(data)
+
+	// Run processors
+	for _, proc := range a.Processors {
+		data, err = proc.Encode(ctx, data)
+		if err != nil {
+			return errors.Wrap(err, "cannot encode data")
 		}
 		ctx.AddCloser(data)
+	}
+
+	n := &notification.Notification{
+		Type:      notification.Success,
+		Operation: notification.Backup,
+		StartTime: ctx.StartTime,
+		Body:      fmt.Sprintf("Key %s", key),
+	}
+	var pending error
+	if a.Spool != nil {
+		// Spool backup, and then upload it with the pending ones
+		data = ctx.Progress("Spooling file", data, 0)
+		if err := a.Spool.Add(ctx, key, data); err != nil {
+			return errors.Wrap(err, "cannot spool data")
+		}
+		data.Close()
 
-		// Run processors
-		for _, proc := range agent.Processors {
-			data, err = proc.Encode(ctx, data)
-			if err != nil {
-				ctx.Error("Failed to encode data", log.Error(err))
-				return
+		if err := uploadSpool(ctx, a, key); err != nil {
+			if exitCode(ctx, err) == exitStorage {
+				// The backup has been quarantined, it is not pending
+				return err
 			}
-			ctx.AddCloser(data)
+			ctx.Warn("Backup is pending upload", log.String("key", key))
+			n.Type = notification.Pending
+			n.Error = err
+			pending = pendingError(errors.Wrap(err, "backup is pending upload"))
 		}
-
+	} else {
 		// Store backup
+		data = a.ThrottleUpload(ctx, data)
 		data = ctx.Progress("Pushing file", data, 0)
-		if key == "" {
-			key = fmt.Sprintf("%s-%d", agent.Source.Name(), time.Now().Unix())
-		}
-		if err := agent.Storage.Push(ctx, key, data); err != nil {
-			ctx.Error("Failed to push data", log.Error(err))
-			return
+		meta := &storage.Meta{CreatedAt: ctx.StartTime}
+		if err := storage.PushMeta(ctx, a.Storage, key, data, meta); err != nil {
+			return storageError(errors.Wrap(err, "cannot push data"))
 		}
 		data.Close()
+	}
 
-		n := &notification.Notification{
-			Type:      notification.Success,
-			Operation: notification.Backup,
-			StartTime: ctx.StartTime,
-			EndTime:   time.Now(),
-			Body:      fmt.Sprintf("Key %s", key),
-		}
-		if err := agent.Notify(ctx, n); err != nil {
-			return
-		}
-		notified = true
+	n.EndTime = time.Now()
+	a.Notify(ctx, n)
+	return pending
+}
 
-		ctx.Info("OK",
-			log.String("key", key),
-			log.String("duration", time.Now().Sub(ctx.StartTime).String()),
-		)
-	},
+// notifyFailure notifies the failure of the operation op
+func notifyFailure(
+	ctx *context.Context, a *agent.Agent, op notification.Operation, err error,
+) {
+	ctx.Warn("Sending failure notification...")
+	n := &notification.Notification{
+		Type:      notification.Failure,
+		Operation: op,
+		StartTime: ctx.StartTime,
+		EndTime:   time.Now(),
+		Error:     err,
+	}
+	if exitCode(ctx, err) == exitTimeout {
+		n.Type = notification.Timeout
+	}
+	a.Notify(ctx, n)
 }
 
 func init() {
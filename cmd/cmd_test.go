@@ -0,0 +1,236 @@
+// Copyright © 2018 Stairlin ltd <it@stairlin.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/pkg/testutil"
+	"github.com/stairlin/kargo/plugin/storage/memory"
+)
+
+// TestCommands runs commands in-process against a memory storage, and checks
+// their exit codes
+func TestCommands(t *testing.T) {
+	dir := testutil.TempDir(t, "cmd")
+	defer os.RemoveAll(dir)
+	conf := writeConfig(t, dir, "conf.toml", "cmd-test", 1)
+	other := writeConfig(t, dir, "other.toml", "cmd-test", 2)
+	ctx := context.Background()
+
+	// Backup
+	execute(t, exitOK, "backup", "--config", conf, "--key", "db/1")
+	execute(t, exitOK, "backup", "--config", conf, "--key", "db/2")
+
+	// List
+	out := execute(t, exitOK, "list", "--config", conf, "-o", "json")
+	var items []struct {
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal([]byte(out), &items); err != nil {
+		t.Fatalf("cannot decode list output %q: %s", out, err)
+	}
+	if len(items) != 2 {
+		t.Errorf("expect 2 backups, but got %s", out)
+	}
+
+	// Restore and verify
+	execute(t, exitOK, "restore", "--config", conf, "--force", "db/1")
+	execute(t, exitOK, "restore", "--config", conf, "--force", "--latest")
+	execute(t, exitOK, "verify", "--config", conf, "db/2")
+
+	// Failures
+	execute(t, exitUsage, "list", "--config", conf, "--unknown")
+	execute(t, exitConfig, "backup", "--config", filepath.Join(dir, "missing.toml"))
+	execute(t, exitStorage, "restore", "--config", conf, "--force", "db/missing")
+	execute(t, exitStorage, "verify", "--config", conf, "db/missing")
+
+	// The data of another seed does not match the source
+	execute(t, exitSource, "restore", "--config", other, "--force", "db/1")
+
+	// Corrupted backups cannot be verified nor restored
+	store := &memory.Store{Bucket: "cmd-test"}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	garbage := bytes.Repeat([]byte("x"), 1024)
+	if err := store.Push(ctx, "db/2", bytes.NewReader(garbage)); err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+	execute(t, exitVerify, "verify", "--config", conf, "db/2")
+	execute(t, exitVerify, "restore", "--config", conf, "--force", "db/2")
+}
+
+// TestCopy copies backups between memory storages
+func TestCopy(t *testing.T) {
+	dir := testutil.TempDir(t, "cmd")
+	defer os.RemoveAll(dir)
+	from := writeConfig(t, dir, "from.toml", "cmd-copy-from", 1)
+	to := writeConfig(t, dir, "to.toml", "cmd-copy-to", 1)
+	ctx := context.Background()
+
+	execute(t, exitOK, "backup", "--config", from, "--key", "db/1")
+	execute(t, exitOK, "backup", "--config", from, "--key", "db/2")
+	execute(t, exitOK, "copy", "--from", from, "--to", to)
+	execute(t, exitOK, "verify", "--config", to, "db/1")
+	execute(t, exitOK, "verify", "--config", to, "db/2")
+
+	// Keys with the same size are only copied again when checksums differ
+	store := &memory.Store{Bucket: "cmd-copy-to"}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := store.Info(ctx, "db/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	garbage := bytes.Repeat([]byte("x"), int(info.Size()))
+	if err := store.Push(ctx, "db/2", bytes.NewReader(garbage)); err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+	execute(t, exitVerify, "verify", "--config", to, "db/2")
+	out := execute(t, exitOK, "copy", "--from", from, "--to", to)
+	if !strings.Contains(out, "COPIED 1") || !strings.Contains(out, "SKIPPED 1") {
+		t.Errorf("expect 1 key copied and 1 skipped, but got %q", out)
+	}
+	execute(t, exitOK, "verify", "--config", to, "db/2")
+}
+
+// TestInterruptAfterTimeout checks that a first signal after the timeout does
+// not exit right away
+func TestInterruptAfterTimeout(t *testing.T) {
+	defer func(d time.Duration) { timeout = d }(timeout)
+	timeout = time.Millisecond
+
+	// Keep the signal from killing the test once the context stops listening
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	defer signal.Stop(signals)
+
+	ctx, cancel := newContext()
+	<-ctx.Done()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+	<-signals
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	cancel()
+}
+
+func TestSelectorBefore(t *testing.T) {
+	table := []struct {
+		before string
+		expect time.Time
+	}{
+		{"2018-06-01", time.Date(2018, 6, 1, 23, 59, 59, 999999999, time.UTC)},
+		{"2018-06-01T12:00", time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)},
+		{"2018-06-01T00:00:00Z", time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range table {
+		cmd := &cobra.Command{}
+		addSelectorFlags(cmd)
+		if err := cmd.Flags().Set("before", test.before); err != nil {
+			t.Fatal(err)
+		}
+		sel, err := parseSelector(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sel.Before.Equal(test.expect) {
+			t.Errorf("%s: expect %s, but got %s", test.before, test.expect, sel.Before)
+		}
+	}
+}
+
+// writeConfig writes a config with a random source of the given seed, which
+// is backed up to a memory bucket with error correction
+func writeConfig(t *testing.T, dir, name, bucket string, seed int) string {
+	conf := fmt.Sprintf(`
+[source.random]
+  size = "64 kB"
+  seed = %d
+
+[processors.ecc]
+
+[storage.memory]
+  bucket = %q
+`, seed, bucket)
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// execute runs the command of args, and returns its standard output. It fails
+// when the command does not exit with code.
+func execute(t *testing.T, code int, args ...string) string {
+	resetFlags(rootCmd)
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	out := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		out <- b
+	}()
+
+	rootCmd.SetArgs(args)
+	err = rootCmd.Execute()
+	w.Close()
+	os.Stdout = stdout
+	b := <-out
+
+	if got := exitCode(nil, err); got != code {
+		t.Errorf("%s: expect exit code %d, but got %d (%v)",
+			strings.Join(args, " "), code, got, err,
+		)
+	}
+	return string(b)
+}
+
+// resetFlags sets the flags changed by previous commands back to their
+// default value, since flags are kept between executions
+func resetFlags(cmd *cobra.Command) {
+	reset := func(f *pflag.Flag) {
+		if f.Changed {
+			f.Value.Set(f.DefValue)
+			f.Changed = false
+		}
+	}
+	cmd.Flags().VisitAll(reset)
+	cmd.PersistentFlags().VisitAll(reset)
+	for _, c := range cmd.Commands() {
+		resetFlags(c)
+	}
+}
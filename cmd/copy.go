@@ -0,0 +1,328 @@
+// Copyright © 2018 Stairlin ltd <it@stairlin.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/stairlin/kargo/agent"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/log"
+	"github.com/stairlin/kargo/pkg/bytefmt"
+	"github.com/stairlin/kargo/plugin/storage"
+)
+
+const defaultCopyConcurrency = 4
+
+// copyCmd represents the copy command
+var copyCmd = &cobra.Command{
+	Use:   "copy",
+	Short: "Copy backups from a storage to another",
+	Long: `Copy transfers backups from the storage of a config file (--from, defaults
+to --config) to the storage of another config file (--to). Backups are
+streamed verbatim, without being decoded, so their headers (e.g. signature,
+encryption) are preserved, and the same processors can restore them.
+
+Keys which already exist on the destination with the same size are skipped,
+so an interrupted copy can be resumed by running the same command again.
+When both storages expose the checksum of keys (e.g. the MD5 of S3 and GCS
+objects), keys with a different checksum are copied again. With --checksum,
+the content of keys is compared when their checksums cannot be.
+
+The creation time of backups is preserved, as well as their storage class
+between storages of the same kind, unless the destination config sets one.
+Other metadata, such as S3 tags, come from the destination config.
+
+Keys are selected with the same filters as "kargo list", except the time
+range, which is set with --after and --before.`,
+	RunE: run(func(ctx *context.Context, cmd *cobra.Command, args []string, s *summary) error {
+		from := cmd.Flag("from").Value.String()
+		if from == "" {
+			from = configPath
+		}
+		to := cmd.Flag("to").Value.String()
+		if to == "" {
+			return usageError(errors.New("missing destination config file (--to)"))
+		}
+		concurrency, err := cmd.Flags().GetInt("concurrency")
+		if err != nil || concurrency < 1 {
+			return usageError(errors.New("concurrency must be positive"))
+		}
+		checksum, _ := cmd.Flags().GetBool("checksum")
+		limit, _ := cmd.Flags().GetUint("limit")
+
+		// Build storages
+		src, err := agent.BuildStorage(ctx, from)
+		if err != nil {
+			return configError(errors.Wrap(err, "cannot build source storage"))
+		}
+		dst, err := agent.BuildStorage(ctx, to)
+		if err != nil {
+			return configError(errors.Wrap(err, "cannot build destination storage"))
+		}
+
+		// Build filters
+		var pattern *regexp.Regexp
+		if expr := cmd.Flag("pattern").Value.String(); len(expr) > 0 {
+			pattern, err = regexp.Compile(expr)
+			if err != nil {
+				return usageError(err)
+			}
+		}
+		after, before, err := parseRange(
+			cmd.Flag("after").Value.String(), cmd.Flag("before").Value.String(),
+		)
+		if err != nil {
+			return usageError(err)
+		}
+		filter := storage.WalkFilter{
+			From:    after,
+			To:      before,
+			Prefix:  cmd.Flag("prefix").Value.String(),
+			Pattern: pattern,
+			Limit:   limit,
+		}
+
+		// Collect keys first, since the destination may be the same storage
+		var infos []os.FileInfo
+		err = src.Backups(ctx, filter, func(b *agent.Backup) error {
+			infos = append(infos, b.FileInfo)
+			return nil
+		})
+		if err != nil {
+			return storageError(errors.Wrap(err, "cannot list backups"))
+		}
+
+		var mu sync.Mutex
+		var copied, skipped, failed int
+		var size int64
+		jobs := make(chan os.FileInfo)
+		var wg sync.WaitGroup
+		for i := 0; i < concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for info := range jobs {
+					ok, err := copyKey(ctx, src, dst, info, checksum)
+
+					mu.Lock()
+					switch {
+					case err != nil:
+						failed++
+					case ok:
+						copied++
+						size += info.Size()
+					default:
+						skipped++
+					}
+					progress := fmt.Sprintf("%d/%d", copied+skipped+failed, len(infos))
+					mu.Unlock()
+
+					switch {
+					case err != nil:
+						ctx.Error("Failed to copy backup",
+							log.String("key", info.Name()),
+							log.String("progress", progress),
+							log.Error(err),
+						)
+					case ok:
+						ctx.Info("Backup copied",
+							log.String("key", info.Name()),
+							log.String("progress", progress),
+						)
+					default:
+						ctx.Info("Backup already copied",
+							log.String("key", info.Name()),
+							log.String("progress", progress),
+						)
+					}
+				}
+			}()
+		}
+		for _, info := range infos {
+			jobs <- info
+		}
+		close(jobs)
+		wg.Wait()
+
+		fmt.Println()
+		fmt.Printf(
+			"COPIED %d (%s) SKIPPED %d FAILED %d\n",
+			copied,
+			bytefmt.HumanReadableByte(size),
+			skipped,
+			failed,
+		)
+		s.Count("copied", copied)
+		s.Count("skipped", skipped)
+		s.Count("failed", failed)
+		if failed > 0 {
+			return storageError(errors.Errorf("%d backups cannot be copied", failed))
+		}
+		return nil
+	}),
+}
+
+func init() {
+	rootCmd.AddCommand(copyCmd)
+
+	copyCmd.Flags().StringP("from", "", "", "Config file of the source storage (defaults to --config)")
+	copyCmd.Flags().StringP("to", "", "", "Config file of the destination storage")
+	copyCmd.Flags().StringP("pattern", "", "", "Copy keys matching a pattern")
+	copyCmd.Flags().StringP("prefix", "", "", "Copy keys with a prefix")
+	copyCmd.Flags().StringP("after", "", "", "Copy keys created after time t")
+	copyCmd.Flags().StringP("before", "", "", "Copy keys created before time t")
+	copyCmd.Flags().UintP("limit", "l", 0, "Limit the number of keys copied (most recent first)")
+	copyCmd.Flags().IntP("concurrency", "c", defaultCopyConcurrency, "Number of keys copied concurrently")
+	copyCmd.Flags().BoolP("checksum", "", false, "Compare the content of keys whose checksums cannot be compared")
+}
+
+// copyKey copies the backup described by info from src to dst. It returns
+// false when the backup already exists on dst.
+func copyKey(
+	parent *context.Context, src, dst *agent.Agent, info os.FileInfo, checksum bool,
+) (bool, error) {
+	key := info.Name()
+	ctx := context.WithKey(parent, key)
+	defer ctx.Cleanup()
+
+	existing, err := dst.Storage.Info(ctx, key)
+	switch {
+	case err == storage.ErrKeyNotFound:
+	case err != nil:
+		return false, errors.Wrap(err, "cannot get destination info")
+	case existing.Size() == info.Size():
+		same, err := sameKey(ctx, src, dst, info, existing, checksum)
+		if err != nil {
+			return false, err
+		}
+		if same {
+			return false, nil
+		}
+	}
+
+	data, pulled, err := src.Storage.Pull(ctx, key)
+	if err != nil {
+		return false, errors.Wrap(err, "cannot pull backup")
+	}
+	ctx.AddCloser(data)
+	data = dst.ThrottleUpload(ctx, src.ThrottleDownload(ctx, data))
+
+	// Keep the creation time of the backup. Listings of some storages omit
+	// metadata, so it is read from the info of the pulled key.
+	meta := &storage.Meta{CreatedAt: src.BackupTime(pulled)}
+	if c, ok := pulled.(storage.ClassInfo); ok && src.Storage.Name() == dst.Storage.Name() {
+		// Storage classes only make sense to storages of the same kind
+		meta.StorageClass = c.StorageClass()
+	}
+	if err := storage.PushMeta(ctx, dst.Storage, key, data, meta); err != nil {
+		return false, errors.Wrap(err, "cannot push backup")
+	}
+
+	// Ensure the whole backup has been copied
+	copied, err := dst.Storage.Info(ctx, key)
+	if err != nil {
+		return false, errors.Wrap(err, "cannot get destination info")
+	}
+	if copied.Size() != info.Size() {
+		return false, errors.Errorf(
+			"expect %d bytes to be copied, but got %d", info.Size(), copied.Size(),
+		)
+	}
+	return true, nil
+}
+
+// sameKey returns whether the key of info, which has the same size on both
+// storages, has the same content. Checksums exposed by both storages are
+// compared first. When they cannot be compared, the content is compared with
+// full, and otherwise the key is considered the same.
+func sameKey(
+	ctx *context.Context, src, dst *agent.Agent, info, existing os.FileInfo, full bool,
+) (bool, error) {
+	key := info.Name()
+	theirs := infoChecksum(existing)
+	ours := infoChecksum(info)
+	if theirs != "" && ours == "" {
+		// Listings of some storages omit checksums
+		i, err := src.Storage.Info(ctx, key)
+		if err != nil {
+			return false, errors.Wrap(err, "cannot get source info")
+		}
+		ours = infoChecksum(i)
+	}
+	if ours != "" && checksumAlgorithm(ours) == checksumAlgorithm(theirs) {
+		return ours == theirs, nil
+	}
+	if full {
+		return sameContent(ctx, src, dst, key)
+	}
+	return true, nil
+}
+
+// infoChecksum returns the checksum exposed by the storage of a key, or an
+// empty string
+func infoChecksum(f os.FileInfo) string {
+	if i, ok := f.(storage.ChecksumInfo); ok {
+		return i.Checksum()
+	}
+	return ""
+}
+
+// checksumAlgorithm returns the algorithm of a checksum (e.g. md5)
+func checksumAlgorithm(checksum string) string {
+	return strings.SplitN(checksum, ":", 2)[0]
+}
+
+// sameContent returns whether key has the same content on both storages
+func sameContent(
+	ctx *context.Context, src, dst *agent.Agent, key string,
+) (bool, error) {
+	a, err := checksumOf(ctx, src, key)
+	if err != nil {
+		return false, errors.Wrap(err, "cannot get source checksum")
+	}
+	b, err := checksumOf(ctx, dst, key)
+	if err != nil {
+		return false, errors.Wrap(err, "cannot get destination checksum")
+	}
+	return a == b, nil
+}
+
+// checksumOf returns the SHA-256 checksum of key
+func checksumOf(
+	ctx *context.Context, a *agent.Agent, key string,
+) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	data, _, err := a.Storage.Pull(ctx, key)
+	if err != nil {
+		return sum, err
+	}
+	data = a.ThrottleDownload(ctx, data)
+	defer data.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, data); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
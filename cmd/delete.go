@@ -0,0 +1,84 @@
+// Copyright © 2018 Stairlin ltd <it@stairlin.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/stairlin/kargo/agent"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/log"
+	"github.com/stairlin/kargo/plugin/storage"
+)
+
+// deleteCmd represents the delete command
+var deleteCmd = &cobra.Command{
+	Use:   "delete [keys]",
+	Short: "Delete backups from storage",
+	Long: `Delete removes backups from the storage.
+
+Storages which share data between backups (e.g. repo) then delete data which
+is no longer referenced by any backup.`,
+	RunE: run(func(ctx *context.Context, cmd *cobra.Command, args []string, s *summary) error {
+		if len(args) == 0 {
+			return usageError(errors.New("missing key"))
+		}
+
+		// Build agent
+		agent, err := agent.Build(ctx, configPath)
+		if err != nil {
+			return configError(errors.Wrap(err, "cannot build agent"))
+		}
+		d, ok := agent.Storage.(storage.Deleter)
+		if !ok {
+			return configError(
+				errors.Errorf("%s storage cannot delete keys", agent.Storage.Name()),
+			)
+		}
+
+		// Locked backups are skipped, since they cannot be deleted until their
+		// retention expires
+		var deleted, locked int
+		defer func() {
+			s.Count("deleted", deleted)
+			s.Count("locked", locked)
+		}()
+		for _, key := range args {
+			ctx.Info("Deleting backup...", log.String("key", key))
+			err := d.Delete(ctx, key)
+			if errors.Cause(err) == storage.ErrLocked {
+				ctx.Warn("Backup is locked", log.String("key", key), log.Error(err))
+				locked++
+				continue
+			}
+			if err != nil {
+				return storageError(errors.Wrapf(err, "cannot delete %s", key))
+			}
+			deleted++
+		}
+
+		if c, ok := agent.Storage.(storage.Collector); ok {
+			ctx.Info("Collecting unreferenced data...")
+			if err := c.Collect(ctx); err != nil {
+				return storageError(errors.Wrap(err, "cannot collect unreferenced data"))
+			}
+		}
+		return nil
+	}),
+}
+
+func init() {
+	rootCmd.AddCommand(deleteCmd)
+}
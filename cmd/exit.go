@@ -0,0 +1,277 @@
+// Copyright © 2018 Stairlin ltd <it@stairlin.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	stdcontext "context"
+	"encoding/json"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/log"
+	"github.com/stairlin/kargo/pkg/output"
+	"github.com/stairlin/kargo/pkg/sec"
+	"github.com/stairlin/kargo/plugin/process/ecc"
+	"github.com/stairlin/kargo/plugin/process/sign"
+	"github.com/stairlin/kargo/plugin/storage"
+)
+
+// Exit codes, which let scripts and cron jobs tell failures apart
+const (
+	exitOK = 0
+	// exitFailure is returned for failures which do not belong to a class
+	exitFailure = 1
+	// exitUsage is returned for invalid arguments or flags
+	exitUsage   = 2
+	exitConfig  = 3
+	exitSource  = 4
+	exitStorage = 5
+	// exitVerify is returned when data cannot be verified (e.g. invalid
+	// signature, decryption failure, corrupted data)
+	exitVerify  = 6
+	exitTimeout = 7
+	// exitAborted is returned when the user does not confirm an operation,
+	// or interrupts it
+	exitAborted = 8
+	// exitPending is returned when an operation can be resumed later (e.g. a
+	// backup pending upload, or an archived backup being restored)
+	exitPending = 9
+)
+
+var exitClasses = map[int]string{
+	exitFailure: "failure",
+	exitUsage:   "usage",
+	exitConfig:  "config",
+	exitSource:  "source",
+	exitStorage: "storage",
+	exitVerify:  "verification",
+	exitTimeout: "timeout",
+	exitAborted: "aborted",
+	exitPending: "pending",
+}
+
+// verifyErrors are the errors returned by processors when data cannot be
+// verified
+var verifyErrors = []error{
+	sign.ErrUnsigned,
+	sign.ErrUnknownSigner,
+	sign.ErrBadSignature,
+	ecc.ErrUnrecoverable,
+	ecc.ErrInvalidHeader,
+	sec.ErrDecrypt,
+	sec.ErrTruncated,
+}
+
+// errAborted is returned when the user does not confirm an operation
+var errAborted = errors.New("aborted by user")
+
+var (
+	// timeout is the maximum duration of a command (0 for no timeout)
+	timeout time.Duration
+)
+
+// exitError is an error with the exit code of its class
+type exitError struct {
+	code int
+	err  error
+	// reported is true once the error has been printed by a summary
+	reported bool
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+// Cause returns the underlying error
+func (e *exitError) Cause() error {
+	return e.err
+}
+
+func withCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: code, err: err}
+}
+
+func usageError(err error) error   { return withCode(exitUsage, err) }
+func configError(err error) error  { return withCode(exitConfig, err) }
+func sourceError(err error) error  { return withCode(exitSource, err) }
+func storageError(err error) error { return withCode(exitStorage, err) }
+func verifyError(err error) error  { return withCode(exitVerify, err) }
+func pendingError(err error) error { return withCode(exitPending, err) }
+
+// exitCode returns the exit code of err. Commands which timed out or were
+// interrupted (ctx done), and data which cannot be verified have their own
+// code, regardless of the class of err.
+func exitCode(ctx *context.Context, err error) int {
+	if err == nil {
+		return exitOK
+	}
+	if ctx != nil {
+		switch ctx.Err() {
+		case stdcontext.DeadlineExceeded:
+			return exitTimeout
+		case stdcontext.Canceled:
+			return exitAborted
+		}
+	}
+	cause := errors.Cause(err)
+	switch cause {
+	case errAborted:
+		return exitAborted
+	case stdcontext.DeadlineExceeded:
+		return exitTimeout
+	case storage.ErrNotAvailable:
+		return exitPending
+	}
+	for _, e := range verifyErrors {
+		if cause == e {
+			return exitVerify
+		}
+	}
+	if e, ok := err.(*exitError); ok {
+		return e.code
+	}
+	return exitFailure
+}
+
+// summary is the outcome of a command. It is reported once the command
+// returns, as a log line, or as a JSON line with --output json.
+type summary struct {
+	Command  string         `json:"command"`
+	Status   string         `json:"status"`
+	ExitCode int            `json:"exit_code"`
+	Class    string         `json:"class,omitempty"`
+	Error    string         `json:"error,omitempty"`
+	Key      string         `json:"key,omitempty"`
+	Counts   map[string]int `json:"counts,omitempty"`
+	Duration string         `json:"duration"`
+}
+
+// Count sets the counter name (e.g. number of backups deleted)
+func (s *summary) Count(name string, n int) {
+	if s.Counts == nil {
+		s.Counts = map[string]int{}
+	}
+	s.Counts[name] = n
+}
+
+// report prints the summary to stderr
+func (s *summary) report(ctx *context.Context) {
+	if format, _ := output.Parse(outputFormat); format == output.JSON {
+		json.NewEncoder(os.Stderr).Encode(s)
+		return
+	}
+
+	fields := []log.Field{log.String("command", s.Command)}
+	if s.Key != "" {
+		fields = append(fields, log.String("key", s.Key))
+	}
+	var names []string
+	for name := range s.Counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fields = append(fields, log.Int(name, s.Counts[name]))
+	}
+	fields = append(fields, log.String("duration", s.Duration))
+	if s.ExitCode == exitOK {
+		ctx.Info("OK", fields...)
+		return
+	}
+	fields = append(fields,
+		log.String("class", s.Class),
+		log.Int("exit_code", s.ExitCode),
+		log.String("error", s.Error),
+	)
+	ctx.Error("FAILED", fields...)
+}
+
+// runFunc is the body of a command. It can add details to the summary s.
+type runFunc func(ctx *context.Context, cmd *cobra.Command, args []string, s *summary) error
+
+// run returns the RunE function of a command which runs fn with a context,
+// and then reports a summary. The context is canceled on SIGINT/SIGTERM, or
+// once --timeout is over.
+func run(fn runFunc) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := newContext()
+		defer cancel()
+
+		s := &summary{Command: cmd.CommandPath()}
+		err := fn(ctx, cmd, args, s)
+		ctx.Cleanup()
+
+		s.ExitCode = exitCode(ctx, err)
+		s.Key = ctx.Key
+		s.Duration = time.Now().Sub(ctx.StartTime).String()
+		s.Status = "ok"
+		if err != nil {
+			s.Status = "failed"
+			s.Class = exitClasses[s.ExitCode]
+			s.Error = err.Error()
+		}
+		s.report(ctx)
+		if err != nil {
+			return &exitError{code: s.ExitCode, err: err, reported: true}
+		}
+		return nil
+	}
+}
+
+// newContext returns the context of a command. A first signal cancels it,
+// and a second one exits right away.
+func newContext() (*context.Context, stdcontext.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout > 0 {
+		ctx = context.WithDeadline(ctx, time.Now().Add(timeout))
+	}
+	ctx.Workdir = workdir
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		// The context may also be done because of the timeout, which does
+		// not count as a first signal
+		var interrupted bool
+		for sig := range signals {
+			if interrupted {
+				os.Exit(exitAborted)
+			}
+			interrupted = true
+			ctx.Warn("Interrupted. Stopping...", log.String("signal", sig.String()))
+			cancel()
+		}
+	}()
+	var once sync.Once
+	return ctx, func() {
+		// No signal is delivered once Stop returns, so closing the channel
+		// ends the goroutine
+		once.Do(func() {
+			signal.Stop(signals)
+			close(signals)
+		})
+		cancel()
+	}
+}
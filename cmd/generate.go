@@ -15,11 +15,14 @@
 package cmd
 
 import (
+	"crypto/rand"
 	"encoding/base64"
 	"fmt"
 
 	"github.com/spf13/cobra"
 	"github.com/stairlin/kargo/pkg/sec"
+	"github.com/stairlin/kargo/plugin/process/cipher"
+	"golang.org/x/crypto/ed25519"
 )
 
 // generateCmd represents the generate command
@@ -29,17 +32,58 @@ var generateCmd = &cobra.Command{
 	Long:  ``,
 }
 
+var (
+	// shares is the number of shares a cipher key is split into
+	shares int
+	// threshold is the number of shares required to rebuild a cipher key
+	threshold int
+)
+
 // generateCipherCmd represents the generate cipher command
 var generateCipherCmd = &cobra.Command{
 	Use:   "cipher",
 	Short: "Generate a random cipher key",
-	Long:  ``,
-	Run: func(cmd *cobra.Command, args []string) {
+	Long: `Generate a random cipher key.
+
+The key can be split into shares with --shares and --threshold, so that no
+single person holds it. Any threshold shares can then rebuild the key with
+"kargo keys combine", or be set in the "key_shares" field of the cipher
+processor.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
 		k, err := sec.GenerateKey()
 		if err != nil {
-			fmt.Println(err)
+			return err
+		}
+		if shares == 0 {
+			fmt.Println("Cipher key:", base64.StdEncoding.EncodeToString(k))
+			return nil
+		}
+
+		encodedShares, err := cipher.SplitKey(k, shares, threshold)
+		if err != nil {
+			return usageError(err)
+		}
+		fmt.Printf("Cipher key shares (%d required):\n", threshold)
+		for i, share := range encodedShares {
+			fmt.Printf("%d. %s\n", i+1, share)
+		}
+		return nil
+	},
+}
+
+// generateSignCmd represents the generate sign command
+var generateSignCmd = &cobra.Command{
+	Use:   "sign",
+	Short: "Generate a random Ed25519 signing key pair",
+	Long:  ``,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
 		}
-		fmt.Println("Cipher key:", base64.StdEncoding.EncodeToString(k))
+		fmt.Println("Private key:", base64.StdEncoding.EncodeToString(priv.Seed()))
+		fmt.Println("Public key:", base64.StdEncoding.EncodeToString(pub))
+		return nil
 	},
 }
 
@@ -47,6 +91,9 @@ func init() {
 	rootCmd.AddCommand(generateCmd)
 
 	generateCmd.AddCommand(generateCipherCmd)
+	generateCmd.AddCommand(generateSignCmd)
+	generateCipherCmd.Flags().IntVarP(&shares, "shares", "", 0, "Split the key into n shares")
+	generateCipherCmd.Flags().IntVarP(&threshold, "threshold", "", 0, "Number of shares required to rebuild the key")
 
 	// Here you will define your flags and configuration settings.
 
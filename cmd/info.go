@@ -16,11 +16,13 @@ package cmd
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/stairlin/kargo/agent"
 	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/pkg/output"
 )
 
 // infoCmd represents the info command
@@ -28,17 +30,20 @@ var infoCmd = &cobra.Command{
 	Use:   "info",
 	Short: "Show the current config",
 	Long:  ``,
-	Run: func(cmd *cobra.Command, args []string) {
-		// Build context
-		ctx := context.Background()
-		ctx.Workdir = workdir
-		defer ctx.Cleanup()
+	RunE: run(func(ctx *context.Context, cmd *cobra.Command, args []string, s *summary) error {
+		format, err := output.Parse(outputFormat)
+		if err != nil {
+			return usageError(err)
+		}
 
 		agent, err := agent.Build(ctx, configPath)
 		if err != nil {
-			err = errors.Wrapf(err, "agent backup error")
-			fmt.Println(err)
-			return
+			return configError(errors.Wrap(err, "cannot build agent"))
+		}
+
+		if format != output.Table {
+			stages := agent.Pipeline()
+			return printResult(format, stages, stageHeader, stageRows(stages))
 		}
 
 		fmt.Println("WORKFLOW:")
@@ -52,7 +57,8 @@ var infoCmd = &cobra.Command{
 		for _, n := range agent.Notifiers {
 			fmt.Printf("\t - %s\n", n.Name())
 		}
-	},
+		return nil
+	}),
 }
 
 func init() {
@@ -68,3 +74,38 @@ func init() {
 	// is called directly, e.g.:
 	// infoCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
+
+var stageHeader = []string{"type", "name", "key", "value"}
+
+// stageRows returns a row per config value of each stage, sorted by key.
+// Nested tables are flattened (e.g. backend.fs.path).
+func stageRows(stages []agent.Stage) [][]string {
+	var rows [][]string
+	for _, s := range stages {
+		values := map[string]string{}
+		flatten(values, "", s.Config)
+		if len(values) == 0 {
+			rows = append(rows, []string{s.Type, s.Name, "", ""})
+			continue
+		}
+		var keys []string
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			rows = append(rows, []string{s.Type, s.Name, k, values[k]})
+		}
+	}
+	return rows
+}
+
+func flatten(values map[string]string, prefix string, m map[string]interface{}) {
+	for k, v := range m {
+		if sub, ok := v.(map[string]interface{}); ok {
+			flatten(values, prefix+k+".", sub)
+			continue
+		}
+		values[prefix+k] = fmt.Sprint(v)
+	}
+}
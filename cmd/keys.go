@@ -0,0 +1,88 @@
+// Copyright © 2018 Stairlin ltd <it@stairlin.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/stairlin/kargo/plugin/process/cipher"
+	"github.com/tcnksm/go-input"
+)
+
+// keysCmd represents the keys command
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage cipher keys",
+	Long:  ``,
+}
+
+// keysCombineCmd represents the keys combine command
+var keysCombineCmd = &cobra.Command{
+	Use:   "combine [files]",
+	Short: "Rebuild a cipher key from its shares",
+	Long: `Rebuild a cipher key from the shares generated by
+"kargo generate cipher --shares n --threshold t".
+
+Shares are read from the given files (one share per file). When no files are
+given, shares are requested interactively.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var shares []string
+		if len(args) > 0 {
+			for _, name := range args {
+				b, err := ioutil.ReadFile(name)
+				if err != nil {
+					return usageError(err)
+				}
+				shares = append(shares, strings.TrimSpace(string(b)))
+			}
+		} else {
+			ui := &input.UI{
+				Writer: os.Stdout,
+				Reader: os.Stdin,
+			}
+			for {
+				query := fmt.Sprintf("Share #%d (leave empty when done)", len(shares)+1)
+				res, err := ui.Ask(query, &input.Options{
+					HideOrder: true,
+					Mask:      true,
+				})
+				if err != nil {
+					return errAborted
+				}
+				if res == "" {
+					break
+				}
+				shares = append(shares, res)
+			}
+		}
+
+		key, err := cipher.CombineShares(shares)
+		if err != nil {
+			return verifyError(err)
+		}
+		fmt.Println("Cipher key:", key)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(keysCmd)
+
+	keysCmd.AddCommand(keysCombineCmd)
+}
@@ -18,17 +18,18 @@ import (
 	"bytes"
 	"fmt"
 	"math"
-	"os"
 	"regexp"
+	"strconv"
 	"text/tabwriter"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/stairlin/kargo/agent"
 	"github.com/stairlin/kargo/context"
-	"github.com/stairlin/kargo/log"
 	"github.com/stairlin/kargo/pkg/ago"
 	"github.com/stairlin/kargo/pkg/bytefmt"
+	"github.com/stairlin/kargo/pkg/output"
 	"github.com/stairlin/kargo/plugin/storage"
 )
 
@@ -43,17 +44,16 @@ var (
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List/Filter all available backups",
-	Run: func(cmd *cobra.Command, args []string) {
-		// Build context
-		ctx := context.Background()
-		ctx.Workdir = workdir
-		defer ctx.Cleanup()
+	RunE: run(func(ctx *context.Context, cmd *cobra.Command, args []string, s *summary) error {
+		format, err := output.Parse(outputFormat)
+		if err != nil {
+			return usageError(err)
+		}
 
 		// Build agent
 		agent, err := agent.Build(ctx, configPath)
 		if err != nil {
-			ctx.Error("Failed to build agent", log.Error(err))
-			return
+			return configError(errors.Wrap(err, "cannot build agent"))
 		}
 
 		// Build filters
@@ -62,30 +62,22 @@ var listCmd = &cobra.Command{
 		if len(expr) > 0 {
 			pattern, err = regexp.Compile(expr)
 			if err != nil {
-				fmt.Println(err)
-				return
+				return usageError(err)
 			}
 		}
 		prefix := cmd.Flag("prefix").Value.String()
-		fromS := cmd.Flag("from").Value.String()
-		var from int64
-		if len(fromS) > 0 {
-			t, err := time.Parse("2006-01-02", fromS)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-			from = beginningOfDay(t.UnixNano())
+		from, to, err := parseRange(
+			cmd.Flag("from").Value.String(), cmd.Flag("to").Value.String(),
+		)
+		if err != nil {
+			return usageError(err)
 		}
-		toS := cmd.Flag("to").Value.String()
-		to := int64(math.MaxInt64)
-		if len(toS) > 0 {
-			t, err := time.Parse("2006-01-02", toS)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-			to = endOfDay(t.UnixNano())
+		from, to, err = parseAges(
+			from, to,
+			cmd.Flag("since").Value.String(), cmd.Flag("older-than").Value.String(),
+		)
+		if err != nil {
+			return usageError(err)
 		}
 		filter := storage.WalkFilter{
 			From:    from,
@@ -95,40 +87,82 @@ var listCmd = &cobra.Command{
 			Limit:   limit,
 		}
 
-		// Build output
+		items, classes, err := listBackups(ctx, agent, filter)
+		if err != nil {
+			return storageError(errors.Wrap(err, "cannot list backups"))
+		}
+		s.Count("items", len(items))
+
+		// Lock state of storages which support it
+		locker, locks := agent.Storage.(storage.Locker)
+		if locks {
+			for i := range items {
+				lock, err := locker.Lock(ctx, items[i].Key)
+				if err != nil {
+					return storageError(errors.Wrapf(err, "cannot get lock of %s", items[i].Key))
+				}
+				items[i].setLock(lock)
+			}
+		}
+
+		if format != output.Table {
+			return printResult(format, items, listHeader, listRows(items))
+		}
+
+		// Build output. The storage class and the lock state are shown for
+		// storages which support them
+		var totalSize int64
 		w := new(tabwriter.Writer)
 		buf := bytes.NewBuffer([]byte{})
 		w.Init(buf, 0, 8, 0, '\t', 0)
-		fmt.Fprintln(w, "KEY\t SIZE\t LAST MODIFICATION\t FROM NOW")
-
-		var totalItems int
-		var totalSize int64
-		walkFn := func(key string, f os.FileInfo, err error) error {
-			if err != nil {
-				return err
+		fmt.Fprint(w, "KEY\t SIZE\t ")
+		if classes {
+			fmt.Fprint(w, "CLASS\t ")
+		}
+		if locks {
+			fmt.Fprint(w, "LOCK\t ")
+		}
+		fmt.Fprintln(w, "CREATED\t FROM NOW")
+		for _, item := range items {
+			totalSize += item.Size
+			fmt.Fprintf(w, "%s\t %s\t ", item.Key, bytefmt.HumanReadableByte(item.Size))
+			if classes {
+				class := item.StorageClass
+				if class == "" {
+					class = "-"
+				}
+				fmt.Fprintf(w, "%s\t ", class)
 			}
-			totalItems++
-			totalSize += f.Size()
-
-			fmt.Fprintf(w, "%s\t %s\t %s\t %s\n",
-				key,
-				bytefmt.HumanReadableByte(f.Size()),
-				f.ModTime().String(),
-				ago.Ago(f.ModTime()),
-			)
-			return nil
+			if locks {
+				fmt.Fprintf(w, "%s\t ", item.lock)
+			}
+			fmt.Fprintf(w, "%s\t %s\n", item.Time.String(), ago.Ago(item.Time))
 		}
-		agent.Storage.Walk(ctx, &filter, walkFn)
 
 		w.Flush()
 		fmt.Println()
 		fmt.Println(buf.String())
 		fmt.Printf(
 			"ITEMS %d (%s)\n",
-			totalItems,
+			len(items),
 			bytefmt.HumanReadableByte(totalSize),
 		)
-	},
+
+		// Deduplication ratio of the whole storage
+		if d, ok := agent.Storage.(storage.Deduper); ok {
+			stats, err := d.DedupStats(ctx)
+			if err != nil {
+				return storageError(errors.Wrap(err, "cannot get deduplication stats"))
+			}
+			fmt.Printf(
+				"DEDUP %.2fx (%s stored for %s)\n",
+				stats.Ratio(),
+				bytefmt.HumanReadableByte(stats.Stored),
+				bytefmt.HumanReadableByte(stats.Size),
+			)
+		}
+		return nil
+	}),
 }
 
 func init() {
@@ -144,11 +178,174 @@ func init() {
 	// is called directly, e.g.:
 	listCmd.Flags().StringP("pattern", "", "", "Filter keys with a pattern")
 	listCmd.Flags().StringP("prefix", "", "", "Filter keys with a prefix")
-	listCmd.Flags().StringP("from", "", "", "Keep keys created after time t")
-	listCmd.Flags().StringP("to", "", "", "Keep keys created before time t")
+	listCmd.Flags().StringP("from", "", "", "Keep keys created after time t (e.g. 2018-06-01, or RFC 3339)")
+	listCmd.Flags().StringP("to", "", "", "Keep keys created before time t (e.g. 2018-06-01, or RFC 3339)")
+	listCmd.Flags().StringP("since", "", "", "Keep keys created within duration d (e.g. 36h)")
+	listCmd.Flags().StringP("older-than", "", "", "Keep keys created before duration d (e.g. 30d)")
 	listCmd.Flags().UintVarP(&limit, "limit", "l", 30, "Limit the number of keys displayed")
 }
 
+// listItem is a backup listed by the list command
+type listItem struct {
+	Key          string     `json:"key"`
+	Size         int64      `json:"size"`
+	Time         time.Time  `json:"time"`
+	ModTime      time.Time  `json:"mod_time"`
+	StorageClass string     `json:"storage_class,omitempty"`
+	LockMode     string     `json:"lock_mode,omitempty"`
+	RetainUntil  *time.Time `json:"retain_until,omitempty"`
+	LegalHold    bool       `json:"legal_hold,omitempty"`
+
+	lock *storage.Lock
+}
+
+func (i *listItem) setLock(l *storage.Lock) {
+	i.lock = l
+	if !l.Locked(time.Now()) {
+		return
+	}
+	i.LockMode = l.Mode
+	if !l.RetainUntil.IsZero() {
+		i.RetainUntil = &l.RetainUntil
+	}
+	i.LegalHold = l.LegalHold
+}
+
+// listBackups returns the backups of the storage of a selected by filter,
+// and whether the storage has storage classes. Backups are filtered on their
+// creation time, which comes from the metadata or the key when available.
+func listBackups(
+	ctx *context.Context, a *agent.Agent, filter storage.WalkFilter,
+) ([]listItem, bool, error) {
+	var items []listItem
+	var classes bool
+	err := a.Backups(ctx, filter, func(b *agent.Backup) error {
+		item := listItem{
+			Key:     b.Name(),
+			Size:    b.Size(),
+			Time:    b.Time,
+			ModTime: b.ModTime(),
+		}
+		if c, ok := b.FileInfo.(storage.ClassInfo); ok {
+			item.StorageClass = c.StorageClass()
+			classes = true
+		}
+		items = append(items, item)
+		return nil
+	})
+	return items, classes, err
+}
+
+var listHeader = []string{
+	"key", "size", "time", "mod_time", "storage_class", "lock_mode", "retain_until", "legal_hold",
+}
+
+func listRows(items []listItem) [][]string {
+	rows := make([][]string, len(items))
+	for i, item := range items {
+		var until string
+		if item.RetainUntil != nil {
+			until = item.RetainUntil.Format(time.RFC3339)
+		}
+		rows[i] = []string{
+			item.Key,
+			strconv.FormatInt(item.Size, 10),
+			item.Time.Format(time.RFC3339Nano),
+			item.ModTime.Format(time.RFC3339Nano),
+			item.StorageClass,
+			item.LockMode,
+			until,
+			strconv.FormatBool(item.LegalHold),
+		}
+	}
+	return rows
+}
+
+// parseRange parses the times of a time range (see timeLayouts). Dates
+// without time include the whole day. Both ends are optional.
+func parseRange(fromTime, toTime string) (from, to int64, err error) {
+	to = int64(math.MaxInt64)
+	if s := fromTime; len(s) > 0 {
+		t, err := parseTime(s)
+		if err != nil {
+			return 0, 0, err
+		}
+		from = t.UnixNano()
+		if isDate(s) {
+			from = beginningOfDay(from)
+		}
+	}
+	if s := toTime; len(s) > 0 {
+		t, err := parseTime(s)
+		if err != nil {
+			return 0, 0, err
+		}
+		to = t.UnixNano()
+		if isDate(s) {
+			to = endOfDay(to)
+		}
+	}
+	return from, to, nil
+}
+
+// parseAges narrows the time range [from, to] to backups created within
+// duration since, and before duration olderThan. Both are optional.
+func parseAges(from, to int64, since, olderThan string) (int64, int64, error) {
+	now := time.Now()
+	if since != "" {
+		d, err := parseDuration(since)
+		if err != nil {
+			return 0, 0, errors.Wrap(err, "invalid --since")
+		}
+		if t := now.Add(-d).UnixNano(); t > from {
+			from = t
+		}
+	}
+	if olderThan != "" {
+		d, err := parseDuration(olderThan)
+		if err != nil {
+			return 0, 0, errors.Wrap(err, "invalid --older-than")
+		}
+		if t := now.Add(-d).UnixNano(); t < to {
+			to = t
+		}
+	}
+	return from, to, nil
+}
+
+var durationRegexp = regexp.MustCompile(`^([0-9]+)([dw])$`)
+
+// parseDuration parses a duration such as "36h" (see time.ParseDuration),
+// and also accepts days (e.g. "30d") and weeks (e.g. "2w")
+func parseDuration(s string) (time.Duration, error) {
+	var d time.Duration
+	if m := durationRegexp.FindStringSubmatch(s); m != nil {
+		n, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		d = time.Duration(n) * day
+		if m[2] == "w" {
+			d *= 7
+		}
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, errors.Errorf("cannot parse duration %s (e.g. 36h, or 30d)", s)
+		}
+	}
+	if d < 0 {
+		return 0, errors.Errorf("negative duration %s", s)
+	}
+	return d, nil
+}
+
+// isDate returns whether t is a date without time
+func isDate(t string) bool {
+	_, err := time.Parse("2006-01-02", t)
+	return err == nil
+}
+
 func beginningOfDay(t int64) int64 {
 	return floor(t, day)
 }
@@ -0,0 +1,30 @@
+// Copyright © 2018 Stairlin ltd <it@stairlin.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/stairlin/kargo/pkg/output"
+)
+
+// printResult writes the result of a command to stdout in the format f. v is
+// encoded to JSON and YAML, and header and rows are written to CSV.
+func printResult(f output.Format, v interface{}, header []string, rows [][]string) error {
+	if f == output.CSV {
+		return output.WriteCSV(os.Stdout, header, rows)
+	}
+	return output.Encode(os.Stdout, f, v)
+}
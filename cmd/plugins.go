@@ -16,7 +16,10 @@ package cmd
 
 import (
 	"fmt"
+	"sort"
 
+	"github.com/stairlin/kargo/agent"
+	"github.com/stairlin/kargo/pkg/output"
 	"github.com/stairlin/kargo/plugin/notification"
 	"github.com/stairlin/kargo/plugin/process"
 	"github.com/stairlin/kargo/plugin/source"
@@ -30,27 +33,81 @@ var pluginsCmd = &cobra.Command{
 	Use:   "plugins",
 	Short: "Show all available plugins",
 	Long:  ``,
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("Sources:")
-		for name := range source.Sources {
-			fmt.Println("\t -", name)
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, err := output.Parse(outputFormat)
+		if err != nil {
+			return usageError(err)
 		}
 
-		fmt.Println("Processors:")
-		for name := range process.Processors {
-			fmt.Println("\t -", name)
+		plugins := registeredPlugins()
+		if format != output.Table {
+			var rows [][]string
+			for _, p := range plugins {
+				rows = append(rows, []string{p.Type, p.Name})
+			}
+			header := []string{"type", "name"}
+			return printResult(format, plugins, header, rows)
 		}
 
-		fmt.Println("Storages:")
-		for name := range storage.Storages {
-			fmt.Println("\t -", name)
+		var typ string
+		for _, p := range plugins {
+			if p.Type != typ {
+				typ = p.Type
+				fmt.Printf("%s:\n", pluginTitles[typ])
+			}
+			fmt.Println("\t -", p.Name)
 		}
+		return nil
+	},
+}
+
+// plugin is a registered plugin
+type plugin struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+var pluginTitles = map[string]string{
+	agent.StageSource:    "Sources",
+	agent.StageProcessor: "Processors",
+	agent.StageStorage:   "Storages",
+	agent.StageNotifier:  "Notifiers",
+}
 
-		fmt.Println("Notifiers:")
-		for name := range notification.Notifiers {
-			fmt.Println("\t -", name)
+// registeredPlugins returns all plugins, grouped by type and sorted by name
+func registeredPlugins() []plugin {
+	var plugins []plugin
+	add := func(typ string, names []string) {
+		sort.Strings(names)
+		for _, name := range names {
+			plugins = append(plugins, plugin{Type: typ, Name: name})
 		}
-	},
+	}
+
+	var names []string
+	for name := range source.Sources {
+		names = append(names, name)
+	}
+	add(agent.StageSource, names)
+
+	names = nil
+	for name := range process.Processors {
+		names = append(names, name)
+	}
+	add(agent.StageProcessor, names)
+
+	names = nil
+	for name := range storage.Storages {
+		names = append(names, name)
+	}
+	add(agent.StageStorage, names)
+
+	names = nil
+	for name := range notification.Notifiers {
+		names = append(names, name)
+	}
+	add(agent.StageNotifier, names)
+	return plugins
 }
 
 func init() {
@@ -15,12 +15,13 @@
 package cmd
 
 import (
-	"fmt"
-
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/stairlin/kargo/agent"
 	"github.com/stairlin/kargo/context"
 	"github.com/stairlin/kargo/log"
+	"github.com/stairlin/kargo/pkg/unit"
+	"github.com/stairlin/kargo/plugin/storage"
 )
 
 var (
@@ -29,34 +30,38 @@ var (
 
 // pullCmd represents the pull command
 var pullCmd = &cobra.Command{
-	Use:   "pull",
+	Use:   "pull [key]",
 	Short: "Pull a backup from storage, process it, and then persist it locally",
-	Long:  ``,
-	Run: func(cmd *cobra.Command, args []string) {
-		if len(args) == 0 {
-			fmt.Println("missing key")
-			return
-		}
-		key := args[0]
-
-		// Build context
-		ctx := context.Background()
-		ctx.Workdir = workdir
-		defer ctx.Cleanup()
+	Long: `Pull the backup key from storage, process it, and then persist it locally.
 
+Instead of a key, the most recent backup matching --latest, --before, --prefix
+or --label is pulled. Labels are the fields of the key template.`,
+	RunE: run(func(ctx *context.Context, cmd *cobra.Command, args []string, s *summary) error {
 		// Build agent
 		agent, err := agent.Build(ctx, configPath)
 		if err != nil {
-			ctx.Error("Failed to build agent", log.Error(err))
-			return
+			return configError(errors.Wrap(err, "cannot build agent"))
+		}
+		if insecure {
+			allowInsecure(ctx, agent)
+		}
+
+		key, err := selectKey(ctx, cmd, agent, args)
+		if err != nil {
+			return err
 		}
+		ctx.Key = key
 
 		// Pull data from store
+		downloader, err := newDownloader(cmd)
+		if err != nil {
+			return usageError(errors.Wrap(err, "invalid download settings"))
+		}
+		downloader.Throttle = agent.ThrottleDownload
 		ctx.Info("Pulling file from storage...", log.String("key", key))
-		data, info, err := agent.Storage.Pull(ctx, key)
+		data, info, err := downloader.Pull(ctx, agent.Storage, key)
 		if err != nil {
-			ctx.Error("Failed to pull file", log.Error(err))
-			return
+			return storageError(errors.Wrap(err, "cannot pull file"))
 		}
 		data = ctx.Progress("Pulling file", data, info.Size())
 		ctx.AddCloser(data)
@@ -67,8 +72,7 @@ var pullCmd = &cobra.Command{
 				proc := agent.Processors[i]
 				data, err = proc.Decode(ctx, data)
 				if err != nil {
-					ctx.Error("Failed to decode data", log.Error(err))
-					return
+					return errors.Wrap(err, "cannot decode data")
 				}
 				ctx.AddCloser(data)
 			}
@@ -76,10 +80,10 @@ var pullCmd = &cobra.Command{
 
 		// Persist it locally
 		if err := ctx.Persist(key, data); err != nil {
-			ctx.Error("Failed to persist data", log.Error(err))
-			return
+			return errors.Wrap(err, "cannot persist data")
 		}
-	},
+		return nil
+	}),
 }
 
 func init() {
@@ -95,4 +99,36 @@ func init() {
 	// is called directly, e.g.:
 	pullCmd.Flags().StringP("key", "k", "", "Backup key")
 	pullCmd.Flags().BoolVarP(&processBackup, "process", "p", true, "Process backup")
+	pullCmd.Flags().BoolVarP(&insecure, "insecure", "", false, "Pull unsigned or mis-signed backups")
+	addDownloadFlags(pullCmd)
+	addSelectorFlags(pullCmd)
+}
+
+// addDownloadFlags adds the flags of downloads by parts to cmd
+func addDownloadFlags(cmd *cobra.Command) {
+	cmd.Flags().IntP("concurrency", "", storage.DefaultConcurrency, "Number of parts downloaded in parallel")
+	cmd.Flags().StringP("part-size", "", unit.Byte(storage.DefaultPartSize).String(), "Size of the parts downloaded")
+}
+
+// newDownloader returns a downloader configured with the flags of cmd
+func newDownloader(cmd *cobra.Command) (*storage.Downloader, error) {
+	d := storage.NewDownloader()
+	concurrency, err := cmd.Flags().GetInt("concurrency")
+	if err != nil {
+		return nil, err
+	}
+	if concurrency < 1 {
+		return nil, errors.New("concurrency must be greater than 0")
+	}
+	d.Concurrency = concurrency
+
+	partSize, err := unit.ParseByte(cmd.Flag("part-size").Value.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid part size")
+	}
+	if partSize < 1 {
+		return nil, errors.New("part size must be greater than 0")
+	}
+	d.PartSize = int64(partSize)
+	return d, nil
 }
@@ -0,0 +1,227 @@
+// Copyright © 2018 Stairlin ltd <it@stairlin.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/stairlin/kargo/agent"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/log"
+	"github.com/stairlin/kargo/pkg/sec"
+	"github.com/stairlin/kargo/plugin/process/cipher"
+	"github.com/stairlin/kargo/plugin/storage"
+)
+
+// rekeyCmd represents the rekey command
+var rekeyCmd = &cobra.Command{
+	Use:   "rekey [keys]",
+	Short: "Re-encrypt backups with the default cipher key",
+	Long: `Rekey pulls backups from the storage, decrypts them with the key they have
+been encrypted with, and then replaces them with a copy encrypted with the
+default key of the cipher processor.
+
+Backups already encrypted with the default key are skipped, so an interrupted
+rekey can be resumed by running the same command again.`,
+	RunE: run(func(ctx *context.Context, cmd *cobra.Command, args []string, s *summary) error {
+		// Build agent
+		agent, err := agent.Build(ctx, configPath)
+		if err != nil {
+			return configError(errors.Wrap(err, "cannot build agent"))
+		}
+
+		idx := -1
+		for i, proc := range agent.Processors {
+			if _, ok := proc.(*cipher.Processor); ok {
+				idx = i
+			}
+		}
+		if idx < 0 {
+			return configError(errors.New("missing cipher processor"))
+		}
+
+		keys, err := rekeySelection(ctx, cmd, agent, args)
+		if err != nil {
+			return err
+		}
+
+		var rekeyed, skipped, failed int
+		for i, key := range keys {
+			ctx.Info(
+				fmt.Sprintf("Rekeying backup %d/%d...", i+1, len(keys)),
+				log.String("key", key),
+			)
+			ok, err := rekey(ctx, agent, idx, key)
+			switch {
+			case err != nil:
+				failed++
+				ctx.Error("Failed to rekey backup",
+					log.String("key", key), log.Error(err),
+				)
+			case ok:
+				rekeyed++
+			default:
+				skipped++
+				ctx.Info("Backup already encrypted with the default key",
+					log.String("key", key),
+				)
+			}
+		}
+
+		s.Count("rekeyed", rekeyed)
+		s.Count("skipped", skipped)
+		s.Count("failed", failed)
+		if failed > 0 {
+			return errors.Errorf("%d backups cannot be rekeyed", failed)
+		}
+		return nil
+	}),
+}
+
+func init() {
+	rootCmd.AddCommand(rekeyCmd)
+
+	rekeyCmd.Flags().StringP("prefix", "", "", "Rekey keys with a prefix")
+	rekeyCmd.Flags().StringP("from", "", "", "Rekey keys created after time t")
+	rekeyCmd.Flags().StringP("to", "", "", "Rekey keys created before time t")
+	rekeyCmd.Flags().BoolP("all", "", false, "Rekey all backups")
+}
+
+// rekeySelection returns the keys selected by the arguments/flags of cmd
+func rekeySelection(
+	ctx *context.Context, cmd *cobra.Command, a *agent.Agent, args []string,
+) ([]string, error) {
+	if len(args) > 0 {
+		return args, nil
+	}
+
+	all := cmd.Flag("all").Value.String() == "true"
+	prefix := cmd.Flag("prefix").Value.String()
+	if !all && prefix == "" && !cmd.Flag("from").Changed && !cmd.Flag("to").Changed {
+		return nil, usageError(
+			errors.New("missing keys (use --prefix, --from, --to or --all)"),
+		)
+	}
+	from, to, err := parseRange(
+		cmd.Flag("from").Value.String(), cmd.Flag("to").Value.String(),
+	)
+	if err != nil {
+		return nil, usageError(err)
+	}
+	filter := storage.WalkFilter{
+		From:   from,
+		To:     to,
+		Prefix: prefix,
+	}
+
+	// Collect keys first, since backups are replaced while rekeying
+	var keys []string
+	err = a.Backups(ctx, filter, func(b *agent.Backup) error {
+		keys = append(keys, b.Name())
+		return nil
+	})
+	return keys, storageError(err)
+}
+
+// rekey re-encrypts the backup stored under key with the default cipher key.
+// It returns false when the backup is already encrypted with that key.
+//
+// The new backup is fully written and verified on local disk before it
+// replaces the original one.
+func rekey(
+	parent *context.Context, a *agent.Agent, idx int, key string,
+) (bool, error) {
+	ctx := context.WithKey(parent, key)
+	defer ctx.Cleanup()
+	proc := a.Processors[idx].(*cipher.Processor)
+
+	data, info, err := a.Storage.Pull(ctx, key)
+	if err != nil {
+		return false, errors.Wrap(err, "cannot pull backup")
+	}
+	ctx.AddCloser(data)
+	data = a.ThrottleDownload(ctx, data)
+	data = ctx.Progress("Pulling file", data, info.Size())
+
+	// Run processors applied after the cipher backward
+	for i := len(a.Processors) - 1; i > idx; i-- {
+		data, err = a.Processors[i].Decode(ctx, data)
+		if err != nil {
+			return false, errors.Wrap(err, "cannot decode backup")
+		}
+		ctx.AddCloser(data)
+	}
+
+	br := bufio.NewReader(data)
+	stream, err := sec.Inspect(br)
+	if err != nil {
+		return false, errors.Wrap(err, "cannot inspect encrypted backup")
+	}
+	if stream.Version == sec.StreamVersion &&
+		stream.Sender == proc.Rotator.DefaultSender() {
+		return false, nil
+	}
+
+	// Re-encrypt backup
+	plain, err := proc.Decode(ctx, br)
+	if err != nil {
+		return false, errors.Wrap(err, "cannot decrypt backup")
+	}
+	ctx.AddCloser(plain)
+	encrypted, err := proc.Encode(ctx, plain)
+	if err != nil {
+		return false, errors.Wrap(err, "cannot encrypt backup")
+	}
+	ctx.AddCloser(encrypted)
+	f, err := ctx.CreateTempFile(encrypted)
+	if err != nil {
+		return false, err
+	}
+
+	// Ensure the new backup can be decrypted before replacing the original one
+	verify, err := proc.Decode(ctx, f)
+	if err != nil {
+		return false, errors.Wrap(err, "cannot decrypt rekeyed backup")
+	}
+	ctx.AddCloser(verify)
+	if _, err := io.Copy(ioutil.Discard, verify); err != nil {
+		return false, errors.Wrap(err, "cannot verify rekeyed backup")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, errors.Wrap(err, "cannot rewind rekeyed backup")
+	}
+
+	// Run processors applied after the cipher
+	var out io.ReadCloser = f
+	for i := idx + 1; i < len(a.Processors); i++ {
+		out, err = a.Processors[i].Encode(ctx, out)
+		if err != nil {
+			return false, errors.Wrap(err, "cannot encode backup")
+		}
+		ctx.AddCloser(out)
+	}
+
+	out = a.ThrottleUpload(ctx, out)
+	meta := &storage.Meta{CreatedAt: a.BackupTime(info)}
+	if err := storage.PushMeta(ctx, a.Storage, key, out, meta); err != nil {
+		return false, errors.Wrap(err, "cannot push rekeyed backup")
+	}
+	return true, nil
+}
@@ -15,17 +15,18 @@
 package cmd
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"os"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/stairlin/kargo/agent"
 	"github.com/stairlin/kargo/context"
 	"github.com/stairlin/kargo/log"
 	"github.com/stairlin/kargo/plugin/notification"
+	"github.com/stairlin/kargo/plugin/process/sign"
 	"github.com/tcnksm/go-input"
 )
 
@@ -33,32 +34,38 @@ var (
 	// local returns whether a command should use local a backup instead of the
 	// backup from storage
 	local bool
+	// insecure returns whether unsigned or mis-signed backups can be decoded
+	insecure bool
 )
 
 // restoreCmd represents the restore command
 var restoreCmd = &cobra.Command{
-	Use:   "restore",
+	Use:   "restore [key]",
 	Short: "Restore the source from a backup",
-	Long:  ``,
-	Run: func(cmd *cobra.Command, args []string) {
-		if len(args) == 0 {
-			fmt.Println("missing key")
-			return
-		}
-		key := args[0]
+	Long: `Restore the source from the backup key.
 
-		// Build context
-		ctx := context.Background()
-		ctx.Workdir = workdir
-		defer ctx.Cleanup()
+Instead of a key, the most recent backup matching --latest, --before, --prefix
+or --label is restored. Labels are the fields of the key template.`,
+	RunE: run(func(ctx *context.Context, cmd *cobra.Command, args []string, s *summary) error {
+		if local && len(args) == 0 {
+			return usageError(errors.New("missing key of the local file"))
+		}
 
 		// Build agent
 		agent, err := agent.Build(ctx, configPath)
 		if err != nil {
-			ctx.Error("Failed to build agent", log.Error(err))
-			return
+			return configError(errors.Wrap(err, "cannot build agent"))
 		}
 		agent.Silent = silent
+		if insecure {
+			allowInsecure(ctx, agent)
+		}
+
+		key, err := selectKey(ctx, cmd, agent, args)
+		if err != nil {
+			return err
+		}
+		ctx.Key = key
 
 		// Request confirmation
 		force := cmd.Flag("force").Value.String() == "true"
@@ -69,76 +76,24 @@ var restoreCmd = &cobra.Command{
 				Writer: os.Stdout,
 				Reader: os.Stdin,
 			}
-			query := "Warning! Restoring the source may cause data loss. Are you sure? (Y/n)"
+			query := fmt.Sprintf(
+				"Warning! Restoring the source from %s may cause data loss. Are you sure? (Y/n)",
+				key,
+			)
 			res, err := ui.Ask(query, &input.Options{
 				Default:  "n",
 				Required: true,
 				Loop:     true,
 			})
-			if err != nil {
-				return
-			}
-			if res != "Y" {
-				return
+			if err != nil || res != "Y" {
+				return errAborted
 			}
 		}
 
-		var notified bool
-		defer func() {
-			if notified {
-				return
-			}
-			ctx.Warn("Sending unknown failure notification...")
-			n := notification.Notification{
-				Type:      notification.Failure,
-				Operation: notification.Restore,
-				StartTime: ctx.StartTime,
-				EndTime:   time.Now(),
-				Error:     errors.New("unknown failure"),
-			}
-			for _, notifier := range agent.Notifiers {
-				if err := notifier.Send(ctx, n); err != nil {
-					ctx.Error("Failed to send notification", log.Error(err))
-				}
-			}
-		}()
-
-		// Pull data from store or local file
-		var data io.ReadCloser
-		var info os.FileInfo
-		if local {
-			ctx.Info("Loading file from local disk...", log.String("key", key))
-			data, info, err = ctx.Load(key)
-		} else {
-			ctx.Info("Pulling file from storage...", log.String("key", key))
-			data, info, err = agent.Storage.Pull(ctx, key)
-
-			// Run processors backward
-			if processBackup {
-				for i := len(agent.Processors) - 1; i >= 0; i-- {
-					proc := agent.Processors[i]
-					data, err = proc.Decode(ctx, data)
-					if err != nil {
-						ctx.Error("Failed to decode data", log.Error(err))
-						return
-					}
-					ctx.AddCloser(data)
-				}
-			}
-
-			data = ctx.Progress("Pulling file", data, info.Size())
-		}
-		if err != nil {
-			ctx.Error("Failed to pull/load file", log.Error(err))
-			return
+		if err := restore(ctx, cmd, agent, key); err != nil {
+			notifyFailure(ctx, agent, notification.Restore, err)
+			return err
 		}
-
-		// Start restore
-		if err := agent.Source.Restore(ctx, data); err != nil {
-			ctx.Error("Failed to restore data", log.Error(err))
-			return
-		}
-
 		n := &notification.Notification{
 			Type:      notification.Success,
 			Operation: notification.Restore,
@@ -146,13 +101,54 @@ var restoreCmd = &cobra.Command{
 			EndTime:   time.Now(),
 			Body:      fmt.Sprintf("Key %s", key),
 		}
-		if err := agent.Notify(ctx, n); err != nil {
-			return
+		agent.Notify(ctx, n)
+		return nil
+	}),
+}
+
+// restore restores the source of a from the backup key
+func restore(ctx *context.Context, cmd *cobra.Command, a *agent.Agent, key string) error {
+	// Pull data from store or local file
+	var data io.ReadCloser
+	if local {
+		ctx.Info("Loading file from local disk...", log.String("key", key))
+		f, _, err := ctx.Load(key)
+		if err != nil {
+			return errors.Wrap(err, "cannot load file")
+		}
+		data = f
+	} else {
+		downloader, err := newDownloader(cmd)
+		if err != nil {
+			return usageError(errors.Wrap(err, "invalid download settings"))
+		}
+		downloader.Throttle = a.ThrottleDownload
+		ctx.Info("Pulling file from storage...", log.String("key", key))
+		r, info, err := downloader.Pull(ctx, a.Storage, key)
+		if err != nil {
+			return storageError(errors.Wrap(err, "cannot pull file"))
+		}
+		data = ctx.Progress("Pulling file", r, info.Size())
+		ctx.AddCloser(data)
+
+		// Run processors backward
+		if processBackup {
+			for i := len(a.Processors) - 1; i >= 0; i-- {
+				proc := a.Processors[i]
+				data, err = proc.Decode(ctx, data)
+				if err != nil {
+					return errors.Wrap(err, "cannot decode data")
+				}
+				ctx.AddCloser(data)
+			}
 		}
-		notified = true
+	}
 
-		ctx.Info("OK", log.String("duration", time.Now().Sub(ctx.StartTime).String()))
-	},
+	// Start restore
+	if err := a.Source.Restore(ctx, data); err != nil {
+		return sourceError(errors.Wrap(err, "cannot restore data"))
+	}
+	return nil
 }
 
 func init() {
@@ -168,4 +164,17 @@ func init() {
 	// is called directly, e.g.:
 	restoreCmd.Flags().BoolP("force", "", false, "Bypass confirmation")
 	restoreCmd.Flags().BoolVarP(&local, "local", "l", false, "Restore from a local file instead of the storage")
+	restoreCmd.Flags().BoolVarP(&insecure, "insecure", "", false, "Restore unsigned or mis-signed backups")
+	addDownloadFlags(restoreCmd)
+	addSelectorFlags(restoreCmd)
+}
+
+// allowInsecure allows sign processors to decode unsigned or mis-signed data
+func allowInsecure(ctx *context.Context, a *agent.Agent) {
+	ctx.Warn("Insecure mode (signatures are not enforced)")
+	for _, proc := range a.Processors {
+		if p, ok := proc.(*sign.Processor); ok {
+			p.Insecure = true
+		}
+	}
 }
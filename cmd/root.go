@@ -19,6 +19,7 @@ import (
 	"os"
 
 	"github.com/spf13/cobra"
+	"github.com/stairlin/kargo/pkg/output"
 )
 
 var (
@@ -32,6 +33,8 @@ var (
 	// silent returns whether the command can trigger notifications or not.
 	// When silent is true, there must be no notifications.
 	silent bool
+	// outputFormat is the format of the results of list, info and plugins
+	outputFormat string
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -46,10 +49,15 @@ var rootCmd = &cobra.Command{
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+//
+// Errors which have not been reported by the summary of a command are printed,
+// and the process exits with the code of the error class.
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		if e, ok := err.(*exitError); !ok || !e.reported {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+		}
+		os.Exit(exitCode(nil, err))
 	}
 }
 
@@ -59,6 +67,15 @@ func init() {
 	// will be global for your application.
 	rootCmd.PersistentFlags().StringVar(&configPath, "config", "", "config file")
 	rootCmd.PersistentFlags().StringVar(&workdir, "workdir", "", "directory where temporary files are stored")
+	rootCmd.PersistentFlags().DurationVar(&timeout, "timeout", 0, "maximum duration of a command (e.g. 2h)")
+	rootCmd.PersistentFlags().StringVarP(&outputFormat, "output", "o", string(output.Table), "output format (table, json, yaml or csv)")
+
+	// Errors are returned by commands, and reported by Execute
+	rootCmd.SilenceErrors = true
+	rootCmd.SilenceUsage = true
+	rootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return usageError(err)
+	})
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
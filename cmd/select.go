@@ -0,0 +1,186 @@
+// Copyright © 2018 Stairlin ltd <it@stairlin.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/stairlin/kargo/agent"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/log"
+	"github.com/stairlin/kargo/pkg/bytefmt"
+	"github.com/stairlin/kargo/plugin/storage"
+)
+
+// timeLayouts are the layouts accepted by time flags
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// errFound stops a walk once a backup has been selected
+var errFound = errors.New("found")
+
+// selector selects the most recent backup matching all its criteria
+type selector struct {
+	Before time.Time
+	Prefix string
+	// Labels are matched against the fields of keys, which are extracted with
+	// the key template
+	Labels map[string]string
+}
+
+// addSelectorFlags adds the flags which select a backup to cmd
+func addSelectorFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolP("latest", "", false, "Select the most recent backup")
+	cmd.Flags().StringP("before", "", "", "Select the most recent backup created before or at time t (a date includes the whole day)")
+	cmd.Flags().StringP("prefix", "", "", "Select the most recent backup with a prefix")
+	cmd.Flags().StringSliceP("label", "", nil, "Select the most recent backup with a label (e.g. env=prod)")
+}
+
+// parseSelector returns the selector of the flags of cmd, or nil when no
+// selector flag is set
+func parseSelector(cmd *cobra.Command) (*selector, error) {
+	latest, _ := cmd.Flags().GetBool("latest")
+	before := cmd.Flag("before").Value.String()
+	prefix := cmd.Flag("prefix").Value.String()
+	labels, _ := cmd.Flags().GetStringSlice("label")
+	if !latest && before == "" && prefix == "" && len(labels) == 0 {
+		return nil, nil
+	}
+
+	sel := &selector{Prefix: prefix, Labels: map[string]string{}}
+	if before != "" {
+		t, err := parseTime(before)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid --before")
+		}
+		sel.Before = t
+		if isDate(before) {
+			// As with list --to, a date includes the whole day
+			sel.Before = time.Unix(0, endOfDay(t.UnixNano())).UTC()
+		}
+	}
+	for _, l := range labels {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.Errorf("invalid label %s (e.g. env=prod)", l)
+		}
+		sel.Labels[kv[0]] = kv[1]
+	}
+	return sel, nil
+}
+
+// selectKey returns the key given as argument, or the key of the most recent
+// backup selected by the flags of cmd
+func selectKey(
+	ctx *context.Context, cmd *cobra.Command, a *agent.Agent, args []string,
+) (string, error) {
+	sel, err := parseSelector(cmd)
+	if err != nil {
+		return "", usageError(err)
+	}
+	switch {
+	case len(args) > 0 && sel != nil:
+		return "", usageError(errors.New(
+			"a key cannot be combined with --latest, --before, --prefix or --label",
+		))
+	case len(args) > 0:
+		key, err := storage.CleanKey(args[0])
+		return key, usageError(err)
+	case sel == nil:
+		return "", usageError(errors.New(
+			"missing key (or --latest, --before, --prefix or --label)",
+		))
+	}
+
+	b, err := sel.find(ctx, a)
+	if err != nil {
+		return "", err
+	}
+	ctx.Info("Selected backup",
+		log.String("key", b.Name()),
+		log.String("size", bytefmt.HumanReadableByte(b.Size())),
+		log.String("created", b.Time.String()),
+	)
+	return b.Name(), nil
+}
+
+// find returns the most recent backup of the storage of a matching the
+// selector. Backups are ordered by creation time (see Agent.BackupTime).
+func (s *selector) find(ctx *context.Context, a *agent.Agent) (*agent.Backup, error) {
+	filter := storage.WalkFilter{
+		To:     math.MaxInt64,
+		Prefix: s.Prefix,
+	}
+	if !s.Before.IsZero() {
+		filter.To = s.Before.UnixNano()
+	}
+	if len(s.Labels) == 0 {
+		filter.Limit = 1
+	}
+
+	var found *agent.Backup
+	err := a.Backups(ctx, filter, func(b *agent.Backup) error {
+		if !s.matches(a, b.Name()) {
+			return nil
+		}
+		found = b
+		return errFound
+	})
+	if err != nil && err != errFound {
+		return nil, storageError(errors.Wrap(err, "cannot list backups"))
+	}
+	if found == nil {
+		return nil, storageError(errors.Wrap(storage.ErrKeyNotFound, "no backup selected"))
+	}
+	return found, nil
+}
+
+// matches returns whether key has the labels of the selector
+func (s *selector) matches(a *agent.Agent, key string) bool {
+	if len(s.Labels) == 0 {
+		return true
+	}
+	fields, ok := a.Template.Match(key)
+	if !ok {
+		return false
+	}
+	for k, v := range s.Labels {
+		if fields[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTime parses t with the first layout of timeLayouts which matches it.
+// Times without time zone are in UTC.
+func parseTime(t string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if ts, err := time.Parse(layout, t); err == nil {
+			return ts, nil
+		}
+	}
+	return time.Time{}, errors.Errorf(
+		"cannot parse time %s (e.g. 2018-06-01T12:00, or RFC 3339)", t,
+	)
+}
@@ -0,0 +1,168 @@
+// Copyright © 2018 Stairlin ltd <it@stairlin.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/stairlin/kargo/agent"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/log"
+	"github.com/stairlin/kargo/pkg/ago"
+	"github.com/stairlin/kargo/pkg/bytefmt"
+	"github.com/stairlin/kargo/plugin/notification"
+)
+
+// spoolCmd represents the spool command
+var spoolCmd = &cobra.Command{
+	Use:   "spool",
+	Short: "List backups pending upload in the spool",
+	Long: `List backups which have been spooled, but not uploaded to the storage
+yet (e.g. because the storage was unavailable).
+
+Pending backups are uploaded by the next backup, or by "kargo spool flush".`,
+	RunE: run(func(ctx *context.Context, cmd *cobra.Command, args []string, s *summary) error {
+		agent, err := agent.Build(ctx, configPath)
+		if err != nil {
+			return configError(errors.Wrap(err, "cannot build agent"))
+		}
+		if agent.Spool == nil {
+			return configError(errors.New("no spool_dir configured"))
+		}
+		entries, err := agent.Spool.Entries()
+		if err != nil {
+			return errors.Wrap(err, "cannot list spool")
+		}
+		s.Count("pending", len(entries))
+
+		w := new(tabwriter.Writer)
+		buf := bytes.NewBuffer([]byte{})
+		w.Init(buf, 0, 8, 0, '\t', 0)
+		fmt.Fprintln(w, "KEY\t SIZE\t SPOOLED\t FROM NOW")
+		var totalSize int64
+		for _, e := range entries {
+			totalSize += e.Size
+			fmt.Fprintf(w, "%s\t %s\t %s\t %s\n",
+				e.Key,
+				bytefmt.HumanReadableByte(e.Size),
+				e.ModTime.String(),
+				ago.Ago(e.ModTime),
+			)
+		}
+		w.Flush()
+		fmt.Println()
+		fmt.Println(buf.String())
+		fmt.Printf(
+			"PENDING %d (%s)\n", len(entries), bytefmt.HumanReadableByte(totalSize),
+		)
+		return nil
+	}),
+}
+
+// spoolFlushCmd represents the spool flush command
+var spoolFlushCmd = &cobra.Command{
+	Use:   "flush",
+	Short: "Upload backups pending upload in the spool",
+	Long:  ``,
+	RunE: run(func(ctx *context.Context, cmd *cobra.Command, args []string, s *summary) error {
+		agent, err := agent.Build(ctx, configPath)
+		if err != nil {
+			return configError(errors.Wrap(err, "cannot build agent"))
+		}
+		agent.Silent = silent
+		if agent.Spool == nil {
+			return configError(errors.New("no spool_dir configured"))
+		}
+		if err := uploadSpool(ctx, agent, ""); err != nil {
+			if exitCode(ctx, err) == exitStorage {
+				return err
+			}
+			return storageError(errors.Wrap(err, "cannot upload spool"))
+		}
+		return nil
+	}),
+}
+
+func init() {
+	rootCmd.AddCommand(spoolCmd)
+	spoolCmd.AddCommand(spoolFlushCmd)
+}
+
+// uploadSpool uploads the backups of the spool, oldest first, and notifies
+// the upload of backups other than key, which were pending. Backups which can
+// never be uploaded are quarantined, and their failure is notified. It
+// returns a storage error when key is quarantined, or when backups were
+// quarantined while flushing the spool (empty key).
+func uploadSpool(ctx *context.Context, a *agent.Agent, key string) error {
+	ctx.Info("Uploading spooled backups...")
+	var quarantined []string
+	var failed error
+	for res := range a.Queue().Start(ctx) {
+		switch {
+		case res.Quarantined:
+			ctx.Error("Spooled backup cannot be uploaded. Moved to the failed directory of the spool",
+				log.String("key", res.Key),
+				log.Error(res.Err),
+			)
+			if res.Key == key {
+				failed = res.Err
+				continue
+			}
+			quarantined = append(quarantined, res.Key)
+			a.Notify(ctx, &notification.Notification{
+				Type:      notification.Failure,
+				Operation: notification.Upload,
+				StartTime: ctx.StartTime,
+				EndTime:   time.Now(),
+				Body:      fmt.Sprintf("Key %s", res.Key),
+				Error:     res.Err,
+			})
+			continue
+		case res.Err != nil:
+			return res.Err
+		}
+		ctx.Info("Uploaded spooled backup",
+			log.String("key", res.Key),
+			log.String("size", bytefmt.HumanReadableByte(res.Size)),
+		)
+		if res.Key == key {
+			continue
+		}
+		n := &notification.Notification{
+			Type:      notification.Success,
+			Operation: notification.Upload,
+			StartTime: ctx.StartTime,
+			EndTime:   time.Now(),
+			Body:      fmt.Sprintf("Key %s", res.Key),
+		}
+		a.Notify(ctx, n)
+	}
+	switch {
+	case failed != nil:
+		return storageError(errors.Wrap(failed, "backup cannot be uploaded"))
+	case key == "" && len(quarantined) > 0:
+		return storageError(errors.Errorf(
+			"%d spooled backups cannot be uploaded: %s",
+			len(quarantined), strings.Join(quarantined, ", "),
+		))
+	}
+	return nil
+}
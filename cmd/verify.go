@@ -0,0 +1,86 @@
+// Copyright © 2018 Stairlin ltd <it@stairlin.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/stairlin/kargo/agent"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/log"
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify [key]",
+	Short: "Check that a backup can be pulled and decoded",
+	Long: `Verify pulls a backup from storage, and decodes it with the processors,
+without restoring it. Therefore, the signature, the encryption and the error
+correction codes of the backup are checked.
+
+Instead of a key, the most recent backup matching --latest, --before, --prefix
+or --label is verified. Labels are the fields of the key template.`,
+	RunE: run(func(ctx *context.Context, cmd *cobra.Command, args []string, s *summary) error {
+		// Build agent
+		agent, err := agent.Build(ctx, configPath)
+		if err != nil {
+			return configError(errors.Wrap(err, "cannot build agent"))
+		}
+
+		key, err := selectKey(ctx, cmd, agent, args)
+		if err != nil {
+			return err
+		}
+		ctx.Key = key
+
+		// Pull data from store
+		downloader, err := newDownloader(cmd)
+		if err != nil {
+			return usageError(errors.Wrap(err, "invalid download settings"))
+		}
+		downloader.Throttle = agent.ThrottleDownload
+		ctx.Info("Pulling file from storage...", log.String("key", key))
+		data, info, err := downloader.Pull(ctx, agent.Storage, key)
+		if err != nil {
+			return storageError(errors.Wrap(err, "cannot pull file"))
+		}
+		data = ctx.Progress("Verifying file", data, info.Size())
+		ctx.AddCloser(data)
+
+		// Run processors backward
+		for i := len(agent.Processors) - 1; i >= 0; i-- {
+			data, err = agent.Processors[i].Decode(ctx, data)
+			if err != nil {
+				return verifyError(errors.Wrap(err, "cannot decode data"))
+			}
+			ctx.AddCloser(data)
+		}
+
+		if _, err := io.Copy(ioutil.Discard, data); err != nil {
+			return verifyError(errors.Wrap(err, "cannot verify data"))
+		}
+		return nil
+	}),
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	addDownloadFlags(verifyCmd)
+	addSelectorFlags(verifyCmd)
+}
@@ -25,8 +25,9 @@ var versionCmd = &cobra.Command{
 	Use:   "version",
 	Short: "Print Kargo version",
 	Long:  "Version prints the Kargo version, as reported by cmd.Version",
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		fmt.Println("Kargo version", Version)
+		return nil
 	},
 }
 
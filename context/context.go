@@ -37,6 +37,8 @@ type Context struct {
 	Context context.Context
 	// Workdir contains the path where files must be created
 	Workdir string
+	// Key is the backup key this context is working on (if any)
+	Key string
 	// StartTime is the moment in time where this context was created
 	StartTime time.Time
 }
@@ -59,6 +61,29 @@ func WithDeadline(parent *Context, deadline time.Time) *Context {
 	c, _ := context.WithDeadline(parent.Context, deadline)
 	ctx := newContext(c)
 	ctx.Workdir = parent.Workdir
+	ctx.Key = parent.Key
+	return ctx
+}
+
+// WithCancel returns a copy of the parent context with a new Done channel.
+// The returned context's Done channel is closed when the returned cancel
+// function is called or when the parent context's Done channel is closed,
+// whichever happens first.
+func WithCancel(parent *Context) (*Context, context.CancelFunc) {
+	c, cancel := context.WithCancel(parent.Context)
+	ctx := newContext(c)
+	ctx.Workdir = parent.Workdir
+	ctx.Key = parent.Key
+	return ctx, cancel
+}
+
+// WithKey returns a copy of the parent context working on the given backup
+// key. Temporary files and closers registered on the returned context are
+// released by its own Cleanup function.
+func WithKey(parent *Context, key string) *Context {
+	ctx := newContext(parent.Context)
+	ctx.Workdir = parent.Workdir
+	ctx.Key = key
 	return ctx
 }
 
@@ -91,7 +116,7 @@ func (c *Context) CreateTempFile(r io.Reader) (*os.File, error) {
 	// Buffer writes to disk
 	buf := bufio.NewWriter(f)
 
-	_, err = io.Copy(buf, r)
+	_, err = io.Copy(buf, c.Reader(r))
 	switch err {
 	case nil, io.ErrUnexpectedEOF:
 	default:
@@ -108,7 +133,11 @@ func (c *Context) CreateTempFile(r io.Reader) (*os.File, error) {
 
 // Persist saves data from r in a file on the working directory.
 func (c *Context) Persist(name string, r io.Reader) error {
-	f, err := os.Create(filepath.Join(c.Workdir, name))
+	p := filepath.Join(c.Workdir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0770); err != nil {
+		return errors.Wrap(err, "cannot create directory")
+	}
+	f, err := os.Create(p)
 	if err != nil {
 		return errors.Wrap(err, "cannot create file")
 	}
@@ -134,7 +163,7 @@ func (c *Context) Persist(name string, r io.Reader) error {
 
 // Load loads data from local file
 func (c *Context) Load(name string) (io.ReadCloser, os.FileInfo, error) {
-	f, err := os.Open(filepath.Join(c.Workdir, name))
+	f, err := os.Open(filepath.Join(c.Workdir, filepath.FromSlash(name)))
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "cannot open file")
 	}
@@ -146,6 +175,12 @@ func (c *Context) Load(name string) (io.ReadCloser, os.FileInfo, error) {
 	return f, info, nil
 }
 
+// Reader returns a reader which reads data from r until the context is done.
+// From then on, reads fail with the context error.
+func (c *Context) Reader(r io.Reader) io.Reader {
+	return &reader{ctx: c, r: r}
+}
+
 // TempPath returns a random file name for a temporary file
 // TODO: Remove
 func (c *Context) TempPath() string {
@@ -252,3 +287,15 @@ func (c *Context) Err() error {
 func (c *Context) Value(key interface{}) interface{} {
 	return c.Context.Value(key)
 }
+
+type reader struct {
+	ctx *Context
+	r   io.Reader
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -2,9 +2,11 @@ package context_test
 
 import (
 	"bytes"
+	stdcontext "context"
 	"io/ioutil"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stairlin/kargo/context"
 )
 
@@ -25,3 +27,14 @@ func TestCreateTempFile(t *testing.T) {
 		t.Errorf("expect %s, but got %s", expect, got)
 	}
 }
+
+func TestCreateTempFileCancel(t *testing.T) {
+	c, cancel := context.WithCancel(context.Background())
+	defer c.Cleanup()
+	cancel()
+
+	_, err := c.CreateTempFile(bytes.NewReader([]byte("foo")))
+	if errors.Cause(err) != stdcontext.Canceled {
+		t.Errorf("expect error %s, but got %v", stdcontext.Canceled, err)
+	}
+}
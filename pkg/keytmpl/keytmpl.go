@@ -0,0 +1,189 @@
+// Package keytmpl builds backup keys from a template, and extracts the fields
+// of existing keys, such as their labels.
+//
+// A template is a key with fields between braces, e.g. "{source}/{env}/{unix}".
+// Built-in fields are:
+//
+//   - source: name of the source plugin
+//   - unix: creation time (UNIX seconds)
+//   - date: creation date (2006-01-02)
+//   - time: creation time (20060102T150405Z)
+//
+// Other fields are labels, whose values are set in the agent config.
+package keytmpl
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Default is the template of keys when none is configured
+const Default = "{source}-{unix}"
+
+// Built-in fields
+const (
+	FieldSource = "source"
+	FieldUnix   = "unix"
+	FieldDate   = "date"
+	FieldTime   = "time"
+)
+
+const (
+	dateLayout = "2006-01-02"
+	timeLayout = "20060102T150405Z"
+)
+
+// patterns are the patterns of built-in fields. Labels match any text
+// without slashes.
+var patterns = map[string]string{
+	FieldUnix: `[0-9]+`,
+	FieldDate: `[0-9]{4}-[0-9]{2}-[0-9]{2}`,
+	FieldTime: `[0-9]{8}T[0-9]{6}Z`,
+}
+
+var fieldRegexp = regexp.MustCompile(`\{([a-z][a-z0-9_]*)\}`)
+
+// Template is a parsed key template
+type Template struct {
+	text   string
+	fields []string
+	re     *regexp.Regexp
+}
+
+// Parse parses the key template text
+func Parse(text string) (*Template, error) {
+	if text == "" {
+		text = Default
+	}
+	t := &Template{text: text}
+	seen := map[string]bool{}
+	var expr bytes.Buffer
+	expr.WriteString("^")
+	last := 0
+	for _, m := range fieldRegexp.FindAllStringSubmatchIndex(text, -1) {
+		name := text[m[2]:m[3]]
+		if seen[name] {
+			return nil, errors.Errorf("duplicate field {%s} in key template", name)
+		}
+		seen[name] = true
+		t.fields = append(t.fields, name)
+
+		expr.WriteString(regexp.QuoteMeta(text[last:m[0]]))
+		pattern, ok := patterns[name]
+		if !ok {
+			pattern = `[^/]+?`
+		}
+		expr.WriteString("(?P<" + name + ">" + pattern + ")")
+		last = m[1]
+	}
+	expr.WriteString(regexp.QuoteMeta(text[last:]))
+	expr.WriteString("$")
+	if strings.ContainsAny(fieldRegexp.ReplaceAllString(text, ""), "{}") {
+		return nil, errors.Errorf("invalid key template %s", text)
+	}
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid key template")
+	}
+	t.re = re
+	return t, nil
+}
+
+// String returns the text of the template
+func (t *Template) String() string {
+	return t.text
+}
+
+// Labels returns the labels of the template, which are its fields other than
+// the built-in ones
+func (t *Template) Labels() []string {
+	var labels []string
+	for _, f := range t.fields {
+		if !isBuiltin(f) {
+			labels = append(labels, f)
+		}
+	}
+	return labels
+}
+
+// Execute returns the key of a backup of source created at ts, with the
+// given labels
+func (t *Template) Execute(source string, ts time.Time, labels map[string]string) (string, error) {
+	values := map[string]string{
+		FieldSource: source,
+		FieldUnix:   strconv.FormatInt(ts.Unix(), 10),
+		FieldDate:   ts.UTC().Format(dateLayout),
+		FieldTime:   ts.UTC().Format(timeLayout),
+	}
+	for _, f := range t.Labels() {
+		v, ok := labels[f]
+		if !ok || v == "" {
+			return "", errors.Errorf("missing value of label %s", f)
+		}
+		if strings.Contains(v, "/") {
+			return "", errors.Errorf("label %s cannot contain slashes", f)
+		}
+		values[f] = v
+	}
+	return fieldRegexp.ReplaceAllStringFunc(t.text, func(m string) string {
+		return values[m[1:len(m)-1]]
+	}), nil
+}
+
+// Match returns the fields of key, or false when key does not match the
+// template
+func (t *Template) Match(key string) (map[string]string, bool) {
+	m := t.re.FindStringSubmatch(key)
+	if m == nil {
+		return nil, false
+	}
+	fields := map[string]string{}
+	for i, name := range t.re.SubexpNames() {
+		if name != "" {
+			fields[name] = m[i]
+		}
+	}
+	return fields, true
+}
+
+// Time returns the creation time of a backup from the fields of its key, or
+// false when the template has no time field
+func (t *Template) Time(fields map[string]string) (time.Time, bool) {
+	if v, ok := fields[FieldUnix]; ok {
+		if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Unix(sec, 0).UTC(), true
+		}
+	}
+	if v, ok := fields[FieldTime]; ok {
+		if ts, err := time.Parse(timeLayout, v); err == nil {
+			return ts, true
+		}
+	}
+	if v, ok := fields[FieldDate]; ok {
+		if ts, err := time.Parse(dateLayout, v); err == nil {
+			return ts, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// HasTime returns whether keys built from the template hold their creation
+// time
+func (t *Template) HasTime() bool {
+	for _, f := range t.fields {
+		if f == FieldUnix || f == FieldTime || f == FieldDate {
+			return true
+		}
+	}
+	return false
+}
+
+func isBuiltin(field string) bool {
+	return field == FieldSource || patterns[field] != ""
+}
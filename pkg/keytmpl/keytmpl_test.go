@@ -0,0 +1,128 @@
+package keytmpl_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stairlin/kargo/pkg/keytmpl"
+)
+
+func TestExecute(t *testing.T) {
+	t.Parallel()
+
+	ts := time.Date(2018, 6, 1, 12, 30, 0, 0, time.UTC)
+	table := []struct {
+		text   string
+		labels map[string]string
+		expect string
+	}{
+		{text: "", expect: "postgresql-1527856200"},
+		{text: "{source}/{date}/{time}", expect: "postgresql/2018-06-01/20180601T123000Z"},
+		{
+			text:   "{env}/{source}-{unix}",
+			labels: map[string]string{"env": "prod"},
+			expect: "prod/postgresql-1527856200",
+		},
+	}
+	for _, test := range table {
+		tmpl, err := keytmpl.Parse(test.text)
+		if err != nil {
+			t.Fatalf("%s: cannot parse template: %s", test.text, err)
+		}
+		key, err := tmpl.Execute("postgresql", ts, test.labels)
+		if err != nil {
+			t.Errorf("%s: cannot execute template: %s", test.text, err)
+			continue
+		}
+		if key != test.expect {
+			t.Errorf("%s: expect key %s, but got %s", test.text, test.expect, key)
+		}
+	}
+
+	tmpl, err := keytmpl.Parse("{env}/{unix}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.Execute("dir", ts, nil); err == nil {
+		t.Error("expect missing label to be rejected")
+	}
+	if _, err := tmpl.Execute("dir", ts, map[string]string{"env": "a/b"}); err == nil {
+		t.Error("expect label with slashes to be rejected")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	t.Parallel()
+
+	tmpl, err := keytmpl.Parse("{env}/{source}-{unix}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if labels := tmpl.Labels(); len(labels) != 1 || labels[0] != "env" {
+		t.Errorf("expect labels [env], but got %v", labels)
+	}
+
+	fields, ok := tmpl.Match("prod/postgresql-1527856200")
+	if !ok {
+		t.Fatal("expect key to match")
+	}
+	if fields["env"] != "prod" || fields["source"] != "postgresql" ||
+		fields["unix"] != "1527856200" {
+		t.Errorf("unexpected fields %v", fields)
+	}
+	for _, key := range []string{"prod/postgresql", "prod/a/postgresql-1", "postgresql-1"} {
+		if _, ok := tmpl.Match(key); ok {
+			t.Errorf("expect %s not to match", key)
+		}
+	}
+}
+
+func TestTime(t *testing.T) {
+	t.Parallel()
+
+	ts := time.Date(2018, 6, 1, 12, 30, 0, 0, time.UTC)
+	table := []struct {
+		text   string
+		expect time.Time
+	}{
+		{text: "{source}-{unix}", expect: ts},
+		{text: "{source}/{time}", expect: ts},
+		{text: "{source}/{date}", expect: time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range table {
+		tmpl, err := keytmpl.Parse(test.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := tmpl.Execute("dir", ts, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields, _ := tmpl.Match(key)
+		got, ok := tmpl.Time(fields)
+		if !ok || !got.Equal(test.expect) {
+			t.Errorf("%s: expect time %s, but got %s (%v)", test.text, test.expect, got, ok)
+		}
+	}
+
+	tmpl, err := keytmpl.Parse("{source}/{env}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmpl.HasTime() {
+		t.Error("expect template without time")
+	}
+	if _, ok := tmpl.Time(map[string]string{"source": "dir", "env": "prod"}); ok {
+		t.Error("expect no time")
+	}
+}
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	for _, text := range []string{"{env}/{env}", "{env", "{Env}/{unix}"} {
+		if _, err := keytmpl.Parse(text); err == nil {
+			t.Errorf("expect %s to be rejected", text)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Package output writes command results in machine-readable formats
+package output
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Format is an output format
+type Format string
+
+const (
+	// Table is the human-readable format of each command
+	Table Format = "table"
+	JSON  Format = "json"
+	YAML  Format = "yaml"
+	CSV   Format = "csv"
+)
+
+// Formats lists all supported formats
+var Formats = []Format{Table, JSON, YAML, CSV}
+
+// Parse returns the format named s
+func Parse(s string) (Format, error) {
+	for _, f := range Formats {
+		if Format(strings.ToLower(s)) == f {
+			return f, nil
+		}
+	}
+	return "", errors.Errorf("unsupported output format %s (table, json, yaml or csv)", s)
+}
+
+// Encode writes v to w in the format f, which must be either JSON or YAML.
+// Values are encoded with their JSON field names.
+func Encode(w io.Writer, f Format, v interface{}) error {
+	switch f {
+	case JSON:
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case YAML:
+		return encodeYAML(w, v)
+	}
+	return errors.Errorf("cannot encode values to %s", f)
+}
+
+// WriteCSV writes a header followed by rows to w
+func WriteCSV(w io.Writer, header []string, rows [][]string) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	if err := cw.WriteAll(rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
@@ -0,0 +1,81 @@
+package output_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stairlin/kargo/pkg/output"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	for _, s := range []string{"table", "json", "YAML", "csv"} {
+		if _, err := output.Parse(s); err != nil {
+			t.Errorf("%s: unexpected error %s", s, err)
+		}
+	}
+	if _, err := output.Parse("xml"); err == nil {
+		t.Error("expect xml to be rejected")
+	}
+}
+
+func TestYAML(t *testing.T) {
+	t.Parallel()
+
+	type item struct {
+		Key    string            `json:"key"`
+		Size   int64             `json:"size"`
+		Locked bool              `json:"locked"`
+		Tags   []string          `json:"tags"`
+		Config map[string]string `json:"config,omitempty"`
+	}
+	v := []item{
+		{Key: "db/foo", Size: 42, Tags: []string{"a", "b"}},
+		{
+			Key:    "2018-06-01",
+			Locked: true,
+			Tags:   []string{},
+			Config: map[string]string{"path": "/tmp", "mode": "on", "note": "a: b"},
+		},
+	}
+	expect := `- key: db/foo
+  size: 42
+  locked: false
+  tags:
+    - a
+    - b
+- key: "2018-06-01"
+  size: 0
+  locked: true
+  tags: []
+  config:
+    mode: "on"
+    note: "a: b"
+    path: /tmp
+`
+	var buf bytes.Buffer
+	if err := output.Encode(&buf, output.YAML, v); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expect {
+		t.Errorf("expect YAML\n%s\nbut got\n%s", expect, buf.String())
+	}
+}
+
+func TestCSV(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	err := output.WriteCSV(&buf,
+		[]string{"key", "size"},
+		[][]string{{"foo", "1"}, {"bar, baz", "2"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "key,size\nfoo,1\n\"bar, baz\",2\n"
+	if buf.String() != expect {
+		t.Errorf("expect CSV %q, but got %q", expect, buf.String())
+	}
+}
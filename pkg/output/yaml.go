@@ -0,0 +1,168 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// encodeYAML writes v as a YAML document. v is first encoded to JSON, so that
+// it keeps the field names and the field order of its JSON encoding.
+func encodeYAML(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	node, err := decodeNode(d)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, strings.Join(yamlLines(node), "\n")+"\n")
+	return err
+}
+
+// object is a JSON object which keeps the order of its fields
+type object []field
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// decodeNode decodes the next JSON value of d to an object, a slice, or a
+// scalar (string, json.Number, bool or nil)
+func decodeNode(d *json.Decoder) (interface{}, error) {
+	t, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case json.Delim('{'):
+		o := object{}
+		for d.More() {
+			k, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeNode(d)
+			if err != nil {
+				return nil, err
+			}
+			o = append(o, field{key: k.(string), value: v})
+		}
+		_, err := d.Token()
+		return o, err
+	case json.Delim('['):
+		l := []interface{}{}
+		for d.More() {
+			v, err := decodeNode(d)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, v)
+		}
+		_, err := d.Token()
+		return l, err
+	}
+	return t, nil
+}
+
+// yamlLines returns the lines of the block representation of v
+func yamlLines(v interface{}) []string {
+	var lines []string
+	switch v := v.(type) {
+	case object:
+		for _, f := range v {
+			if isBlock(f.value) {
+				lines = append(lines, yamlString(f.key)+":")
+				lines = append(lines, indent(yamlLines(f.value), "  ", "  ")...)
+			} else {
+				lines = append(lines, yamlString(f.key)+": "+yamlScalar(f.value))
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if isBlock(item) {
+				lines = append(lines, indent(yamlLines(item), "- ", "  ")...)
+			} else {
+				lines = append(lines, "- "+yamlScalar(item))
+			}
+		}
+	}
+	if lines == nil {
+		return []string{yamlScalar(v)}
+	}
+	return lines
+}
+
+// isBlock returns whether v is a non-empty object or slice
+func isBlock(v interface{}) bool {
+	switch v := v.(type) {
+	case object:
+		return len(v) > 0
+	case []interface{}:
+		return len(v) > 0
+	}
+	return false
+}
+
+// indent prefixes the first line with first, and the other lines with rest
+func indent(lines []string, first, rest string) []string {
+	for i := range lines {
+		if i == 0 {
+			lines[i] = first + lines[i]
+		} else {
+			lines[i] = rest + lines[i]
+		}
+	}
+	return lines
+}
+
+// yamlScalar returns the flow representation of a scalar or an empty
+// collection
+func yamlScalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case json.Number:
+		return v.String()
+	case string:
+		return yamlString(v)
+	case object:
+		return "{}"
+	case []interface{}:
+		return "[]"
+	}
+	return ""
+}
+
+var plain = regexp.MustCompile(`^[A-Za-z_/][A-Za-z0-9_ ./@+=-]*$`)
+
+// reserved are plain scalars which YAML parsers may not read as strings
+var reserved = map[string]bool{
+	"true": true, "false": true, "yes": true, "no": true, "on": true,
+	"off": true, "y": true, "n": true, "null": true, "~": true,
+}
+
+// yamlString returns s as a plain scalar when it is unambiguous, or as a
+// double-quoted scalar otherwise
+func yamlString(s string) string {
+	if plain.MatchString(s) && !strings.HasSuffix(s, " ") &&
+		!reserved[strings.ToLower(s)] {
+		return s
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
@@ -8,7 +8,6 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
-	"fmt"
 	"io"
 
 	"github.com/pkg/errors"
@@ -112,6 +111,8 @@ func Decrypt(key, message []byte) ([]byte, error) {
 type Rotator struct {
 	keys          map[uint32][]byte
 	defaultSender uint32
+	passphrase    []byte
+	kdf           KDFParams
 }
 
 // NewRotator creates a new Rotator with the given keys.
@@ -124,99 +125,75 @@ func NewRotator(keys map[uint32][]byte, defaultSender uint32) *Rotator {
 	}
 }
 
+// NewPassphraseRotator creates a new Rotator that encrypts streams with a key
+// derived from passphrase. The salt and the KDF parameters are stored in the
+// stream header, so the passphrase is enough to decrypt them.
+// The given keys can still be used to decrypt streams.
+func NewPassphraseRotator(
+	passphrase []byte, params KDFParams, keys map[uint32][]byte,
+) *Rotator {
+	if keys == nil {
+		keys = map[uint32][]byte{}
+	}
+	return &Rotator{
+		keys:          keys,
+		defaultSender: PassphraseSender,
+		passphrase:    passphrase,
+		kdf:           params,
+	}
+}
+
+// DefaultSender returns the sender ID used to encrypt data
+func (r *Rotator) DefaultSender() uint32 {
+	return r.defaultSender
+}
+
 // Encrypt secures a message and prepends the default 4-byte sender ID to the
 // message.
 func (r *Rotator) Encrypt(plaintext []byte) ([]byte, error) {
 	return r.EncryptWithSender(plaintext, r.defaultSender)
 }
 
+// EncryptReader encrypts data from plainReader as a stream with the default
+// sender ID. The plaintext is split in blocks of dataBlockSize.
 func (r *Rotator) EncryptReader(
 	plainReader io.Reader, dataBlockSize int,
 ) (io.ReadCloser, error) {
-	return r.EncryptReaderWithSender(plainReader, dataBlockSize, r.defaultSender)
+	return r.EncryptReaderWithSender(plainReader, dataBlockSize, r.defaultSender, nil)
 }
 
-func (r *Rotator) EncryptReaderWithSender(
-	plainreader io.Reader, dataBlockSize int, sender uint32,
+// EncryptReaderWithData encrypts data from plainReader as a stream with the
+// default sender ID. additionalData is authenticated, but not encrypted. The
+// exact same data must be given to decrypt the stream.
+func (r *Rotator) EncryptReaderWithData(
+	plainReader io.Reader, dataBlockSize int, additionalData []byte,
 ) (io.ReadCloser, error) {
-	key, ok := r.keys[sender]
-	if !ok {
-		return nil, ErrEncrypt
-	}
+	return r.EncryptReaderWithSender(
+		plainReader, dataBlockSize, r.defaultSender, additionalData,
+	)
+}
 
-	block, err := aes.NewCipher(key[:CKeySize])
-	if err != nil {
+// EncryptReaderWithSender encrypts data from plainReader as a stream with the
+// given sender ID.
+func (r *Rotator) EncryptReaderWithSender(
+	plainreader io.Reader, dataBlockSize int, sender uint32, additionalData []byte,
+) (io.ReadCloser, error) {
+	if sender == PassphraseSender {
+		if len(r.passphrase) == 0 {
+			return nil, ErrEncrypt
+		}
+		if err := r.kdf.Validate(); err != nil {
+			return nil, err
+		}
+	} else if _, ok := r.keys[sender]; !ok {
 		return nil, ErrEncrypt
 	}
 
 	out, in := io.Pipe()
 	go func() {
-		err := func() error {
-			defer in.Close()
-
-			header := make([]byte, SenderSize)
-			binary.BigEndian.PutUint32(header, sender)
-			_, err := in.Write(header)
-			if err != nil {
-				return ErrEncrypt
-			}
-
-			// Buffer to read by block
-			bout, bin := io.Pipe()
-			defer bout.Close()
-			go func() {
-				defer bin.Close()
-				buf := bufio.NewWriterSize(bin, dataBlockSize)
-				_, err := io.Copy(buf, plainreader)
-				if err != nil {
-					fmt.Println("Encrypt err", err)
-				}
-				buf.Flush()
-			}()
-
-			plaintext := make([]byte, dataBlockSize)
-			signedtext := make([]byte, aes.BlockSize+dataBlockSize+MACSize)
-			for {
-				nr, err := bout.Read(plaintext)
-				if nr > 0 {
-					// Cipher data
-					iv := signedtext[:aes.BlockSize]
-					if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-						return ErrEncrypt
-					}
-					stream := cipher.NewCTR(block, iv)
-					stream.XORKeyStream(
-						signedtext[aes.BlockSize:aes.BlockSize+nr],
-						plaintext[:nr],
-					)
-
-					// Sign
-					h := hmac.New(sha256.New, key[CKeySize:])
-					h.Write(signedtext[:aes.BlockSize+nr])
-					signedtext = h.Sum(signedtext[:aes.BlockSize+nr])
-
-					// Write block to the pipe
-					nw, err := in.Write(signedtext[:aes.BlockSize+nr+MACSize])
-					if err != nil {
-						return errors.Wrap(err, "cannot write encrypted data to pipe")
-					}
-					if len(signedtext) != nw {
-						return io.ErrShortWrite
-					}
-				}
-				switch err {
-				case nil:
-				case io.EOF:
-					// Ignore this error
-					return nil
-				default:
-					return err
-				}
-			}
-		}()
-		if err != nil {
-			fmt.Println("Encrypt error", err)
-		}
+		in.CloseWithError(r.encryptStream(
+			in, plainreader, sender, dataBlockSize, additionalData,
+		))
 	}()
 	return out, nil
 }
@@ -290,96 +267,101 @@ func (r *Rotator) Decrypt(ciphertext []byte) ([]byte, error) {
 	return out, nil
 }
 
+// DecryptReader decrypts data from cipherreader. Both streams and legacy
+// encrypted readers are supported. dataBlockSize is only used by the latter,
+// since streams carry their own block size.
 func (r *Rotator) DecryptReader(
 	cipherreader io.Reader, dataBlockSize int,
 ) (io.ReadCloser, error) {
+	return r.DecryptReaderWithData(cipherreader, dataBlockSize, nil)
+}
 
+// DecryptReaderWithData decrypts data from cipherreader and authenticates
+// additionalData along with it. Legacy encrypted readers do not support
+// additional data, so it is ignored for them.
+//
+// Any decryption error, including a truncated stream, is returned by the
+// reader, which means that data read before the error must not be trusted.
+func (r *Rotator) DecryptReaderWithData(
+	cipherreader io.Reader, dataBlockSize int, additionalData []byte,
+) (io.ReadCloser, error) {
 	out, in := io.Pipe()
 	go func() {
-		err := func() error {
-			defer in.Close()
-
-			// Retrieve sender from the cipher stream
-			header := make([]byte, SenderSize)
-			_, err := cipherreader.Read(header)
-			if err != nil {
-				return ErrDecrypt
-			}
-
-			sender := binary.BigEndian.Uint32(header)
-			key, ok := r.keys[sender]
-			if !ok {
-				return ErrDecrypt
-			}
-
-			block, err := aes.NewCipher(key[:CKeySize])
-			if err != nil {
-				return ErrDecrypt
-			}
-
-			// Buffer to read by block
-			bout, bin := io.Pipe()
-			defer bout.Close()
-			go func() {
-				defer bin.Close()
-				buf := bufio.NewWriterSize(bin, aes.BlockSize+dataBlockSize+MACSize)
-				_, err := io.Copy(buf, cipherreader)
-				if err != nil {
-					fmt.Println("Decrypt err", err)
-				}
-				buf.Flush()
-			}()
-
-			// Then read blocks
-			signedtext := make([]byte, aes.BlockSize+dataBlockSize+MACSize)
-			plaintext := make([]byte, dataBlockSize)
-			for {
-				nr, err := bout.Read(signedtext)
-				if nr > 0 {
-					if nr <= (aes.BlockSize + MACSize) {
-						return ErrDecrypt
-					}
-
-					// Check auth
-					macStart := nr - MACSize
-					tag := signedtext[macStart:nr]
-					ciphertext := signedtext[:macStart]
-					h := hmac.New(sha256.New, key[CKeySize:])
-					h.Write(ciphertext)
-					mac := h.Sum(nil)
-					if !hmac.Equal(mac, tag) {
-						fmt.Println("Not equal")
-						return ErrDecrypt
-					}
-
-					// Decipher
-					iv := ciphertext[:aes.BlockSize]
-					stream := cipher.NewCTR(block, iv)
-					stream.XORKeyStream(plaintext, ciphertext[aes.BlockSize:])
-
-					// Write plain block to writer
-					nw, err := in.Write(plaintext[:len(ciphertext)-aes.BlockSize])
-					if err != nil {
-						return errors.Wrap(err, "cannot write decrypted data to pipe")
-					}
-					if len(plaintext) != nw {
-						return io.ErrShortWrite
-					}
-				}
-				switch err {
-				case nil:
-				case io.EOF:
-					return nil
-				default:
-					return err
-				}
-			}
-		}()
+		in.CloseWithError(r.decrypt(in, cipherreader, dataBlockSize, additionalData))
+	}()
+	return out, nil
+}
+
+func (r *Rotator) decrypt(
+	w io.Writer, cipherreader io.Reader, dataBlockSize int, additionalData []byte,
+) error {
+	br := bufio.NewReader(cipherreader)
+
+	// A legacy reader starts with the sender ID, whereas a stream starts with
+	// a magic number and its version
+	prefix := make([]byte, SenderSize)
+	if _, err := io.ReadFull(br, prefix); err != nil {
+		return ErrTruncated
+	}
+	if isStream(prefix) {
+		return r.decryptStream(w, br, prefix, additionalData)
+	}
+	return r.decryptLegacy(w, br, binary.BigEndian.Uint32(prefix), dataBlockSize)
+}
+
+// decryptLegacy decrypts readers written before the stream format. Each block
+// is encrypted with AES-CTR and authenticated with HMAC-SHA-256 on its own.
+func (r *Rotator) decryptLegacy(
+	w io.Writer, cipherreader io.Reader, sender uint32, dataBlockSize int,
+) error {
+	key, ok := r.keys[sender]
+	if !ok {
+		return ErrDecrypt
+	}
+
+	block, err := aes.NewCipher(key[:CKeySize])
+	if err != nil {
+		return ErrDecrypt
+	}
+
+	signedtext := make([]byte, aes.BlockSize+dataBlockSize+MACSize)
+	plaintext := make([]byte, dataBlockSize)
+	for {
+		nr, err := io.ReadFull(cipherreader, signedtext)
 		switch err {
-		case nil, io.ErrShortWrite:
+		case nil, io.ErrUnexpectedEOF:
+		case io.EOF:
+			return nil
 		default:
-			fmt.Println("Decrypt error", err)
+			return errors.Wrap(err, "cannot read encrypted data")
 		}
-	}()
-	return out, nil
+		if nr <= (aes.BlockSize + MACSize) {
+			return ErrDecrypt
+		}
+
+		// Check auth
+		macStart := nr - MACSize
+		tag := signedtext[macStart:nr]
+		ciphertext := signedtext[:macStart]
+		h := hmac.New(sha256.New, key[CKeySize:])
+		h.Write(ciphertext)
+		mac := h.Sum(nil)
+		if !hmac.Equal(mac, tag) {
+			return ErrDecrypt
+		}
+
+		// Decipher
+		iv := ciphertext[:aes.BlockSize]
+		stream := cipher.NewCTR(block, iv)
+		l := len(ciphertext) - aes.BlockSize
+		stream.XORKeyStream(plaintext[:l], ciphertext[aes.BlockSize:])
+
+		// Write plain block to writer
+		if _, err := w.Write(plaintext[:l]); err != nil {
+			return errors.Wrap(err, "cannot write decrypted data")
+		}
+		if err == io.ErrUnexpectedEOF {
+			return nil
+		}
+	}
 }
@@ -1,7 +1,12 @@
 package sec_test
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
 	"io"
 	"io/ioutil"
 	"testing"
@@ -59,6 +64,209 @@ func TestReaderVerbatim(t *testing.T) {
 	}
 }
 
+func TestReaderAdditionalData(t *testing.T) {
+	rotator := newRotator(t)
+	expect := testutil.GenRandBytes(t, int(10*unit.KB))
+	chunkSize := int(unit.KB)
+
+	cipher, err := rotator.EncryptReaderWithData(
+		bytes.NewReader(expect), chunkSize, []byte("foo"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain, err := rotator.DecryptReaderWithData(
+		bytes.NewReader(b), chunkSize, []byte("foo"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expect, got) {
+		t.Errorf("expect text %s, but got %s",
+			testutil.Truncate(expect, 140),
+			testutil.Truncate(got, 140),
+		)
+	}
+
+	plain, err = rotator.DecryptReaderWithData(
+		bytes.NewReader(b), chunkSize, []byte("bar"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(plain); err != sec.ErrDecrypt {
+		t.Errorf("expect error %s, but got %v", sec.ErrDecrypt, err)
+	}
+}
+
+func TestReaderTampering(t *testing.T) {
+	rotator := newRotator(t)
+	chunkSize := int(unit.KB)
+	sealedSize := chunkSize + sec.TagSize
+
+	cipher, err := rotator.EncryptReader(
+		bytes.NewReader(testutil.GenRandBytes(t, 4*chunkSize+100)), chunkSize,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := b[:sec.StreamHeaderSize]
+	blocks := [][]byte{}
+	for i := sec.StreamHeaderSize; i < len(b); i += sealedSize {
+		end := i + sealedSize
+		if end > len(b) {
+			end = len(b)
+		}
+		blocks = append(blocks, b[i:end])
+	}
+	if len(blocks) != 5 {
+		t.Fatalf("expect 5 blocks, but got %d", len(blocks))
+	}
+
+	table := []struct {
+		name   string
+		stream [][]byte
+		err    error
+	}{
+		{"header only", [][]byte{header}, sec.ErrTruncated},
+		{"truncated header", [][]byte{header[:10]}, sec.ErrTruncated},
+		{"last block dropped", append([][]byte{header}, blocks[:4]...), sec.ErrDecrypt},
+		{"partial last block", append([][]byte{header}, blocks[0], blocks[1][:20]), sec.ErrDecrypt},
+		{"swapped blocks", [][]byte{header, blocks[1], blocks[0], blocks[2], blocks[3], blocks[4]}, sec.ErrDecrypt},
+		{"duplicated block", [][]byte{header, blocks[0], blocks[0], blocks[2], blocks[3], blocks[4]}, sec.ErrDecrypt},
+	}
+	for _, test := range table {
+		plain, err := rotator.DecryptReader(
+			bytes.NewReader(bytes.Join(test.stream, nil)), chunkSize,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(plain); err != test.err {
+			t.Errorf("%s: expect error %v, but got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestReaderLegacy(t *testing.T) {
+	rotator := newRotator(t)
+	chunkSize := int(32 * unit.KB)
+	expect := testutil.GenRandBytes(t, 3*chunkSize+100)
+
+	// Encrypt data with the legacy format
+	key := rotator.keys[42]
+	block, err := aes.NewCipher(key[:sec.CKeySize])
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := []byte{0, 0, 0, 42}
+	for i := 0; i < len(expect); i += chunkSize {
+		end := i + chunkSize
+		if end > len(expect) {
+			end = len(expect)
+		}
+		iv := testutil.GenRandBytes(t, aes.BlockSize)
+		ciphertext := make([]byte, end-i)
+		cipher.NewCTR(block, iv).XORKeyStream(ciphertext, expect[i:end])
+		h := hmac.New(sha256.New, key[sec.CKeySize:])
+		h.Write(iv)
+		h.Write(ciphertext)
+		legacy = append(legacy, iv...)
+		legacy = append(legacy, ciphertext...)
+		legacy = h.Sum(legacy)
+	}
+
+	plain, err := rotator.DecryptReader(bytes.NewReader(legacy), chunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expect, got) {
+		t.Errorf("expect text %s, but got %s",
+			testutil.Truncate(expect, 140),
+			testutil.Truncate(got, 140),
+		)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	rotator := newRotator(t)
+	cipher, err := rotator.EncryptReaderWithSender(
+		bytes.NewReader([]byte("foo")), int(unit.KB), 45, nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(cipher)
+	info, err := sec.Inspect(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != sec.StreamVersion {
+		t.Errorf("expect version %d, but got %d", sec.StreamVersion, info.Version)
+	}
+	if info.Sender != 45 {
+		t.Errorf("expect sender %d, but got %d", 45, info.Sender)
+	}
+
+	// Inspect must not consume data
+	plain, err := rotator.DecryptReader(r, int(unit.KB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "foo" {
+		t.Errorf("expect text foo, but got %s", got)
+	}
+
+	info, err = sec.Inspect(bufio.NewReader(bytes.NewReader([]byte{0, 0, 0, 42, 1})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != 0 || info.Sender != 42 {
+		t.Errorf("expect legacy sender 42, but got %+v", info)
+	}
+}
+
+type testRotator struct {
+	*sec.Rotator
+	keys map[uint32][]byte
+}
+
+func newRotator(t *testing.T) *testRotator {
+	keys := map[uint32][]byte{}
+	for _, id := range []uint32{42, 43, 45} {
+		key, err := sec.GenRandBytes(sec.KeySize)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		keys[id] = key
+	}
+	return &testRotator{
+		Rotator: sec.NewRotator(keys, 43),
+		keys:    keys,
+	}
+}
+
 const longText = `
 Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod tempor incididunt ut labore et dolore magna aliqua. Feugiat nibh sed pulvinar proin gravida hendrerit lectus a. Integer eget aliquet nibh praesent tristique magna sit amet. Aliquam nulla facilisi cras fermentum odio eu feugiat. Volutpat ac tincidunt vitae semper quis lectus nulla at volutpat. Elementum integer enim neque volutpat ac tincidunt. Amet volutpat consequat mauris nunc congue nisi vitae. Pellentesque habitant morbi tristique senectus et. Malesuada proin libero nunc consequat interdum varius. Aliquet bibendum enim facilisis gravida. Feugiat nibh sed pulvinar proin gravida hendrerit lectus a. Pellentesque nec nam aliquam sem. Urna nunc id cursus metus aliquam eleifend mi. Nam at lectus urna duis convallis convallis tellus id. Et molestie ac feugiat sed.
 
@@ -0,0 +1,80 @@
+package sec
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// PassphraseSender is the sender ID reserved to streams encrypted with a
+	// key derived from a passphrase
+	PassphraseSender = math.MaxUint32
+	// KDFParamsSize is the size of the KDF parameters in a stream header
+	KDFParamsSize = 9
+
+	// Upper bounds of the KDF parameters accepted from a stream header. The
+	// header is only authenticated once the key has been derived, so they
+	// bound the memory and the time a hostile stream can cost.
+	maxKDFTime    = 16
+	maxKDFMemory  = 1 << 20 // 1 GiB
+	maxKDFThreads = 64
+)
+
+// KDFParams are the Argon2id parameters used to derive a key from a
+// passphrase
+type KDFParams struct {
+	// Time is the number of passes over the memory
+	Time uint32
+	// Memory is the amount of memory used in KiB
+	Memory uint32
+	// Threads is the number of threads used
+	Threads uint8
+}
+
+// DefaultKDFParams are the recommended Argon2id parameters (RFC 9106)
+var DefaultKDFParams = KDFParams{
+	Time:    3,
+	Memory:  64 * 1024,
+	Threads: 4,
+}
+
+// Validate returns an error when the parameters are out of bounds
+func (p KDFParams) Validate() error {
+	switch {
+	case p.Time == 0 || p.Time > maxKDFTime:
+		return errors.Errorf("sec: invalid KDF time %d", p.Time)
+	case p.Memory < 8*uint32(p.Threads) || p.Memory > maxKDFMemory:
+		return errors.Errorf("sec: invalid KDF memory %d", p.Memory)
+	case p.Threads == 0 || p.Threads > maxKDFThreads:
+		return errors.Errorf("sec: invalid KDF threads %d", p.Threads)
+	}
+	return nil
+}
+
+func (p KDFParams) marshal() []byte {
+	b := make([]byte, KDFParamsSize)
+	binary.BigEndian.PutUint32(b, p.Time)
+	binary.BigEndian.PutUint32(b[4:], p.Memory)
+	b[8] = p.Threads
+	return b
+}
+
+func parseKDFParams(b []byte) KDFParams {
+	return KDFParams{
+		Time:    binary.BigEndian.Uint32(b),
+		Memory:  binary.BigEndian.Uint32(b[4:]),
+		Threads: b[8],
+	}
+}
+
+// DeriveKey derives an encryption key from a passphrase with Argon2id. It
+// fails when the parameters are out of bounds.
+func DeriveKey(passphrase, salt []byte, p KDFParams) ([]byte, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return argon2.IDKey(passphrase, salt, p.Time, p.Memory, p.Threads, KeySize), nil
+}
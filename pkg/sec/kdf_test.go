@@ -0,0 +1,62 @@
+package sec_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stairlin/kargo/pkg/sec"
+	"github.com/stairlin/kargo/pkg/unit"
+)
+
+func TestKDFParams(t *testing.T) {
+	tests := []struct {
+		params sec.KDFParams
+		valid  bool
+	}{
+		{params: sec.DefaultKDFParams, valid: true},
+		{params: sec.KDFParams{Time: 16, Memory: 1 << 20, Threads: 4}, valid: true},
+		{params: sec.KDFParams{Time: 17, Memory: 64, Threads: 1}},
+		{params: sec.KDFParams{Time: 1, Memory: 1<<20 + 1, Threads: 1}},
+		{params: sec.KDFParams{Time: 1, Memory: 4 << 20, Threads: 1}},
+		{params: sec.KDFParams{Time: 1, Memory: 7, Threads: 1}},
+		{params: sec.KDFParams{Time: 1, Memory: 64, Threads: 0}},
+	}
+	for _, test := range tests {
+		if err := test.params.Validate(); (err == nil) != test.valid {
+			t.Errorf("%+v: expect valid %t, but got %v", test.params, test.valid, err)
+		}
+	}
+
+	params := sec.KDFParams{Time: 1, Memory: 4 << 20, Threads: 1}
+	if _, err := sec.DeriveKey([]byte("foo"), []byte("salt"), params); err == nil {
+		t.Error("expect keys not to be derived with out of bounds parameters")
+	}
+}
+
+func TestKDFHostileHeader(t *testing.T) {
+	params := sec.KDFParams{Time: 1, Memory: 64, Threads: 1}
+	rotator := sec.NewPassphraseRotator([]byte("passphrase"), params, nil)
+	chunkSize := int(32 * unit.KB)
+
+	r, err := rotator.EncryptReader(ioutil.NopCloser(bytes.NewReader([]byte(longText))), chunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The KDF parameters follow the stream header, and the memory follows
+	// the time. Deriving a key with 4 GiB would exhaust the memory of tests.
+	binary.BigEndian.PutUint32(data[sec.StreamHeaderSize+4:], 4<<20)
+	plain, err := rotator.DecryptReader(ioutil.NopCloser(bytes.NewReader(data)), chunkSize)
+	if err == nil {
+		_, err = ioutil.ReadAll(plain)
+	}
+	if err != sec.ErrDecrypt {
+		t.Errorf("expect error %s, but got %v", sec.ErrDecrypt, err)
+	}
+}
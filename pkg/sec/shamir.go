@@ -0,0 +1,147 @@
+package sec
+
+import (
+	"crypto/rand"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Shamir's Secret Sharing over GF(2^8)
+//
+// Each byte of the secret is the constant term of a random polynomial of
+// degree threshold-1. A share is made of the evaluation of all polynomials
+// for a given x coordinate, followed by this coordinate (1 byte).
+
+const (
+	// MaxShares is the maximum number of shares a secret can be split into
+	MaxShares = 255
+)
+
+var (
+	// ErrInvalidShares occurs when shares cannot be combined
+	ErrInvalidShares = errors.New("sec: invalid shares")
+)
+
+// Split splits secret into n shares. Any threshold shares can then be
+// combined to rebuild the secret, whereas less shares do not reveal anything
+// about it.
+func Split(secret []byte, n, threshold int) ([][]byte, error) {
+	switch {
+	case len(secret) == 0:
+		return nil, errors.New("sec: cannot split an empty secret")
+	case threshold < 2:
+		return nil, errors.New("sec: threshold must be at least 2")
+	case n < threshold:
+		return nil, errors.New("sec: shares must be at least equal to the threshold")
+	case n > MaxShares:
+		return nil, errors.Errorf("sec: too many shares (max %d)", MaxShares)
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+
+	coefficients := make([]byte, threshold)
+	for i, b := range secret {
+		coefficients[0] = b
+		if _, err := io.ReadFull(rand.Reader, coefficients[1:]); err != nil {
+			return nil, errors.Wrap(err, "rand error")
+		}
+		for _, share := range shares {
+			share[i] = evaluate(coefficients, share[len(secret)])
+		}
+	}
+	return shares, nil
+}
+
+// Combine rebuilds a secret from shares. Combining less shares than the
+// threshold used to split the secret returns a wrong secret.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, ErrInvalidShares
+	}
+	l := len(shares[0])
+	if l < 2 {
+		return nil, ErrInvalidShares
+	}
+
+	xs := make([]byte, len(shares))
+	seen := map[byte]bool{}
+	for i, share := range shares {
+		if len(share) != l {
+			return nil, ErrInvalidShares
+		}
+		x := share[l-1]
+		if x == 0 || seen[x] {
+			return nil, ErrInvalidShares
+		}
+		seen[x] = true
+		xs[i] = x
+	}
+
+	// Lagrange interpolation at x = 0
+	secret := make([]byte, l-1)
+	for i := range secret {
+		var b byte
+		for j, share := range shares {
+			basis := byte(1)
+			for k := range shares {
+				if j != k {
+					basis = mul(basis, div(xs[k], xs[k]^xs[j]))
+				}
+			}
+			b ^= mul(share[i], basis)
+		}
+		secret[i] = b
+	}
+	return secret, nil
+}
+
+// evaluate evaluates the polynomial p at x using Horner's method
+func evaluate(p []byte, x byte) byte {
+	var y byte
+	for i := len(p) - 1; i >= 0; i-- {
+		y = mul(y, x) ^ p[i]
+	}
+	return y
+}
+
+// GF(2^8) arithmetic with the AES polynomial x^8 + x^4 + x^3 + x + 1
+var (
+	expTable [255]byte
+	logTable [256]byte
+)
+
+func init() {
+	// 3 is a generator of the multiplicative group
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		expTable[i] = x
+		logTable[x] = byte(i)
+		xtime := x << 1
+		if x&0x80 != 0 {
+			xtime ^= 0x1b
+		}
+		x ^= xtime
+	}
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])+int(logTable[b]))%255]
+}
+
+func div(a, b byte) byte {
+	if b == 0 {
+		panic("sec: division by zero")
+	}
+	if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])-int(logTable[b])+255)%255]
+}
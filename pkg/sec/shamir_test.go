@@ -0,0 +1,83 @@
+package sec_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stairlin/kargo/pkg/sec"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret, err := sec.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shares, err := sec.Split(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 5 {
+		t.Fatalf("expect 5 shares, but got %d", len(shares))
+	}
+
+	table := [][][]byte{
+		{shares[0], shares[1], shares[2]},
+		{shares[4], shares[2], shares[0]},
+		{shares[1], shares[3], shares[4]},
+		shares,
+	}
+	for i, subset := range table {
+		got, err := sec.Combine(subset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(secret, got) {
+			t.Errorf("#%d: expect combined shares to match the secret", i)
+		}
+	}
+
+	// Below the threshold
+	got, err := sec.Combine(shares[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(secret, got) {
+		t.Error("expect combined shares below the threshold to mismatch")
+	}
+}
+
+func TestCombineInvalid(t *testing.T) {
+	shares, err := sec.Split([]byte("foo"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := [][][]byte{
+		{},
+		{shares[0]},
+		{shares[0], shares[0]},
+		{shares[0], shares[1][:2]},
+		{shares[0], {'a', 'b', 'c', 0}},
+	}
+	for i, subset := range table {
+		if _, err := sec.Combine(subset); err != sec.ErrInvalidShares {
+			t.Errorf("#%d: expect error %s, but got %v", i, sec.ErrInvalidShares, err)
+		}
+	}
+}
+
+func TestSplitInvalid(t *testing.T) {
+	table := []struct {
+		n, threshold int
+	}{
+		{3, 1},
+		{2, 3},
+		{256, 3},
+	}
+	for _, test := range table {
+		if _, err := sec.Split([]byte("foo"), test.n, test.threshold); err == nil {
+			t.Errorf("expect error with %d shares and threshold %d", test.n, test.threshold)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package sec
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+// The stream format is a STREAM construction (Hoang, Reyhanitabar, Rogaway
+// and Vizár) on top of AES-256-GCM.
+//
+// A stream starts with a header:
+//
+//	magic (3) | version (1) | sender ID (4) | block size (4) | salt (32)
+//
+// When the key is derived from a passphrase, the sender ID is set to
+// PassphraseSender and the header ends with the KDF parameters (version 2):
+//
+//	time (4) | memory (4) | threads (1)
+//
+// The header is followed by a sequence of sealed blocks. Every block, but the last one,
+// contains exactly block size bytes of plaintext. The nonce of each block is
+// made of a prefix derived from the key, a 4-byte block counter, and a
+// 1-byte flag set on the last block. Blocks therefore cannot be dropped,
+// reordered or truncated without failing the authentication.
+//
+// The whole header and the caller's additional data are authenticated with
+// each block.
+const (
+	// StreamVersion is the current version of the stream format
+	StreamVersion = 2
+	// SaltSize is the size of the random salt used to derive a stream key
+	SaltSize = 32
+	// TagSize is the size of the authentication tag appended to each block
+	TagSize = 16
+	// StreamHeaderSize is the size of the stream header (without the KDF
+	// parameters)
+	StreamHeaderSize = len(streamMagic) + 1 + SenderSize + 4 + SaltSize
+	// MaxBlockSize is the largest block size accepted by a stream
+	MaxBlockSize = 16 << 20
+
+	streamNoncePrefixSize = 7
+	streamInfo            = "kargo stream v1"
+)
+
+// streamMagic identifies a stream. Legacy streams start with the sender ID
+// directly, so the magic number must not collide with a realistic sender ID.
+var streamMagic = [3]byte{'K', 'G', 'S'}
+
+var (
+	// ErrTruncated occurs when a stream ends before its last block
+	ErrTruncated = errors.New("sec: truncated stream")
+	// ErrUnsupportedVersion occurs when a stream has been written with an
+	// unknown version of the stream format
+	ErrUnsupportedVersion = errors.New("sec: unsupported stream version")
+)
+
+// streamHeader is the header written at the beginning of every stream
+type streamHeader struct {
+	Version   byte
+	Sender    uint32
+	BlockSize uint32
+	Salt      []byte
+	KDF       KDFParams
+}
+
+// hasKDF returns whether the stream key is derived from a passphrase
+func (h *streamHeader) hasKDF() bool {
+	return h.Version >= 2 && h.Sender == PassphraseSender
+}
+
+// size returns the size of the marshalled header
+func (h *streamHeader) size() int {
+	if h.hasKDF() {
+		return StreamHeaderSize + KDFParamsSize
+	}
+	return StreamHeaderSize
+}
+
+func (h *streamHeader) marshal() []byte {
+	b := make([]byte, h.size())
+	n := copy(b, streamMagic[:])
+	b[n] = h.Version
+	n++
+	binary.BigEndian.PutUint32(b[n:], h.Sender)
+	n += SenderSize
+	binary.BigEndian.PutUint32(b[n:], h.BlockSize)
+	n += 4
+	n += copy(b[n:], h.Salt)
+	if h.hasKDF() {
+		copy(b[n:], h.KDF.marshal())
+	}
+	return b
+}
+
+// parseStreamHeader parses the fixed part of a stream header. The KDF
+// parameters must be parsed separately, since they are optional.
+func parseStreamHeader(b []byte) (*streamHeader, error) {
+	if len(b) != StreamHeaderSize || !isStream(b) {
+		return nil, ErrDecrypt
+	}
+	n := len(streamMagic)
+	h := &streamHeader{Version: b[n]}
+	if h.Version == 0 || h.Version > StreamVersion {
+		return nil, ErrUnsupportedVersion
+	}
+	n++
+	h.Sender = binary.BigEndian.Uint32(b[n:])
+	n += SenderSize
+	h.BlockSize = binary.BigEndian.Uint32(b[n:])
+	if h.BlockSize == 0 || h.BlockSize > MaxBlockSize {
+		return nil, ErrDecrypt
+	}
+	n += 4
+	h.Salt = b[n : n+SaltSize]
+	return h, nil
+}
+
+// isStream returns whether b starts with the stream magic number
+func isStream(b []byte) bool {
+	if len(b) < len(streamMagic) {
+		return false
+	}
+	for i := range streamMagic {
+		if b[i] != streamMagic[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// stream seals/opens the blocks of a stream
+type stream struct {
+	aead   cipher.AEAD
+	nonce  []byte
+	data   []byte
+	header []byte
+}
+
+// newStream derives a stream key from key and the header salt.
+// The header and data are authenticated with every block.
+func newStream(key []byte, h *streamHeader, data []byte) (*stream, error) {
+	kdf := hkdf.New(sha256.New, key, h.Salt, []byte(streamInfo))
+	k := make([]byte, CKeySize+streamNoncePrefixSize)
+	if _, err := io.ReadFull(kdf, k); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(k[:CKeySize])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	header := h.marshal()
+	ad := make([]byte, 0, len(header)+len(data))
+	ad = append(ad, header...)
+	ad = append(ad, data...)
+
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, k[CKeySize:])
+	return &stream{
+		aead:   aead,
+		nonce:  nonce,
+		data:   ad,
+		header: header,
+	}, nil
+}
+
+// nonceFor returns the nonce of the nth block
+func (s *stream) nonceFor(counter uint32, last bool) []byte {
+	binary.BigEndian.PutUint32(s.nonce[streamNoncePrefixSize:], counter)
+	s.nonce[len(s.nonce)-1] = 0
+	if last {
+		s.nonce[len(s.nonce)-1] = 1
+	}
+	return s.nonce
+}
+
+// encryptStream reads plaintext from r and writes a stream to w
+func (r *Rotator) encryptStream(
+	w io.Writer, plain io.Reader, sender uint32, blockSize int, data []byte,
+) error {
+	if blockSize <= 0 || blockSize > MaxBlockSize {
+		return errors.Errorf("sec: invalid block size %d", blockSize)
+	}
+	salt, err := GenRandBytes(SaltSize)
+	if err != nil {
+		return ErrEncrypt
+	}
+	h := &streamHeader{
+		Version:   StreamVersion,
+		Sender:    sender,
+		BlockSize: uint32(blockSize),
+		Salt:      salt,
+		KDF:       r.kdf,
+	}
+	key, err := r.keyFor(h)
+	if err != nil {
+		return ErrEncrypt
+	}
+	s, err := newStream(key, h, data)
+	if err != nil {
+		return ErrEncrypt
+	}
+	if _, err := w.Write(s.header); err != nil {
+		return errors.Wrap(err, "cannot write stream header")
+	}
+
+	br := bufio.NewReaderSize(plain, blockSize)
+	plaintext := make([]byte, blockSize)
+	sealed := make([]byte, 0, blockSize+TagSize)
+	for counter := uint32(0); ; counter++ {
+		n, last, err := readBlock(br, plaintext)
+		if err != nil {
+			return errors.Wrap(err, "cannot read plaintext")
+		}
+
+		sealed = s.aead.Seal(sealed[:0], s.nonceFor(counter, last), plaintext[:n], s.data)
+		if _, err := w.Write(sealed); err != nil {
+			return errors.Wrap(err, "cannot write encrypted data")
+		}
+		if last {
+			return nil
+		}
+		if counter == math.MaxUint32 {
+			return errors.New("sec: too many blocks in stream")
+		}
+	}
+}
+
+// decryptStream reads a stream from r and writes the plaintext to w. The
+// magic number and the version must already be consumed from r and passed
+// as prefix.
+func (r *Rotator) decryptStream(
+	w io.Writer, br *bufio.Reader, prefix []byte, data []byte,
+) error {
+	b := make([]byte, StreamHeaderSize)
+	n := copy(b, prefix)
+	if _, err := io.ReadFull(br, b[n:]); err != nil {
+		return ErrTruncated
+	}
+	h, err := parseStreamHeader(b)
+	if err != nil {
+		return err
+	}
+	if h.hasKDF() {
+		b := make([]byte, KDFParamsSize)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return ErrTruncated
+		}
+		h.KDF = parseKDFParams(b)
+		if err := h.KDF.Validate(); err != nil {
+			return ErrDecrypt
+		}
+	}
+	key, err := r.keyFor(h)
+	if err != nil {
+		return err
+	}
+	s, err := newStream(key, h, data)
+	if err != nil {
+		return ErrDecrypt
+	}
+
+	sealed := make([]byte, int(h.BlockSize)+TagSize)
+	plaintext := make([]byte, 0, h.BlockSize)
+	for counter := uint32(0); ; counter++ {
+		n, last, err := readBlock(br, sealed)
+		switch {
+		case err != nil:
+			return errors.Wrap(err, "cannot read encrypted data")
+		case n == 0 && last:
+			// Every stream ends with a sealed block, even when it is empty
+			return ErrTruncated
+		}
+
+		plaintext, err = s.aead.Open(
+			plaintext[:0], s.nonceFor(counter, last), sealed[:n], s.data,
+		)
+		if err != nil {
+			return ErrDecrypt
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			return errors.Wrap(err, "cannot write decrypted data")
+		}
+		if last {
+			return nil
+		}
+		if counter == math.MaxUint32 {
+			return ErrDecrypt
+		}
+	}
+}
+
+// StreamInfo describes the header of encrypted data
+type StreamInfo struct {
+	// Version is the version of the stream format (0 for legacy readers)
+	Version byte
+	// Sender is the ID of the key used to encrypt data
+	Sender uint32
+}
+
+// Inspect returns information about encrypted data from r without consuming
+// it.
+func Inspect(r *bufio.Reader) (*StreamInfo, error) {
+	b, err := r.Peek(SenderSize)
+	if err != nil {
+		return nil, ErrTruncated
+	}
+	if !isStream(b) {
+		return &StreamInfo{Sender: binary.BigEndian.Uint32(b)}, nil
+	}
+	b, err = r.Peek(StreamHeaderSize)
+	if err != nil {
+		return nil, ErrTruncated
+	}
+	h, err := parseStreamHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamInfo{Version: h.Version, Sender: h.Sender}, nil
+}
+
+// keyFor returns the key of the stream described by h
+func (r *Rotator) keyFor(h *streamHeader) ([]byte, error) {
+	if h.hasKDF() {
+		if len(r.passphrase) == 0 {
+			return nil, ErrDecrypt
+		}
+		key, err := DeriveKey(r.passphrase, h.Salt, h.KDF)
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+		return key, nil
+	}
+	key, ok := r.keys[h.Sender]
+	if !ok {
+		return nil, ErrDecrypt
+	}
+	return key, nil
+}
+
+// readBlock fills b from r and returns whether it is the last block of r
+func readBlock(r *bufio.Reader, b []byte) (n int, last bool, err error) {
+	n, err = io.ReadFull(r, b)
+	switch err {
+	case nil:
+		// Peek to find out whether it was the last block
+		if _, err := r.Peek(1); err == io.EOF {
+			return n, true, nil
+		} else if err != nil {
+			return n, false, err
+		}
+		return n, false, nil
+	case io.EOF, io.ErrUnexpectedEOF:
+		return n, true, nil
+	}
+	return n, false, err
+}
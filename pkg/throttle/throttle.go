@@ -0,0 +1,195 @@
+// Package throttle limits the bandwidth of streams with a token bucket
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// slices is the number of reads per second of a throttled stream
+const slices = 10
+
+// Window is a time of day during which a different rate applies
+type Window struct {
+	// Start and End are durations since midnight (local time). A window which
+	// ends before it starts spans midnight.
+	Start time.Duration
+	End   time.Duration
+	// Rate is the limit during the window in bytes per second. Zero means
+	// unlimited.
+	Rate int64
+}
+
+// ParseWindow parses a window formatted as "15:04-15:04" (e.g. "22:00-06:00")
+func ParseWindow(s string, rate int64) (Window, error) {
+	p := strings.Split(s, "-")
+	if len(p) != 2 {
+		return Window{}, fmt.Errorf("invalid window %q (e.g. 08:00-18:00)", s)
+	}
+	start, err := parseTimeOfDay(p[0])
+	if err != nil {
+		return Window{}, err
+	}
+	end, err := parseTimeOfDay(p[1])
+	if err != nil {
+		return Window{}, err
+	}
+	return Window{Start: start, End: end, Rate: rate}, nil
+}
+
+// Contains returns whether t is within the window
+func (w *Window) Contains(t time.Time) bool {
+	y, m, d := t.Date()
+	since := t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+	if w.Start <= w.End {
+		return since >= w.Start && since < w.End
+	}
+	return since >= w.Start || since < w.End
+}
+
+// Limiter is a token bucket, which allows a burst of one second. It can be
+// shared by several streams, and its rate can be changed while they are
+// being read.
+type Limiter struct {
+	mu      sync.Mutex
+	rate    int64
+	windows []Window
+	tokens  float64
+	last    time.Time
+}
+
+// NewLimiter returns a limiter of rate bytes per second. Zero means
+// unlimited.
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{rate: rate}
+}
+
+// SetRate changes the rate outside of windows
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	l.rate = rate
+	l.mu.Unlock()
+}
+
+// SetWindows replaces the windows of the limiter. When windows overlap, the
+// first one applies.
+func (l *Limiter) SetWindows(windows []Window) {
+	l.mu.Lock()
+	l.windows = append([]Window{}, windows...)
+	l.mu.Unlock()
+}
+
+// Rate returns the rate which applies at t
+func (l *Limiter) Rate(t time.Time) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rateAt(t)
+}
+
+func (l *Limiter) rateAt(t time.Time) int64 {
+	for _, w := range l.windows {
+		if w.Contains(t) {
+			return w.Rate
+		}
+	}
+	return l.rate
+}
+
+// WaitN takes n tokens from the bucket, and blocks until they are available
+// or ctx is done
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	rate := l.rateAt(now)
+	if rate <= 0 {
+		l.last = time.Time{}
+		l.mu.Unlock()
+		return nil
+	}
+
+	// Refill the bucket, which starts full
+	burst := float64(rate)
+	if l.last.IsZero() {
+		l.tokens = burst
+	} else if l.tokens += now.Sub(l.last).Seconds() * float64(rate); l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	debt := l.tokens
+	l.mu.Unlock()
+
+	if debt >= 0 {
+		return nil
+	}
+	t := time.NewTimer(time.Duration(-debt / float64(rate) * float64(time.Second)))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// chunk returns the maximum number of bytes read at once, so that throttled
+// streams flow steadily
+func (l *Limiter) chunk() int {
+	rate := l.Rate(time.Now())
+	if rate <= 0 {
+		return 0
+	}
+	if c := rate / slices; c > 0 {
+		return int(c)
+	}
+	return 1
+}
+
+// NewReader returns a reader which reads r within the rate of l
+func NewReader(ctx context.Context, r io.Reader, l *Limiter) io.Reader {
+	return &reader{ctx: ctx, r: r, l: l}
+}
+
+// NewReadCloser is like NewReader, but it closes r
+func NewReadCloser(ctx context.Context, r io.ReadCloser, l *Limiter) io.ReadCloser {
+	return &readCloser{
+		Reader: NewReader(ctx, r, l),
+		Closer: r,
+	}
+}
+
+type reader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if c := r.l.chunk(); c > 0 && len(p) > c {
+		p = p[:c]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.l.WaitN(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q (e.g. 18:00)", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
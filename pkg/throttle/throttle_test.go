@@ -0,0 +1,134 @@
+package throttle_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stairlin/kargo/pkg/throttle"
+)
+
+func TestParseWindow(t *testing.T) {
+	table := []struct {
+		in    string
+		start time.Duration
+		end   time.Duration
+		err   bool
+	}{
+		{in: "08:00-18:00", start: 8 * time.Hour, end: 18 * time.Hour},
+		{in: "22:30 - 06:15", start: 22*time.Hour + 30*time.Minute, end: 6*time.Hour + 15*time.Minute},
+		{in: "00:00-00:00", start: 0, end: 0},
+		{in: "08:00", err: true},
+		{in: "08:00-18:00-20:00", err: true},
+		{in: "8h-18h", err: true},
+		{in: "08:00-24:00", err: true},
+	}
+	for _, test := range table {
+		w, err := throttle.ParseWindow(test.in, 42)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expect error", test.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.in, err)
+			continue
+		}
+		if w.Start != test.start || w.End != test.end || w.Rate != 42 {
+			t.Errorf("%s: expect window %s-%s (42), but got %s-%s (%d)",
+				test.in, test.start, test.end, w.Start, w.End, w.Rate,
+			)
+		}
+	}
+}
+
+func TestRate(t *testing.T) {
+	day, err := throttle.ParseWindow("08:00-18:00", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	night, err := throttle.ParseWindow("22:00-06:00", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := throttle.NewLimiter(500)
+	l.SetWindows([]throttle.Window{day, night})
+
+	table := []struct {
+		hour   int
+		minute int
+		expect int64
+	}{
+		{hour: 7, minute: 59, expect: 500},
+		{hour: 8, minute: 0, expect: 100},
+		{hour: 17, minute: 59, expect: 100},
+		{hour: 18, minute: 0, expect: 500},
+		{hour: 22, minute: 0, expect: 0},
+		{hour: 0, minute: 0, expect: 0},
+		{hour: 5, minute: 59, expect: 0},
+		{hour: 6, minute: 0, expect: 500},
+	}
+	for _, test := range table {
+		now := time.Date(2018, 3, 1, test.hour, test.minute, 0, 0, time.Local)
+		if got := l.Rate(now); got != test.expect {
+			t.Errorf("%02d:%02d: expect rate %d, but got %d",
+				test.hour, test.minute, test.expect, got,
+			)
+		}
+	}
+
+	l.SetRate(200)
+	now := time.Date(2018, 3, 1, 20, 0, 0, 0, time.Local)
+	if got := l.Rate(now); got != 200 {
+		t.Errorf("expect rate 200 after update, but got %d", got)
+	}
+}
+
+func TestReader(t *testing.T) {
+	const rate = 200 << 10
+	data := make([]byte, rate*2)
+	l := throttle.NewLimiter(rate)
+
+	// The first second is a burst
+	start := time.Now()
+	r := throttle.NewReader(context.Background(), bytes.NewReader(data), l)
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, got) {
+		t.Error("expect throttled data to be unchanged")
+	}
+	if d := time.Since(start); d < 900*time.Millisecond || d > 2*time.Second {
+		t.Errorf("expect read to take about 1s, but got %s", d)
+	}
+
+	// Unlimited
+	l.SetRate(0)
+	start = time.Now()
+	r = throttle.NewReader(context.Background(), bytes.NewReader(data), l)
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("expect unlimited read to be immediate, but got %s", d)
+	}
+}
+
+func TestReaderCancel(t *testing.T) {
+	l := throttle.NewLimiter(1 << 10)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	r := throttle.NewReader(ctx, bytes.NewReader(make([]byte, 1<<20)), l)
+	start := time.Now()
+	if _, err := ioutil.ReadAll(r); err != context.DeadlineExceeded {
+		t.Errorf("expect error %s, but got %v", context.DeadlineExceeded, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expect read to stop once the context is done, but got %s", d)
+	}
+}
@@ -52,12 +52,22 @@ func (n *Notifier) Send(
 		operation = "Backup"
 	case notification.Restore:
 		operation = "Restore"
+	case notification.Upload:
+		operation = "Upload"
 	default:
 		operation = "?"
 	}
 
 	var desc string
 	switch notif.Type {
+	case notification.Pending:
+		desc = fmt.Sprintf(
+			"%s done in %s, but its upload is pending - %s\n\nReason: %s",
+			operation,
+			duration.String(),
+			notif.Body,
+			notif.Error,
+		)
 	case notification.Failure:
 		desc = fmt.Sprintf(
 			"%s failed after %s.\n\nReason: %s",
@@ -29,6 +29,8 @@ const (
 	Success Type = iota
 	Failure Type = iota
 	Timeout Type = iota
+	// Pending means that a backup has been spooled, but not uploaded yet
+	Pending Type = iota
 )
 
 // Operation is the operation that triggers the notification
@@ -37,6 +39,8 @@ type Operation int
 const (
 	Backup  Operation = iota
 	Restore Operation = iota
+	// Upload is the upload of a spooled backup
+	Upload Operation = iota
 )
 
 type Creator func() Notifier
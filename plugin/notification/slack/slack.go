@@ -65,6 +65,8 @@ func (n *Notifier) Send(
 		operation = "Backup"
 	case notification.Restore:
 		operation = "Restore"
+	case notification.Upload:
+		operation = "Upload"
 	default:
 		operation = "?"
 	}
@@ -75,6 +77,14 @@ func (n *Notifier) Send(
 		text = fmt.Sprintf(
 			"%s done in %s - %s", operation, duration.String(), notif.Body,
 		)
+	case notification.Pending:
+		text = fmt.Sprintf(
+			"WARNING: %s done in %s, but its upload is pending - %s\n\nReason: %s",
+			operation,
+			duration.String(),
+			notif.Body,
+			notif.Error,
+		)
 	case notification.Failure:
 		text = fmt.Sprintf(
 			"ERROR: %s failed after %s.\n\nReason: %s",
@@ -3,5 +3,7 @@ package all
 import (
 	// Import all plugins
 	_ "github.com/stairlin/kargo/plugin/process/cipher"
+	_ "github.com/stairlin/kargo/plugin/process/ecc"
 	_ "github.com/stairlin/kargo/plugin/process/gzip"
+	_ "github.com/stairlin/kargo/plugin/process/sign"
 )
@@ -3,6 +3,8 @@ package cipher
 import (
 	"encoding/base64"
 	"io"
+	"io/ioutil"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/stairlin/kargo/context"
@@ -28,8 +30,11 @@ func init() {
 
 // Processor is a cipher processor
 type Processor struct {
-	Keys    []string `toml:"keys"`
-	Default uint32   `toml:"default"`
+	Keys           []string `toml:"keys"`
+	KeyShares      []string `toml:"key_shares"`
+	Default        uint32   `toml:"default"`
+	Passphrase     string   `toml:"passphrase"`
+	PassphraseFile string   `toml:"passphrase_file"`
 
 	Rotator *sec.Rotator
 }
@@ -39,16 +44,33 @@ func (p *Processor) Name() string {
 }
 
 func (p *Processor) Init() error {
-	if len(p.Keys) < 1 {
-		return errors.New("there must be at lest one encryption key")
+	passphrase, err := p.loadPassphrase()
+	if err != nil {
+		return err
 	}
-	if int(p.Default) >= len(p.Keys) {
-		return errors.New("invalid default key index")
+
+	// Rebuild the key split into shares (if any). It comes after other keys.
+	encodedKeys := append([]string{}, p.Keys...)
+	if len(p.KeyShares) > 0 {
+		key, err := CombineShares(p.KeyShares)
+		if err != nil {
+			return err
+		}
+		encodedKeys = append(encodedKeys, key)
+	}
+
+	if passphrase == "" {
+		if len(encodedKeys) < 1 {
+			return errors.New("there must be at lest one encryption key or a passphrase")
+		}
+		if int(p.Default) >= len(encodedKeys) {
+			return errors.New("invalid default key index")
+		}
 	}
 
 	// Decode keys
 	keys := map[uint32][]byte{}
-	for i, key := range p.Keys {
+	for i, key := range encodedKeys {
 		decodedKey, err := base64.StdEncoding.DecodeString(key)
 		if err != nil {
 			return errors.Wrapf(err, "cannot decode key #%d", i)
@@ -61,20 +83,84 @@ func (p *Processor) Init() error {
 		keys[uint32(i)] = decodedKey
 	}
 
+	if passphrase != "" {
+		// Keys remain available to decrypt older backups
+		p.Rotator = sec.NewPassphraseRotator(
+			[]byte(passphrase), sec.DefaultKDFParams, keys,
+		)
+		return nil
+	}
 	p.Rotator = sec.NewRotator(keys, p.Default)
 	return nil
 }
 
-// Encode encrypt data from r
+// SplitKey splits key into n base64 encoded shares. Any threshold shares can
+// be combined to rebuild the key.
+func SplitKey(key []byte, n, threshold int) ([]string, error) {
+	shares, err := sec.Split(key, n, threshold)
+	if err != nil {
+		return nil, err
+	}
+	encoded := make([]string, len(shares))
+	for i, share := range shares {
+		encoded[i] = base64.StdEncoding.EncodeToString(share)
+	}
+	return encoded, nil
+}
+
+// CombineShares rebuilds a base64 encoded key from base64 encoded shares
+func CombineShares(shares []string) (string, error) {
+	decoded := make([][]byte, len(shares))
+	for i, share := range shares {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(share))
+		if err != nil {
+			return "", errors.Wrapf(err, "cannot decode key share #%d", i)
+		}
+		decoded[i] = b
+	}
+	key, err := sec.Combine(decoded)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot combine key shares")
+	}
+	if len(key) != sec.KeySize {
+		return "", errors.Errorf(
+			"invalid combined key length %d != %d", len(key), sec.KeySize,
+		)
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// loadPassphrase returns the passphrase either from the config or from the
+// passphrase file
+func (p *Processor) loadPassphrase() (string, error) {
+	if p.PassphraseFile == "" {
+		return p.Passphrase, nil
+	}
+	if p.Passphrase != "" {
+		return "", errors.New("passphrase and passphrase_file are mutually exclusive")
+	}
+	b, err := ioutil.ReadFile(p.PassphraseFile)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot read passphrase file")
+	}
+	passphrase := strings.TrimRight(string(b), "\r\n")
+	if passphrase == "" {
+		return "", errors.New("passphrase file is empty")
+	}
+	return passphrase, nil
+}
+
+// Encode encrypt data from r. The backup key is authenticated along with
+// data, so a backup cannot be restored under another key.
 func (p *Processor) Encode(
 	ctx *context.Context, r io.Reader,
 ) (io.ReadCloser, error) {
-	return p.Rotator.EncryptReader(r, int(blockSize))
+	return p.Rotator.EncryptReaderWithData(r, int(blockSize), []byte(ctx.Key))
 }
 
 // Decode decrypt data from r
 func (p *Processor) Decode(
 	ctx *context.Context, r io.Reader,
 ) (io.ReadCloser, error) {
-	return p.Rotator.DecryptReader(r, int(blockSize))
+	return p.Rotator.DecryptReaderWithData(r, int(blockSize), []byte(ctx.Key))
 }
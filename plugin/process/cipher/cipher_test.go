@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/base64"
 	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/stairlin/kargo/context"
@@ -116,3 +117,156 @@ func TestDiff(t *testing.T) {
 		t.Error("encoded close err", err)
 	}
 }
+
+func TestPassphrase(t *testing.T) {
+	key, err := sec.GenRandBytes(sec.KeySize)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+
+	// Encode data with a key
+	keyProc := cipher.Processor{
+		Keys: []string{encodedKey},
+	}
+	if err := keyProc.Init(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	expectKey := testutil.GenRandBytes(t, int(128*unit.KB))
+	encodedWithKey, err := keyProc.Encode(ctx, bytes.NewReader(expectKey))
+	if err != nil {
+		t.Fatal("Error encoding", err)
+	}
+
+	// Encode data with a passphrase
+	proc := cipher.Processor{
+		Keys:       []string{encodedKey},
+		Passphrase: "correct horse battery staple",
+	}
+	if err := proc.Init(); err != nil {
+		t.Fatal(err)
+	}
+	expect := testutil.GenRandBytes(t, int(128*unit.KB))
+	encoded, err := proc.Encode(ctx, bytes.NewReader(expect))
+	if err != nil {
+		t.Fatal("Error encoding", err)
+	}
+	b, err := ioutil.ReadAll(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The passphrase must be enough to decode it
+	f, err := ioutil.TempFile("", "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("correct horse battery staple\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	fileProc := cipher.Processor{
+		PassphraseFile: f.Name(),
+	}
+	if err := fileProc.Init(); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := fileProc.Decode(ctx, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal("Error decoding", err)
+	}
+	got, err := ioutil.ReadAll(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expect, got) {
+		t.Errorf("expect text %s, but got %s",
+			testutil.Truncate(expect, 140), testutil.Truncate(got, 140),
+		)
+	}
+
+	// Keys must still decode older backups
+	decoded, err = proc.Decode(ctx, encodedWithKey)
+	if err != nil {
+		t.Fatal("Error decoding", err)
+	}
+	got, err = ioutil.ReadAll(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expectKey, got) {
+		t.Errorf("expect text %s, but got %s",
+			testutil.Truncate(expectKey, 140), testutil.Truncate(got, 140),
+		)
+	}
+
+	// A wrong passphrase must fail
+	wrongProc := cipher.Processor{
+		Passphrase: "wrong horse battery staple",
+	}
+	if err := wrongProc.Init(); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err = wrongProc.Decode(ctx, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal("Error decoding", err)
+	}
+	if _, err := ioutil.ReadAll(decoded); err != sec.ErrDecrypt {
+		t.Errorf("expect error %s, but got %v", sec.ErrDecrypt, err)
+	}
+}
+
+func TestKeyShares(t *testing.T) {
+	key, err := sec.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares, err := cipher.SplitKey(key, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proc := cipher.Processor{
+		Keys: []string{base64.StdEncoding.EncodeToString(key)},
+	}
+	if err := proc.Init(); err != nil {
+		t.Fatal(err)
+	}
+	shareProc := cipher.Processor{
+		KeyShares: []string{shares[3], shares[0], shares[4]},
+	}
+	if err := shareProc.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Data encoded with the key must be decoded with its shares
+	ctx := context.Background()
+	expect := testutil.GenRandBytes(t, int(128*unit.KB))
+	encoded, err := proc.Encode(ctx, bytes.NewReader(expect))
+	if err != nil {
+		t.Fatal("Error encoding", err)
+	}
+	decoded, err := shareProc.Decode(ctx, encoded)
+	if err != nil {
+		t.Fatal("Error decoding", err)
+	}
+	got, err := ioutil.ReadAll(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expect, got) {
+		t.Errorf("expect text %s, but got %s",
+			testutil.Truncate(expect, 140), testutil.Truncate(got, 140),
+		)
+	}
+
+	// Too few shares
+	shareProc = cipher.Processor{
+		KeyShares: []string{shares[3]},
+	}
+	if err := shareProc.Init(); err == nil {
+		t.Error("expect error with a single key share")
+	}
+}
@@ -0,0 +1,323 @@
+// Package ecc adds Reed-Solomon parity blocks to backups in order to repair
+// corrupted data
+package ecc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	"github.com/klauspost/reedsolomon"
+	"github.com/pkg/errors"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/log"
+	"github.com/stairlin/kargo/pkg/unit"
+	"github.com/stairlin/kargo/plugin/process"
+)
+
+// An encoded stream starts with a header, which is repeated to survive
+// corruption:
+//
+//	magic (4) | version (1) | data shards (1) | parity shards (1) |
+//	block size (4) | CRC-32 (4)
+//
+// Data is then split into groups of data shards, each shard being a block.
+// The first 4 bytes of a group contain the length of data it holds, the
+// remaining of the last group is padded with zeros. The last group is always
+// partially filled, and may be empty, so that a stream truncated at a group
+// boundary is detected. Parity shards are computed for each group. Every shard is written with its CRC-32, which is
+// used to detect corrupted shards:
+//
+//	CRC-32 (4) | block
+const (
+	name = "ecc"
+
+	version      = 1
+	headerSize   = 15
+	headerCopies = 3
+	crcSize      = 4
+	lengthSize   = 4
+
+	defaultDataShards   = 10
+	defaultParityShards = 2
+	defaultBlockSize    = unit.KB * 64
+	maxShards           = 256
+	minBlockSize        = unit.KB
+	maxBlockSize        = unit.MB * 16
+)
+
+var magic = [4]byte{'K', 'E', 'C', 'C'}
+
+var table = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// ErrUnrecoverable occurs when a group has more corrupted blocks than
+	// parity blocks
+	ErrUnrecoverable = errors.New("ecc: too many corrupted blocks")
+	// ErrInvalidHeader occurs when none of the header copies is valid
+	ErrInvalidHeader = errors.New("ecc: invalid header")
+	// ErrTruncated occurs when data ends before the last group
+	ErrTruncated = errors.New("ecc: truncated data")
+)
+
+func init() {
+	process.Add(name, func() process.Processor {
+		return &Processor{}
+	})
+}
+
+// Processor is a Reed-Solomon error correction processor
+type Processor struct {
+	DataShards   int    `toml:"data_shards"`
+	ParityShards int    `toml:"parity_shards"`
+	BlockSize    string `toml:"block_size"`
+
+	// Repairs is the number of corrupted blocks repaired by Decode
+	Repairs int
+
+	blockSize int
+}
+
+func (p *Processor) Name() string {
+	return name
+}
+
+func (p *Processor) Init() error {
+	if p.DataShards == 0 {
+		p.DataShards = defaultDataShards
+	}
+	if p.ParityShards == 0 {
+		p.ParityShards = defaultParityShards
+	}
+	if p.DataShards < 0 || p.ParityShards < 0 {
+		return errors.New("ecc: shards must be positive")
+	}
+	if p.DataShards+p.ParityShards > maxShards {
+		return errors.Errorf("ecc: too many shards (max %d)", maxShards)
+	}
+
+	blockSize := defaultBlockSize
+	if p.BlockSize != "" {
+		b, err := unit.ParseByte(p.BlockSize)
+		if err != nil {
+			return errors.Wrap(err, "ecc: invalid block size")
+		}
+		blockSize = b
+	}
+	if blockSize < minBlockSize || blockSize > maxBlockSize {
+		return errors.Errorf(
+			"ecc: block size must be between %s and %s", minBlockSize, maxBlockSize,
+		)
+	}
+	p.blockSize = int(blockSize)
+	return nil
+}
+
+// Encode adds parity blocks to data from r
+func (p *Processor) Encode(
+	ctx *context.Context, r io.Reader,
+) (io.ReadCloser, error) {
+	h := header{
+		DataShards:   p.DataShards,
+		ParityShards: p.ParityShards,
+		BlockSize:    p.blockSize,
+	}
+	enc, err := reedsolomon.New(h.DataShards, h.ParityShards)
+	if err != nil {
+		return nil, errors.Wrap(err, "ecc: cannot create encoder")
+	}
+
+	out, in := io.Pipe()
+	go func() {
+		in.CloseWithError(encode(in, r, enc, &h))
+	}()
+	return out, nil
+}
+
+// Decode detects and repairs corrupted blocks from r
+func (p *Processor) Decode(
+	ctx *context.Context, r io.Reader,
+) (io.ReadCloser, error) {
+	out, in := io.Pipe()
+	go func() {
+		in.CloseWithError(p.decode(ctx, in, r))
+	}()
+	return out, nil
+}
+
+func encode(
+	w io.Writer, r io.Reader, enc reedsolomon.Encoder, h *header,
+) error {
+	b := h.marshal()
+	for i := 0; i < headerCopies; i++ {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	data := make([]byte, h.DataShards*h.BlockSize)
+	shards := h.shards(data)
+	checksum := make([]byte, crcSize)
+	for {
+		n, err := io.ReadFull(r, data[lengthSize:])
+		switch err {
+		case nil, io.EOF, io.ErrUnexpectedEOF:
+		default:
+			return errors.Wrap(err, "ecc: cannot read data")
+		}
+
+		// Store the length of data and pad the group with zeros
+		binary.BigEndian.PutUint32(data, uint32(n))
+		for i := lengthSize + n; i < len(data); i++ {
+			data[i] = 0
+		}
+
+		if err := enc.Encode(shards); err != nil {
+			return errors.Wrap(err, "ecc: cannot compute parity")
+		}
+		for _, shard := range shards {
+			binary.BigEndian.PutUint32(checksum, crc32.Checksum(shard, table))
+			if _, err := w.Write(checksum); err != nil {
+				return err
+			}
+			if _, err := w.Write(shard); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+func (p *Processor) decode(ctx *context.Context, w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	h, err := readHeader(br)
+	if err != nil {
+		return err
+	}
+	enc, err := reedsolomon.New(h.DataShards, h.ParityShards)
+	if err != nil {
+		return errors.Wrap(err, "ecc: cannot create decoder")
+	}
+
+	var repairs int
+	defer func() {
+		p.Repairs += repairs
+		if repairs > 0 {
+			ctx.Warn("Repaired corrupted blocks",
+				log.String("proc", name), log.Int("blocks", repairs),
+			)
+		}
+	}()
+
+	stride := crcSize + h.BlockSize
+	group := make([]byte, (h.DataShards+h.ParityShards)*stride)
+	shards := make([][]byte, h.DataShards+h.ParityShards)
+	data := make([]byte, h.DataShards*h.BlockSize)
+	for {
+		_, err := io.ReadFull(br, group)
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return ErrTruncated
+		default:
+			return errors.Wrap(err, "ecc: cannot read data")
+		}
+
+		// Detect corrupted blocks
+		var corrupted int
+		for i := range shards {
+			b := group[i*stride : (i+1)*stride]
+			shards[i] = b[crcSize:]
+			if crc32.Checksum(shards[i], table) != binary.BigEndian.Uint32(b) {
+				shards[i] = nil
+				corrupted++
+			}
+		}
+		if corrupted > h.ParityShards {
+			return ErrUnrecoverable
+		}
+		if corrupted > 0 {
+			if err := enc.ReconstructData(shards); err != nil {
+				return errors.Wrap(err, "ecc: cannot repair data")
+			}
+			repairs += corrupted
+		}
+
+		for i := 0; i < h.DataShards; i++ {
+			copy(data[i*h.BlockSize:], shards[i])
+		}
+		n := int(binary.BigEndian.Uint32(data))
+		if n > len(data)-lengthSize {
+			return ErrUnrecoverable
+		}
+		if _, err := w.Write(data[lengthSize : lengthSize+n]); err != nil {
+			return err
+		}
+		if n < len(data)-lengthSize {
+			return nil
+		}
+	}
+}
+
+type header struct {
+	DataShards   int
+	ParityShards int
+	BlockSize    int
+}
+
+func (h *header) marshal() []byte {
+	b := make([]byte, headerSize)
+	copy(b, magic[:])
+	b[4] = version
+	b[5] = byte(h.DataShards)
+	b[6] = byte(h.ParityShards)
+	binary.BigEndian.PutUint32(b[7:], uint32(h.BlockSize))
+	binary.BigEndian.PutUint32(b[11:], crc32.Checksum(b[:11], table))
+	return b
+}
+
+// shards splits data into data shards and allocates parity shards
+func (h *header) shards(data []byte) [][]byte {
+	shards := make([][]byte, h.DataShards+h.ParityShards)
+	for i := range shards {
+		if i < h.DataShards {
+			shards[i] = data[i*h.BlockSize : (i+1)*h.BlockSize]
+		} else {
+			shards[i] = make([]byte, h.BlockSize)
+		}
+	}
+	return shards
+}
+
+// readHeader returns the first valid copy of the header
+func readHeader(r io.Reader) (*header, error) {
+	b := make([]byte, headerSize*headerCopies)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, ErrInvalidHeader
+	}
+	for i := 0; i < headerCopies; i++ {
+		c := b[i*headerSize : (i+1)*headerSize]
+		if !bytes.Equal(c[:4], magic[:]) ||
+			crc32.Checksum(c[:11], table) != binary.BigEndian.Uint32(c[11:]) {
+			continue
+		}
+		if c[4] != version {
+			return nil, errors.Errorf("ecc: unsupported version %d", c[4])
+		}
+		h := &header{
+			DataShards:   int(c[5]),
+			ParityShards: int(c[6]),
+			BlockSize:    int(binary.BigEndian.Uint32(c[7:])),
+		}
+		if h.DataShards == 0 || h.BlockSize <= lengthSize ||
+			h.BlockSize > int(maxBlockSize) {
+			return nil, ErrInvalidHeader
+		}
+		return h, nil
+	}
+	return nil, ErrInvalidHeader
+}
@@ -0,0 +1,154 @@
+package ecc_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/pkg/testutil"
+	"github.com/stairlin/kargo/pkg/unit"
+	"github.com/stairlin/kargo/plugin/process/ecc"
+)
+
+// Encoded sizes with 4 data shards and 2 parity shards of 1 kB
+const (
+	headerSize = 3 * 15
+	groupSize  = 6 * (4 + 1024)
+	groupData  = 4*1024 - 4
+)
+
+func TestVerbatim(t *testing.T) {
+	table := []int{0, 1, 1020, 1021, groupData, 2 * groupData, 4 * int(unit.MB)}
+	for _, size := range table {
+		proc := ecc.Processor{DataShards: 4, ParityShards: 2, BlockSize: "1 kB"}
+		if err := proc.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		expect := testutil.GenRandBytes(t, size)
+		got := roundTrip(t, &proc, expect, nil)
+		if !bytes.Equal(expect, got) {
+			t.Errorf("%d: expect text %s, but got %s", size,
+				testutil.Truncate(expect, 140), testutil.Truncate(got, 140),
+			)
+		}
+	}
+}
+
+func TestRepair(t *testing.T) {
+	proc := ecc.Processor{DataShards: 4, ParityShards: 2, BlockSize: "1 kB"}
+	if err := proc.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := testutil.GenRandBytes(t, 64*int(unit.KB))
+	got := roundTrip(t, &proc, expect, func(b []byte) {
+		b[0] ^= 0xff    // First header copy
+		b[100] ^= 0xff  // First group, first shard
+		b[3000] ^= 0xff // First group, third shard
+		b[9000] ^= 0xff // Second group
+	})
+	if !bytes.Equal(expect, got) {
+		t.Errorf("expect text %s, but got %s",
+			testutil.Truncate(expect, 140), testutil.Truncate(got, 140),
+		)
+	}
+	if proc.Repairs != 3 {
+		t.Errorf("expect 3 repaired blocks, but got %d", proc.Repairs)
+	}
+}
+
+func TestUnrecoverable(t *testing.T) {
+	proc := ecc.Processor{DataShards: 4, ParityShards: 2, BlockSize: "1 kB"}
+	if err := proc.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	encoded, err := proc.Encode(ctx, bytes.NewReader(testutil.GenRandBytes(t, 8192)))
+	if err != nil {
+		t.Fatal("Error encoding", err)
+	}
+	b, err := ioutil.ReadAll(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{100, 1200, 2300} {
+		b[i] ^= 0xff
+	}
+
+	decoded, err := proc.Decode(ctx, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal("Error decoding", err)
+	}
+	if _, err := ioutil.ReadAll(decoded); err != ecc.ErrUnrecoverable {
+		t.Errorf("expect error %s, but got %v", ecc.ErrUnrecoverable, err)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	proc := ecc.Processor{DataShards: 4, ParityShards: 2, BlockSize: "1 kB"}
+	if err := proc.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two full groups, followed by an empty one
+	ctx := context.Background()
+	data := testutil.GenRandBytes(t, 2*groupData)
+	encoded, err := proc.Encode(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("Error encoding", err)
+	}
+	b, err := ioutil.ReadAll(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != headerSize+3*groupSize {
+		t.Fatalf("expect %d encoded bytes, but got %d", headerSize+3*groupSize, len(b))
+	}
+
+	table := []int{
+		len(b) - 1,
+		headerSize + 2*groupSize, // Group boundary
+		headerSize + groupSize,
+		headerSize,
+	}
+	for _, size := range table {
+		decoded, err := proc.Decode(ctx, bytes.NewReader(b[:size]))
+		if err != nil {
+			t.Fatal("Error decoding", err)
+		}
+		if _, err := ioutil.ReadAll(decoded); err != ecc.ErrTruncated {
+			t.Errorf("%d: expect error %s, but got %v", size, ecc.ErrTruncated, err)
+		}
+	}
+}
+
+func roundTrip(
+	t *testing.T, proc *ecc.Processor, data []byte, corrupt func([]byte),
+) []byte {
+	ctx := context.Background()
+
+	encoded, err := proc.Encode(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("Error encoding", err)
+	}
+	b, err := ioutil.ReadAll(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if corrupt != nil {
+		corrupt(b)
+	}
+
+	decoded, err := proc.Decode(ctx, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal("Error decoding", err)
+	}
+	got, err := ioutil.ReadAll(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
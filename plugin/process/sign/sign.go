@@ -0,0 +1,248 @@
+// Package sign signs backups with Ed25519 and verifies them on restore
+package sign
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/log"
+	"github.com/stairlin/kargo/plugin/process"
+	"golang.org/x/crypto/ed25519"
+)
+
+// A signed stream is made of a header, the data, and the signature:
+//
+//	magic (4) | version (1) | key ID (8) | data | signature (64)
+//
+// The signature covers the SHA-512 digest of the header and the data,
+// followed by the backup key.
+const (
+	name = "sign"
+
+	version    = 1
+	keyIDSize  = 8
+	headerSize = len(magic) + 1 + keyIDSize
+)
+
+var magic = [4]byte{'K', 'S', 'I', 'G'}
+
+var (
+	// ErrUnsigned occurs when data to decode has not been signed
+	ErrUnsigned = errors.New("sign: data is not signed")
+	// ErrUnknownSigner occurs when data has been signed by an untrusted key
+	ErrUnknownSigner = errors.New("sign: data signed by an untrusted key")
+	// ErrBadSignature occurs when the signature does not match the data
+	ErrBadSignature = errors.New("sign: invalid signature")
+)
+
+func init() {
+	process.Add(name, func() process.Processor {
+		return &Processor{}
+	})
+}
+
+// Processor signs data on Encode and verifies it on Decode
+type Processor struct {
+	PrivateKey     string   `toml:"private_key"`
+	PrivateKeyFile string   `toml:"private_key_file"`
+	PublicKeys     []string `toml:"public_keys"`
+
+	// Insecure allows Decode to pass through unsigned or mis-signed data
+	Insecure bool
+
+	privateKey ed25519.PrivateKey
+	keyID      []byte
+	trusted    map[string]ed25519.PublicKey
+}
+
+func (p *Processor) Name() string {
+	return name
+}
+
+func (p *Processor) Init() error {
+	p.trusted = map[string]ed25519.PublicKey{}
+
+	privateKey, err := p.loadPrivateKey()
+	if err != nil {
+		return err
+	}
+	if privateKey != "" {
+		b, err := base64.StdEncoding.DecodeString(privateKey)
+		if err != nil {
+			return errors.Wrap(err, "cannot decode private key")
+		}
+		switch len(b) {
+		case ed25519.SeedSize:
+			p.privateKey = ed25519.NewKeyFromSeed(b)
+		case ed25519.PrivateKeySize:
+			p.privateKey = ed25519.PrivateKey(b)
+		default:
+			return errors.Errorf("invalid private key length %d", len(b))
+		}
+		pub := p.privateKey.Public().(ed25519.PublicKey)
+		p.keyID = KeyID(pub)
+		p.trusted[string(p.keyID)] = pub
+	}
+
+	for i, key := range p.PublicKeys {
+		b, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return errors.Wrapf(err, "cannot decode public key #%d", i)
+		}
+		if len(b) != ed25519.PublicKeySize {
+			return errors.Errorf(
+				"invalid public key length %d != %d", len(b), ed25519.PublicKeySize,
+			)
+		}
+		p.trusted[string(KeyID(b))] = ed25519.PublicKey(b)
+	}
+
+	if len(p.trusted) == 0 {
+		return errors.New("there must be at least a private key or a public key")
+	}
+	return nil
+}
+
+// Encode signs data from r
+func (p *Processor) Encode(
+	ctx *context.Context, r io.Reader,
+) (io.ReadCloser, error) {
+	if p.privateKey == nil {
+		return nil, errors.New("sign: missing private key")
+	}
+
+	out, in := io.Pipe()
+	go func() {
+		in.CloseWithError(func() error {
+			header := make([]byte, 0, headerSize)
+			header = append(header, magic[:]...)
+			header = append(header, version)
+			header = append(header, p.keyID...)
+
+			h := sha512.New()
+			h.Write(header)
+			if _, err := in.Write(header); err != nil {
+				return err
+			}
+			if _, err := io.Copy(io.MultiWriter(in, h), r); err != nil {
+				return errors.Wrap(err, "sign: cannot copy data")
+			}
+			sig := ed25519.Sign(p.privateKey, message(h, ctx.Key))
+			_, err := in.Write(sig)
+			return err
+		}())
+	}()
+	return out, nil
+}
+
+// Decode verifies data from r. Data is written to a temporary file until its
+// signature is verified, so the returned reader only contains trusted data.
+func (p *Processor) Decode(
+	ctx *context.Context, r io.Reader,
+) (io.ReadCloser, error) {
+	tail := &tailWriter{h: sha512.New(), size: ed25519.SignatureSize}
+	f, err := ctx.CreateTempFile(io.TeeReader(r, tail))
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "sign: cannot get temporary file stat")
+	}
+
+	data := io.NewSectionReader(
+		f, int64(headerSize), info.Size()-int64(headerSize+ed25519.SignatureSize),
+	)
+	err = p.verify(ctx, f, info.Size(), tail)
+	switch {
+	case err == nil:
+		return ioutil.NopCloser(data), nil
+	case err == ErrUnsigned && p.Insecure:
+		ctx.Warn("Data is not signed", log.String("proc", name))
+		return ioutil.NopCloser(f), nil
+	case p.Insecure:
+		ctx.Warn("Data signature cannot be verified",
+			log.String("proc", name), log.Error(err),
+		)
+		return ioutil.NopCloser(data), nil
+	}
+	return nil, err
+}
+
+func (p *Processor) verify(
+	ctx *context.Context, f io.ReaderAt, size int64, tail *tailWriter,
+) error {
+	if size < int64(headerSize+ed25519.SignatureSize) {
+		return ErrUnsigned
+	}
+	header := make([]byte, headerSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return errors.Wrap(err, "sign: cannot read header")
+	}
+	if !bytes.Equal(header[:len(magic)], magic[:]) {
+		return ErrUnsigned
+	}
+	if header[len(magic)] != version {
+		return errors.Errorf("sign: unsupported version %d", header[len(magic)])
+	}
+
+	pub, ok := p.trusted[string(header[len(magic)+1:])]
+	if !ok {
+		return ErrUnknownSigner
+	}
+	if !ed25519.Verify(pub, message(tail.h, ctx.Key), tail.tail) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// loadPrivateKey returns the private key either from the config or from the
+// private key file
+func (p *Processor) loadPrivateKey() (string, error) {
+	if p.PrivateKeyFile == "" {
+		return p.PrivateKey, nil
+	}
+	if p.PrivateKey != "" {
+		return "", errors.New("private_key and private_key_file are mutually exclusive")
+	}
+	b, err := ioutil.ReadFile(p.PrivateKeyFile)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot read private key file")
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// KeyID returns the ID of a public key, which is stored in signed data
+func KeyID(pub ed25519.PublicKey) []byte {
+	sum := sha256.Sum256(pub)
+	return sum[:keyIDSize]
+}
+
+// message returns the signed message from the data digest and the backup key
+func message(h hash.Hash, key string) []byte {
+	return append(h.Sum(nil), key...)
+}
+
+// tailWriter hashes everything written to it, but the last size bytes
+type tailWriter struct {
+	h    hash.Hash
+	size int
+	tail []byte
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.tail = append(w.tail, p...)
+	if over := len(w.tail) - w.size; over > 0 {
+		w.h.Write(w.tail[:over])
+		w.tail = append(w.tail[:0], w.tail[over:]...)
+	}
+	return len(p), nil
+}
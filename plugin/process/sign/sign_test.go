@@ -0,0 +1,134 @@
+package sign_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/pkg/testutil"
+	"github.com/stairlin/kargo/pkg/unit"
+	"github.com/stairlin/kargo/plugin/process/sign"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestVerbatim(t *testing.T) {
+	pub, priv := generateKey(t)
+	signer := sign.Processor{
+		PrivateKey: base64.StdEncoding.EncodeToString(priv.Seed()),
+	}
+	if err := signer.Init(); err != nil {
+		t.Fatal(err)
+	}
+	verifier := sign.Processor{
+		PublicKeys: []string{base64.StdEncoding.EncodeToString(pub)},
+	}
+	if err := verifier.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := testutil.GenRandBytes(t, int(1024*unit.KB))
+	ctx := context.Background()
+	defer ctx.Cleanup()
+	ctx.Key = "foo"
+
+	// Encode/Decode
+	encoded, err := signer.Encode(ctx, bytes.NewReader(expect))
+	if err != nil {
+		t.Fatal("Error encoding", err)
+	}
+	decoded, err := verifier.Decode(ctx, encoded)
+	if err != nil {
+		t.Fatal("Error decoding", err)
+	}
+
+	// Tests
+	got, err := ioutil.ReadAll(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expect, got) {
+		t.Errorf("expect text %s, but got %s",
+			testutil.Truncate(expect, 140), testutil.Truncate(got, 140),
+		)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	_, priv := generateKey(t)
+	signer := sign.Processor{
+		PrivateKey: base64.StdEncoding.EncodeToString(priv),
+	}
+	if err := signer.Init(); err != nil {
+		t.Fatal(err)
+	}
+	untrustedPub, _ := generateKey(t)
+	untrusted := sign.Processor{
+		PublicKeys: []string{base64.StdEncoding.EncodeToString(untrustedPub)},
+	}
+	if err := untrusted.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	defer ctx.Cleanup()
+	ctx.Key = "foo"
+
+	encoded, err := signer.Encode(ctx, bytes.NewReader([]byte("some data")))
+	if err != nil {
+		t.Fatal("Error encoding", err)
+	}
+	signed, err := ioutil.ReadAll(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte{}, signed...)
+	tampered[15] ^= 1
+	wrongKey := context.Background()
+	defer wrongKey.Cleanup()
+	wrongKey.Key = "bar"
+
+	table := []struct {
+		name string
+		ctx  *context.Context
+		proc *sign.Processor
+		data []byte
+		err  error
+	}{
+		{"unsigned", ctx, &signer, []byte("some data"), sign.ErrUnsigned},
+		{"tampered", ctx, &signer, tampered, sign.ErrBadSignature},
+		{"truncated", ctx, &signer, signed[:len(signed)-1], sign.ErrBadSignature},
+		{"wrong key", wrongKey, &signer, signed, sign.ErrBadSignature},
+		{"untrusted", ctx, &untrusted, signed, sign.ErrUnknownSigner},
+	}
+	for _, test := range table {
+		_, err := test.proc.Decode(test.ctx, bytes.NewReader(test.data))
+		if err != test.err {
+			t.Errorf("%s: expect error %v, but got %v", test.name, test.err, err)
+		}
+	}
+
+	// Insecure mode passes unsigned data through
+	signer.Insecure = true
+	decoded, err := signer.Decode(ctx, bytes.NewReader([]byte("some data")))
+	if err != nil {
+		t.Fatal("Error decoding", err)
+	}
+	got, err := ioutil.ReadAll(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "some data" {
+		t.Errorf("expect text %s, but got %s", "some data", got)
+	}
+}
+
+func generateKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, priv
+}
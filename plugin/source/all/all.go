@@ -8,4 +8,5 @@ import (
 	_ "github.com/stairlin/kargo/plugin/source/foundationdb"
 	_ "github.com/stairlin/kargo/plugin/source/influxdb"
 	_ "github.com/stairlin/kargo/plugin/source/postgresql"
+	_ "github.com/stairlin/kargo/plugin/source/random"
 )
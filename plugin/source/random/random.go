@@ -0,0 +1,117 @@
+// Package random generates deterministic data, and verifies it on restore.
+// It is meant to test processors and storages without a real source.
+package random
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+
+	"github.com/pkg/errors"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/log"
+	"github.com/stairlin/kargo/pkg/unit"
+	"github.com/stairlin/kargo/plugin/source"
+)
+
+const (
+	name = "random"
+
+	defaultSize = unit.MB
+	bufferSize  = 32 << 10
+)
+
+func init() {
+	source.Add(name, func() source.Source {
+		return &Source{}
+	})
+}
+
+// Source is a source of pseudo-random data. The same seed and size always
+// generate the same data.
+type Source struct {
+	Size string `toml:"size"`
+	Seed int64  `toml:"seed"`
+
+	size int64
+}
+
+func (s *Source) Name() string {
+	return name
+}
+
+func (s *Source) Init() error {
+	size := defaultSize
+	if s.Size != "" {
+		b, err := unit.ParseByte(s.Size)
+		if err != nil {
+			return errors.Wrap(err, "random: invalid size")
+		}
+		size = b
+	}
+	if size < 0 {
+		return errors.New("random: size must be positive")
+	}
+	s.size = int64(size)
+	return nil
+}
+
+// Backup returns the data generated from the seed
+func (s *Source) Backup(ctx *context.Context) (io.ReadCloser, error) {
+	return ioutil.NopCloser(s.generate()), nil
+}
+
+// Restore verifies that data from r is identical to the data generated from
+// the seed
+func (s *Source) Restore(ctx *context.Context, r io.Reader) error {
+	expect := s.generate()
+	got := make([]byte, bufferSize)
+	want := make([]byte, bufferSize)
+
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, got)
+		switch err {
+		case nil, io.EOF, io.ErrUnexpectedEOF:
+		default:
+			return errors.Wrap(err, "cannot read data")
+		}
+		m, _ := io.ReadFull(expect, want[:n])
+		if i := mismatch(got[:m], want[:m]); i >= 0 {
+			return errors.Errorf("random: data differs at offset %d", offset+int64(i))
+		}
+		if m < n {
+			return errors.Errorf("random: data is longer than %d bytes", s.size)
+		}
+		offset += int64(n)
+		if err != nil {
+			break
+		}
+	}
+	if offset != s.size {
+		return errors.Errorf("random: expect %d bytes, but got %d", s.size, offset)
+	}
+
+	ctx.Info("Data verified", log.Int64("size", offset))
+	return nil
+}
+
+// generate returns a reader of the data generated from the seed
+func (s *Source) generate() io.Reader {
+	return io.LimitReader(rand.New(rand.NewSource(s.Seed)), s.size)
+}
+
+// mismatch returns the index of the first byte which differs between a and b,
+// or -1 when they are equal
+func mismatch(a, b []byte) int {
+	if bytes.Equal(a, b) {
+		return -1
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,75 @@
+package random_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/plugin/source/random"
+)
+
+func TestBackupRestore(t *testing.T) {
+	src := newSource(t, "100 kB", 42)
+	ctx := context.Background()
+
+	data := backup(t, src)
+	if len(data) != 100*1024 {
+		t.Errorf("expect %d bytes, but got %d", 100*1024, len(data))
+	}
+	if err := src.Restore(ctx, bytes.NewReader(data)); err != nil {
+		t.Error("expect data to be verified, but got", err)
+	}
+
+	// Same seed
+	if other := backup(t, newSource(t, "100 kB", 42)); !bytes.Equal(data, other) {
+		t.Error("expect sources with the same seed to generate the same data")
+	}
+
+	// Different seed
+	if other := backup(t, newSource(t, "100 kB", 43)); bytes.Equal(data, other) {
+		t.Error("expect sources with different seeds to generate different data")
+	}
+}
+
+func TestRestoreMismatch(t *testing.T) {
+	src := newSource(t, "100 kB", 42)
+	ctx := context.Background()
+	data := backup(t, src)
+
+	corrupted := append([]byte{}, data...)
+	corrupted[50000] ^= 0xff
+
+	tests := map[string][]byte{
+		"corrupted": corrupted,
+		"truncated": data[:len(data)-1],
+		"longer":    append(append([]byte{}, data...), 0),
+		"empty":     nil,
+	}
+	for name, data := range tests {
+		if err := src.Restore(ctx, bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: expect restore to fail", name)
+		}
+	}
+}
+
+func newSource(t *testing.T, size string, seed int64) *random.Source {
+	src := &random.Source{Size: size, Seed: seed}
+	if err := src.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return src
+}
+
+func backup(t *testing.T, src *random.Source) []byte {
+	r, err := src.Backup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -2,6 +2,12 @@ package all
 
 import (
 	// Import all plugins
+	_ "github.com/stairlin/kargo/plugin/storage/azblob"
 	_ "github.com/stairlin/kargo/plugin/storage/fs"
+	_ "github.com/stairlin/kargo/plugin/storage/gcs"
+	_ "github.com/stairlin/kargo/plugin/storage/memory"
+	_ "github.com/stairlin/kargo/plugin/storage/repo"
 	_ "github.com/stairlin/kargo/plugin/storage/s3"
+	_ "github.com/stairlin/kargo/plugin/storage/sftp"
+	_ "github.com/stairlin/kargo/plugin/storage/webdav"
 )
@@ -0,0 +1,644 @@
+// Package azblob stores backups on Azure Blob Storage
+package azblob
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/pkg/unit"
+	"github.com/stairlin/kargo/plugin/storage"
+)
+
+const (
+	name  = "azblob"
+	slash = "/"
+
+	apiVersion         = "2020-04-08"
+	defaultBlockSize   = unit.MB * 8
+	maxBlockSize       = unit.MB * 4000
+	defaultParallelism = 4
+	maxBlocks          = 50000 // Max blocks per blob
+	maxResults         = 5000  // Azure max items per listing
+
+	// createdAtMeta is the metadata of the creation time of backups. Azure
+	// metadata names must be valid C# identifiers.
+	createdAtMeta = "kargo_created_at"
+)
+
+// Access tiers supported by block blobs
+var tiers = map[string]bool{
+	"Hot":     true,
+	"Cool":    true,
+	"Cold":    true,
+	"Archive": true,
+}
+
+func init() {
+	storage.Add(name, func() storage.Storage {
+		return &Store{}
+	})
+}
+
+// Store is an Azure Blob Storage store
+type Store struct {
+	Account          string `toml:"account"`
+	AccountKey       string `toml:"account_key"`
+	SASToken         string `toml:"sas_token"`
+	ConnectionString string `toml:"connection_string"`
+	Container        string `toml:"container"`
+	Folder           string `toml:"folder"`
+	Endpoint         string `toml:"endpoint"`
+	BlockSize        string `toml:"block_size"`
+	Parallelism      int    `toml:"parallelism"`
+	AccessTier       string `toml:"access_tier"`
+
+	Client *http.Client
+
+	ns        storage.Namespace
+	sharedKey []byte
+	sas       url.Values
+	blockSize int
+}
+
+func (s *Store) Name() string {
+	return name
+}
+
+func (s *Store) Init() error {
+	if s.ConnectionString != "" {
+		if err := s.parseConnectionString(); err != nil {
+			return err
+		}
+	}
+	if s.Account == "" {
+		return errors.New("missing account")
+	}
+	if s.Container == "" {
+		return errors.New("missing container")
+	}
+	ns, err := storage.NewNamespace(s.Folder)
+	if err != nil {
+		return err
+	}
+	s.ns = ns
+	s.Folder = ns.Folder()
+	if s.Endpoint == "" {
+		s.Endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", s.Account)
+	}
+	s.Endpoint = strings.TrimSuffix(s.Endpoint, slash)
+
+	// Authentication
+	switch {
+	case s.AccountKey != "" && s.SASToken != "":
+		return errors.New("account_key and sas_token are mutually exclusive")
+	case s.AccountKey != "":
+		key, err := base64.StdEncoding.DecodeString(s.AccountKey)
+		if err != nil {
+			return errors.Wrap(err, "cannot decode account key")
+		}
+		s.sharedKey = key
+	case s.SASToken != "":
+		sas, err := url.ParseQuery(strings.TrimPrefix(s.SASToken, "?"))
+		if err != nil {
+			return errors.Wrap(err, "cannot parse SAS token")
+		}
+		s.sas = sas
+	default:
+		return errors.New("there must be an account key, a SAS token or a connection string")
+	}
+
+	blockSize := defaultBlockSize
+	if s.BlockSize != "" {
+		b, err := unit.ParseByte(s.BlockSize)
+		if err != nil {
+			return errors.Wrap(err, "invalid block size")
+		}
+		blockSize = b
+	}
+	if blockSize < 1 || blockSize > maxBlockSize {
+		return errors.Errorf("block size must be between 1 B and %s", maxBlockSize)
+	}
+	s.blockSize = int(blockSize)
+
+	if s.Parallelism == 0 {
+		s.Parallelism = defaultParallelism
+	}
+	if s.Parallelism < 0 {
+		return errors.New("parallelism must be positive")
+	}
+	if s.AccessTier != "" && !tiers[s.AccessTier] {
+		return errors.Errorf("invalid access tier %s", s.AccessTier)
+	}
+	if s.Client == nil {
+		s.Client = http.DefaultClient
+	}
+	return nil
+}
+
+func (s *Store) Info(ctx *context.Context, key string) (os.FileInfo, error) {
+	name, err := s.ns.Name(key)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.do(ctx, "HEAD", s.blobURL(name, nil), nil, nil)
+	if err != nil {
+		if err == storage.ErrKeyNotFound {
+			return nil, err
+		}
+		return nil, errors.Wrap(err, "cannot get data from Azure")
+	}
+	res.Body.Close()
+	return s.responseInfo(name, res), nil
+}
+
+// Push streams data as a block blob. Blocks are uploaded in parallel, and
+// then committed at once, so a failed push does not alter an existing blob.
+func (s *Store) Push(ctx *context.Context, key string, r io.Reader) error {
+	return s.PushMeta(ctx, key, r, &storage.Meta{CreatedAt: time.Now()})
+}
+
+// PushMeta pushes data from r, and records the creation time of the backup
+// in the metadata of the blob
+func (s *Store) PushMeta(
+	ctx *context.Context, key string, r io.Reader, meta *storage.Meta,
+) error {
+	name, err := s.ns.Name(key)
+	if err != nil {
+		return err
+	}
+
+	pool := make(chan []byte, s.Parallelism)
+	for i := 0; i < s.Parallelism; i++ {
+		pool <- make([]byte, s.blockSize)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var uploadErr error
+	setErr := func(err error) {
+		mu.Lock()
+		if uploadErr == nil {
+			uploadErr = err
+		}
+		mu.Unlock()
+	}
+	getErr := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return uploadErr
+	}
+
+	var ids []string
+	for i := 0; ; i++ {
+		buf := <-pool
+		if getErr() != nil {
+			break
+		}
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			setErr(errors.Wrap(err, "cannot read data"))
+			break
+		}
+		if i >= maxBlocks {
+			setErr(errors.Errorf("too many blocks (max %d), increase block_size", maxBlocks))
+			break
+		}
+
+		id := blockID(i)
+		ids = append(ids, id)
+		wg.Add(1)
+		go func(buf []byte, id string) {
+			defer wg.Done()
+			defer func() { pool <- buf }()
+			if err := s.putBlock(ctx, name, id, buf); err != nil {
+				setErr(err)
+			}
+		}(buf[:n], id)
+
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	wg.Wait()
+	if err := getErr(); err != nil {
+		return err
+	}
+	return s.putBlockList(ctx, name, ids, meta)
+}
+
+func (s *Store) Pull(
+	ctx *context.Context, key string,
+) (io.ReadCloser, os.FileInfo, error) {
+	name, err := s.ns.Name(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	res, err := s.do(ctx, "GET", s.blobURL(name, nil), nil, nil)
+	if err != nil {
+		if err == storage.ErrKeyNotFound {
+			return nil, nil, err
+		}
+		return nil, nil, errors.Wrap(err, "cannot get data from Azure")
+	}
+	return res.Body, s.responseInfo(name, res), nil
+}
+
+func (s *Store) Delete(ctx *context.Context, key string) error {
+	name, err := s.ns.Name(key)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(ctx, "DELETE", s.blobURL(name, nil), nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *Store) Walk(
+	ctx *context.Context,
+	filter *storage.WalkFilter,
+	walkFn func(key string, f os.FileInfo, err error) error,
+) {
+	q := url.Values{}
+	q.Set("restype", "container")
+	q.Set("comp", "list")
+	q.Set("prefix", s.ns.Prefix(filter.Prefix))
+	q.Set("maxresults", strconv.Itoa(maxResults))
+	q.Set("include", "metadata")
+
+	var infos []*info
+	for {
+		var out struct {
+			Blobs []struct {
+				Name       string `xml:"Name"`
+				Properties struct {
+					LastModified  string `xml:"Last-Modified"`
+					ContentLength int64  `xml:"Content-Length"`
+				} `xml:"Properties"`
+				Metadata struct {
+					CreatedAt string `xml:"kargo_created_at"`
+				} `xml:"Metadata"`
+			} `xml:"Blobs>Blob"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		u := s.containerURL(q)
+		res, err := s.do(ctx, "GET", u, nil, nil)
+		if err == nil {
+			err = xml.NewDecoder(res.Body).Decode(&out)
+			res.Body.Close()
+		}
+		if err != nil {
+			walkFn("", nil, errors.Wrap(err, "cannot list backups from Azure"))
+			return
+		}
+
+		for _, b := range out.Blobs {
+			key, ok := s.ns.Key(b.Name)
+			if !ok {
+				continue
+			}
+			modTime, _ := http.ParseTime(b.Properties.LastModified)
+			createdAt, _ := time.Parse(storage.MetaTimeFormat, b.Metadata.CreatedAt)
+			info := &info{
+				name:      key,
+				size:      b.Properties.ContentLength,
+				modTime:   modTime,
+				createdAt: createdAt,
+			}
+			if isBetween(filter, info.ModTime().UnixNano()) &&
+				matches(filter, info.Name()) {
+				infos = append(infos, info)
+			}
+		}
+
+		if out.NextMarker == "" {
+			break
+		}
+		q.Set("marker", out.NextMarker)
+	}
+
+	// Sort items, and keep the most recent ones
+	sort.Sort(byModTimeDesc(infos))
+	if filter.Limit > 0 && len(infos) > int(filter.Limit) {
+		infos = infos[:filter.Limit]
+	}
+
+	for _, info := range infos {
+		if err := walkFn(info.Name(), info, nil); err != nil {
+			return
+		}
+	}
+}
+
+// putBlock uploads an uncommitted block of the blob name
+func (s *Store) putBlock(ctx *context.Context, name, id string, data []byte) error {
+	q := url.Values{}
+	q.Set("comp", "block")
+	q.Set("blockid", id)
+	res, err := s.do(ctx, "PUT", s.blobURL(name, q), nil, data)
+	if err != nil {
+		return errors.Wrap(err, "cannot upload block to Azure")
+	}
+	res.Body.Close()
+	return nil
+}
+
+// putBlockList commits the given blocks as the content of the blob name
+func (s *Store) putBlockList(
+	ctx *context.Context, name string, ids []string, meta *storage.Meta,
+) error {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString("<BlockList>")
+	for _, id := range ids {
+		buf.WriteString("<Latest>" + id + "</Latest>")
+	}
+	buf.WriteString("</BlockList>")
+
+	q := url.Values{}
+	q.Set("comp", "blocklist")
+	header := http.Header{}
+	header.Set("Content-Type", "application/xml")
+	if s.AccessTier != "" {
+		header.Set("x-ms-access-tier", s.AccessTier)
+	}
+	if !meta.CreatedAt.IsZero() {
+		header.Set("x-ms-meta-"+createdAtMeta, meta.CreatedAt.UTC().Format(storage.MetaTimeFormat))
+	}
+	res, err := s.do(ctx, "PUT", s.blobURL(name, q), header, buf.Bytes())
+	if err != nil {
+		return errors.Wrap(err, "cannot commit blob to Azure")
+	}
+	res.Body.Close()
+	return nil
+}
+
+// do sends a request, and returns an error when its response is not successful
+func (s *Store) do(
+	ctx *context.Context, method, u string, header http.Header, body []byte,
+) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("x-ms-version", apiVersion)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	if s.sharedKey != nil {
+		req.Header.Set("Authorization", s.sign(req))
+	}
+
+	res, err := s.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound &&
+		res.Header.Get("x-ms-error-code") != "ContainerNotFound" {
+		return nil, storage.ErrKeyNotFound
+	}
+
+	var out struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<16))
+	if err := xml.Unmarshal(b, &out); err == nil && out.Code != "" {
+		return nil, errors.Errorf("%s: %s (%s)",
+			out.Code, strings.SplitN(out.Message, "\n", 2)[0], res.Status,
+		)
+	}
+	if code := res.Header.Get("x-ms-error-code"); code != "" {
+		return nil, errors.Errorf("%s (%s)", code, res.Status)
+	}
+	return nil, errors.New(res.Status)
+}
+
+// sign returns the Shared Key authorization header of req
+//
+// https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func (s *Store) sign(req *http.Request) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	// Canonicalized headers
+	var headers []string
+	for k := range req.Header {
+		if k := strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			headers = append(headers, k)
+		}
+	}
+	sort.Strings(headers)
+	var canonicalHeaders bytes.Buffer
+	for _, k := range headers {
+		canonicalHeaders.WriteString(k + ":" + strings.TrimSpace(req.Header.Get(k)) + "\n")
+	}
+
+	// Canonicalized resource
+	resource := "/" + s.Account + req.URL.EscapedPath()
+	q := req.URL.Query()
+	var params []string
+	for k := range q {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	for _, k := range params {
+		values := q[k]
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(k) + ":" + strings.Join(values, ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date (x-ms-date is used instead)
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}, "\n") + "\n" + canonicalHeaders.String() + resource
+
+	h := hmac.New(sha256.New, s.sharedKey)
+	h.Write([]byte(stringToSign))
+	return "SharedKey " + s.Account + ":" +
+		base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// parseConnectionString sets the account, credentials and endpoint from the
+// connection string
+func (s *Store) parseConnectionString() error {
+	conf := map[string]string{}
+	for _, part := range strings.Split(s.ConnectionString, ";") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return errors.New("invalid connection string")
+		}
+		conf[kv[0]] = kv[1]
+	}
+
+	if v := conf["AccountName"]; v != "" {
+		s.Account = v
+	}
+	if v := conf["AccountKey"]; v != "" {
+		s.AccountKey = v
+	}
+	if v := conf["SharedAccessSignature"]; v != "" {
+		s.SASToken = v
+	}
+	switch {
+	case conf["BlobEndpoint"] != "":
+		s.Endpoint = conf["BlobEndpoint"]
+	case s.Account != "" && conf["EndpointSuffix"] != "":
+		protocol := conf["DefaultEndpointsProtocol"]
+		if protocol == "" {
+			protocol = "https"
+		}
+		s.Endpoint = fmt.Sprintf(
+			"%s://%s.blob.%s", protocol, s.Account, conf["EndpointSuffix"],
+		)
+	}
+	return nil
+}
+
+func (s *Store) containerURL(q url.Values) string {
+	return s.url(url.PathEscape(s.Container), q)
+}
+
+func (s *Store) blobURL(name string, q url.Values) string {
+	segments := strings.Split(name, slash)
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+	return s.url(url.PathEscape(s.Container)+slash+strings.Join(segments, slash), q)
+}
+
+func (s *Store) url(p string, q url.Values) string {
+	if q == nil {
+		q = url.Values{}
+	}
+	for k, v := range s.sas {
+		q[k] = v
+	}
+	u := s.Endpoint + slash + p
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	return u
+}
+
+// blockID returns the ID of the i-th block. All IDs of a blob must have the
+// same length.
+func blockID(i int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", i)))
+}
+
+func (s *Store) responseInfo(name string, res *http.Response) *info {
+	key, _ := s.ns.Key(name)
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	createdAt, _ := time.Parse(
+		storage.MetaTimeFormat, res.Header.Get("x-ms-meta-"+createdAtMeta),
+	)
+	return &info{
+		name:      key,
+		size:      res.ContentLength,
+		modTime:   modTime,
+		createdAt: createdAt,
+	}
+}
+
+// info wraps an Azure blob to a struct that implements os.FileInfo
+type info struct {
+	name      string
+	size      int64
+	modTime   time.Time
+	createdAt time.Time
+}
+
+// base name of the file
+func (i *info) Name() string {
+	return i.name
+}
+
+// length in bytes for regular files; system-dependent for others
+func (i *info) Size() int64 {
+	return i.size
+}
+
+// file mode bits
+func (i *info) Mode() os.FileMode {
+	return os.ModePerm
+}
+
+// modification time
+func (i *info) ModTime() time.Time {
+	return i.modTime
+}
+
+// abbreviation for Mode().IsDir()
+func (i *info) IsDir() bool {
+	return false
+}
+
+// underlying data source (can return nil)
+func (i *info) Sys() interface{} {
+	return nil
+}
+
+// CreatedAt returns the creation time of the backup
+func (i *info) CreatedAt() time.Time {
+	return i.createdAt
+}
+
+func isBetween(f *storage.WalkFilter, t int64) bool {
+	return t >= f.From && t <= f.To
+}
+
+func matches(f *storage.WalkFilter, name string) bool {
+	return strings.HasPrefix(name, f.Prefix) &&
+		(f.Pattern == nil || f.Pattern.MatchString(name))
+}
+
+type byModTimeDesc []*info
+
+func (l byModTimeDesc) Len() int      { return len(l) }
+func (l byModTimeDesc) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l byModTimeDesc) Less(i, j int) bool {
+	return l[i].modTime.UnixNano() > l[j].modTime.UnixNano()
+}
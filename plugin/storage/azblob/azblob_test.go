@@ -0,0 +1,406 @@
+package azblob_test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/pkg/testutil"
+	"github.com/stairlin/kargo/pkg/unit"
+	"github.com/stairlin/kargo/plugin/storage"
+	"github.com/stairlin/kargo/plugin/storage/azblob"
+	"github.com/stairlin/kargo/plugin/storage/storagetest"
+)
+
+const (
+	// Well-known Azurite development account
+	account    = "devstoreaccount1"
+	accountKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+	sasToken   = "sv=2020-04-08&ss=b&srt=co&sp=rwdlac&sig=secret"
+)
+
+func TestVerbatim(t *testing.T) {
+	fake := newFakeServer()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store := newStore(t, &azblob.Store{
+		Account:    account,
+		AccountKey: accountKey,
+		Endpoint:   server.URL + "/" + account,
+	})
+
+	ctx := context.Background()
+	table := []int{0, 1, 64 * int(unit.KB), 5*64*int(unit.KB) + 42}
+	for _, size := range table {
+		expect := testutil.GenRandBytes(t, size)
+		key := fmt.Sprintf("foo/%d", size)
+		if err := store.Push(ctx, key, bytes.NewReader(expect)); err != nil {
+			t.Fatal("Error pushing data to storage", err)
+		}
+		out, info, err := store.Pull(ctx, key)
+		if err != nil {
+			t.Fatal("Error pulling data from storage", err)
+		}
+		got, err := ioutil.ReadAll(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.Close()
+		if !bytes.Equal(expect, got) {
+			t.Errorf("%d: expect text %s, but got %s", size,
+				testutil.Truncate(expect, 140), testutil.Truncate(got, 140),
+			)
+		}
+		if info.Name() != key || info.Size() != int64(size) {
+			t.Errorf("expect info %s (%d), but got %s (%d)",
+				key, size, info.Name(), info.Size(),
+			)
+		}
+	}
+
+	b := fake.blob("kargo/backups/foo/1")
+	if b == nil {
+		t.Fatal("expect blob to be stored in the folder")
+	}
+	if b.tier != "Cool" {
+		t.Errorf("expect access tier Cool, but got %s", b.tier)
+	}
+	if n := len(fake.blob("kargo/backups/foo/327722").blocks); n != 6 {
+		t.Errorf("expect 6 blocks, but got %d", n)
+	}
+}
+
+func TestSASToken(t *testing.T) {
+	fake := newFakeServer()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store := newStore(t, &azblob.Store{
+		Account:  account,
+		SASToken: "?" + sasToken,
+		Endpoint: server.URL + "/" + account,
+	})
+
+	ctx := context.Background()
+	if err := store.Push(ctx, "foo", bytes.NewReader([]byte("bar"))); err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+	if _, err := store.Info(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnectionString(t *testing.T) {
+	fake := newFakeServer()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store := newStore(t, &azblob.Store{
+		ConnectionString: fmt.Sprintf(
+			"DefaultEndpointsProtocol=http;AccountName=%s;AccountKey=%s;BlobEndpoint=%s/%s;",
+			account, accountKey, server.URL, account,
+		),
+	})
+
+	ctx := context.Background()
+	if err := store.Push(ctx, "foo", bytes.NewReader([]byte("bar"))); err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+	if _, err := store.Info(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBadAccountKey(t *testing.T) {
+	fake := newFakeServer()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store := newStore(t, &azblob.Store{
+		Account:    account,
+		AccountKey: base64.StdEncoding.EncodeToString([]byte("wrong")),
+		Endpoint:   server.URL + "/" + account,
+	})
+
+	ctx := context.Background()
+	if err := store.Push(ctx, "foo", bytes.NewReader([]byte("bar"))); err == nil {
+		t.Error("expect push with a wrong account key to fail")
+	}
+	if fake.blob("kargo/backups/foo") != nil {
+		t.Error("expect blob not to be committed")
+	}
+}
+
+func TestWalk(t *testing.T) {
+	fake := newFakeServer()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store := newStore(t, &azblob.Store{
+		Account:    account,
+		AccountKey: accountKey,
+		Endpoint:   server.URL + "/" + account,
+	})
+
+	ctx := context.Background()
+	expect := []string{"e", "d", "c", "b", "a"}
+	for i := len(expect) - 1; i >= 0; i-- {
+		if err := store.Push(ctx, expect[i], bytes.NewReader([]byte("foo"))); err != nil {
+			t.Fatal("Error pushing data to storage", err)
+		}
+	}
+
+	var keys []string
+	filter := storage.WalkFilter{To: math.MaxInt64}
+	store.Walk(ctx, &filter, func(key string, f os.FileInfo, err error) error {
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if strings.Join(keys, ",") != strings.Join(expect, ",") {
+		t.Errorf("expect keys %v, but got %v", expect, keys)
+	}
+
+	// Info/Delete
+	if err := store.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Info(ctx, "a"); err != storage.ErrKeyNotFound {
+		t.Errorf("expect error %s, but got %v", storage.ErrKeyNotFound, err)
+	}
+	if _, _, err := store.Pull(ctx, "a"); err != storage.ErrKeyNotFound {
+		t.Errorf("expect error %s, but got %v", storage.ErrKeyNotFound, err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	server := httptest.NewServer(newFakeServer())
+	defer server.Close()
+
+	var i int
+	storagetest.Run(t, func() storage.Storage {
+		i++
+		return &azblob.Store{
+			Account:     account,
+			AccountKey:  accountKey,
+			Endpoint:    server.URL + "/" + account,
+			Container:   "kargo",
+			Folder:      strconv.Itoa(i),
+			BlockSize:   "64 kB",
+			Parallelism: 3,
+		}
+	})
+}
+
+func newStore(t *testing.T, store *azblob.Store) *azblob.Store {
+	store.Container = "kargo"
+	store.Folder = "backups"
+	store.BlockSize = "64 kB"
+	store.Parallelism = 3
+	store.AccessTier = "Cool"
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// fakeServer is an in-memory stand-in of Azurite
+type fakeServer struct {
+	mu          sync.Mutex
+	blobs       map[string]*fakeBlob
+	uncommitted map[string]map[string][]byte
+	clock       time.Time
+}
+
+type fakeBlob struct {
+	data    []byte
+	blocks  []string
+	tier    string
+	modTime time.Time
+	// createdAt is the metadata of the creation time of the backup
+	createdAt string
+}
+
+func newFakeServer() *fakeServer {
+	return &fakeServer{
+		blobs:       map[string]*fakeBlob{},
+		uncommitted: map[string]map[string][]byte{},
+		clock:       time.Now(),
+	}
+}
+
+func (s *fakeServer) blob(name string) *fakeBlob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.blobs[name]
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("x-ms-error-code", "AuthenticationFailed")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// e.g. /devstoreaccount1/kargo/backups/foo
+	p := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"+account+"/"), "/", 2)
+	q := r.URL.Query()
+	switch {
+	case len(p) == 1 && q.Get("comp") == "list":
+		s.list(w, r, p[0])
+		return
+	case len(p) != 2:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	name := p[0] + "/" + p[1]
+	switch {
+	case r.Method == "PUT" && q.Get("comp") == "block":
+		if s.uncommitted[name] == nil {
+			s.uncommitted[name] = map[string][]byte{}
+		}
+		s.uncommitted[name][q.Get("blockid")], _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "PUT" && q.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string `xml:"Latest"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&list); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.clock = s.clock.Add(time.Second)
+		b := &fakeBlob{
+			blocks:    list.Latest,
+			tier:      r.Header.Get("x-ms-access-tier"),
+			modTime:   s.clock,
+			createdAt: r.Header.Get("x-ms-meta-kargo_created_at"),
+		}
+		for _, id := range list.Latest {
+			data, ok := s.uncommitted[name][id]
+			if !ok {
+				w.Header().Set("x-ms-error-code", "InvalidBlockList")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			b.data = append(b.data, data...)
+		}
+		delete(s.uncommitted, name)
+		s.blobs[name] = b
+		w.WriteHeader(http.StatusCreated)
+	default:
+		b, ok := s.blobs[name]
+		if !ok {
+			w.Header().Set("x-ms-error-code", "BlobNotFound")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case "DELETE":
+			delete(s.blobs, name)
+			w.WriteHeader(http.StatusAccepted)
+		case "HEAD", "GET":
+			w.Header().Set("Content-Length", strconv.Itoa(len(b.data)))
+			w.Header().Set("Last-Modified", b.modTime.UTC().Format(http.TimeFormat))
+			if b.createdAt != "" {
+				w.Header().Set("x-ms-meta-kargo_created_at", b.createdAt)
+			}
+			w.Write(b.data)
+		}
+	}
+}
+
+// list returns blobs by pages of 2
+func (s *fakeServer) list(w http.ResponseWriter, r *http.Request, container string) {
+	prefix := container + "/" + r.URL.Query().Get("prefix")
+	var names []string
+	for name := range s.blobs {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	start, _ := strconv.Atoi(r.URL.Query().Get("marker"))
+	var buf bytes.Buffer
+	buf.WriteString("<EnumerationResults><Blobs>")
+	for i := start; i < len(names) && i < start+2; i++ {
+		b := s.blobs[names[i]]
+		fmt.Fprintf(&buf, "<Blob><Name>%s</Name><Properties>"+
+			"<Last-Modified>%s</Last-Modified><Content-Length>%d</Content-Length>"+
+			"</Properties>",
+			strings.TrimPrefix(names[i], container+"/"),
+			b.modTime.UTC().Format(http.TimeFormat), len(b.data),
+		)
+		if r.URL.Query().Get("include") == "metadata" && b.createdAt != "" {
+			fmt.Fprintf(&buf, "<Metadata><kargo_created_at>%s</kargo_created_at></Metadata>",
+				b.createdAt,
+			)
+		}
+		buf.WriteString("</Blob>")
+	}
+	buf.WriteString("</Blobs><NextMarker>")
+	if start+2 < len(names) {
+		buf.WriteString(strconv.Itoa(start + 2))
+	}
+	buf.WriteString("</NextMarker></EnumerationResults>")
+	w.Write(buf.Bytes())
+}
+
+// authorized checks either the SAS token or the Shared Key signature
+func (s *fakeServer) authorized(r *http.Request) bool {
+	if r.URL.Query().Get("sig") != "" {
+		sas, _ := url.ParseQuery(sasToken)
+		return r.URL.Query().Get("sig") == sas.Get("sig")
+	}
+	if r.Header.Get("x-ms-version") == "" || r.Header.Get("x-ms-date") == "" {
+		return false
+	}
+
+	var headers []string
+	for k := range r.Header {
+		if k := strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			headers = append(headers, k+":"+r.Header.Get(k)+"\n")
+		}
+	}
+	sort.Strings(headers)
+	q := r.URL.Query()
+	var params []string
+	for k := range q {
+		params = append(params, "\n"+k+":"+strings.Join(q[k], ","))
+	}
+	sort.Strings(params)
+
+	contentLength := r.Header.Get("Content-Length")
+	if contentLength == "0" {
+		contentLength = ""
+	}
+	stringToSign := r.Method + "\n\n\n" + contentLength + "\n\n" +
+		r.Header.Get("Content-Type") + "\n\n\n\n\n\n\n" +
+		strings.Join(headers, "") +
+		"/" + account + r.URL.EscapedPath() + strings.Join(params, "")
+
+	key, _ := base64.StdEncoding.DecodeString(accountKey)
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(stringToSign))
+	expect := "SharedKey " + account + ":" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+	return r.Header.Get("Authorization") == expect
+}
@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/log"
+)
+
+const (
+	// DefaultPartSize is the default size of the parts of a download
+	DefaultPartSize = 16 << 20
+	// DefaultConcurrency is the default number of parts downloaded in parallel
+	DefaultConcurrency = 4
+	// DefaultRetries is the default number of retries of a part
+	DefaultRetries = 5
+
+	// md5Prefix is the prefix of MD5 checksums (see ChecksumInfo)
+	md5Prefix = "md5:"
+)
+
+// RangePuller is implemented by storages which can pull a part of a key
+type RangePuller interface {
+	// PullRange pulls length bytes of key starting at offset. A negative
+	// length pulls data until the end of the key. When version is set, it
+	// fails with ErrVersionChanged unless the key still has this version.
+	PullRange(
+		ctx *context.Context, key, version string, offset, length int64,
+	) (io.ReadCloser, error)
+}
+
+// Downloader pulls keys by parts, which are downloaded in parallel and
+// retried independently. When a part fails, it resumes from the last byte
+// received, so a dropped connection does not restart the whole download.
+//
+// Parts are pulled from the version of the key read before the download
+// (see VersionInfo), so a key overwritten meanwhile fails the download with
+// ErrVersionChanged, instead of mixing both versions. When the storage
+// exposes the MD5 checksum of the key (see ChecksumInfo), the data is
+// verified once it has been read.
+//
+// Storages which do not implement RangePuller are pulled sequentially.
+type Downloader struct {
+	// PartSize is the size of each part
+	PartSize int64
+	// Concurrency is the number of parts downloaded in parallel. It also
+	// bounds the number of parts buffered in memory.
+	Concurrency int
+	// Retries is the number of times a part is retried before failing
+	Retries int
+	// Backoff is the delay before the first retry of a part. It doubles on
+	// every retry.
+	Backoff time.Duration
+	// Throttle wraps the data of each request (optional). Parts are buffered
+	// ahead of the reader, so data must be throttled as it is received.
+	Throttle func(ctx *context.Context, r io.ReadCloser) io.ReadCloser
+}
+
+// NewDownloader returns a downloader with the default settings
+func NewDownloader() *Downloader {
+	return &Downloader{
+		PartSize:    DefaultPartSize,
+		Concurrency: DefaultConcurrency,
+		Retries:     DefaultRetries,
+		Backoff:     time.Second,
+	}
+}
+
+// Pull pulls key from s, and returns a reader of its data
+func (d *Downloader) Pull(
+	ctx *context.Context, s Storage, key string,
+) (io.ReadCloser, os.FileInfo, error) {
+	rp, ok := s.(RangePuller)
+	if !ok {
+		r, info, err := s.Pull(ctx, key)
+		if err != nil || d.Throttle == nil {
+			return r, info, err
+		}
+		return d.Throttle(ctx, r), info, nil
+	}
+	if d.PartSize <= 0 || d.Concurrency <= 0 || d.Retries < 0 {
+		return nil, nil, errors.New("invalid downloader settings")
+	}
+	info, err := s.Info(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var version string
+	if v, ok := info.(VersionInfo); ok {
+		version = v.Version()
+	}
+
+	parts := int((info.Size() + d.PartSize - 1) / d.PartSize)
+	pctx, cancel := context.WithCancel(ctx)
+	r := &partReader{
+		ctx:     pctx,
+		cancel:  cancel,
+		results: make([]chan *part, parts),
+		slots:   make(chan struct{}, d.Concurrency),
+	}
+	if c, ok := info.(ChecksumInfo); ok && strings.HasPrefix(c.Checksum(), md5Prefix) {
+		r.checksum = c.Checksum()
+		r.hash = md5.New()
+	}
+	for i := range r.results {
+		r.results[i] = make(chan *part, 1)
+	}
+
+	go func() {
+		for i := 0; i < parts; i++ {
+			select {
+			case r.slots <- struct{}{}:
+			case <-pctx.Done():
+				return
+			}
+			offset := int64(i) * d.PartSize
+			length := d.PartSize
+			if offset+length > info.Size() {
+				length = info.Size() - offset
+			}
+			go func(i int) {
+				data, err := d.pullPart(pctx, rp, key, version, offset, length)
+				r.results[i] <- &part{data: data, err: err}
+			}(i)
+		}
+	}()
+	return r, info, nil
+}
+
+// pullPart pulls a part of a version of key, and retries it from the last
+// byte received when it fails
+func (d *Downloader) pullPart(
+	ctx *context.Context, rp RangePuller, key, version string, offset, length int64,
+) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, length))
+	backoff := d.Backoff
+	for retry := 0; ; retry++ {
+		received := int64(buf.Len())
+		err := func() error {
+			r, err := rp.PullRange(ctx, key, version, offset+received, length-received)
+			if err != nil {
+				return err
+			}
+			if d.Throttle != nil {
+				r = d.Throttle(ctx, r)
+			}
+			defer r.Close()
+			_, err = io.Copy(buf, io.LimitReader(r, length-received))
+			return err
+		}()
+		if err == nil && int64(buf.Len()) < length {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			return buf.Bytes(), nil
+		}
+		cause := errors.Cause(err)
+		if retry == d.Retries || cause == ErrKeyNotFound ||
+			cause == ErrNotAvailable || cause == ErrVersionChanged || ctx.Err() != nil {
+			return nil, errors.Wrapf(err, "cannot pull part at offset %d", offset)
+		}
+
+		ctx.Warn("Pulling part failed. Retrying...",
+			log.Int64("offset", offset+int64(buf.Len())),
+			log.Int("retry", retry+1),
+			log.Error(err),
+		)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "cannot pull part at offset %d", offset)
+		}
+		backoff *= 2
+	}
+}
+
+// part is a downloaded part
+type part struct {
+	data []byte
+	err  error
+}
+
+// partReader reads parts in order as they are downloaded
+type partReader struct {
+	ctx     *context.Context
+	cancel  func()
+	results []chan *part
+	slots   chan struct{}
+	// checksum is the MD5 checksum of the key, which hash verifies
+	checksum string
+	hash     hash.Hash
+
+	mu      sync.Mutex
+	current *part
+	next    int
+	err     error
+}
+
+func (r *partReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.current == nil || len(r.current.data) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.current != nil {
+			// Free a slot for the next part
+			r.current = nil
+			<-r.slots
+		}
+		if r.next == len(r.results) {
+			r.err = r.verify()
+			continue
+		}
+		select {
+		case r.current = <-r.results[r.next]:
+		case <-r.ctx.Done():
+			r.err = r.ctx.Err()
+			continue
+		}
+		r.next++
+		if r.current.err != nil {
+			r.err = r.current.err
+			r.cancel()
+		}
+	}
+	n := copy(p, r.current.data)
+	if r.hash != nil {
+		r.hash.Write(p[:n])
+	}
+	r.current.data = r.current.data[n:]
+	return n, nil
+}
+
+// verify returns io.EOF when the data read matches the checksum of the key
+func (r *partReader) verify() error {
+	if r.hash == nil {
+		return io.EOF
+	}
+	sum := md5Prefix + hex.EncodeToString(r.hash.Sum(nil))
+	if sum != r.checksum {
+		return errors.Errorf("expect checksum %s, but got %s", r.checksum, sum)
+	}
+	return io.EOF
+}
+
+// Close stops the download
+func (r *partReader) Close() error {
+	r.cancel()
+	return nil
+}
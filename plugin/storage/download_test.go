@@ -0,0 +1,292 @@
+package storage_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/pkg/testutil"
+	"github.com/stairlin/kargo/plugin/storage"
+	"github.com/stairlin/kargo/plugin/storage/memory"
+)
+
+func TestDownloader(t *testing.T) {
+	const partSize = 64 << 10
+	sizes := []int{0, 1, partSize - 1, partSize, partSize * 5, partSize*7 + 123}
+	for _, size := range sizes {
+		store := newMemoryStore(t)
+		data := testutil.GenRandBytes(t, size)
+		pushData(t, store, "foo", data)
+
+		d := &storage.Downloader{PartSize: partSize, Concurrency: 3, Retries: 0}
+		got := download(t, d, store, "foo")
+		if !bytes.Equal(data, got) {
+			t.Errorf("%d: expect data (%d) %s, but got (%d) %s", size,
+				len(data), testutil.Truncate(data, 140),
+				len(got), testutil.Truncate(got, 140),
+			)
+		}
+	}
+}
+
+func TestDownloaderRetry(t *testing.T) {
+	store := &flakyStore{Store: newMemoryStore(t), failures: 3, after: 1000}
+	data := testutil.GenRandBytes(t, 300<<10)
+	pushData(t, store, "foo", data)
+
+	d := &storage.Downloader{
+		PartSize:    64 << 10,
+		Concurrency: 2,
+		Retries:     3,
+		Backoff:     time.Millisecond,
+	}
+	got := download(t, d, store, "foo")
+	if !bytes.Equal(data, got) {
+		t.Errorf("expect data (%d) %s, but got (%d) %s",
+			len(data), testutil.Truncate(data, 140),
+			len(got), testutil.Truncate(got, 140),
+		)
+	}
+	// 5 parts + 3 failures
+	if store.calls != 8 {
+		t.Errorf("expect 8 range pulls, but got %d", store.calls)
+	}
+	// Parts are resumed from the last byte received
+	if store.transferred != int64(len(data)) {
+		t.Errorf("expect %d bytes to be transferred, but got %d",
+			len(data), store.transferred,
+		)
+	}
+}
+
+func TestDownloaderFailure(t *testing.T) {
+	store := &flakyStore{Store: newMemoryStore(t), failures: 100, after: 1000}
+	pushData(t, store, "foo", testutil.GenRandBytes(t, 300<<10))
+
+	d := &storage.Downloader{
+		PartSize:    64 << 10,
+		Concurrency: 2,
+		Retries:     2,
+		Backoff:     time.Millisecond,
+	}
+	r, _, err := d.Pull(context.Background(), store, "foo")
+	if err != nil {
+		t.Fatal("cannot pull key", err)
+	}
+	defer r.Close()
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("expect download to fail once retries are exhausted")
+	}
+
+	if _, _, err := d.Pull(context.Background(), store, "bar"); err != storage.ErrKeyNotFound {
+		t.Errorf("expect error %s, but got %v", storage.ErrKeyNotFound, err)
+	}
+}
+
+func TestDownloaderChecksum(t *testing.T) {
+	store := &corruptStore{Store: newMemoryStore(t)}
+	pushData(t, store, "foo", testutil.GenRandBytes(t, 300<<10))
+
+	d := &storage.Downloader{PartSize: 64 << 10, Concurrency: 2}
+	r, _, err := d.Pull(context.Background(), store, "foo")
+	if err != nil {
+		t.Fatal("cannot pull key", err)
+	}
+	defer r.Close()
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("expect corrupted data not to match the checksum")
+	}
+}
+
+func TestDownloaderFallback(t *testing.T) {
+	// Embedding the interface hides PullRange
+	store := struct{ storage.Storage }{newMemoryStore(t)}
+	if _, ok := interface{}(store).(storage.RangePuller); ok {
+		t.Fatal("expect store not to implement RangePuller")
+	}
+	data := testutil.GenRandBytes(t, 300<<10)
+	pushData(t, store, "foo", data)
+
+	got := download(t, storage.NewDownloader(), store, "foo")
+	if !bytes.Equal(data, got) {
+		t.Errorf("expect data (%d) %s, but got (%d) %s",
+			len(data), testutil.Truncate(data, 140),
+			len(got), testutil.Truncate(got, 140),
+		)
+	}
+}
+
+func TestDownloaderThrottle(t *testing.T) {
+	data := testutil.GenRandBytes(t, 300<<10)
+	table := []struct {
+		name  string
+		store storage.Storage
+		calls int
+	}{
+		{name: "range", store: newMemoryStore(t), calls: 5},
+		{name: "fallback", store: struct{ storage.Storage }{newMemoryStore(t)}, calls: 1},
+	}
+	for _, test := range table {
+		pushData(t, test.store, "foo", data)
+
+		// The throttle must see each request, rather than the parts buffered
+		var mu sync.Mutex
+		var calls int
+		counter := &countReader{}
+		d := &storage.Downloader{PartSize: 64 << 10, Concurrency: 2}
+		d.Throttle = func(ctx *context.Context, r io.ReadCloser) io.ReadCloser {
+			mu.Lock()
+			calls++
+			mu.Unlock()
+			return &countReader{ReadCloser: r, parent: counter}
+		}
+		if got := download(t, d, test.store, "foo"); !bytes.Equal(data, got) {
+			t.Errorf("%s: expect throttled data to match pulled data", test.name)
+		}
+		if calls != test.calls {
+			t.Errorf("%s: expect %d throttled requests, but got %d", test.name, test.calls, calls)
+		}
+		if counter.n != int64(len(data)) {
+			t.Errorf("%s: expect %d throttled bytes, but got %d", test.name, len(data), counter.n)
+		}
+	}
+}
+
+var memoryBuckets int
+
+func newMemoryStore(t *testing.T) *memory.Store {
+	memoryBuckets++
+	store := &memory.Store{Bucket: "download-" + strconv.Itoa(memoryBuckets)}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func pushData(t *testing.T, store storage.Storage, key string, data []byte) {
+	if err := store.Push(context.Background(), key, bytes.NewReader(data)); err != nil {
+		t.Fatal("cannot push data to storage", err)
+	}
+}
+
+func download(
+	t *testing.T, d *storage.Downloader, store storage.Storage, key string,
+) []byte {
+	r, info, err := d.Pull(context.Background(), store, key)
+	if err != nil {
+		t.Fatal("cannot pull key", err)
+	}
+	defer r.Close()
+	if info.Name() != key {
+		t.Errorf("expect info name %s, but got %s", key, info.Name())
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("cannot read data", err)
+	}
+	if info.Size() != int64(len(data)) {
+		t.Errorf("expect info size %d, but got %d", len(data), info.Size())
+	}
+	return data
+}
+
+// flakyStore drops the connection of its first range pulls after a number
+// of bytes
+type flakyStore struct {
+	*memory.Store
+
+	failures int
+	after    int64
+
+	mu          sync.Mutex
+	calls       int
+	transferred int64
+}
+
+func (s *flakyStore) PullRange(
+	ctx *context.Context, key, version string, offset, length int64,
+) (io.ReadCloser, error) {
+	r, err := s.Store.PullRange(ctx, key, version, offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	fr := &flakyReader{ReadCloser: r, s: s, left: -1}
+	if s.failures > 0 {
+		s.failures--
+		fr.left = s.after
+	}
+	return fr, nil
+}
+
+type flakyReader struct {
+	io.ReadCloser
+	s    *flakyStore
+	left int64
+}
+
+func (r *flakyReader) Read(p []byte) (int, error) {
+	if r.left == 0 {
+		return 0, errors.New("connection reset by peer")
+	}
+	if r.left > 0 && int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if r.left > 0 {
+		r.left -= int64(n)
+	}
+	r.s.mu.Lock()
+	r.s.transferred += int64(n)
+	r.s.mu.Unlock()
+	return n, err
+}
+
+// corruptStore flips the first byte of the range pulls at offset 0
+type corruptStore struct {
+	*memory.Store
+}
+
+func (s *corruptStore) PullRange(
+	ctx *context.Context, key, version string, offset, length int64,
+) (io.ReadCloser, error) {
+	r, err := s.Store.PullRange(ctx, key, version, offset, length)
+	if err != nil || offset > 0 {
+		return r, err
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		data[0]++
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// countReader counts the bytes read through it into parent
+type countReader struct {
+	io.ReadCloser
+	parent *countReader
+
+	mu sync.Mutex
+	n  int64
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.parent.mu.Lock()
+	r.parent.n += int64(n)
+	r.parent.mu.Unlock()
+	return n, err
+}
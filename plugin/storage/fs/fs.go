@@ -5,18 +5,25 @@ import (
 	"bufio"
 	"io"
 	"os"
-	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/stairlin/kargo/context"
 	"github.com/stairlin/kargo/log"
 	"github.com/stairlin/kargo/plugin/storage"
 )
 
-const name = "fs"
+const (
+	name = "fs"
+
+	// staleAge is the age after which a temporary file is considered abandoned
+	staleAge = time.Hour * 24
+)
 
 func init() {
 	storage.Add(name, func() storage.Storage {
@@ -26,6 +33,8 @@ func init() {
 
 type Store struct {
 	Path string `toml:"path"`
+	// WriteOnce refuses to overwrite existing keys
+	WriteOnce bool `toml:"write_once"`
 }
 
 func (s *Store) Name() string {
@@ -37,42 +46,90 @@ func (s *Store) Init() error {
 	if err := os.MkdirAll(path, 0770); err != nil {
 		return errors.Wrapf(err, "cannot create fs storage base path '%s'", path)
 	}
+	s.sweep()
 	return nil
 }
 
 func (s *Store) Info(ctx *context.Context, key string) (os.FileInfo, error) {
-	info, err := os.Stat(path.Join(s.Path, key))
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(s.path(key))
 	switch {
 	case err == nil:
-		return info, nil
+		return &keyInfo{FileInfo: info, key: key}, nil
 	case os.IsNotExist(err):
 		return nil, storage.ErrKeyNotFound
 	}
 	return nil, errors.Wrap(err, "cannot open file")
 }
 
+// Push writes data to a temporary file, which is then renamed to key once it
+// has been synced to disk. Therefore, a failed push never leaves a partial
+// backup behind.
 func (s *Store) Push(ctx *context.Context, key string, r io.Reader) error {
-	f, err := os.Create(path.Join(s.Path, key))
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return err
+	}
+	p := s.path(key)
+	if s.WriteOnce {
+		if _, err := os.Lstat(p); err == nil {
+			return errors.Wrapf(storage.ErrLocked, "%s already exists (write once)", key)
+		}
+	}
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return errors.Wrap(err, "cannot create directory")
+	}
+	tmp := filepath.Join(dir, storage.TempPrefix+uuid.New().String())
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
 	if err != nil {
 		return errors.Wrap(err, "cannot create file")
 	}
-	defer f.Close()
 
-	bufw := bufio.NewWriter(f)
-	defer bufw.Flush()
+	err = write(f, ctx.Reader(r))
+	if err == nil {
+		err = s.rename(tmp, p)
+	}
+	if err == nil {
+		err = syncDir(dir)
+	}
+	if err != nil {
+		if rerr := os.Remove(tmp); rerr != nil && !os.IsNotExist(rerr) {
+			ctx.Warn("fs: cannot remove temporary file",
+				log.String("path", tmp), log.Error(rerr),
+			)
+		}
+		if os.IsExist(err) {
+			return errors.Wrapf(storage.ErrLocked, "%s already exists (write once)", key)
+		}
+		return errors.Wrap(err, "cannot write file")
+	}
+	return nil
+}
 
-	_, err = io.Copy(bufw, r)
-	switch err {
-	case nil, io.ErrUnexpectedEOF:
-		return nil
+// rename moves tmp to p. Write-once stores link it instead, which fails
+// atomically when p already exists.
+func (s *Store) rename(tmp, p string) error {
+	if !s.WriteOnce {
+		return os.Rename(tmp, p)
 	}
-	return err
+	if err := os.Link(tmp, p); err != nil {
+		return err
+	}
+	return os.Remove(tmp)
 }
 
 func (s *Store) Pull(
 	ctx *context.Context, key string,
 ) (io.ReadCloser, os.FileInfo, error) {
-	f, err := os.Open(path.Join(s.Path, key))
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(s.path(key))
 	switch {
 	case err == nil:
 	case os.IsNotExist(err):
@@ -82,9 +139,69 @@ func (s *Store) Pull(
 	}
 	info, err := f.Stat()
 	if err != nil {
+		f.Close()
 		return nil, nil, err
 	}
-	return f, info, nil
+	return f, &keyInfo{FileInfo: info, key: key}, nil
+}
+
+// PullRange pulls length bytes of key starting at offset. Files are replaced
+// by renames, so the open file keeps the version it had.
+func (s *Store) PullRange(
+	ctx *context.Context, key, version string, offset, length int64,
+) (io.ReadCloser, error) {
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(s.path(key))
+	switch {
+	case err == nil:
+	case os.IsNotExist(err):
+		return nil, storage.ErrKeyNotFound
+	default:
+		return nil, errors.Wrap(err, "cannot open file")
+	}
+	if version != "" {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if fileVersion(info) != version {
+			f.Close()
+			return nil, storage.ErrVersionChanged
+		}
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "cannot seek file")
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return &limitedFile{Reader: io.LimitReader(f, length), Closer: f}, nil
+}
+
+// limitedFile reads a section of a file, and closes the file
+type limitedFile struct {
+	io.Reader
+	io.Closer
+}
+
+func (s *Store) Delete(ctx *context.Context, key string) error {
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(s.path(key))
+	switch {
+	case err == nil:
+		return nil
+	case os.IsNotExist(err):
+		return storage.ErrKeyNotFound
+	}
+	return errors.Wrap(err, "cannot delete file")
 }
 
 func (s *Store) Walk(
@@ -92,29 +209,27 @@ func (s *Store) Walk(
 	filter *storage.WalkFilter,
 	walkFn func(key string, f os.FileInfo, err error) error,
 ) {
-	var i int
 	var items []listItem
 	err := filepath.Walk(s.Path, func(path string, f os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if f.IsDir() {
+		if f.IsDir() || isTemp(f) {
 			return nil
 		}
-		i++
 
 		key, err := filepath.Rel(s.Path, path)
 		if err != nil {
 			return err
 		}
+		key = filepath.ToSlash(key)
 
-		if (filter.Limit == 0 || i <= int(filter.Limit)) &&
-			isBetween(filter, f.ModTime().UnixNano()) &&
+		if isBetween(filter, f.ModTime().UnixNano()) &&
 			matches(filter, key) {
 			items = append(items, listItem{
 				SortingKey: f.ModTime().UnixNano(),
 				Key:        key,
-				Info:       f,
+				Info:       &keyInfo{FileInfo: f, key: key},
 			})
 		}
 		return nil
@@ -124,8 +239,11 @@ func (s *Store) Walk(
 		return
 	}
 
-	// Sort items
+	// Sort items, and keep the most recent ones
 	sort.Sort(listItemsDesc(items))
+	if filter.Limit > 0 && len(items) > int(filter.Limit) {
+		items = items[:filter.Limit]
+	}
 
 	// Call back
 	for _, item := range items {
@@ -135,6 +253,58 @@ func (s *Store) Walk(
 	}
 }
 
+// path returns the path of the file of key
+func (s *Store) path(key string) string {
+	return filepath.Join(s.Path, filepath.FromSlash(key))
+}
+
+// sweep removes temporary files left behind by pushes that were interrupted
+// (e.g. crash, power loss)
+func (s *Store) sweep() {
+	filepath.Walk(s.Path, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !f.IsDir() && isTemp(f) && time.Since(f.ModTime()) > staleAge {
+			os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// write copies r to f, and then flushes it to disk
+func write(f *os.File, r io.Reader) error {
+	bufw := bufio.NewWriter(f)
+	_, err := io.Copy(bufw, r)
+	if err == nil {
+		err = bufw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// syncDir flushes the directory entries of dir to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func isTemp(f os.FileInfo) bool {
+	return strings.HasPrefix(f.Name(), storage.TempPrefix)
+}
+
 func isBetween(f *storage.WalkFilter, t int64) bool {
 	return t >= f.From && t <= f.To
 }
@@ -144,6 +314,28 @@ func matches(f *storage.WalkFilter, name string) bool {
 		(f.Pattern == nil || f.Pattern.MatchString(name))
 }
 
+// keyInfo describes the file of a key
+type keyInfo struct {
+	os.FileInfo
+	key string
+}
+
+// Name returns the key of the file
+func (i *keyInfo) Name() string {
+	return i.key
+}
+
+// Version returns the modification time and the size of the file
+func (i *keyInfo) Version() string {
+	return fileVersion(i.FileInfo)
+}
+
+// fileVersion returns the version of a file
+func fileVersion(f os.FileInfo) string {
+	return strconv.FormatInt(f.ModTime().UnixNano(), 10) + "-" +
+		strconv.FormatInt(f.Size(), 10)
+}
+
 type listItem struct {
 	SortingKey int64
 	Key        string
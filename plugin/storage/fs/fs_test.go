@@ -2,17 +2,22 @@ package fs_test
 
 import (
 	"bytes"
+	"io"
 	"io/ioutil"
 	"math"
 	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stairlin/kargo/context"
 	"github.com/stairlin/kargo/pkg/testutil"
 	"github.com/stairlin/kargo/pkg/unit"
 	"github.com/stairlin/kargo/plugin/storage"
 	"github.com/stairlin/kargo/plugin/storage/fs"
+	"github.com/stairlin/kargo/plugin/storage/storagetest"
 )
 
 func TestVerbatim(t *testing.T) {
@@ -161,3 +166,153 @@ func TestWalk(t *testing.T) {
 		t.Errorf("expect walk to be called %d times, but got %d", expect, count)
 	}
 }
+
+func TestFailedPush(t *testing.T) {
+	dir := testutil.TempDir(t, "fs")
+	defer os.RemoveAll(dir)
+	store := &fs.Store{
+		Path: dir,
+	}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := store.Push(ctx, "foo", bytes.NewReader([]byte("bar"))); err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+
+	// Upstream fails half way
+	input := io.MultiReader(
+		bytes.NewReader(testutil.GenRandBytes(t, int(unit.MB))),
+		&errReader{err: io.ErrUnexpectedEOF},
+	)
+	if err := store.Push(ctx, "foo", input); err == nil {
+		t.Fatal("expect push to fail")
+	}
+	if err := store.Push(ctx, "baz", input); err == nil {
+		t.Fatal("expect push to fail")
+	}
+
+	// The previous backup is left untouched
+	info, err := store.Info(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 3 {
+		t.Errorf("expect size 3, but got %d", info.Size())
+	}
+	if _, err := store.Info(ctx, "baz"); err != storage.ErrKeyNotFound {
+		t.Errorf("expect error %s, but got %v", storage.ErrKeyNotFound, err)
+	}
+
+	// No temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("expect 1 file, but got %d", len(files))
+	}
+}
+
+func TestWriteOnce(t *testing.T) {
+	dir := testutil.TempDir(t, "fs")
+	defer os.RemoveAll(dir)
+	store := &fs.Store{
+		Path:      dir,
+		WriteOnce: true,
+	}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := store.Push(ctx, "foo", bytes.NewReader([]byte("bar"))); err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+	err := store.Push(ctx, "foo", bytes.NewReader([]byte("overwrite")))
+	if errors.Cause(err) != storage.ErrLocked {
+		t.Errorf("expect error %s, but got %v", storage.ErrLocked, err)
+	}
+
+	// The existing backup is left untouched
+	info, err := store.Info(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 3 {
+		t.Errorf("expect size 3, but got %d", info.Size())
+	}
+
+	// No temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("expect 1 file, but got %d", len(files))
+	}
+}
+
+func TestSweep(t *testing.T) {
+	dir := testutil.TempDir(t, "fs")
+	defer os.RemoveAll(dir)
+
+	stale := filepath.Join(dir, ".kargo-stale")
+	fresh := filepath.Join(dir, ".kargo-fresh")
+	for _, p := range []string{stale, fresh} {
+		if err := ioutil.WriteFile(p, []byte("foo"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-time.Hour * 48)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	store := &fs.Store{
+		Path: dir,
+	}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("expect stale temporary file to be removed")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Error("expect in-progress temporary file to be kept", err)
+	}
+
+	// Temporary files are not listed
+	count := 0
+	filter := &storage.WalkFilter{
+		To: int64(math.MaxInt64),
+	}
+	store.Walk(context.Background(), filter, func(path string, f os.FileInfo, err error) error {
+		count++
+		return nil
+	})
+	if count != 0 {
+		t.Errorf("expect walk to be called 0 times, but got %d", count)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	dir := testutil.TempDir(t, "fs")
+	defer os.RemoveAll(dir)
+
+	var i int
+	storagetest.Run(t, func() storage.Storage {
+		i++
+		return &fs.Store{Path: filepath.Join(dir, strconv.Itoa(i))}
+	})
+}
+
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,627 @@
+// Package gcs stores backups on Google Cloud Storage
+package gcs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/log"
+	"github.com/stairlin/kargo/pkg/unit"
+	"github.com/stairlin/kargo/plugin/storage"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	name  = "gcs"
+	slash = "/"
+	scope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+	defaultEndpoint  = "https://storage.googleapis.com"
+	defaultChunkSize = unit.MB * 16
+	chunkAlignment   = 256 << 10 // Upload chunks must be a multiple of 256 KiB
+	maxResults       = 1000      // GCS max items per listing
+	maxRetries       = 5
+
+	// Status code returned by GCS when an upload chunk has been persisted
+	statusResumeIncomplete = 308
+
+	// createdAtMeta is the custom metadata of the creation time of backups
+	createdAtMeta = "kargo-created-at"
+)
+
+func init() {
+	storage.Add(name, func() storage.Storage {
+		return &Store{}
+	})
+}
+
+// Store is a Google Cloud Storage store
+type Store struct {
+	Bucket          string `toml:"bucket"`
+	Folder          string `toml:"folder"`
+	Credentials     string `toml:"credentials"`
+	CredentialsFile string `toml:"credentials_file"`
+	StorageClass    string `toml:"storage_class"`
+	KMSKeyName      string `toml:"kms_key_name"`
+	ChunkSize       string `toml:"chunk_size"`
+	Endpoint        string `toml:"endpoint"`
+	NoAuth          bool   `toml:"no_auth"`
+
+	Client *http.Client
+
+	ns        storage.Namespace
+	chunkSize int
+}
+
+// object is the metadata of a GCS object
+type object struct {
+	Name         string    `json:"name"`
+	Size         string    `json:"size"`
+	Updated      time.Time `json:"updated"`
+	Generation   string    `json:"generation,omitempty"`
+	StorageClass string    `json:"storageClass,omitempty"`
+	// MD5Hash is the base64 MD5 checksum of the data, which composite
+	// objects do not have
+	MD5Hash string `json:"md5Hash,omitempty"`
+	// Metadata is the custom metadata of the object
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func (s *Store) Name() string {
+	return name
+}
+
+func (s *Store) Init() error {
+	if s.Bucket == "" {
+		return errors.New("missing bucket")
+	}
+	ns, err := storage.NewNamespace(s.Folder)
+	if err != nil {
+		return err
+	}
+	s.ns = ns
+	s.Folder = ns.Folder()
+	if s.Endpoint == "" {
+		s.Endpoint = defaultEndpoint
+	}
+	s.Endpoint = strings.TrimSuffix(s.Endpoint, slash)
+
+	chunkSize := defaultChunkSize
+	if s.ChunkSize != "" {
+		b, err := unit.ParseByte(s.ChunkSize)
+		if err != nil {
+			return errors.Wrap(err, "invalid chunk size")
+		}
+		chunkSize = b
+	}
+	s.chunkSize = int(chunkSize)
+	if s.chunkSize < chunkAlignment || s.chunkSize%chunkAlignment != 0 {
+		return errors.New("chunk size must be a multiple of 256 kB")
+	}
+
+	if s.Client != nil {
+		return nil
+	}
+	if s.NoAuth {
+		s.Client = http.DefaultClient
+		return nil
+	}
+
+	// Credentials
+	credentials, err := s.loadCredentials()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	var creds *google.Credentials
+	if credentials != nil {
+		creds, err = google.CredentialsFromJSON(ctx, credentials, scope)
+	} else {
+		// Application default credentials
+		creds, err = google.FindDefaultCredentials(ctx, scope)
+	}
+	if err != nil {
+		return errors.Wrap(err, "cannot load GCP credentials")
+	}
+	s.Client = oauth2.NewClient(ctx, creds.TokenSource)
+	return nil
+}
+
+func (s *Store) Info(ctx *context.Context, key string) (os.FileInfo, error) {
+	name, err := s.ns.Name(key)
+	if err != nil {
+		return nil, err
+	}
+	o, err := s.stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return s.objectInfo(o), nil
+}
+
+// Push streams data to GCS with a resumable upload. Data is sent by chunks,
+// and a chunk is sent again when it fails, so only a chunk is kept in memory.
+func (s *Store) Push(ctx *context.Context, key string, r io.Reader) error {
+	return s.PushMeta(ctx, key, r, &storage.Meta{CreatedAt: time.Now()})
+}
+
+// PushMeta pushes data from r, and records the creation time of the backup
+// in the custom metadata of the object
+func (s *Store) PushMeta(
+	ctx *context.Context, key string, r io.Reader, meta *storage.Meta,
+) error {
+	name, err := s.ns.Name(key)
+	if err != nil {
+		return err
+	}
+	session, err := s.startUpload(ctx, name, meta)
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(r)
+	chunk := make([]byte, s.chunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(br, chunk)
+		switch err {
+		case nil, io.EOF, io.ErrUnexpectedEOF:
+		default:
+			s.cancelUpload(ctx, session)
+			return errors.Wrap(err, "cannot read data")
+		}
+		last := err != nil
+		if !last {
+			// The chunk is the last one when no more data follows
+			if _, err := br.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+
+		if err := s.uploadChunk(ctx, session, chunk[:n], offset, last); err != nil {
+			s.cancelUpload(ctx, session)
+			return err
+		}
+		offset += int64(n)
+		if last {
+			return nil
+		}
+	}
+}
+
+func (s *Store) Pull(
+	ctx *context.Context, key string,
+) (io.ReadCloser, os.FileInfo, error) {
+	name, err := s.ns.Name(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	o, err := s.stat(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Pin the generation, so the object cannot change in between
+	u := s.objectURL(name) + "?alt=media"
+	if o.Generation != "" {
+		u += "&generation=" + o.Generation
+	}
+	res, err := s.do(ctx, "GET", u, nil, nil)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot get data from GCS")
+	}
+	return res.Body, s.objectInfo(o), nil
+}
+
+func (s *Store) Delete(ctx *context.Context, key string) error {
+	name, err := s.ns.Name(key)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(ctx, "DELETE", s.objectURL(name), nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *Store) Walk(
+	ctx *context.Context,
+	filter *storage.WalkFilter,
+	walkFn func(key string, f os.FileInfo, err error) error,
+) {
+	q := url.Values{}
+	q.Set("prefix", s.ns.Prefix(filter.Prefix))
+	q.Set("maxResults", strconv.Itoa(maxResults))
+	q.Set("fields", "items(name,size,updated,generation,storageClass,md5Hash,metadata),nextPageToken")
+
+	var infos []*info
+	for {
+		var out struct {
+			Items         []*object `json:"items"`
+			NextPageToken string    `json:"nextPageToken"`
+		}
+		u := fmt.Sprintf("%s/storage/v1/b/%s/o?%s",
+			s.Endpoint, url.PathEscape(s.Bucket), q.Encode(),
+		)
+		if err := s.getJSON(ctx, u, &out); err != nil {
+			walkFn("", nil, errors.Wrap(err, "cannot list backups from GCS"))
+			return
+		}
+
+		for _, o := range out.Items {
+			info := s.objectInfo(o)
+			if info == nil {
+				continue
+			}
+			if isBetween(filter, info.ModTime().UnixNano()) &&
+				matches(filter, info.Name()) {
+				infos = append(infos, info)
+			}
+		}
+
+		if out.NextPageToken == "" {
+			break
+		}
+		q.Set("pageToken", out.NextPageToken)
+	}
+
+	// Sort items, and keep the most recent ones
+	sort.Sort(byModTimeDesc(infos))
+	if filter.Limit > 0 && len(infos) > int(filter.Limit) {
+		infos = infos[:filter.Limit]
+	}
+
+	for _, info := range infos {
+		if err := walkFn(info.Name(), info, nil); err != nil {
+			return
+		}
+	}
+}
+
+// stat returns the metadata of the object name
+func (s *Store) stat(ctx *context.Context, name string) (*object, error) {
+	var o object
+	if err := s.getJSON(ctx, s.objectURL(name), &o); err != nil {
+		if err == storage.ErrKeyNotFound {
+			return nil, err
+		}
+		return nil, errors.Wrap(err, "cannot get data from GCS")
+	}
+	return &o, nil
+}
+
+// startUpload initiates a resumable upload and returns its session URI
+func (s *Store) startUpload(
+	ctx *context.Context, name string, meta *storage.Meta,
+) (string, error) {
+	q := url.Values{}
+	q.Set("uploadType", "resumable")
+	q.Set("name", name)
+	if s.KMSKeyName != "" {
+		q.Set("kmsKeyName", s.KMSKeyName)
+	}
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s",
+		s.Endpoint, url.PathEscape(s.Bucket), q.Encode(),
+	)
+
+	o := &object{
+		Name:         name,
+		StorageClass: s.StorageClass,
+	}
+	if o.StorageClass == "" {
+		o.StorageClass = meta.StorageClass
+	}
+	if !meta.CreatedAt.IsZero() {
+		o.Metadata = map[string]string{
+			createdAtMeta: meta.CreatedAt.UTC().Format(storage.MetaTimeFormat),
+		}
+	}
+	metadata, err := json.Marshal(o)
+	if err != nil {
+		return "", err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json; charset=UTF-8")
+	res, err := s.do(ctx, "POST", u, header, metadata)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot start upload to GCS")
+	}
+	res.Body.Close()
+
+	session := res.Header.Get("Location")
+	if session == "" {
+		return "", errors.New("missing GCS upload session")
+	}
+	return session, nil
+}
+
+// uploadChunk uploads a chunk starting at offset. When the upload of a chunk
+// fails, the upload offset is queried and the rest of the chunk is sent again.
+func (s *Store) uploadChunk(
+	ctx *context.Context, session string, chunk []byte, offset int64, last bool,
+) error {
+	var sent int64
+	for retry := 0; ; retry++ {
+		data := chunk[sent:]
+		header := http.Header{}
+		total := "*"
+		if last {
+			total = strconv.FormatInt(offset+int64(len(chunk)), 10)
+		}
+		if len(data) == 0 {
+			header.Set("Content-Range", "bytes */"+total)
+		} else {
+			start := offset + sent
+			header.Set("Content-Range", fmt.Sprintf(
+				"bytes %d-%d/%s", start, start+int64(len(data))-1, total,
+			))
+		}
+
+		res, err := s.send(ctx, "PUT", session, header, data)
+		if err == nil {
+			res.Body.Close()
+			switch {
+			case res.StatusCode == http.StatusOK || res.StatusCode == http.StatusCreated:
+				return nil
+			case res.StatusCode == statusResumeIncomplete && !last:
+				return nil
+			case res.StatusCode < 500 && res.StatusCode != statusResumeIncomplete:
+				return errors.Errorf("cannot upload data to GCS (%s)", res.Status)
+			}
+		}
+		if retry == maxRetries || ctx.Err() != nil {
+			if err == nil {
+				err = errors.New(res.Status)
+			}
+			return errors.Wrap(err, "cannot upload data to GCS")
+		}
+		ctx.Warn("GCS upload chunk failed. Retrying...",
+			log.Int64("offset", offset+sent), log.Int("retry", retry+1),
+		)
+		select {
+		case <-time.After(time.Duration(1<<uint(retry)) * time.Second):
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "cannot upload data to GCS")
+		}
+
+		// Resume from the persisted offset
+		persisted, err := s.uploadStatus(ctx, session)
+		if err != nil {
+			continue
+		}
+		if persisted < offset || persisted > offset+int64(len(chunk)) {
+			return errors.New("cannot resume GCS upload")
+		}
+		sent = persisted - offset
+	}
+}
+
+// uploadStatus returns the number of bytes persisted by an upload session
+func (s *Store) uploadStatus(ctx *context.Context, session string) (int64, error) {
+	header := http.Header{}
+	header.Set("Content-Range", "bytes */*")
+	res, err := s.send(ctx, "PUT", session, header, nil)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode != statusResumeIncomplete {
+		return 0, errors.Errorf("unexpected upload status %s", res.Status)
+	}
+
+	// e.g. Range: bytes=0-42
+	r := res.Header.Get("Range")
+	if r == "" {
+		return 0, nil
+	}
+	i := strings.LastIndex(r, "-")
+	if i < 0 {
+		return 0, errors.Errorf("invalid range %s", r)
+	}
+	end, err := strconv.ParseInt(r[i+1:], 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid range %s", r)
+	}
+	return end + 1, nil
+}
+
+// cancelUpload cancels an upload, so it does not linger on GCS
+func (s *Store) cancelUpload(ctx *context.Context, session string) {
+	res, err := s.send(ctx, "DELETE", session, nil, nil)
+	if err != nil {
+		ctx.Warn("Cannot cancel GCS upload", log.Error(err))
+		return
+	}
+	res.Body.Close()
+}
+
+// getJSON gets u and decodes its JSON response into v
+func (s *Store) getJSON(ctx *context.Context, u string, v interface{}) error {
+	res, err := s.do(ctx, "GET", u, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return errors.Wrap(err, "cannot decode GCS response")
+	}
+	return nil
+}
+
+// do sends a request, and returns an error when its response is not successful
+func (s *Store) do(
+	ctx *context.Context, method, u string, header http.Header, body []byte,
+) (*http.Response, error) {
+	res, err := s.send(ctx, method, u, header, body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, storage.ErrKeyNotFound
+	}
+
+	var out struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<16))
+	if err := json.Unmarshal(b, &out); err == nil && out.Error.Message != "" {
+		return nil, errors.Errorf("%s (%s)", out.Error.Message, res.Status)
+	}
+	return nil, errors.New(res.Status)
+}
+
+func (s *Store) send(
+	ctx *context.Context, method, u string, header http.Header, body []byte,
+) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return s.Client.Do(req.WithContext(ctx))
+}
+
+func (s *Store) objectURL(name string) string {
+	return fmt.Sprintf("%s/storage/v1/b/%s/o/%s",
+		s.Endpoint, url.PathEscape(s.Bucket), url.PathEscape(name),
+	)
+}
+
+// objectInfo returns the info of o, or nil when o is not within the folder
+func (s *Store) objectInfo(o *object) *info {
+	key, ok := s.ns.Key(o.Name)
+	if !ok {
+		return nil
+	}
+	size, _ := strconv.ParseInt(o.Size, 10, 64)
+	createdAt, _ := time.Parse(storage.MetaTimeFormat, o.Metadata[createdAtMeta])
+	var checksum string
+	if sum, err := base64.StdEncoding.DecodeString(o.MD5Hash); err == nil && len(sum) > 0 {
+		checksum = "md5:" + hex.EncodeToString(sum)
+	}
+	return &info{
+		name:         key,
+		size:         size,
+		modTime:      o.Updated,
+		storageClass: o.StorageClass,
+		createdAt:    createdAt,
+		checksum:     checksum,
+	}
+}
+
+// loadCredentials returns the service account credentials either from the
+// config or from the credentials file
+func (s *Store) loadCredentials() ([]byte, error) {
+	if s.CredentialsFile == "" {
+		if s.Credentials == "" {
+			return nil, nil
+		}
+		return []byte(s.Credentials), nil
+	}
+	if s.Credentials != "" {
+		return nil, errors.New("credentials and credentials_file are mutually exclusive")
+	}
+	b, err := ioutil.ReadFile(s.CredentialsFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read credentials file")
+	}
+	return b, nil
+}
+
+// info wraps a GCS object to a struct that implements os.FileInfo
+type info struct {
+	name         string
+	size         int64
+	modTime      time.Time
+	storageClass string
+	createdAt    time.Time
+	checksum     string
+}
+
+// base name of the file
+func (i *info) Name() string {
+	return i.name
+}
+
+// length in bytes for regular files; system-dependent for others
+func (i *info) Size() int64 {
+	return i.size
+}
+
+// file mode bits
+func (i *info) Mode() os.FileMode {
+	return os.ModePerm
+}
+
+// modification time
+func (i *info) ModTime() time.Time {
+	return i.modTime
+}
+
+// abbreviation for Mode().IsDir()
+func (i *info) IsDir() bool {
+	return false
+}
+
+// underlying data source (can return nil)
+func (i *info) Sys() interface{} {
+	return nil
+}
+
+// StorageClass returns the storage class of the object
+func (i *info) StorageClass() string {
+	return i.storageClass
+}
+
+// CreatedAt returns the creation time of the backup
+func (i *info) CreatedAt() time.Time {
+	return i.createdAt
+}
+
+// Checksum returns the MD5 checksum of the object
+func (i *info) Checksum() string {
+	return i.checksum
+}
+
+func isBetween(f *storage.WalkFilter, t int64) bool {
+	return t >= f.From && t <= f.To
+}
+
+func matches(f *storage.WalkFilter, name string) bool {
+	return strings.HasPrefix(name, f.Prefix) &&
+		(f.Pattern == nil || f.Pattern.MatchString(name))
+}
+
+type byModTimeDesc []*info
+
+func (l byModTimeDesc) Len() int      { return len(l) }
+func (l byModTimeDesc) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l byModTimeDesc) Less(i, j int) bool {
+	return l[i].modTime.UnixNano() > l[j].modTime.UnixNano()
+}
@@ -0,0 +1,392 @@
+package gcs_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/pkg/testutil"
+	"github.com/stairlin/kargo/pkg/unit"
+	"github.com/stairlin/kargo/plugin/storage"
+	"github.com/stairlin/kargo/plugin/storage/gcs"
+	"github.com/stairlin/kargo/plugin/storage/storagetest"
+)
+
+func TestVerbatim(t *testing.T) {
+	fake := newFakeServer()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store := newStore(t, server.URL)
+
+	ctx := context.Background()
+	table := []int{0, 1, 256 * int(unit.KB), 3*256*int(unit.KB) + 42}
+	for _, size := range table {
+		expect := testutil.GenRandBytes(t, size)
+		key := fmt.Sprintf("foo/%d", size)
+		if err := store.Push(ctx, key, bytes.NewReader(expect)); err != nil {
+			t.Fatal("Error pushing data to storage", err)
+		}
+		out, info, err := store.Pull(ctx, key)
+		if err != nil {
+			t.Fatal("Error pulling data from storage", err)
+		}
+		got, err := ioutil.ReadAll(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.Close()
+		if !bytes.Equal(expect, got) {
+			t.Errorf("%d: expect text %s, but got %s", size,
+				testutil.Truncate(expect, 140), testutil.Truncate(got, 140),
+			)
+		}
+		if info.Name() != key || info.Size() != int64(size) {
+			t.Errorf("expect info %s (%d), but got %s (%d)",
+				key, size, info.Name(), info.Size(),
+			)
+		}
+	}
+
+	o := fake.object("backups/foo/1")
+	if o == nil {
+		t.Fatal("expect object to be stored in the folder")
+	}
+	if o.storageClass != "NEARLINE" {
+		t.Errorf("expect storage class NEARLINE, but got %s", o.storageClass)
+	}
+}
+
+func TestResume(t *testing.T) {
+	fake := newFakeServer()
+	fake.failures = 2
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store := newStore(t, server.URL)
+
+	ctx := context.Background()
+	expect := testutil.GenRandBytes(t, 3*256*int(unit.KB))
+	if err := store.Push(ctx, "foo", bytes.NewReader(expect)); err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+	o := fake.object("backups/foo")
+	if o == nil || !bytes.Equal(o.data, expect) {
+		t.Error("expect resumed upload to store the whole data")
+	}
+}
+
+func TestWalk(t *testing.T) {
+	fake := newFakeServer()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store := newStore(t, server.URL)
+
+	ctx := context.Background()
+	expect := []string{"e", "d", "c", "b", "a"}
+	for i := len(expect) - 1; i >= 0; i-- {
+		if err := store.Push(ctx, expect[i], bytes.NewReader([]byte("foo"))); err != nil {
+			t.Fatal("Error pushing data to storage", err)
+		}
+	}
+
+	var keys []string
+	filter := storage.WalkFilter{To: math.MaxInt64}
+	store.Walk(ctx, &filter, func(key string, f os.FileInfo, err error) error {
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if strings.Join(keys, ",") != strings.Join(expect, ",") {
+		t.Errorf("expect keys %v, but got %v", expect, keys)
+	}
+
+	// Info/Delete
+	if err := store.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Info(ctx, "a"); err != storage.ErrKeyNotFound {
+		t.Errorf("expect error %s, but got %v", storage.ErrKeyNotFound, err)
+	}
+	if _, _, err := store.Pull(ctx, "a"); err != storage.ErrKeyNotFound {
+		t.Errorf("expect error %s, but got %v", storage.ErrKeyNotFound, err)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	fake := newFakeServer()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	ctx := context.Background()
+	created := time.Date(2018, 6, 1, 12, 30, 0, 0, time.UTC)
+	meta := &storage.Meta{CreatedAt: created, StorageClass: "COLDLINE"}
+
+	// The storage class of the config prevails
+	store := newStore(t, server.URL)
+	if err := store.PushMeta(ctx, "foo", strings.NewReader("foo"), meta); err != nil {
+		t.Fatal("cannot push data", err)
+	}
+	if class := fake.object("backups/foo").storageClass; class != "NEARLINE" {
+		t.Errorf("expect class NEARLINE, but got %s", class)
+	}
+	store.StorageClass = ""
+	if err := store.PushMeta(ctx, "foo", strings.NewReader("foo"), meta); err != nil {
+		t.Fatal("cannot push data", err)
+	}
+
+	info, err := store.Info(ctx, "foo")
+	if err != nil {
+		t.Fatal("cannot get info", err)
+	}
+	if class := info.(storage.ClassInfo).StorageClass(); class != "COLDLINE" {
+		t.Errorf("expect class COLDLINE, but got %s", class)
+	}
+	sum := md5.Sum([]byte("foo"))
+	expect := "md5:" + hex.EncodeToString(sum[:])
+	if got := info.(storage.ChecksumInfo).Checksum(); got != expect {
+		t.Errorf("expect checksum %s, but got %s", expect, got)
+	}
+
+	// Listings have the metadata as well
+	filter := storage.WalkFilter{To: math.MaxInt64}
+	store.Walk(ctx, &filter, func(key string, f os.FileInfo, err error) error {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.(storage.TimeInfo).CreatedAt(); !got.Equal(created) {
+			t.Errorf("expect creation time %s, but got %s", created, got)
+		}
+		if got := f.(storage.ChecksumInfo).Checksum(); got != expect {
+			t.Errorf("expect checksum %s, but got %s", expect, got)
+		}
+		return nil
+	})
+}
+
+func TestConformance(t *testing.T) {
+	server := httptest.NewServer(newFakeServer())
+	defer server.Close()
+
+	var i int
+	storagetest.Run(t, func() storage.Storage {
+		i++
+		return &gcs.Store{
+			Bucket:    "kargo",
+			Folder:    strconv.Itoa(i),
+			ChunkSize: "256 kB",
+			Endpoint:  server.URL,
+			NoAuth:    true,
+		}
+	})
+}
+
+func newStore(t *testing.T, endpoint string) *gcs.Store {
+	store := &gcs.Store{
+		Bucket:       "kargo",
+		Folder:       "backups",
+		StorageClass: "NEARLINE",
+		ChunkSize:    "256 kB",
+		Endpoint:     endpoint,
+		NoAuth:       true,
+	}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// fakeServer is an in-memory stand-in of the GCS JSON API
+type fakeServer struct {
+	mu       sync.Mutex
+	objects  map[string]*fakeObject
+	sessions map[string]*fakeObject
+	clock    time.Time
+	failures int
+}
+
+type fakeObject struct {
+	name         string
+	data         []byte
+	storageClass string
+	custom       map[string]string
+	updated      time.Time
+}
+
+func newFakeServer() *fakeServer {
+	return &fakeServer{
+		objects:  map[string]*fakeObject{},
+		sessions: map[string]*fakeObject{},
+		clock:    time.Now(),
+	}
+}
+
+func (s *fakeServer) object(name string) *fakeObject {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.objects[name]
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	switch {
+	case r.Method == "POST" && len(p) == 6 && p[0] == "upload":
+		var metadata struct {
+			StorageClass string            `json:"storageClass"`
+			Metadata     map[string]string `json:"metadata"`
+		}
+		json.NewDecoder(r.Body).Decode(&metadata)
+		id := strconv.Itoa(len(s.sessions))
+		s.sessions[id] = &fakeObject{
+			name:         r.URL.Query().Get("name"),
+			storageClass: metadata.StorageClass,
+			custom:       metadata.Metadata,
+		}
+		w.Header().Set("Location", "http://"+r.Host+"/session/"+id)
+	case r.Method == "PUT" && len(p) == 2 && p[0] == "session":
+		s.upload(w, r, s.sessions[p[1]])
+	case r.Method == "DELETE" && len(p) == 2 && p[0] == "session":
+		delete(s.sessions, p[1])
+	case r.Method == "GET" && len(p) == 5:
+		s.list(w, r)
+	case len(p) == 6:
+		name, _ := url.PathUnescape(p[5])
+		o, ok := s.objects[name]
+		switch {
+		case !ok:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == "DELETE":
+			delete(s.objects, name)
+		case r.URL.Query().Get("alt") == "media":
+			w.Write(o.data)
+		default:
+			json.NewEncoder(w).Encode(o.metadata())
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (s *fakeServer) upload(w http.ResponseWriter, r *http.Request, o *fakeObject) {
+	if o == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	data, _ := ioutil.ReadAll(r.Body)
+
+	// e.g. bytes 0-42/* or bytes */43
+	var total int64 = -1
+	cr := strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes ")
+	i := strings.Index(cr, "/")
+	if cr[i+1:] != "*" {
+		total, _ = strconv.ParseInt(cr[i+1:], 10, 64)
+	}
+	if cr[:i] != "*" {
+		if s.failures > 0 && len(o.data) > 0 {
+			// Persist half of the chunk, and then fail
+			s.failures--
+			o.data = append(o.data, data[:len(data)/2]...)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		start, _ := strconv.ParseInt(strings.Split(cr[:i], "-")[0], 10, 64)
+		if start != int64(len(o.data)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		o.data = append(o.data, data...)
+	}
+
+	if total == int64(len(o.data)) {
+		s.clock = s.clock.Add(time.Second)
+		o.updated = s.clock
+		s.objects[o.name] = o
+		json.NewEncoder(w).Encode(o.metadata())
+		return
+	}
+	if len(o.data) > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(o.data)-1))
+	}
+	w.WriteHeader(308)
+}
+
+// list returns objects by pages of 2
+func (s *fakeServer) list(w http.ResponseWriter, r *http.Request) {
+	var names []string
+	for name := range s.objects {
+		if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	start, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+	var out struct {
+		Items         []map[string]interface{} `json:"items"`
+		NextPageToken string                   `json:"nextPageToken,omitempty"`
+	}
+	fields := itemFields(r.URL.Query().Get("fields"))
+	for i := start; i < len(names) && i < start+2; i++ {
+		item := s.objects[names[i]].metadata()
+		if fields != nil {
+			// Like GCS, only return the selected fields
+			for k := range item {
+				if !fields[k] {
+					delete(item, k)
+				}
+			}
+		}
+		out.Items = append(out.Items, item)
+	}
+	if start+2 < len(names) {
+		out.NextPageToken = strconv.Itoa(start + 2)
+	}
+	json.NewEncoder(w).Encode(&out)
+}
+
+// itemFields returns the item fields selected by a fields parameter (e.g.
+// items(name,size),nextPageToken), or nil when all fields are selected
+func itemFields(fields string) map[string]bool {
+	i := strings.Index(fields, "items(")
+	if i < 0 {
+		return nil
+	}
+	list := fields[i+len("items("):]
+	list = list[:strings.Index(list, ")")]
+	m := map[string]bool{}
+	for _, f := range strings.Split(list, ",") {
+		m[f] = true
+	}
+	return m
+}
+
+func (o *fakeObject) metadata() map[string]interface{} {
+	sum := md5.Sum(o.data)
+	return map[string]interface{}{
+		"name":         o.name,
+		"size":         strconv.Itoa(len(o.data)),
+		"updated":      o.updated.Format(time.RFC3339Nano),
+		"generation":   "1",
+		"storageClass": o.storageClass,
+		"metadata":     o.custom,
+		"md5Hash":      base64.StdEncoding.EncodeToString(sum[:]),
+	}
+}
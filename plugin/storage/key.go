@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// KeySeparator separates the segments of nested keys (e.g. db/2018/01/foo)
+	KeySeparator = "/"
+	// MaxKeyLength is the maximum length of a key in bytes
+	MaxKeyLength = 1024
+	// TempPrefix is the name prefix of temporary files created by storages
+	// while data is being pushed. Keys cannot have segments starting with it.
+	TempPrefix = ".kargo-"
+)
+
+// CleanKey validates key, and returns its normalised form.
+//
+// Keys are made of segments separated by slashes, which storages map to
+// directories or object name prefixes. Leading, trailing and repeated slashes
+// are removed. A key cannot contain "." or ".." segments, backslashes, nor
+// control characters, so that it never escapes the storage root.
+func CleanKey(key string) (string, error) {
+	if !utf8.ValidString(key) {
+		return "", errors.Wrap(ErrInvalidKey, "key is not valid UTF-8")
+	}
+	var segments []string
+	for _, s := range strings.Split(key, KeySeparator) {
+		switch {
+		case s == "":
+			continue
+		case s == "." || s == "..":
+			return "", errors.Wrapf(ErrInvalidKey, "key %q has a relative segment", key)
+		case strings.HasPrefix(s, TempPrefix):
+			return "", errors.Wrapf(ErrInvalidKey, "key %q has a reserved segment", key)
+		case strings.IndexFunc(s, isForbidden) >= 0:
+			return "", errors.Wrapf(ErrInvalidKey, "key %q has a forbidden character", key)
+		}
+		segments = append(segments, s)
+	}
+	key = strings.Join(segments, KeySeparator)
+	switch {
+	case key == "":
+		return "", errors.Wrap(ErrInvalidKey, "key is empty")
+	case len(key) > MaxKeyLength:
+		return "", errors.Wrapf(ErrInvalidKey, "key is longer than %d bytes", MaxKeyLength)
+	}
+	return key, nil
+}
+
+// Namespace maps keys to object names under a folder, for storages which
+// store all objects in a flat namespace (e.g. a bucket).
+type Namespace struct {
+	folder string
+}
+
+// NewNamespace returns a namespace that stores keys under folder. An empty
+// folder stores keys at the root.
+func NewNamespace(folder string) (Namespace, error) {
+	if strings.Trim(folder, KeySeparator) == "" {
+		return Namespace{}, nil
+	}
+	folder, err := CleanKey(folder)
+	if err != nil {
+		return Namespace{}, errors.Wrap(err, "invalid folder")
+	}
+	return Namespace{folder: folder}, nil
+}
+
+// Folder returns the normalised folder of the namespace
+func (n Namespace) Folder() string {
+	return n.folder
+}
+
+// Name validates key, and returns the object name where it is stored
+func (n Namespace) Name(key string) (string, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return n.join(key), nil
+}
+
+// Prefix returns the object name prefix of keys starting with prefix. It is
+// meant to list objects.
+func (n Namespace) Prefix(prefix string) string {
+	return n.join(strings.TrimLeft(prefix, KeySeparator))
+}
+
+// Key returns the key stored under the object name, or false when the name is
+// not within the namespace.
+func (n Namespace) Key(name string) (string, bool) {
+	if n.folder == "" {
+		return name, name != ""
+	}
+	key := strings.TrimPrefix(name, n.folder+KeySeparator)
+	return key, key != name && key != ""
+}
+
+func (n Namespace) join(key string) string {
+	if n.folder == "" {
+		return key
+	}
+	return n.folder + KeySeparator + key
+}
+
+func isForbidden(r rune) bool {
+	return r == '\\' || unicode.IsControl(r)
+}
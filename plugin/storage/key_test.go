@@ -0,0 +1,87 @@
+package storage_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stairlin/kargo/plugin/storage"
+	"github.com/stairlin/kargo/plugin/storage/storagetest"
+)
+
+func TestCleanKey(t *testing.T) {
+	table := []struct {
+		in     string
+		expect string
+	}{
+		{in: "foo", expect: "foo"},
+		{in: "foo/bar", expect: "foo/bar"},
+		{in: "/foo//bar/", expect: "foo/bar"},
+		{in: "foo.bar/..baz", expect: "foo.bar/..baz"},
+		{in: "db/2018-01-02T15:04:05Z", expect: "db/2018-01-02T15:04:05Z"},
+		{in: "données/clé", expect: "données/clé"},
+	}
+	for _, test := range table {
+		got, err := storage.CleanKey(test.in)
+		if err != nil {
+			t.Errorf("%q: unexpected error %s", test.in, err)
+			continue
+		}
+		if got != test.expect {
+			t.Errorf("%q: expect %q, but got %q", test.in, test.expect, got)
+		}
+	}
+
+	for _, key := range storagetest.InvalidKeys {
+		if _, err := storage.CleanKey(key); errors.Cause(err) != storage.ErrInvalidKey {
+			t.Errorf("%q: expect error %s, but got %v", key, storage.ErrInvalidKey, err)
+		}
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	table := []struct {
+		folder string
+		key    string
+		name   string
+	}{
+		{folder: "", key: "foo/bar", name: "foo/bar"},
+		{folder: "/", key: "foo", name: "foo"},
+		{folder: "backups", key: "foo/bar", name: "backups/foo/bar"},
+		{folder: "/backups/db/", key: "/foo", name: "backups/db/foo"},
+	}
+	for _, test := range table {
+		ns, err := storage.NewNamespace(test.folder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, err := ns.Name(test.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != test.name {
+			t.Errorf("expect name %q, but got %q", test.name, name)
+		}
+		key, ok := ns.Key(name)
+		if !ok || key != strings.TrimLeft(test.key, "/") {
+			t.Errorf("expect key %q, but got %q", test.key, key)
+		}
+	}
+
+	ns, err := storage.NewNamespace("backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ns.Key("other/foo"); ok {
+		t.Error("expect name outside of the folder to be ignored")
+	}
+	if _, ok := ns.Key("backups"); ok {
+		t.Error("expect folder itself to be ignored")
+	}
+	if p := ns.Prefix("foo"); p != "backups/foo" {
+		t.Errorf("expect prefix backups/foo, but got %s", p)
+	}
+	if _, err := storage.NewNamespace("../backups"); err == nil {
+		t.Error("expect invalid folder to fail")
+	}
+}
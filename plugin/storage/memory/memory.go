@@ -0,0 +1,274 @@
+// Package memory stores backups in memory. Backups only live as long as the
+// process, so it is meant for tests and dry runs.
+package memory
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/plugin/storage"
+)
+
+const (
+	name          = "memory"
+	defaultBucket = "default"
+)
+
+func init() {
+	storage.Add(name, func() storage.Storage {
+		return &Store{}
+	})
+}
+
+var (
+	mu      sync.Mutex
+	buckets = map[string]*bucket{}
+)
+
+// Store is a memory store. Stores with the same bucket share their keys
+// within a process.
+type Store struct {
+	Bucket string `toml:"bucket"`
+
+	b *bucket
+}
+
+type bucket struct {
+	mu      sync.RWMutex
+	objects map[string]*object
+}
+
+type object struct {
+	data    []byte
+	modTime time.Time
+	sum     [md5.Size]byte
+}
+
+func (s *Store) Name() string {
+	return name
+}
+
+func (s *Store) Init() error {
+	if s.Bucket == "" {
+		s.Bucket = defaultBucket
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	b, ok := buckets[s.Bucket]
+	if !ok {
+		b = &bucket{objects: map[string]*object{}}
+		buckets[s.Bucket] = b
+	}
+	s.b = b
+	return nil
+}
+
+func (s *Store) Info(ctx *context.Context, key string) (os.FileInfo, error) {
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	o, ok := s.b.get(key)
+	if !ok {
+		return nil, storage.ErrKeyNotFound
+	}
+	return o.info(key), nil
+}
+
+// Push reads all data before storing it, so a failed push never leaves a
+// partial backup behind
+func (s *Store) Push(ctx *context.Context, key string, r io.Reader) error {
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(ctx.Reader(r))
+	if err != nil {
+		return errors.Wrap(err, "cannot read data")
+	}
+
+	s.b.mu.Lock()
+	s.b.objects[key] = &object{data: data, modTime: time.Now(), sum: md5.Sum(data)}
+	s.b.mu.Unlock()
+	return nil
+}
+
+func (s *Store) Pull(
+	ctx *context.Context, key string,
+) (io.ReadCloser, os.FileInfo, error) {
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	o, ok := s.b.get(key)
+	if !ok {
+		return nil, nil, storage.ErrKeyNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(o.data)), o.info(key), nil
+}
+
+func (s *Store) PullRange(
+	ctx *context.Context, key, version string, offset, length int64,
+) (io.ReadCloser, error) {
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	o, ok := s.b.get(key)
+	if !ok {
+		return nil, storage.ErrKeyNotFound
+	}
+	if version != "" && o.version() != version {
+		return nil, storage.ErrVersionChanged
+	}
+	data := o.data
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *Store) Delete(ctx *context.Context, key string) error {
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return err
+	}
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	if _, ok := s.b.objects[key]; !ok {
+		return storage.ErrKeyNotFound
+	}
+	delete(s.b.objects, key)
+	return nil
+}
+
+func (s *Store) Walk(
+	ctx *context.Context,
+	filter *storage.WalkFilter,
+	walkFn func(key string, f os.FileInfo, err error) error,
+) {
+	var infos []*info
+	s.b.mu.RLock()
+	for key, o := range s.b.objects {
+		if isBetween(filter, o.modTime.UnixNano()) && matches(filter, key) {
+			infos = append(infos, o.info(key))
+		}
+	}
+	s.b.mu.RUnlock()
+
+	// Sort items, and keep the most recent ones
+	sort.Sort(byModTimeDesc(infos))
+	if filter.Limit > 0 && len(infos) > int(filter.Limit) {
+		infos = infos[:filter.Limit]
+	}
+
+	for _, info := range infos {
+		if err := walkFn(info.Name(), info, nil); err != nil {
+			return
+		}
+	}
+}
+
+func (b *bucket) get(key string) (*object, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	o, ok := b.objects[key]
+	return o, ok
+}
+
+func (o *object) info(key string) *info {
+	return &info{
+		name:     key,
+		size:     int64(len(o.data)),
+		modTime:  o.modTime,
+		checksum: "md5:" + hex.EncodeToString(o.sum[:]),
+		version:  o.version(),
+	}
+}
+
+// version returns the push time and the checksum of the object
+func (o *object) version() string {
+	return strconv.FormatInt(o.modTime.UnixNano(), 10) + "-" + hex.EncodeToString(o.sum[:])
+}
+
+// info describes a key stored in memory
+type info struct {
+	name     string
+	size     int64
+	modTime  time.Time
+	checksum string
+	version  string
+}
+
+// base name of the file
+func (i *info) Name() string {
+	return i.name
+}
+
+// length in bytes for regular files; system-dependent for others
+func (i *info) Size() int64 {
+	return i.size
+}
+
+// file mode bits
+func (i *info) Mode() os.FileMode {
+	return os.ModePerm
+}
+
+// modification time
+func (i *info) ModTime() time.Time {
+	return i.modTime
+}
+
+// abbreviation for Mode().IsDir()
+func (i *info) IsDir() bool {
+	return false
+}
+
+// underlying data source (can return nil)
+func (i *info) Sys() interface{} {
+	return nil
+}
+
+// Version returns the push time and the checksum of the data
+func (i *info) Version() string {
+	return i.version
+}
+
+// Checksum returns the MD5 checksum of the data
+func (i *info) Checksum() string {
+	return i.checksum
+}
+
+func isBetween(f *storage.WalkFilter, t int64) bool {
+	return t >= f.From && t <= f.To
+}
+
+func matches(f *storage.WalkFilter, name string) bool {
+	return strings.HasPrefix(name, f.Prefix) &&
+		(f.Pattern == nil || f.Pattern.MatchString(name))
+}
+
+type byModTimeDesc []*info
+
+func (l byModTimeDesc) Len() int      { return len(l) }
+func (l byModTimeDesc) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l byModTimeDesc) Less(i, j int) bool {
+	return l[i].modTime.UnixNano() > l[j].modTime.UnixNano()
+}
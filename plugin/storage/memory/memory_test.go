@@ -0,0 +1,53 @@
+package memory_test
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/plugin/storage"
+	"github.com/stairlin/kargo/plugin/storage/memory"
+	"github.com/stairlin/kargo/plugin/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	var i int
+	storagetest.Run(t, func() storage.Storage {
+		i++
+		return &memory.Store{Bucket: "conformance-" + strconv.Itoa(i)}
+	})
+}
+
+func TestSharedBucket(t *testing.T) {
+	a := &memory.Store{Bucket: "shared"}
+	b := &memory.Store{Bucket: "shared"}
+	c := &memory.Store{Bucket: "other"}
+	for _, store := range []*memory.Store{a, b, c} {
+		if err := store.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	if err := a.Push(ctx, "foo", strings.NewReader("bar")); err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+
+	r, _, err := b.Pull(ctx, "foo")
+	if err != nil {
+		t.Fatal("Error pulling data from storage", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "bar" {
+		t.Errorf("expect data bar, but got %s", got)
+	}
+
+	if _, err := c.Info(ctx, "foo"); err != storage.ErrKeyNotFound {
+		t.Errorf("expect error %s, but got %v", storage.ErrKeyNotFound, err)
+	}
+}
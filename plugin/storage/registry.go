@@ -5,6 +5,8 @@ import (
 	"io"
 	"os"
 	"regexp"
+	"strings"
+	"time"
 
 	"github.com/stairlin/kargo/context"
 )
@@ -19,10 +21,9 @@ type Storage interface {
 	Push(ctx *context.Context, key string, r io.Reader) error
 	// Pull pulls data from the storage and returns a reader
 	Pull(ctx *context.Context, key string) (io.ReadCloser, os.FileInfo, error)
-	// Walk walks the file tree rooted at root, calling walkFn for each file or
-	// directory in the tree, including root. All errors that arise visiting
-	// files and directories are filtered by walkFn. The files are walked in
-	// lexical order, which makes the output deterministic.
+	// Walk calls walkFn for each key selected by filter, from the most
+	// recently modified to the oldest. Errors that arise while listing keys
+	// are passed to walkFn. Walk stops as soon as walkFn returns an error.
 	Walk(
 		ctx *context.Context,
 		filter *WalkFilter,
@@ -30,13 +31,165 @@ type Storage interface {
 	)
 }
 
+// Deleter is implemented by storages which can delete keys
+type Deleter interface {
+	// Delete deletes the given key from the storage
+	Delete(ctx *context.Context, key string) error
+}
+
+// Collector is implemented by storages which keep data shared between keys,
+// and therefore must collect unreferenced data after keys have been deleted
+type Collector interface {
+	// Collect deletes data no longer referenced by any key
+	Collect(ctx *context.Context) error
+}
+
+// ClassInfo is implemented by the info of keys of storages which have
+// storage classes
+type ClassInfo interface {
+	os.FileInfo
+	// StorageClass returns the storage class of the key (e.g. GLACIER)
+	StorageClass() string
+}
+
+// TimeInfo is implemented by the info of keys of storages which keep the
+// creation time of backups in their metadata
+type TimeInfo interface {
+	os.FileInfo
+	// CreatedAt returns the creation time of the backup, or a zero time when
+	// its metadata does not hold it
+	CreatedAt() time.Time
+}
+
+// ChecksumInfo is implemented by the info of keys of storages which expose a
+// checksum of their content without reading it
+type ChecksumInfo interface {
+	os.FileInfo
+	// Checksum returns the checksum of the content of the key, prefixed by its
+	// algorithm (e.g. md5:9e107d9d372bb6826bd81d3542a419d6), or an empty
+	// string when it is unknown
+	Checksum() string
+}
+
+// VersionInfo is implemented by the info of keys of storages which can pull
+// a given version of a key (see RangePuller)
+type VersionInfo interface {
+	os.FileInfo
+	// Version returns an identifier of the content of the key, which changes
+	// when the key is overwritten (e.g. an ETag)
+	Version() string
+}
+
+// MetaTimeFormat is the format of times kept in the metadata of keys
+const MetaTimeFormat = time.RFC3339Nano
+
+// Meta is the metadata of a backup which storages keep along with its data
+type Meta struct {
+	// CreatedAt is the creation time of the backup
+	CreatedAt time.Time
+	// StorageClass is the storage class of the backup, which applies when
+	// the config of the storage does not set one
+	StorageClass string
+}
+
+// MetaPusher is implemented by storages which keep the metadata of backups.
+// Their info implements TimeInfo.
+type MetaPusher interface {
+	// PushMeta pushes data from r to the storage along with meta. Push
+	// records the current time as the creation time of the backup.
+	PushMeta(ctx *context.Context, key string, r io.Reader, meta *Meta) error
+}
+
+// PushMeta pushes data from r to s along with meta, which is dropped when s
+// does not keep metadata
+func PushMeta(
+	ctx *context.Context, s Storage, key string, r io.Reader, meta *Meta,
+) error {
+	if p, ok := s.(MetaPusher); ok {
+		return p.PushMeta(ctx, key, r, meta)
+	}
+	return s.Push(ctx, key, r)
+}
+
+// Locker is implemented by storages which can lock keys against deletion
+// and overwrites (e.g. S3 Object Lock)
+type Locker interface {
+	// Lock returns the lock of key, or nil when it has none
+	Lock(ctx *context.Context, key string) (*Lock, error)
+}
+
+// Lock describes the retention and the legal hold of a key
+type Lock struct {
+	// Mode is the retention mode (e.g. GOVERNANCE, COMPLIANCE)
+	Mode string
+	// RetainUntil is when the retention expires
+	RetainUntil time.Time
+	// LegalHold protects the key until it is removed, regardless of the
+	// retention
+	LegalHold bool
+}
+
+// Locked returns whether the key is protected at t
+func (l *Lock) Locked(t time.Time) bool {
+	return l != nil && (l.LegalHold || t.Before(l.RetainUntil))
+}
+
+// String returns the state of the lock (e.g. "COMPLIANCE until 2018-06-01")
+func (l *Lock) String() string {
+	if !l.Locked(time.Now()) {
+		return "-"
+	}
+	var s []string
+	if time.Now().Before(l.RetainUntil) {
+		s = append(s, l.Mode+" until "+l.RetainUntil.Format("2006-01-02"))
+	}
+	if l.LegalHold {
+		s = append(s, "legal hold")
+	}
+	return strings.Join(s, ", ")
+}
+
+// Deduper is implemented by storages which deduplicate data between keys
+type Deduper interface {
+	// DedupStats returns the deduplication statistics of the storage
+	DedupStats(ctx *context.Context) (*DedupStats, error)
+}
+
+// DedupStats contains statistics about a deduplicating storage
+type DedupStats struct {
+	// Size is the total size of all keys
+	Size int64
+	// Stored is the size actually stored once data has been deduplicated
+	Stored int64
+}
+
+// Ratio returns the deduplication ratio
+func (s *DedupStats) Ratio() float64 {
+	if s.Stored == 0 {
+		return 0
+	}
+	return float64(s.Size) / float64(s.Stored)
+}
+
+// Wrapper is implemented by storages which store data on another storage.
+// The wrapped storage is configured under the "backend" table of the wrapper.
+type Wrapper interface {
+	// Wrap sets the storage on which data is stored. It is called before Init
+	Wrap(backend Storage)
+}
+
 // WalkFilter filters files called by Walk
 type WalkFilter struct {
-	From    int64
-	To      int64
-	Prefix  string
+	// From and To select keys modified within that range (UNIX nanoseconds)
+	From int64
+	To   int64
+	// Prefix selects keys starting with it
+	Prefix string
+	// Pattern selects keys matching it (optional)
 	Pattern *regexp.Regexp
-	Limit   uint
+	// Limit is the maximum number of keys walked. The most recent keys are
+	// kept. Zero means no limit.
+	Limit uint
 }
 
 type Creator func() Storage
@@ -50,4 +203,15 @@ func Add(name string, creator Creator) {
 var (
 	// ErrKeyNotFound when a requested key does not exist in the storage
 	ErrKeyNotFound = errors.New("the requested key does not exist")
+	// ErrInvalidKey when a key cannot be used to store data (see CleanKey)
+	ErrInvalidKey = errors.New("invalid key")
+	// ErrNotAvailable when a key exists, but cannot be read yet (e.g. it is
+	// being restored from an archive). Pulling it again later may succeed.
+	ErrNotAvailable = errors.New("the requested key is not available yet")
+	// ErrLocked when a key cannot be deleted or overwritten because it is
+	// locked (see Locker)
+	ErrLocked = errors.New("the requested key is locked")
+	// ErrVersionChanged when a key has been overwritten since its version
+	// was read (see VersionInfo)
+	ErrVersionChanged = errors.New("the requested key has changed")
 )
@@ -0,0 +1,106 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// Content-defined chunking with a gear rolling hash (FastCDC)
+//
+// A chunk boundary is set where the hash of the last bytes matches a mask,
+// so boundaries only depend on the surrounding content. Inserting data in a
+// stream only changes the chunks around the insertion.
+const (
+	minChunkSize = 512 << 10 // 512 KiB
+	maxChunkSize = 8 << 20   // 8 MiB
+	// chunkMask matches the 20 most significant bits of the hash, which depend
+	// on the last 64 bytes. A boundary is found every 1 MiB on average after
+	// minChunkSize.
+	chunkMask = uint64(0xfffff) << 44
+)
+
+// gearTable derives the gear table from a seed. A random seed per repository
+// prevents chunk boundaries from leaking information about the content.
+func gearTable(seed []byte) *[256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		h := sha256.New()
+		h.Write(seed)
+		h.Write([]byte{byte(i)})
+		table[i] = binary.BigEndian.Uint64(h.Sum(nil))
+	}
+	return &table
+}
+
+// chunker splits data from r into content-defined chunks
+type chunker struct {
+	r    io.Reader
+	gear *[256]uint64
+
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+}
+
+func newChunker(r io.Reader, gear *[256]uint64) *chunker {
+	return &chunker{
+		r:    r,
+		gear: gear,
+		buf:  make([]byte, maxChunkSize),
+	}
+}
+
+// Next returns the next chunk. The chunk is only valid until the next call.
+// It returns io.EOF when there is no more data.
+func (c *chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	data := c.buf[c.start:c.end]
+	n := c.cut(data)
+	c.start += n
+	return data[:n], nil
+}
+
+// fill fills the buffer until it contains the largest possible chunk
+func (c *chunker) fill() error {
+	if c.eof || c.end-c.start == len(c.buf) {
+		return nil
+	}
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+
+	n, err := io.ReadFull(c.r, c.buf[c.end:])
+	c.end += n
+	switch err {
+	case nil:
+		return nil
+	case io.EOF, io.ErrUnexpectedEOF:
+		c.eof = true
+		return nil
+	}
+	return err
+}
+
+// cut returns the position of the first chunk boundary in data
+func (c *chunker) cut(data []byte) int {
+	if len(data) <= minChunkSize {
+		return len(data)
+	}
+
+	var h uint64
+	for i := minChunkSize; i < len(data); i++ {
+		h = (h << 1) + c.gear[data[i]]
+		if h&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
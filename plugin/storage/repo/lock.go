@@ -0,0 +1,154 @@
+package repo
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/log"
+	"github.com/stairlin/kargo/plugin/storage"
+)
+
+// Backups hold a shared lock of the repository, whereas Collect holds an
+// exclusive lock, so that it never deletes chunks reused by a backup whose
+// index is not pushed yet. Backends which cannot delete objects are not
+// locked, since Collect cannot run on them. A lock is an object of the
+// backend storage:
+//
+//	lock-shared-<uuid>
+//	lock-exclusive-<uuid>
+//
+// Locks are refreshed while they are held, and ignored once they are stale
+// (e.g. when their process crashed).
+const (
+	lockPrefix      = "lock-"
+	sharedPrefix    = lockPrefix + "shared-"
+	exclusivePrefix = lockPrefix + "exclusive-"
+
+	lockRefresh = time.Minute * 5
+	lockTimeout = time.Minute * 30
+	lockRetry   = time.Second * 10
+)
+
+// ErrLocked is returned when the repository is locked by another process
+var ErrLocked = errors.New("repository is locked by another process")
+
+// repoLock is a lock held on the repository
+type repoLock struct {
+	s    *Store
+	name string
+	stop chan struct{}
+	done chan struct{}
+}
+
+// lockShared takes a shared lock of the repository, and waits for exclusive
+// locks to be released
+func (s *Store) lockShared(ctx *context.Context) (*repoLock, error) {
+	for {
+		l, err := s.lock(ctx, sharedPrefix)
+		if err != ErrLocked {
+			return l, err
+		}
+		ctx.Info("Repository is locked, waiting...", log.String("storage", name))
+		select {
+		case <-time.After(lockRetry):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// lockExclusive takes an exclusive lock of the repository, or returns
+// ErrLocked when other processes hold a lock
+func (s *Store) lockExclusive(ctx *context.Context) (*repoLock, error) {
+	return s.lock(ctx, exclusivePrefix)
+}
+
+// lock pushes a lock object with prefix kind, and checks for conflicting
+// locks once it is pushed. When two processes take conflicting locks at the
+// same time, at least one of them sees the other one.
+func (s *Store) lock(ctx *context.Context, kind string) (*repoLock, error) {
+	l := &repoLock{
+		s:    s,
+		name: kind + uuid.New().String(),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if err := l.push(ctx); err != nil {
+		return nil, err
+	}
+
+	stale := time.Now().Add(-lockTimeout)
+	var conflict bool
+	err := s.walkObjects(ctx, lockPrefix, func(n string, f os.FileInfo) error {
+		if n == l.name || f.ModTime().Before(stale) {
+			return nil
+		}
+		if kind == exclusivePrefix || strings.HasPrefix(n, exclusivePrefix) {
+			conflict = true
+		}
+		return nil
+	})
+	if err != nil || conflict {
+		l.remove()
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot list locks")
+		}
+		return nil, ErrLocked
+	}
+
+	go l.refresh(ctx)
+	return l, nil
+}
+
+// refresh pushes the lock again until it is released, so that it does not
+// become stale
+func (l *repoLock) refresh(ctx *context.Context) {
+	defer close(l.done)
+	t := time.NewTicker(lockRefresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := l.push(ctx); err != nil {
+				ctx.Warn("repo: cannot refresh lock",
+					log.String("lock", l.name), log.Error(err),
+				)
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// Release releases the lock
+func (l *repoLock) Release() {
+	close(l.stop)
+	<-l.done
+	l.remove()
+}
+
+func (l *repoLock) push(ctx *context.Context) error {
+	now := []byte(time.Now().UTC().Format(time.RFC3339))
+	if _, err := l.s.writeObject(ctx, l.name, now); err != nil {
+		return errors.Wrap(err, "cannot push lock")
+	}
+	return nil
+}
+
+// remove deletes the lock object. It does not use the context of the
+// operation, which may be cancelled already.
+func (l *repoLock) remove() {
+	d, ok := l.s.backend.(storage.Deleter)
+	if !ok {
+		return
+	}
+	ctx := context.Background()
+	if err := d.Delete(ctx, l.name); err != nil &&
+		err != storage.ErrKeyNotFound {
+		ctx.Warn("repo: cannot remove lock", log.String("lock", l.name), log.Error(err))
+	}
+}
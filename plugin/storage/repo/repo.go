@@ -0,0 +1,595 @@
+// Package repo stores backups as deduplicated chunks on another storage
+package repo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/log"
+	"github.com/stairlin/kargo/pkg/sec"
+	"github.com/stairlin/kargo/pkg/unit"
+	"github.com/stairlin/kargo/plugin/storage"
+)
+
+// A repository is made of the following objects on the backend storage:
+//
+//	config        random secrets of the repository (chunker seed & ID key)
+//	index-<key>   list of chunks of a backup key
+//	chunk-<id>    chunk of data, stored once no matter how many keys use it
+//
+// All objects are compressed and then encrypted. The ID of a chunk is the
+// HMAC-SHA256 of its content, so it does not reveal anything about the data.
+const (
+	name    = "repo"
+	version = 1
+
+	configName  = "config"
+	indexPrefix = "index-"
+	chunkPrefix = "chunk-"
+
+	// gracePeriod protects chunks which have just been pushed by a backup in
+	// progress, and are not referenced by an index yet
+	gracePeriod = time.Hour
+)
+
+var (
+	// contains the maximum amount of data that can be encrypted at once
+	blockSize = unit.KB * 32
+)
+
+func init() {
+	storage.Add(name, func() storage.Storage {
+		return &Store{}
+	})
+}
+
+// Store is a deduplicating repository
+type Store struct {
+	Keys    []string `toml:"keys"`
+	Default uint32   `toml:"default"`
+
+	Rotator *sec.Rotator
+
+	backend storage.Storage
+
+	mu   sync.Mutex
+	conf *config
+	gear *[256]uint64
+}
+
+// config contains the random secrets of a repository
+type config struct {
+	Version     int    `json:"version"`
+	ChunkerSeed []byte `json:"chunker_seed"`
+	IDKey       []byte `json:"id_key"`
+}
+
+// index contains the list of chunks of a backup key
+type index struct {
+	Version int        `json:"version"`
+	Size    int64      `json:"size"`
+	Chunks  []chunkRef `json:"chunks"`
+}
+
+type chunkRef struct {
+	ID   string `json:"id"`
+	Size int64  `json:"size"`
+}
+
+func (s *Store) Name() string {
+	return name
+}
+
+func (s *Store) Wrap(backend storage.Storage) {
+	s.backend = backend
+}
+
+func (s *Store) Init() error {
+	if s.backend == nil {
+		return errors.New("missing backend storage")
+	}
+	if len(s.Keys) < 1 {
+		return errors.New("there must be at lest one encryption key")
+	}
+	if int(s.Default) >= len(s.Keys) {
+		return errors.New("invalid default key index")
+	}
+
+	keys := map[uint32][]byte{}
+	for i, key := range s.Keys {
+		decodedKey, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return errors.Wrapf(err, "cannot decode key #%d", i)
+		}
+		if len(decodedKey) != sec.KeySize {
+			return errors.Errorf(
+				"invalid encryption key length %d != %d", len(decodedKey), sec.KeySize,
+			)
+		}
+		keys[uint32(i)] = decodedKey
+	}
+	s.Rotator = sec.NewRotator(keys, s.Default)
+	return nil
+}
+
+func (s *Store) Info(ctx *context.Context, key string) (os.FileInfo, error) {
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	idx, info, err := s.readIndex(ctx, indexName(key))
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: key, size: idx.Size, modTime: info.ModTime()}, nil
+}
+
+func (s *Store) Push(ctx *context.Context, key string, r io.Reader) error {
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return err
+	}
+	conf, err := s.open(ctx)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.backend.(storage.Deleter); ok {
+		l, err := s.lockShared(ctx)
+		if err != nil {
+			return errors.Wrap(err, "cannot lock repository")
+		}
+		defer l.Release()
+	}
+
+	idx := index{Version: version}
+	var stored int64
+	pushed := map[string]bool{}
+	c := newChunker(ctx.Reader(r), s.gear)
+	for {
+		data, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "cannot read data")
+		}
+
+		id := conf.chunkID(data)
+		idx.Size += int64(len(data))
+		idx.Chunks = append(idx.Chunks, chunkRef{ID: id, Size: int64(len(data))})
+		if pushed[id] {
+			continue
+		}
+		pushed[id] = true
+
+		// Skip chunks which are already stored
+		_, err = s.backend.Info(ctx, chunkPrefix+id)
+		switch err {
+		case nil:
+			continue
+		case storage.ErrKeyNotFound:
+		default:
+			return errors.Wrap(err, "cannot get chunk info")
+		}
+		n, err := s.writeObject(ctx, chunkPrefix+id, data)
+		if err != nil {
+			return errors.Wrap(err, "cannot push chunk")
+		}
+		stored += n
+	}
+
+	b, err := json.Marshal(&idx)
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal index")
+	}
+	if _, err := s.writeObject(ctx, indexName(key), b); err != nil {
+		return errors.Wrap(err, "cannot push index")
+	}
+
+	ctx.Info("Data deduplicated",
+		log.String("storage", name),
+		log.Int("chunks", len(idx.Chunks)),
+		log.Int64("size", idx.Size),
+		log.Int64("stored", stored),
+	)
+	return nil
+}
+
+func (s *Store) Pull(
+	ctx *context.Context, key string,
+) (io.ReadCloser, os.FileInfo, error) {
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	conf, err := s.open(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	idx, info, err := s.readIndex(ctx, indexName(key))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out, in := io.Pipe()
+	go func() {
+		in.CloseWithError(func() error {
+			for _, ref := range idx.Chunks {
+				data, _, err := s.readObject(ctx, chunkPrefix+ref.ID)
+				if err != nil {
+					return errors.Wrapf(err, "cannot pull chunk %s", ref.ID)
+				}
+				if int64(len(data)) != ref.Size || conf.chunkID(data) != ref.ID {
+					return errors.Errorf("chunk %s is corrupted", ref.ID)
+				}
+				if _, err := in.Write(data); err != nil {
+					return err
+				}
+			}
+			return nil
+		}())
+	}()
+	return out, &fileInfo{name: key, size: idx.Size, modTime: info.ModTime()}, nil
+}
+
+// Delete deletes the index of a key. Chunks are only deleted by Collect.
+func (s *Store) Delete(ctx *context.Context, key string) error {
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return err
+	}
+	d, ok := s.backend.(storage.Deleter)
+	if !ok {
+		return errors.Errorf("%s storage cannot delete keys", s.backend.Name())
+	}
+	return d.Delete(ctx, indexName(key))
+}
+
+// Collect deletes chunks which are no longer referenced by any index.
+// It holds an exclusive lock of the repository, since a backup may reference
+// chunks which were already stored before its index is pushed. It returns
+// ErrLocked while a backup is in progress.
+func (s *Store) Collect(ctx *context.Context) error {
+	d, ok := s.backend.(storage.Deleter)
+	if !ok {
+		return errors.Errorf("%s storage cannot delete keys", s.backend.Name())
+	}
+	if _, err := s.open(ctx); err != nil {
+		return err
+	}
+	l, err := s.lockExclusive(ctx)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+
+	// Mark chunks referenced by an index
+	referenced := map[string]bool{}
+	err = s.walkObjects(ctx, indexPrefix, func(name string, f os.FileInfo) error {
+		idx, _, err := s.readIndex(ctx, name)
+		if err != nil {
+			return errors.Wrapf(err, "cannot read index %s", name)
+		}
+		for _, ref := range idx.Chunks {
+			referenced[ref.ID] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Sweep the other ones
+	var chunks int
+	var freed int64
+	deadline := time.Now().Add(-gracePeriod)
+	err = s.walkObjects(ctx, chunkPrefix, func(name string, f os.FileInfo) error {
+		if referenced[strings.TrimPrefix(name, chunkPrefix)] ||
+			f.ModTime().After(deadline) {
+			return nil
+		}
+		if err := d.Delete(ctx, name); err != nil {
+			return errors.Wrapf(err, "cannot delete chunk %s", name)
+		}
+		chunks++
+		freed += f.Size()
+		return nil
+	})
+	ctx.Info("Unreferenced chunks deleted",
+		log.String("storage", name),
+		log.Int("chunks", chunks),
+		log.Int64("freed", freed),
+	)
+	return err
+}
+
+// DedupStats returns the total size of keys along with the size of chunks
+func (s *Store) DedupStats(ctx *context.Context) (*storage.DedupStats, error) {
+	if _, err := s.open(ctx); err != nil {
+		return nil, err
+	}
+
+	var stats storage.DedupStats
+	err := s.walkObjects(ctx, indexPrefix, func(name string, f os.FileInfo) error {
+		idx, _, err := s.readIndex(ctx, name)
+		if err != nil {
+			return errors.Wrapf(err, "cannot read index %s", name)
+		}
+		stats.Size += idx.Size
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.walkObjects(ctx, chunkPrefix, func(name string, f os.FileInfo) error {
+		stats.Stored += f.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+func (s *Store) Walk(
+	ctx *context.Context,
+	filter *storage.WalkFilter,
+	walkFn func(key string, f os.FileInfo, err error) error,
+) {
+	backendFilter := storage.WalkFilter{
+		From:   filter.From,
+		To:     filter.To,
+		Prefix: indexName(filter.Prefix),
+	}
+
+	var keys []string
+	var infos []os.FileInfo
+	var walkErr error
+	s.backend.Walk(ctx, &backendFilter, func(n string, f os.FileInfo, err error) error {
+		if err != nil {
+			walkErr = err
+			return err
+		}
+		key, err := url.PathUnescape(strings.TrimPrefix(n, indexPrefix))
+		if err != nil {
+			return nil
+		}
+		if filter.Pattern != nil && !filter.Pattern.MatchString(key) {
+			return nil
+		}
+		if filter.Limit > 0 && len(keys) >= int(filter.Limit) {
+			return nil
+		}
+		keys = append(keys, key)
+		infos = append(infos, f)
+		return nil
+	})
+	if walkErr != nil {
+		walkFn("", nil, walkErr)
+		return
+	}
+
+	for i, key := range keys {
+		idx, _, err := s.readIndex(ctx, indexName(key))
+		if err != nil {
+			walkFn(key, nil, err)
+			return
+		}
+		info := &fileInfo{name: key, size: idx.Size, modTime: infos[i].ModTime()}
+		if err := walkFn(key, info, nil); err != nil {
+			return
+		}
+	}
+}
+
+// open loads the repository config, or creates it on the first use
+func (s *Store) open(ctx *context.Context) (*config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conf != nil {
+		return s.conf, nil
+	}
+
+	var conf config
+	b, _, err := s.readObject(ctx, configName)
+	switch err {
+	case nil:
+		if err := json.Unmarshal(b, &conf); err != nil {
+			return nil, errors.Wrap(err, "cannot unmarshal repository config")
+		}
+		if conf.Version != version {
+			return nil, errors.Errorf("unsupported repository version %d", conf.Version)
+		}
+	case storage.ErrKeyNotFound:
+		ctx.Info("Creating repository...", log.String("storage", name))
+		conf.Version = version
+		if conf.ChunkerSeed, err = sec.GenRandBytes(sec.KeySize); err != nil {
+			return nil, err
+		}
+		if conf.IDKey, err = sec.GenRandBytes(sec.KeySize); err != nil {
+			return nil, err
+		}
+		b, err := json.Marshal(&conf)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot marshal repository config")
+		}
+		if _, err := s.writeObject(ctx, configName, b); err != nil {
+			return nil, errors.Wrap(err, "cannot push repository config")
+		}
+	default:
+		return nil, errors.Wrap(err, "cannot read repository config")
+	}
+
+	s.conf = &conf
+	s.gear = gearTable(conf.ChunkerSeed)
+	return s.conf, nil
+}
+
+// readIndex pulls and decodes the index object n
+func (s *Store) readIndex(
+	ctx *context.Context, n string,
+) (*index, os.FileInfo, error) {
+	b, info, err := s.readObject(ctx, n)
+	if err != nil {
+		return nil, nil, err
+	}
+	var idx index
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return nil, nil, errors.Wrap(err, "cannot unmarshal index")
+	}
+	if idx.Version != version {
+		return nil, nil, errors.Errorf("unsupported index version %d", idx.Version)
+	}
+	return &idx, info, nil
+}
+
+// readObject pulls, decrypts and decompresses the object n
+func (s *Store) readObject(
+	ctx *context.Context, n string,
+) ([]byte, os.FileInfo, error) {
+	r, info, err := s.backend.Pull(ctx, n)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	// The object name is authenticated, so objects cannot be swapped
+	plain, err := s.Rotator.DecryptReaderWithData(r, int(blockSize), []byte(n))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot decrypt object")
+	}
+	defer plain.Close()
+	zr, err := gzip.NewReader(plain)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot decompress object")
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot read object")
+	}
+	return b, info, nil
+}
+
+// writeObject compresses, encrypts and pushes data to the object n. It
+// returns the size of the stored object.
+func (s *Store) writeObject(
+	ctx *context.Context, n string, data []byte,
+) (int64, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return 0, errors.Wrap(err, "cannot compress object")
+	}
+	if err := zw.Close(); err != nil {
+		return 0, errors.Wrap(err, "cannot compress object")
+	}
+
+	r, err := s.Rotator.EncryptReaderWithData(&buf, int(blockSize), []byte(n))
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot encrypt object")
+	}
+	defer r.Close()
+	c := &counter{r: r}
+	if err := s.backend.Push(ctx, n, c); err != nil {
+		return 0, err
+	}
+	return c.n, nil
+}
+
+// walkObjects calls fn for each object of the backend starting with prefix
+func (s *Store) walkObjects(
+	ctx *context.Context, prefix string, fn func(n string, f os.FileInfo) error,
+) error {
+	filter := storage.WalkFilter{
+		To:     math.MaxInt64,
+		Prefix: prefix,
+	}
+	var walkErr error
+	s.backend.Walk(ctx, &filter, func(n string, f os.FileInfo, err error) error {
+		if err == nil {
+			err = fn(n, f)
+		}
+		walkErr = err
+		return err
+	})
+	return walkErr
+}
+
+// chunkID returns the ID of a chunk of data
+func (c *config) chunkID(data []byte) string {
+	h := hmac.New(sha256.New, c.IDKey)
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// indexName returns the object name of the index of key
+func indexName(key string) string {
+	return indexPrefix + url.PathEscape(key)
+}
+
+// counter counts bytes read from r
+type counter struct {
+	r io.Reader
+	n int64
+}
+
+func (c *counter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// fileInfo describes a backup key
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// base name of the file
+func (i *fileInfo) Name() string {
+	return i.name
+}
+
+// length in bytes for regular files; system-dependent for others
+func (i *fileInfo) Size() int64 {
+	return i.size
+}
+
+// file mode bits
+func (i *fileInfo) Mode() os.FileMode {
+	return os.ModePerm
+}
+
+// modification time
+func (i *fileInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+// abbreviation for Mode().IsDir()
+func (i *fileInfo) IsDir() bool {
+	return false
+}
+
+// underlying data source (can return nil)
+func (i *fileInfo) Sys() interface{} {
+	return nil
+}
@@ -0,0 +1,304 @@
+package repo_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/pkg/sec"
+	"github.com/stairlin/kargo/pkg/testutil"
+	"github.com/stairlin/kargo/pkg/unit"
+	"github.com/stairlin/kargo/plugin/storage"
+	"github.com/stairlin/kargo/plugin/storage/fs"
+	"github.com/stairlin/kargo/plugin/storage/repo"
+	"github.com/stairlin/kargo/plugin/storage/storagetest"
+)
+
+func TestVerbatim(t *testing.T) {
+	dir := testutil.TempDir(t, "repo")
+	defer os.RemoveAll(dir)
+	store := newStore(t, dir)
+
+	expect := testutil.GenRandBytes(t, int(4*unit.MB))
+	ctx := context.Background()
+
+	// Ensure the key does not exist
+	_, _, err := store.Pull(ctx, "foo")
+	if storage.ErrKeyNotFound != err {
+		t.Errorf("expect error %s, but got %s", storage.ErrKeyNotFound, err)
+	}
+
+	// Push/Pull
+	if err := store.Push(ctx, "foo/bar", bytes.NewReader(expect)); err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+	got := pull(t, store, "foo/bar")
+	if !bytes.Equal(expect, got) {
+		t.Errorf("expect text %s, but got %s",
+			testutil.Truncate(expect, 140), testutil.Truncate(got, 140),
+		)
+	}
+
+	info, err := store.Info(ctx, "foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(expect)) {
+		t.Errorf("expect size %d, but got %d", len(expect), info.Size())
+	}
+}
+
+func TestDedup(t *testing.T) {
+	dir := testutil.TempDir(t, "repo")
+	defer os.RemoveAll(dir)
+	store := newStore(t, dir)
+	ctx := context.Background()
+
+	a, b := similarData(t)
+	if err := store.Push(ctx, "a", bytes.NewReader(a)); err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+	if err := store.Push(ctx, "b", bytes.NewReader(b)); err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+	if got := pull(t, store, "b"); !bytes.Equal(b, got) {
+		t.Error("expect pulled data to match pushed data")
+	}
+
+	stats, err := store.DedupStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Size != int64(len(a)+len(b)) {
+		t.Errorf("expect size %d, but got %d", len(a)+len(b), stats.Size)
+	}
+	if stats.Ratio() < 1.4 {
+		t.Errorf("expect dedup ratio of at least 1.4, but got %f", stats.Ratio())
+	}
+
+	// Walk
+	var keys []string
+	filter := storage.WalkFilter{To: math.MaxInt64}
+	store.Walk(ctx, &filter, func(key string, f os.FileInfo, err error) error {
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if len(keys) != 2 {
+		t.Errorf("expect 2 keys, but got %v", keys)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	dir := testutil.TempDir(t, "repo")
+	defer os.RemoveAll(dir)
+	store := newStore(t, dir)
+	ctx := context.Background()
+
+	a, b := similarData(t)
+	if err := store.Push(ctx, "a", bytes.NewReader(a)); err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+	if err := store.Push(ctx, "b", bytes.NewReader(b)); err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+	before, err := store.DedupStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Recent chunks are kept, since they may belong to a backup in progress
+	if err := store.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Collect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := countChunks(t, dir); n == 0 {
+		t.Error("expect recent chunks to be kept")
+	}
+
+	ageChunks(t, dir)
+	if err := store.Collect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	after, err := store.DedupStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Stored >= before.Stored {
+		t.Errorf("expect stored size to decrease, but got %d -> %d",
+			before.Stored, after.Stored,
+		)
+	}
+	if got := pull(t, store, "b"); !bytes.Equal(b, got) {
+		t.Error("expect remaining key to be intact")
+	}
+
+	if err := store.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Collect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := countChunks(t, dir); n != 0 {
+		t.Errorf("expect all chunks to be deleted, but got %d", n)
+	}
+}
+
+// TestCollectLock ensures that Collect does not delete chunks reused by a
+// backup in progress
+func TestCollectLock(t *testing.T) {
+	dir := testutil.TempDir(t, "repo")
+	defer os.RemoveAll(dir)
+	store := newStore(t, dir)
+	ctx := context.Background()
+
+	// Unreferenced chunks which are old enough to be collected
+	a, b := similarData(t)
+	if err := store.Push(ctx, "a", bytes.NewReader(a)); err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+	if err := store.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	ageChunks(t, dir)
+
+	// Backup b, which reuses the chunks of a, is still in progress
+	r, w := io.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- store.Push(ctx, "b", r)
+	}()
+	if _, err := w.Write(b[:len(b)/2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Collect(ctx); err != repo.ErrLocked {
+		t.Errorf("expect error %s, but got %v", repo.ErrLocked, err)
+	}
+	if _, err := w.Write(b[len(b)/2:]); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+
+	if err := store.Collect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := pull(t, store, "b"); !bytes.Equal(b, got) {
+		t.Error("expect key pushed during collection to be intact")
+	}
+	if locks := glob(t, dir, "lock-*"); len(locks) != 0 {
+		t.Errorf("expect locks to be released, but got %v", locks)
+	}
+
+	// Stale locks of crashed processes are ignored
+	stale := filepath.Join(dir, "lock-exclusive-stale")
+	if err := ioutil.WriteFile(stale, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Push(ctx, "c", bytes.NewReader(a[:1024])); err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	dir := testutil.TempDir(t, "repo")
+	defer os.RemoveAll(dir)
+
+	var i int
+	storagetest.Run(t, func() storage.Storage {
+		i++
+		return newRepo(t, filepath.Join(dir, strconv.Itoa(i)))
+	})
+}
+
+func newStore(t *testing.T, dir string) *repo.Store {
+	store := newRepo(t, dir)
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// newRepo returns a repository stored on dir, which is not initialised yet
+func newRepo(t *testing.T, dir string) *repo.Store {
+	backend := &fs.Store{Path: dir}
+	if err := backend.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := sec.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &repo.Store{
+		Keys: []string{base64.StdEncoding.EncodeToString(key)},
+	}
+	store.Wrap(backend)
+	return store
+}
+
+// similarData returns two slices which only differ by a few bytes inserted
+// in the middle
+func similarData(t *testing.T) (a, b []byte) {
+	a = testutil.GenRandBytes(t, int(32*unit.MB))
+	b = append(b, a[:len(a)/2]...)
+	b = append(b, testutil.GenRandBytes(t, 100)...)
+	b = append(b, a[len(a)/2:]...)
+	return a, b
+}
+
+func pull(t *testing.T, store *repo.Store, key string) []byte {
+	r, _, err := store.Pull(context.Background(), key)
+	if err != nil {
+		t.Fatal("Error pulling data from storage", err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func chunks(t *testing.T, dir string) []string {
+	return glob(t, dir, "chunk-*")
+}
+
+func glob(t *testing.T, dir, pattern string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func countChunks(t *testing.T, dir string) int {
+	return len(chunks(t, dir))
+}
+
+func ageChunks(t *testing.T, dir string) {
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range chunks(t, dir) {
+		if err := os.Chtimes(name, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
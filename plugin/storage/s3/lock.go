@@ -0,0 +1,142 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/plugin/storage"
+)
+
+// Object Lock headers. They are set and read directly, so that they do not
+// depend on the version of the SDK.
+const (
+	headerLockMode        = "X-Amz-Object-Lock-Mode"
+	headerLockRetainUntil = "X-Amz-Object-Lock-Retain-Until-Date"
+	headerLegalHold       = "X-Amz-Object-Lock-Legal-Hold"
+	headerContentMD5      = "Content-Md5"
+
+	lockGovernance = "GOVERNANCE"
+	lockCompliance = "COMPLIANCE"
+	legalHoldOn    = "ON"
+)
+
+// Lock returns the Object Lock retention and legal hold of key
+func (s *Store) Lock(ctx *context.Context, key string) (*storage.Lock, error) {
+	name, err := s.ns.Name(key)
+	if err != nil {
+		return nil, err
+	}
+	input := &s3.HeadObjectInput{
+		Key:    aws.String(name),
+		Bucket: aws.String(s.Bucket),
+	}
+
+	var header http.Header
+	_, err = s.S3.HeadObjectWithContext(ctx, input, func(r *request.Request) {
+		r.Handlers.Unmarshal.PushBack(func(r *request.Request) {
+			header = r.HTTPResponse.Header
+		})
+	})
+	if err != nil {
+		return nil, headError(err)
+	}
+	return parseLock(header), nil
+}
+
+// initLock validates the Object Lock options
+func (s *Store) initLock() error {
+	switch s.LockMode {
+	case "":
+		if s.LockDays != 0 {
+			return errors.New("lock_days requires a lock_mode")
+		}
+	case lockGovernance, lockCompliance:
+		if s.LockDays <= 0 {
+			return errors.Errorf("lock_mode %s requires lock_days", s.LockMode)
+		}
+	default:
+		return errors.Errorf(
+			"unsupported lock_mode %s (%s or %s)", s.LockMode, lockGovernance, lockCompliance,
+		)
+	}
+	return nil
+}
+
+// locks returns whether new objects are locked
+func (s *Store) locks() bool {
+	return s.LockMode != "" || s.LegalHold
+}
+
+// lockOption returns a request option which locks the objects uploaded by
+// PutObject or by a multipart upload. S3 requires the MD5 of data uploaded to
+// locked objects, so it is also set.
+func (s *Store) lockOption() request.Option {
+	until := time.Now().Add(time.Duration(s.LockDays) * 24 * time.Hour).UTC()
+	return func(r *request.Request) {
+		r.Handlers.Build.PushBack(func(r *request.Request) {
+			h := r.HTTPRequest.Header
+			switch r.Operation.Name {
+			case "PutObject", "CreateMultipartUpload":
+				if s.LockMode != "" {
+					h.Set(headerLockMode, s.LockMode)
+					h.Set(headerLockRetainUntil, until.Format(time.RFC3339))
+				}
+				if s.LegalHold {
+					h.Set(headerLegalHold, legalHoldOn)
+				}
+			}
+			switch r.Operation.Name {
+			case "PutObject", "UploadPart":
+				if err := setContentMD5(r); err != nil {
+					r.Error = err
+				}
+			}
+		})
+	}
+}
+
+// setContentMD5 sets the MD5 of the body of r, and rewinds it
+func setContentMD5(r *request.Request) error {
+	if r.Body == nil || r.HTTPRequest.Header.Get(headerContentMD5) != "" {
+		return nil
+	}
+	start, err := r.Body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return errors.Wrap(err, "cannot seek body")
+	}
+	h := md5.New()
+	if _, err := io.Copy(h, r.Body); err != nil {
+		return errors.Wrap(err, "cannot compute body MD5")
+	}
+	if _, err := r.Body.Seek(start, io.SeekStart); err != nil {
+		return errors.Wrap(err, "cannot rewind body")
+	}
+	r.HTTPRequest.Header.Set(
+		headerContentMD5, base64.StdEncoding.EncodeToString(h.Sum(nil)),
+	)
+	return nil
+}
+
+// parseLock parses the Object Lock headers of an object, and returns nil
+// when it has none
+func parseLock(h http.Header) *storage.Lock {
+	l := &storage.Lock{
+		Mode:      h.Get(headerLockMode),
+		LegalHold: h.Get(headerLegalHold) == legalHoldOn,
+	}
+	if t, err := time.Parse(time.RFC3339, h.Get(headerLockRetainUntil)); err == nil {
+		l.RetainUntil = t
+	}
+	if l.Mode == "" && !l.LegalHold {
+		return nil
+	}
+	return l
+}
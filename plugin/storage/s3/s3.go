@@ -4,11 +4,12 @@ package s3
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
-	"path"
-	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -33,6 +34,27 @@ const (
 	limit     = unit.GB * 5 // Max allowed chunk size
 	chunk     = unit.MB * 250
 	separator = "/"
+
+	codeNotFound = "NotFound"
+	// codeInvalidObjectState is returned when an archived object is read
+	codeInvalidObjectState = "InvalidObjectState"
+	// codePreconditionFailed is returned when the ETag of an object does not
+	// match If-Match
+	codePreconditionFailed = "PreconditionFailed"
+	// codeRestoreInProgress is returned when an object is already being
+	// restored
+	codeRestoreInProgress = "RestoreAlreadyInProgress"
+
+	sseAES256 = "AES256"
+	sseKMS    = "aws:kms"
+
+	// createdAtMeta is the user metadata of the creation time of backups
+	createdAtMeta = "kargo-created-at"
+
+	defaultRestoreDays = 1
+	defaultRestoreTier = "Standard"
+	defaultRestoreWait = 12 * time.Hour
+	defaultRestorePoll = time.Minute
 )
 
 func init() {
@@ -51,8 +73,47 @@ type Store struct {
 	Bucket string `toml:"bucket"`
 	Debug  bool   `toml:"debug"`
 
+	// Endpoint overrides the S3 endpoint (e.g. MinIO, Ceph)
+	Endpoint string `toml:"endpoint"`
+	// ForcePathStyle addresses buckets with path-style URLs (e.g. MinIO)
+	ForcePathStyle bool `toml:"force_path_style"`
+
+	// StorageClass is the storage class of new objects (e.g. STANDARD_IA)
+	StorageClass string `toml:"storage_class"`
+	// SSE is the server-side encryption of new objects (AES256 or aws:kms).
+	// SSEKMSKeyID is the KMS key of aws:kms (optional).
+	SSE         string `toml:"sse"`
+	SSEKMSKeyID string `toml:"sse_kms_key_id"`
+	// Tags are set to new objects
+	Tags map[string]string `toml:"tags"`
+
+	// RestoreDays is the number of days archived objects stay restored
+	RestoreDays int64 `toml:"restore_days"`
+	// RestoreTier is the retrieval tier of archived objects (Expedited,
+	// Standard or Bulk)
+	RestoreTier string `toml:"restore_tier"`
+	// RestoreWait is how long a pull waits for an archived object to be
+	// restored. Once elapsed, the pull fails, and it can be resumed later.
+	RestoreWait string `toml:"restore_wait"`
+	// RestorePoll is the interval between two checks of a restore
+	RestorePoll string `toml:"restore_poll"`
+
+	// LockMode is the Object Lock retention mode of new objects (GOVERNANCE
+	// or COMPLIANCE), which are retained for LockDays. The bucket must have
+	// Object Lock enabled.
+	LockMode string `toml:"lock_mode"`
+	LockDays int64  `toml:"lock_days"`
+	// LegalHold places a legal hold on new objects
+	LegalHold bool `toml:"legal_hold"`
+
 	Sesh *session.Session
 	S3   *s3.S3
+
+	ns          storage.Namespace
+	tagging     string
+	restoreWait time.Duration
+	restorePoll time.Duration
+	restoreMu   sync.Mutex
 }
 
 func (s *Store) Name() string {
@@ -60,21 +121,35 @@ func (s *Store) Name() string {
 }
 
 func (s *Store) Init() error {
-	if s.Folder != "" {
-		s.Folder = path.Clean(s.Folder)
+	ns, err := storage.NewNamespace(s.Folder)
+	if err != nil {
+		return err
+	}
+	s.ns = ns
+	s.Folder = ns.Folder()
+	if err := s.initOptions(); err != nil {
+		return err
+	}
+	if err := s.initLock(); err != nil {
+		return err
 	}
 
 	// Sessions should be cached when possible, because creating a new Session
 	// will load all configuration values from the environment, and config files
 	// each time the Session is created.
-	sesh, err := session.NewSession(&aws.Config{
+	config := &aws.Config{
 		Region: aws.String(s.Region),
 		Credentials: credentials.NewStaticCredentials(
 			s.ID,
 			s.Secret,
 			s.Token,
 		),
-	})
+		S3ForcePathStyle: aws.Bool(s.ForcePathStyle),
+	}
+	if s.Endpoint != "" {
+		config.Endpoint = aws.String(s.Endpoint)
+	}
+	sesh, err := session.NewSession(config)
 	if err != nil {
 		return errors.Wrap(err, "cannot create AWS session")
 	}
@@ -93,24 +168,47 @@ func (s *Store) Init() error {
 }
 
 func (s *Store) Info(ctx *context.Context, key string) (os.FileInfo, error) {
+	name, err := s.ns.Name(key)
+	if err != nil {
+		return nil, err
+	}
 	input := &s3.HeadObjectInput{
-		Key:    aws.String(key),
+		Key:    aws.String(name),
 		Bucket: aws.String(s.Bucket),
 	}
 
 	out, err := s.S3.HeadObjectWithContext(ctx, input)
-	switch err := err.(type) {
-	case nil:
-		return s.headObjectOutputInfo(out), nil
-	case awserr.Error:
-		if err.Code() == s3.ErrCodeNoSuchKey {
-			return nil, storage.ErrKeyNotFound
+	if err != nil {
+		return nil, headError(err)
+	}
+	return s.headObjectOutputInfo(name, out), nil
+}
+
+// headError returns the error of a HEAD request
+func headError(err error) error {
+	if err, ok := err.(awserr.Error); ok {
+		// HEAD responses have no body, so S3 cannot return a NoSuchKey code
+		if err.Code() == s3.ErrCodeNoSuchKey || err.Code() == codeNotFound {
+			return storage.ErrKeyNotFound
 		}
 	}
-	return nil, errors.Wrap(err, "cannot get data from S3")
+	return errors.Wrap(err, "cannot get data from S3")
 }
 
 func (s *Store) Push(ctx *context.Context, key string, r io.Reader) error {
+	return s.PushMeta(ctx, key, r, &storage.Meta{CreatedAt: time.Now()})
+}
+
+// PushMeta pushes data from r, and records the creation time of the backup
+// in the user metadata of the object
+func (s *Store) PushMeta(
+	ctx *context.Context, key string, r io.Reader, meta *storage.Meta,
+) error {
+	name, err := s.ns.Name(key)
+	if err != nil {
+		return err
+	}
+
 	// TODO: Buffer it has the minimum chunk size and start a multipart
 	// upload
 	f, err := ctx.CreateTempFile(r)
@@ -122,12 +220,18 @@ func (s *Store) Push(ctx *context.Context, key string, r io.Reader) error {
 		return errors.Wrap(err, "cannot get temporary file stat")
 	}
 
+	var opts []request.Option
+	if s.locks() {
+		opts = append(opts, s.lockOption())
+	}
+
 	if stat.Size() > int64(limit) {
 		// Multipart upload
 		uploader := s3manager.NewUploader(s.Sesh, func(u *s3manager.Uploader) {
 			u.Concurrency = 2
 			u.LeavePartsOnError = false
 			u.PartSize = s3manager.MinUploadPartSize
+			u.RequestOptions = append(u.RequestOptions, opts...)
 
 			// Adjust PartSize until the number of parts is small enough.
 			size := stat.Size()
@@ -138,9 +242,14 @@ func (s *Store) Push(ctx *context.Context, key string, r io.Reader) error {
 		})
 
 		input := s3manager.UploadInput{
-			Key:    aws.String(key),
-			Bucket: aws.String(s.Bucket),
-			Body:   f,
+			Key:                  aws.String(name),
+			Bucket:               aws.String(s.Bucket),
+			Body:                 f,
+			StorageClass:         optional(s.storageClass(meta)),
+			ServerSideEncryption: optional(s.SSE),
+			SSEKMSKeyId:          optional(s.SSEKMSKeyID),
+			Tagging:              optional(s.tagging),
+			Metadata:             metadata(meta),
 		}
 		if _, err = uploader.UploadWithContext(ctx, &input); err != nil {
 			return errors.Wrap(err, "cannot upload multipart backup to S3")
@@ -148,12 +257,17 @@ func (s *Store) Push(ctx *context.Context, key string, r io.Reader) error {
 	} else {
 		// Simple upload
 		input := &s3.PutObjectInput{
-			Key:    aws.String(key),
-			Bucket: aws.String(s.Bucket),
-			Body:   f,
+			Key:                  aws.String(name),
+			Bucket:               aws.String(s.Bucket),
+			Body:                 f,
+			StorageClass:         optional(s.storageClass(meta)),
+			ServerSideEncryption: optional(s.SSE),
+			SSEKMSKeyId:          optional(s.SSEKMSKeyID),
+			Tagging:              optional(s.tagging),
+			Metadata:             metadata(meta),
 		}
 
-		_, err := s.S3.PutObjectWithContext(ctx, input)
+		_, err := s.S3.PutObjectWithContext(ctx, input, opts...)
 		if err != nil {
 			return errors.Wrap(err, "cannot upload data to S3")
 		}
@@ -164,15 +278,19 @@ func (s *Store) Push(ctx *context.Context, key string, r io.Reader) error {
 func (s *Store) Pull(
 	ctx *context.Context, key string,
 ) (io.ReadCloser, os.FileInfo, error) {
+	name, err := s.ns.Name(key)
+	if err != nil {
+		return nil, nil, err
+	}
 	input := &s3.GetObjectInput{
-		Key:    aws.String(key),
+		Key:    aws.String(name),
 		Bucket: aws.String(s.Bucket),
 	}
 
-	out, err := s.S3.GetObjectWithContext(ctx, input)
+	out, err := s.getObject(ctx, input)
 	switch err := err.(type) {
 	case nil:
-		return out.Body, s.getObjectOutputInfo(out), nil
+		return out.Body, s.getObjectOutputInfo(name, out), nil
 	case awserr.Error:
 		if err.Code() == s3.ErrCodeNoSuchKey {
 			return nil, nil, storage.ErrKeyNotFound
@@ -181,6 +299,77 @@ func (s *Store) Pull(
 	return nil, nil, errors.Wrap(err, "cannot get data from S3")
 }
 
+// PullRange pulls length bytes of key starting at offset with a ranged
+// GetObject. The version is the ETag of the object, which S3 matches.
+func (s *Store) PullRange(
+	ctx *context.Context, key, version string, offset, length int64,
+) (io.ReadCloser, error) {
+	name, err := s.ns.Name(key)
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		// An empty range is not satisfiable
+		i, err := s.Info(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if version != "" && i.(*info).Version() != version {
+			return nil, storage.ErrVersionChanged
+		}
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	rng := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		rng = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	}
+	input := &s3.GetObjectInput{
+		Key:     aws.String(name),
+		Bucket:  aws.String(s.Bucket),
+		Range:   aws.String(rng),
+		IfMatch: optional(version),
+	}
+
+	out, err := s.getObject(ctx, input)
+	switch err := err.(type) {
+	case nil:
+		return out.Body, nil
+	case awserr.Error:
+		switch err.Code() {
+		case s3.ErrCodeNoSuchKey:
+			return nil, storage.ErrKeyNotFound
+		case codePreconditionFailed:
+			return nil, storage.ErrVersionChanged
+		}
+	}
+	return nil, errors.Wrap(err, "cannot get data from S3")
+}
+
+// Delete deletes key. S3 does not report whether a deleted object existed,
+// so the key is checked beforehand. Locked keys are not deleted, since S3
+// would only hide them behind a delete marker.
+func (s *Store) Delete(ctx *context.Context, key string) error {
+	name, err := s.ns.Name(key)
+	if err != nil {
+		return err
+	}
+	lock, err := s.Lock(ctx, key)
+	if err != nil {
+		return err
+	}
+	if lock.Locked(time.Now()) {
+		return errors.Wrapf(storage.ErrLocked, "%s is locked (%s)", key, lock)
+	}
+	input := &s3.DeleteObjectInput{
+		Key:    aws.String(name),
+		Bucket: aws.String(s.Bucket),
+	}
+	if _, err := s.S3.DeleteObjectWithContext(ctx, input); err != nil {
+		return errors.Wrap(err, "cannot delete data from S3")
+	}
+	return nil
+}
+
 func (s *Store) Walk(
 	ctx *context.Context,
 	filter *storage.WalkFilter,
@@ -190,89 +379,274 @@ func (s *Store) Walk(
 		Bucket:  aws.String(s.Bucket),
 		MaxKeys: aws.Int64(maxKeys),
 	}
-	if s.Folder != "" && s.Folder != slash {
-		input.Prefix = aws.String(path.Clean(s.Folder) + slash)
-	}
-	if filter.Prefix != "" {
-		input.Prefix = aws.String(aws.StringValue(input.Prefix) + filter.Prefix)
+	if prefix := s.ns.Prefix(filter.Prefix); prefix != "" {
+		input.Prefix = aws.String(prefix)
 	}
 
 	// Fetch list
-	out, err := s.S3.ListObjectsWithContext(ctx, input)
+	var contents []*s3.Object
+	err := s.S3.ListObjectsPagesWithContext(ctx, input,
+		func(out *s3.ListObjectsOutput, lastPage bool) bool {
+			contents = append(contents, out.Contents...)
+			return true
+		},
+	)
 	if err != nil {
 		walkFn("", nil, errors.Wrap(err, "cannot list backups from S3"))
 		return
 	}
-	if len(out.Contents) == maxKeys {
-		ctx.Warn(
-			"S3 list objects max key reached. Some keys will be missing.",
-			log.Int64("keys", maxKeys),
-		)
-	}
 
-	var i int
-	var objects []*s3.Object
-	for _, o := range out.Contents {
-		i++
-		if (filter.Limit == 0 || i <= int(filter.Limit)) &&
-			isBetween(filter, aws.TimeValue(o.LastModified).UnixNano()) &&
-			matches(filter, aws.StringValue(o.Key)) {
-			objects = append(objects, o)
+	var infos []*info
+	for _, o := range contents {
+		info := s.objectInfo(o)
+		if info == nil {
+			continue
+		}
+		if isBetween(filter, info.ModTime().UnixNano()) &&
+			matches(filter, info.Name()) {
+			infos = append(infos, info)
 		}
 	}
 
-	// Sort items
-	sort.Sort(byModTimeDesc(objects))
+	// Sort items, and keep the most recent ones
+	sort.Sort(byModTimeDesc(infos))
+	if filter.Limit > 0 && len(infos) > int(filter.Limit) {
+		infos = infos[:filter.Limit]
+	}
 
-	for _, o := range objects {
-		info := s.objectInfo(o)
+	for _, info := range infos {
 		if err := walkFn(info.Name(), info, nil); err != nil {
 			return
 		}
 	}
 }
 
-func (s *Store) objectInfo(o *s3.Object) *info {
-	path, err := filepath.Rel(s.Folder, aws.StringValue(o.Key))
+// getObject gets an object. When the object is archived, it is restored
+// first.
+func (s *Store) getObject(
+	ctx *context.Context, input *s3.GetObjectInput,
+) (*s3.GetObjectOutput, error) {
+	out, err := s.S3.GetObjectWithContext(ctx, input)
+	if err, ok := err.(awserr.Error); ok && err.Code() == codeInvalidObjectState {
+		if err := s.restore(ctx, aws.StringValue(input.Key)); err != nil {
+			return nil, err
+		}
+		return s.S3.GetObjectWithContext(ctx, input)
+	}
+	return out, err
+}
+
+// restore restores the archived object name, and waits until it can be read
+func (s *Store) restore(ctx *context.Context, name string) error {
+	// Parts of a download wait for the same restore
+	s.restoreMu.Lock()
+	defer s.restoreMu.Unlock()
+
+	key, _ := s.ns.Key(name)
+	head := &s3.HeadObjectInput{
+		Key:    aws.String(name),
+		Bucket: aws.String(s.Bucket),
+	}
+	out, err := s.S3.HeadObjectWithContext(ctx, head)
 	if err != nil {
-		path = aws.StringValue(o.Key)
+		return errors.Wrap(err, "cannot get data from S3")
 	}
-	return &info{
-		name:    path,
-		size:    aws.Int64Value(o.Size),
-		modTime: aws.TimeValue(o.LastModified),
+	class := aws.StringValue(out.StorageClass)
+
+	switch restore := aws.StringValue(out.Restore); {
+	case isRestored(restore):
+		return nil
+	case restore == "":
+		ctx.Info("Object is archived. Restoring it...",
+			log.String("key", key),
+			log.String("class", class),
+			log.String("tier", s.RestoreTier),
+		)
+		input := &s3.RestoreObjectInput{
+			Key:    aws.String(name),
+			Bucket: aws.String(s.Bucket),
+			RestoreRequest: &s3.RestoreRequest{
+				Days: aws.Int64(s.RestoreDays),
+				GlacierJobParameters: &s3.GlacierJobParameters{
+					Tier: aws.String(s.RestoreTier),
+				},
+			},
+		}
+		_, err := s.S3.RestoreObjectWithContext(ctx, input)
+		if err, ok := err.(awserr.Error); err != nil &&
+			(!ok || err.Code() != codeRestoreInProgress) {
+			return errors.Wrap(err, "cannot restore archived object")
+		}
+	}
+
+	deadline := time.Now().Add(s.restoreWait)
+	for {
+		if time.Now().Add(s.restorePoll).After(deadline) {
+			return errors.Wrapf(storage.ErrNotAvailable,
+				"%s is being restored from %s. Pull it again later", key, class,
+			)
+		}
+		ctx.Info("Waiting for archived object to be restored...",
+			log.String("key", key),
+			log.String("retry_in", s.restorePoll.String()),
+		)
+		select {
+		case <-time.After(s.restorePoll):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		out, err := s.S3.HeadObjectWithContext(ctx, head)
+		if err != nil {
+			return errors.Wrap(err, "cannot get data from S3")
+		}
+		if isRestored(aws.StringValue(out.Restore)) {
+			ctx.Info("Archived object restored", log.String("key", key))
+			return nil
+		}
 	}
 }
 
-func (s *Store) getObjectOutputInfo(o *s3.GetObjectOutput) *info {
-	path, err := filepath.Rel(s.Folder, o.String())
-	if err != nil {
-		path = o.String()
+// initOptions validates and sets the default values of the options of new
+// objects and restores
+func (s *Store) initOptions() error {
+	switch s.SSE {
+	case "", sseAES256, sseKMS:
+	default:
+		return errors.Errorf("unsupported sse %s (%s or %s)", s.SSE, sseAES256, sseKMS)
+	}
+	if s.SSEKMSKeyID != "" && s.SSE != sseKMS {
+		return errors.Errorf("sse_kms_key_id requires sse %s", sseKMS)
+	}
+	if len(s.Tags) > 0 {
+		v := url.Values{}
+		for k, tag := range s.Tags {
+			v.Set(k, tag)
+		}
+		s.tagging = v.Encode()
+	}
+
+	if s.RestoreDays == 0 {
+		s.RestoreDays = defaultRestoreDays
+	}
+	if s.RestoreDays < 0 {
+		return errors.New("restore_days must be positive")
+	}
+	switch s.RestoreTier {
+	case "":
+		s.RestoreTier = defaultRestoreTier
+	case "Expedited", "Standard", "Bulk":
+	default:
+		return errors.Errorf("unsupported restore_tier %s", s.RestoreTier)
+	}
+	var err error
+	if s.restoreWait, err = parseDuration(s.RestoreWait, defaultRestoreWait); err != nil {
+		return errors.Wrap(err, "invalid restore_wait")
+	}
+	if s.restorePoll, err = parseDuration(s.RestorePoll, defaultRestorePoll); err != nil {
+		return errors.Wrap(err, "invalid restore_poll")
+	}
+	if s.restorePoll <= 0 {
+		return errors.New("restore_poll must be positive")
+	}
+	return nil
+}
+
+// objectInfo returns the info of o, or nil when o is not within the folder
+func (s *Store) objectInfo(o *s3.Object) *info {
+	key, ok := s.ns.Key(aws.StringValue(o.Key))
+	if !ok {
+		return nil
 	}
 	return &info{
-		name:    path,
-		size:    aws.Int64Value(o.ContentLength),
-		modTime: aws.TimeValue(o.LastModified),
+		name:         key,
+		size:         aws.Int64Value(o.Size),
+		modTime:      aws.TimeValue(o.LastModified),
+		storageClass: aws.StringValue(o.StorageClass),
+		etag:         aws.StringValue(o.ETag),
 	}
 }
 
-func (s *Store) headObjectOutputInfo(o *s3.HeadObjectOutput) *info {
-	path, err := filepath.Rel(s.Folder, o.String())
-	if err != nil {
-		path = o.String()
+func (s *Store) getObjectOutputInfo(name string, o *s3.GetObjectOutput) *info {
+	key, _ := s.ns.Key(name)
+	return &info{
+		name:         key,
+		size:         aws.Int64Value(o.ContentLength),
+		modTime:      aws.TimeValue(o.LastModified),
+		storageClass: aws.StringValue(o.StorageClass),
+		createdAt:    createdAt(o.Metadata),
+		checksum:     checksum(o.ETag, o.ServerSideEncryption),
+		etag:         aws.StringValue(o.ETag),
 	}
+}
+
+func (s *Store) headObjectOutputInfo(name string, o *s3.HeadObjectOutput) *info {
+	key, _ := s.ns.Key(name)
 	return &info{
-		name:    path,
-		size:    aws.Int64Value(o.ContentLength),
-		modTime: aws.TimeValue(o.LastModified),
+		name:         key,
+		size:         aws.Int64Value(o.ContentLength),
+		modTime:      aws.TimeValue(o.LastModified),
+		storageClass: aws.StringValue(o.StorageClass),
+		createdAt:    createdAt(o.Metadata),
+		checksum:     checksum(o.ETag, o.ServerSideEncryption),
+		etag:         aws.StringValue(o.ETag),
+	}
+}
+
+// checksum returns the checksum of an object from its ETag. S3 returns the
+// MD5 checksum of objects uploaded in a single part as their ETag, unless
+// they are encrypted with KMS. The ETag of multipart uploads depends on the
+// size of their parts, so it only matches the ETag of other objects.
+func checksum(etag, sse *string) string {
+	tag := strings.Trim(aws.StringValue(etag), `"`)
+	switch {
+	case tag == "", aws.StringValue(sse) == sseKMS:
+		return ""
+	case strings.Contains(tag, "-"):
+		return "s3-etag:" + tag
+	}
+	return "md5:" + tag
+}
+
+// storageClass returns the storage class of an object pushed with meta
+func (s *Store) storageClass(meta *storage.Meta) string {
+	if s.StorageClass != "" {
+		return s.StorageClass
 	}
+	return meta.StorageClass
+}
+
+// metadata returns the user metadata of an object pushed with meta
+func metadata(meta *storage.Meta) map[string]*string {
+	if meta.CreatedAt.IsZero() {
+		return nil
+	}
+	return map[string]*string{
+		createdAtMeta: aws.String(meta.CreatedAt.UTC().Format(storage.MetaTimeFormat)),
+	}
+}
+
+// createdAt returns the creation time recorded in the user metadata of an
+// object. The SDK may change the case of metadata names.
+func createdAt(m map[string]*string) time.Time {
+	for k, v := range m {
+		if strings.EqualFold(k, createdAtMeta) {
+			t, _ := time.Parse(storage.MetaTimeFormat, aws.StringValue(v))
+			return t
+		}
+	}
+	return time.Time{}
 }
 
 // object wraps an S3 object to a struct that implements os.FileInfo
 type info struct {
-	name    string
-	size    int64
-	modTime time.Time
+	name         string
+	size         int64
+	modTime      time.Time
+	storageClass string
+	createdAt    time.Time
+	checksum     string
+	etag         string
 }
 
 // base name of the file
@@ -305,6 +679,61 @@ func (i *info) Sys() interface{} {
 	return nil
 }
 
+// StorageClass returns the storage class of the object. S3 omits it for
+// STANDARD objects.
+func (i *info) StorageClass() string {
+	if i.storageClass == "" {
+		return "STANDARD"
+	}
+	return i.storageClass
+}
+
+// CreatedAt returns the creation time of the backup. Objects listed by Walk
+// do not have it, since listings omit user metadata.
+func (i *info) CreatedAt() time.Time {
+	return i.createdAt
+}
+
+// Version returns the ETag of the object
+func (i *info) Version() string {
+	return i.etag
+}
+
+// Checksum returns the checksum of the object. Objects listed by Walk do
+// not have it, since listings omit their encryption.
+func (i *info) Checksum() string {
+	return i.checksum
+}
+
+// isRestored returns whether the restore header of an object reports a
+// completed restore (e.g. ongoing-request="false", expiry-date="...")
+func isRestored(restore string) bool {
+	return strings.Contains(restore, `ongoing-request="false"`)
+}
+
+// optional returns nil for empty strings
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
+
+// parseDuration parses s, or returns def when s is empty
+func parseDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, errors.New("duration must be positive")
+	}
+	return d, nil
+}
+
 func isBetween(f *storage.WalkFilter, t int64) bool {
 	return t >= f.From && t <= f.To
 }
@@ -314,12 +743,10 @@ func matches(f *storage.WalkFilter, name string) bool {
 		(f.Pattern == nil || f.Pattern.MatchString(name))
 }
 
-type byModTimeDesc []*s3.Object
+type byModTimeDesc []*info
 
 func (l byModTimeDesc) Len() int      { return len(l) }
 func (l byModTimeDesc) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
 func (l byModTimeDesc) Less(i, j int) bool {
-	a := aws.TimeValue(l[i].LastModified).UnixNano()
-	b := aws.TimeValue(l[j].LastModified).UnixNano()
-	return a > b
+	return l[i].modTime.UnixNano() > l[j].modTime.UnixNano()
 }
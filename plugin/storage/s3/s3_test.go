@@ -0,0 +1,585 @@
+package s3_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stairlin/kargo/agent"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/pkg/keytmpl"
+	"github.com/stairlin/kargo/plugin/storage"
+	"github.com/stairlin/kargo/plugin/storage/s3"
+	"github.com/stairlin/kargo/plugin/storage/storagetest"
+)
+
+const bucket = "kargo"
+
+func TestConformance(t *testing.T) {
+	server := httptest.NewServer(newFakeServer())
+	defer server.Close()
+
+	var i int
+	storagetest.Run(t, func() storage.Storage {
+		i++
+		return &s3.Store{
+			ID:             "kargo",
+			Secret:         "secret",
+			Region:         "us-east-1",
+			Bucket:         bucket,
+			Folder:         strconv.Itoa(i),
+			Endpoint:       server.URL,
+			ForcePathStyle: true,
+		}
+	})
+}
+
+func TestArchive(t *testing.T) {
+	fake := newFakeServer()
+	fake.restoreDelay = 50 * time.Millisecond
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	newStore := func(wait string) *s3.Store {
+		store := &s3.Store{
+			ID:             "kargo",
+			Secret:         "secret",
+			Region:         "us-east-1",
+			Bucket:         bucket,
+			Folder:         "archive",
+			Endpoint:       server.URL,
+			ForcePathStyle: true,
+			StorageClass:   "GLACIER",
+			SSE:            "AES256",
+			Tags:           map[string]string{"env": "test"},
+			RestoreWait:    wait,
+			RestorePoll:    "10ms",
+		}
+		if err := store.Init(); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+	store := newStore("1s")
+	ctx := context.Background()
+
+	if err := store.Push(ctx, "foo", strings.NewReader("foo")); err != nil {
+		t.Fatal("cannot push data", err)
+	}
+	o := fake.objects["archive/foo"]
+	if o.class != "GLACIER" || o.sse != "AES256" || o.tagging != "env=test" {
+		t.Errorf("expect GLACIER/AES256/env=test, but got %s/%s/%s",
+			o.class, o.sse, o.tagging,
+		)
+	}
+
+	// Storage class
+	var classes []string
+	store.Walk(ctx, &storage.WalkFilter{To: math.MaxInt64},
+		func(key string, f os.FileInfo, err error) error {
+			if c, ok := f.(storage.ClassInfo); ok {
+				classes = append(classes, c.StorageClass())
+			}
+			return err
+		},
+	)
+	if len(classes) != 1 || classes[0] != "GLACIER" {
+		t.Errorf("expect classes [GLACIER], but got %v", classes)
+	}
+
+	// Restore and wait
+	r, _, err := store.Pull(ctx, "foo")
+	if err != nil {
+		t.Fatal("cannot pull archived data", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "foo" {
+		t.Errorf("expect data foo, but got %s (%v)", data, err)
+	}
+
+	// Restore without waiting
+	if err := store.Push(ctx, "bar", strings.NewReader("bar")); err != nil {
+		t.Fatal("cannot push data", err)
+	}
+	store = newStore("0s")
+	if _, _, err := store.Pull(ctx, "bar"); errors.Cause(err) != storage.ErrNotAvailable {
+		t.Errorf("expect error %s, but got %v", storage.ErrNotAvailable, err)
+	}
+	if fake.objects["archive/bar"].restoreAt.IsZero() {
+		t.Error("expect a restore to be requested")
+	}
+	time.Sleep(fake.restoreDelay)
+	if _, _, err := store.Pull(ctx, "bar"); err != nil {
+		t.Error("expect pull to be resumed once restored, but got", err)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	fake := newFakeServer()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	newStore := func(class, sse string) *s3.Store {
+		store := &s3.Store{
+			ID:             "kargo",
+			Secret:         "secret",
+			Region:         "us-east-1",
+			Bucket:         bucket,
+			Folder:         "meta",
+			Endpoint:       server.URL,
+			ForcePathStyle: true,
+			StorageClass:   class,
+			SSE:            sse,
+		}
+		if err := store.Init(); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+	ctx := context.Background()
+	meta := &storage.Meta{StorageClass: "STANDARD_IA"}
+
+	// The storage class of the config prevails
+	store := newStore("ONEZONE_IA", "")
+	if err := store.PushMeta(ctx, "foo", strings.NewReader("foo"), meta); err != nil {
+		t.Fatal("cannot push data", err)
+	}
+	if class := fake.objects["meta/foo"].class; class != "ONEZONE_IA" {
+		t.Errorf("expect class ONEZONE_IA, but got %s", class)
+	}
+	store = newStore("", "")
+	if err := store.PushMeta(ctx, "foo", strings.NewReader("foo"), meta); err != nil {
+		t.Fatal("cannot push data", err)
+	}
+	if class := fake.objects["meta/foo"].class; class != "STANDARD_IA" {
+		t.Errorf("expect class STANDARD_IA, but got %s", class)
+	}
+
+	// Checksum
+	sum := md5.Sum([]byte("foo"))
+	checksum := func(key string) string {
+		info, err := store.Info(ctx, key)
+		if err != nil {
+			t.Fatal("cannot get info", err)
+		}
+		return info.(storage.ChecksumInfo).Checksum()
+	}
+	if got, expect := checksum("foo"), "md5:"+hex.EncodeToString(sum[:]); got != expect {
+		t.Errorf("expect checksum %s, but got %s", expect, got)
+	}
+	store = newStore("", "aws:kms")
+	if err := store.Push(ctx, "bar", strings.NewReader("foo")); err != nil {
+		t.Fatal("cannot push data", err)
+	}
+	if got := checksum("bar"); got != "" {
+		t.Errorf("expect no checksum for KMS objects, but got %s", got)
+	}
+}
+
+func TestCopiedBackup(t *testing.T) {
+	fake := newFakeServer()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store := &s3.Store{
+		ID:             "kargo",
+		Secret:         "secret",
+		Region:         "us-east-1",
+		Bucket:         bucket,
+		Folder:         "copied",
+		Endpoint:       server.URL,
+		ForcePathStyle: true,
+	}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := keytmpl.Parse("{source}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &agent.Agent{Storage: store, Template: tmpl}
+
+	// Listings omit the creation time, which is read from the object
+	ctx := context.Background()
+	created := time.Date(2018, 6, 1, 12, 30, 0, 0, time.UTC)
+	meta := &storage.Meta{CreatedAt: created}
+	if err := store.PushMeta(ctx, "foo", strings.NewReader("foo"), meta); err != nil {
+		t.Fatal("cannot push data", err)
+	}
+	var got []*agent.Backup
+	err = a.Backups(ctx, storage.WalkFilter{Limit: 1}, func(b *agent.Backup) error {
+		got = append(got, b)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("cannot walk backups", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expect 1 backup, but got %d", len(got))
+	}
+	if !got[0].Time.Equal(created) || got[0].ModTime().Equal(created) {
+		t.Errorf("expect creation time %s and a later modification time, but got %s/%s",
+			created, got[0].Time, got[0].ModTime(),
+		)
+	}
+}
+
+// lockHeaders are the Object Lock headers of an object
+var lockHeaders = []string{
+	"X-Amz-Object-Lock-Mode",
+	"X-Amz-Object-Lock-Retain-Until-Date",
+	"X-Amz-Object-Lock-Legal-Hold",
+}
+
+func TestObjectLock(t *testing.T) {
+	fake := newFakeServer()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	newStore := func(folder, mode string, days int64, hold bool) *s3.Store {
+		store := &s3.Store{
+			ID:             "kargo",
+			Secret:         "secret",
+			Region:         "us-east-1",
+			Bucket:         bucket,
+			Folder:         folder,
+			Endpoint:       server.URL,
+			ForcePathStyle: true,
+			LockMode:       mode,
+			LockDays:       days,
+			LegalHold:      hold,
+		}
+		if err := store.Init(); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+	ctx := context.Background()
+
+	// Retention
+	store := newStore("retention", "COMPLIANCE", 7, false)
+	if err := store.Push(ctx, "foo", strings.NewReader("foo")); err != nil {
+		t.Fatal("cannot push data", err)
+	}
+	lock, err := store.Lock(ctx, "foo")
+	if err != nil {
+		t.Fatal("cannot get lock", err)
+	}
+	if lock == nil || lock.Mode != "COMPLIANCE" || lock.LegalHold {
+		t.Fatalf("expect COMPLIANCE lock without legal hold, but got %v", lock)
+	}
+	until := time.Now().Add(7 * 24 * time.Hour)
+	if d := until.Sub(lock.RetainUntil); d < 0 || d > time.Minute {
+		t.Errorf("expect retention until %s, but got %s", until, lock.RetainUntil)
+	}
+	if err := store.Delete(ctx, "foo"); errors.Cause(err) != storage.ErrLocked {
+		t.Errorf("expect error %s, but got %v", storage.ErrLocked, err)
+	}
+
+	// Legal hold
+	store = newStore("hold", "", 0, true)
+	if err := store.Push(ctx, "foo", strings.NewReader("foo")); err != nil {
+		t.Fatal("cannot push data", err)
+	}
+	lock, err = store.Lock(ctx, "foo")
+	if err != nil {
+		t.Fatal("cannot get lock", err)
+	}
+	if !lock.Locked(time.Now()) || !lock.LegalHold {
+		t.Errorf("expect legal hold, but got %v", lock)
+	}
+	if err := store.Delete(ctx, "foo"); errors.Cause(err) != storage.ErrLocked {
+		t.Errorf("expect error %s, but got %v", storage.ErrLocked, err)
+	}
+
+	// Unlocked
+	store = newStore("unlocked", "", 0, false)
+	if err := store.Push(ctx, "foo", strings.NewReader("foo")); err != nil {
+		t.Fatal("cannot push data", err)
+	}
+	if lock, err := store.Lock(ctx, "foo"); err != nil || lock != nil {
+		t.Errorf("expect no lock, but got %v (%v)", lock, err)
+	}
+	if err := store.Delete(ctx, "foo"); err != nil {
+		t.Error("cannot delete key", err)
+	}
+
+	// Invalid options
+	for _, store := range []*s3.Store{
+		{Bucket: bucket, LockMode: "COMPLIANCE"},
+		{Bucket: bucket, LockDays: 1},
+		{Bucket: bucket, LockMode: "FOREVER", LockDays: 1},
+	} {
+		if err := store.Init(); err == nil {
+			t.Errorf("expect %s/%d to be rejected", store.LockMode, store.LockDays)
+		}
+	}
+}
+
+// fakeServer is an in-memory stand-in of S3 (path-style requests only).
+// Archived objects are restored after restoreDelay.
+type fakeServer struct {
+	mu           sync.Mutex
+	objects      map[string]*fakeObject
+	restoreDelay time.Duration
+}
+
+type fakeObject struct {
+	data    []byte
+	modTime time.Time
+	class   string
+	sse     string
+	tagging string
+	// meta holds the user metadata headers of the object
+	meta http.Header
+	// lock holds the Object Lock headers of the object
+	lock http.Header
+	// restoreAt is when a requested restore completes
+	restoreAt time.Time
+}
+
+// archived returns whether o cannot be read, and its restore header
+func (o *fakeObject) archived() (bool, string) {
+	if o.class != "GLACIER" && o.class != "DEEP_ARCHIVE" {
+		return false, ""
+	}
+	switch {
+	case o.restoreAt.IsZero():
+		return true, ""
+	case time.Now().Before(o.restoreAt):
+		return true, `ongoing-request="true"`
+	}
+	expiry := o.restoreAt.Add(24 * time.Hour).Format(http.TimeFormat)
+	return false, `ongoing-request="false", expiry-date="` + expiry + `"`
+}
+
+// etag returns the ETag of o, which is the MD5 checksum of its data unless
+// it is encrypted with KMS
+func (o *fakeObject) etag() string {
+	sum := md5.Sum(o.data)
+	if o.sse == "aws:kms" {
+		sum = md5.Sum(append([]byte("kms"), o.data...))
+	}
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// locked returns whether o is under retention or legal hold
+func (o *fakeObject) locked() bool {
+	if o.lock.Get("X-Amz-Object-Lock-Legal-Hold") == "ON" {
+		return true
+	}
+	until, err := time.Parse(time.RFC3339, o.lock.Get("X-Amz-Object-Lock-Retain-Until-Date"))
+	return err == nil && time.Now().Before(until)
+}
+
+func newFakeServer() *fakeServer {
+	return &fakeServer{
+		objects: map[string]*fakeObject{},
+	}
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// e.g. /kargo/backups/foo
+	p := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if p[0] != bucket {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if len(p) == 1 || p[1] == "" {
+		if r.Method != "GET" {
+			writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+			return
+		}
+		s.list(w, r)
+		return
+	}
+
+	name := p[1]
+	if r.Method == "PUT" {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		class := r.Header.Get("X-Amz-Storage-Class")
+		if class == "" {
+			class = "STANDARD"
+		}
+		meta := http.Header{}
+		for k := range r.Header {
+			if strings.HasPrefix(k, "X-Amz-Meta-") {
+				meta.Set(k, r.Header.Get(k))
+			}
+		}
+		lock := http.Header{}
+		for _, k := range lockHeaders {
+			if v := r.Header.Get(k); v != "" {
+				lock.Set(k, v)
+			}
+		}
+		// Like S3, locked objects require the MD5 of their data
+		sum := md5.Sum(data)
+		digest := base64.StdEncoding.EncodeToString(sum[:])
+		if len(lock) > 0 && r.Header.Get("Content-Md5") != digest {
+			writeError(w, http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+		o := &fakeObject{
+			data: data,
+			// S3 modification times have a resolution of a second
+			modTime: time.Now().UTC().Truncate(time.Second),
+			class:   class,
+			sse:     r.Header.Get("X-Amz-Server-Side-Encryption"),
+			tagging: r.Header.Get("X-Amz-Tagging"),
+			meta:    meta,
+			lock:    lock,
+		}
+		s.mu.Lock()
+		s.objects[name] = o
+		s.mu.Unlock()
+		w.Header().Set("ETag", o.etag())
+		return
+	}
+
+	s.mu.Lock()
+	o, ok := s.objects[name]
+	if ok && r.Method == "DELETE" {
+		if o.locked() {
+			s.mu.Unlock()
+			writeError(w, http.StatusForbidden, "AccessDenied")
+			return
+		}
+		delete(s.objects, name)
+	}
+	var archived bool
+	var restore string
+	if ok {
+		if _, isRestore := r.URL.Query()["restore"]; isRestore && r.Method == "POST" {
+			if archived, _ = o.archived(); !archived {
+				s.mu.Unlock()
+				writeError(w, http.StatusForbidden, "InvalidObjectState")
+				return
+			}
+			if o.restoreAt.IsZero() {
+				o.restoreAt = time.Now().Add(s.restoreDelay)
+			}
+			s.mu.Unlock()
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		archived, restore = o.archived()
+	}
+	s.mu.Unlock()
+
+	switch {
+	case r.Method == "DELETE":
+		// Deleting a missing object is not an error
+		w.WriteHeader(http.StatusNoContent)
+	case !ok && r.Method == "HEAD":
+		// HEAD responses have no body, so the error code is not sent
+		w.WriteHeader(http.StatusNotFound)
+	case !ok:
+		writeError(w, http.StatusNotFound, "NoSuchKey")
+	case r.Method == "GET" && archived:
+		writeError(w, http.StatusForbidden, "InvalidObjectState")
+	case r.Header.Get("If-Match") != "" && r.Header.Get("If-Match") != o.etag():
+		writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+	case r.Method == "HEAD", r.Method == "GET":
+		if o.class != "STANDARD" {
+			w.Header().Set("X-Amz-Storage-Class", o.class)
+		}
+		if restore != "" {
+			w.Header().Set("X-Amz-Restore", restore)
+		}
+		for k := range o.lock {
+			w.Header().Set(k, o.lock.Get(k))
+		}
+		for k := range o.meta {
+			w.Header().Set(k, o.meta.Get(k))
+		}
+		if o.sse != "" {
+			w.Header().Set("X-Amz-Server-Side-Encryption", o.sse)
+		}
+		w.Header().Set("ETag", o.etag())
+		// ServeContent handles Range requests
+		http.ServeContent(w, r, name, o.modTime, bytes.NewReader(o.data))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// list returns objects by pages of 2. Like S3, it does not return a
+// NextMarker without delimiter, so the last key is the marker of the next page.
+func (s *fakeServer) list(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := r.URL.Query()
+	var names []string
+	for name := range s.objects {
+		if strings.HasPrefix(name, q.Get("prefix")) && name > q.Get("marker") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	type content struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int    `xml:"Size"`
+		StorageClass string `xml:"StorageClass"`
+	}
+	out := struct {
+		XMLName     xml.Name  `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+		Name        string    `xml:"Name"`
+		Prefix      string    `xml:"Prefix"`
+		Marker      string    `xml:"Marker"`
+		MaxKeys     int       `xml:"MaxKeys"`
+		IsTruncated bool      `xml:"IsTruncated"`
+		Contents    []content `xml:"Contents"`
+	}{
+		Name:        bucket,
+		Prefix:      q.Get("prefix"),
+		Marker:      q.Get("marker"),
+		MaxKeys:     2,
+		IsTruncated: len(names) > 2,
+	}
+	for i := 0; i < len(names) && i < 2; i++ {
+		o := s.objects[names[i]]
+		out.Contents = append(out.Contents, content{
+			Key:          names[i],
+			LastModified: o.modTime.Format("2006-01-02T15:04:05.000Z"),
+			ETag:         o.etag(),
+			Size:         len(o.data),
+			StorageClass: o.class,
+		})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(&out)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(&struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: http.StatusText(status)})
+}
@@ -0,0 +1,417 @@
+// Package sftp stores backups on a remote host over SFTP
+package sftp
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/log"
+	"github.com/stairlin/kargo/plugin/storage"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	name = "sftp"
+
+	defaultPort        = "22"
+	defaultConcurrency = 64
+	dialTimeout        = time.Second * 30
+
+	// codeOpUnsupported is the status of requests the server does not
+	// support (SSH_FX_OP_UNSUPPORTED)
+	codeOpUnsupported = 8
+)
+
+func init() {
+	storage.Add(name, func() storage.Storage {
+		return &Store{}
+	})
+}
+
+// Store is an SFTP store
+type Store struct {
+	Host           string `toml:"host"`
+	User           string `toml:"user"`
+	Password       string `toml:"password"`
+	PrivateKey     string `toml:"private_key"`
+	PrivateKeyFile string `toml:"private_key_file"`
+	Passphrase     string `toml:"passphrase"`
+	KnownHosts     string `toml:"known_hosts"`
+	Insecure       bool   `toml:"insecure_ignore_host_key"`
+	Folder         string `toml:"folder"`
+	Concurrency    int    `toml:"concurrency"`
+
+	config *ssh.ClientConfig
+	addr   string
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+func (s *Store) Name() string {
+	return name
+}
+
+func (s *Store) Init() error {
+	if s.Host == "" {
+		return errors.New("missing host")
+	}
+	if s.User == "" {
+		return errors.New("missing user")
+	}
+	s.addr = s.Host
+	if _, _, err := net.SplitHostPort(s.Host); err != nil {
+		s.addr = net.JoinHostPort(s.Host, defaultPort)
+	}
+	if s.Folder == "" {
+		s.Folder = "."
+	}
+	s.Folder = path.Clean(s.Folder)
+	if s.Concurrency == 0 {
+		s.Concurrency = defaultConcurrency
+	}
+	if s.Concurrency < 0 {
+		return errors.New("concurrency must be positive")
+	}
+
+	// Authentication
+	var auth []ssh.AuthMethod
+	privateKey, err := s.loadPrivateKey()
+	if err != nil {
+		return err
+	}
+	if privateKey != nil {
+		var signer ssh.Signer
+		if s.Passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(
+				privateKey, []byte(s.Passphrase),
+			)
+		} else {
+			signer, err = ssh.ParsePrivateKey(privateKey)
+		}
+		if err != nil {
+			return errors.Wrap(err, "cannot parse private key")
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if s.Password != "" {
+		auth = append(auth, ssh.Password(s.Password))
+	}
+	if len(auth) == 0 {
+		return errors.New("there must be at least a password or a private key")
+	}
+
+	// Host key verification
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if !s.Insecure {
+		if s.KnownHosts == "" {
+			home, err := homeDir()
+			if err != nil {
+				return err
+			}
+			s.KnownHosts = filepath.Join(home, ".ssh", "known_hosts")
+		}
+		hostKeyCallback, err = knownhosts.New(s.KnownHosts)
+		if err != nil {
+			return errors.Wrap(err, "cannot load known hosts")
+		}
+	}
+
+	s.config = &ssh.ClientConfig{
+		User:            s.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         dialTimeout,
+	}
+	return nil
+}
+
+func (s *Store) Info(ctx *context.Context, key string) (os.FileInfo, error) {
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	info, err := c.Stat(s.path(key))
+	switch {
+	case err == nil:
+		return &keyInfo{FileInfo: info, key: key}, nil
+	case os.IsNotExist(err):
+		return nil, storage.ErrKeyNotFound
+	}
+	return nil, errors.Wrap(err, "cannot stat file")
+}
+
+// Push uploads data to a temporary file, which is then renamed to key.
+// Therefore, an interrupted push never leaves a partial backup behind.
+func (s *Store) Push(ctx *context.Context, key string, r io.Reader) error {
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return err
+	}
+	c, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	p := s.path(key)
+	if err := c.MkdirAll(path.Dir(p)); err != nil {
+		return errors.Wrap(err, "cannot create directory")
+	}
+	tmp := path.Join(path.Dir(p), storage.TempPrefix+uuid.New().String())
+	f, err := c.Create(tmp)
+	if err != nil {
+		return errors.Wrap(err, "cannot create file")
+	}
+
+	// ReadFrom sends up to Concurrency write requests at once
+	_, err = f.ReadFrom(ctx.Reader(r))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = s.rename(c, tmp, p)
+	}
+	if err != nil {
+		if rerr := c.Remove(tmp); rerr != nil {
+			ctx.Warn("sftp: cannot remove temporary file",
+				log.String("path", tmp), log.Error(rerr),
+			)
+		}
+		return errors.Wrap(err, "cannot upload file")
+	}
+	return nil
+}
+
+func (s *Store) Pull(
+	ctx *context.Context, key string,
+) (io.ReadCloser, os.FileInfo, error) {
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := s.connect(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := c.Open(s.path(key))
+	switch {
+	case err == nil:
+	case os.IsNotExist(err):
+		return nil, nil, storage.ErrKeyNotFound
+	default:
+		return nil, nil, errors.Wrap(err, "cannot open file")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, &keyInfo{FileInfo: info, key: key}, nil
+}
+
+func (s *Store) Delete(ctx *context.Context, key string) error {
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return err
+	}
+	c, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = c.Remove(s.path(key))
+	switch {
+	case err == nil:
+		return nil
+	case os.IsNotExist(err):
+		return storage.ErrKeyNotFound
+	}
+	return errors.Wrap(err, "cannot delete file")
+}
+
+func (s *Store) Walk(
+	ctx *context.Context,
+	filter *storage.WalkFilter,
+	walkFn func(key string, f os.FileInfo, err error) error,
+) {
+	c, err := s.connect(ctx)
+	if err != nil {
+		walkFn("", nil, err)
+		return
+	}
+
+	var items []listItem
+	walker := c.Walk(s.Folder)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			walkFn("", nil, errors.Wrap(err, "sftp: walk error"))
+			return
+		}
+		f := walker.Stat()
+		if f.IsDir() || strings.HasPrefix(f.Name(), storage.TempPrefix) {
+			continue
+		}
+
+		key := s.key(walker.Path())
+		if isBetween(filter, f.ModTime().UnixNano()) &&
+			matches(filter, key) {
+			items = append(items, listItem{
+				SortingKey: f.ModTime().UnixNano(),
+				Key:        key,
+				Info:       &keyInfo{FileInfo: f, key: key},
+			})
+		}
+	}
+
+	// Sort items, and keep the most recent ones
+	sort.Sort(listItemsDesc(items))
+	if filter.Limit > 0 && len(items) > int(filter.Limit) {
+		items = items[:filter.Limit]
+	}
+
+	// Call back
+	for _, item := range items {
+		if err := walkFn(item.Key, item.Info, nil); err != nil {
+			return
+		}
+	}
+}
+
+// connect returns an SFTP client, and connects to the host if needed
+func (s *Store) connect(ctx *context.Context) (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	ctx.Info("Connecting to SFTP host...", log.String("host", s.addr))
+	conn, err := ssh.Dial("tcp", s.addr, s.config)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot connect to %s", s.addr)
+	}
+	client, err := sftp.NewClient(conn,
+		sftp.MaxConcurrentRequestsPerFile(s.Concurrency),
+	)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "cannot start SFTP session")
+	}
+	s.conn = conn
+	s.client = client
+
+	// Reconnect on the next call when the connection is lost
+	go func() {
+		conn.Wait()
+		client.Close()
+		s.mu.Lock()
+		if s.conn == conn {
+			s.conn, s.client = nil, nil
+		}
+		s.mu.Unlock()
+	}()
+	return client, nil
+}
+
+// rename renames oldname to newname, and replaces newname if it exists
+func (s *Store) rename(c *sftp.Client, oldname, newname string) error {
+	err := c.PosixRename(oldname, newname)
+	if e, ok := err.(*sftp.StatusError); !ok || e.Code != codeOpUnsupported {
+		return err
+	}
+	// Without the posix-rename extension, SFTP rename fails when the target
+	// exists
+	if err := c.Remove(newname); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return c.Rename(oldname, newname)
+}
+
+// path returns the path of the file of key
+func (s *Store) path(key string) string {
+	return path.Join(s.Folder, key)
+}
+
+// key returns the key of the file at p within the folder. The root folder
+// ends with a slash, unlike the others.
+func (s *Store) key(p string) string {
+	if s.Folder == "." {
+		return p
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(p, s.Folder), "/")
+}
+
+// loadPrivateKey returns the private key either from the config or from the
+// private key file
+func (s *Store) loadPrivateKey() ([]byte, error) {
+	if s.PrivateKeyFile == "" {
+		if s.PrivateKey == "" {
+			return nil, nil
+		}
+		return []byte(s.PrivateKey), nil
+	}
+	if s.PrivateKey != "" {
+		return nil, errors.New("private_key and private_key_file are mutually exclusive")
+	}
+	b, err := ioutil.ReadFile(s.PrivateKeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read private key file")
+	}
+	return b, nil
+}
+
+func homeDir() (string, error) {
+	if home := os.Getenv("HOME"); home != "" {
+		return home, nil
+	}
+	return "", errors.New("cannot find home directory (set known_hosts)")
+}
+
+func isBetween(f *storage.WalkFilter, t int64) bool {
+	return t >= f.From && t <= f.To
+}
+
+func matches(f *storage.WalkFilter, name string) bool {
+	return strings.HasPrefix(name, f.Prefix) &&
+		(f.Pattern == nil || f.Pattern.MatchString(name))
+}
+
+// keyInfo describes the file of a key
+type keyInfo struct {
+	os.FileInfo
+	key string
+}
+
+// Name returns the key of the file
+func (i *keyInfo) Name() string {
+	return i.key
+}
+
+type listItem struct {
+	SortingKey int64
+	Key        string
+	Info       os.FileInfo
+}
+
+type listItemsDesc []listItem
+
+func (a listItemsDesc) Len() int           { return len(a) }
+func (a listItemsDesc) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a listItemsDesc) Less(i, j int) bool { return a[i].SortingKey > a[j].SortingKey }
@@ -0,0 +1,388 @@
+package sftp_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	pkgsftp "github.com/pkg/sftp"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/pkg/testutil"
+	"github.com/stairlin/kargo/pkg/unit"
+	"github.com/stairlin/kargo/plugin/storage"
+	"github.com/stairlin/kargo/plugin/storage/sftp"
+	"github.com/stairlin/kargo/plugin/storage/storagetest"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	user     = "kargo"
+	password = "secret"
+)
+
+func TestVerbatim(t *testing.T) {
+	dir := testutil.TempDir(t, "sftp")
+	defer os.RemoveAll(dir)
+	addr, knownHosts := startServer(t, dir, "")
+
+	store := &sftp.Store{
+		Host:       addr,
+		User:       user,
+		Password:   password,
+		KnownHosts: knownHosts,
+		Folder:     filepath.Join(dir, "backups"),
+	}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := testutil.GenRandBytes(t, int(8*unit.MB))
+	ctx := context.Background()
+
+	// Ensure the key does not exist
+	_, _, err := store.Pull(ctx, "foo/bar")
+	if storage.ErrKeyNotFound != err {
+		t.Errorf("expect error %s, but got %s", storage.ErrKeyNotFound, err)
+	}
+
+	// Push/Pull
+	if err := store.Push(ctx, "foo/bar", bytes.NewReader(expect)); err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+	out, info, err := store.Pull(ctx, "foo/bar")
+	if err != nil {
+		t.Fatal("Error pulling data from storage", err)
+	}
+	got, err := ioutil.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	if !bytes.Equal(expect, got) {
+		t.Errorf("expect text %s, but got %s",
+			testutil.Truncate(expect, 140), testutil.Truncate(got, 140),
+		)
+	}
+	if info.Size() != int64(len(expect)) {
+		t.Errorf("expect size %d, but got %d", len(expect), info.Size())
+	}
+
+	// Overwrite
+	if err := store.Push(ctx, "foo/bar", bytes.NewReader([]byte("baz"))); err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+	info, err = store.Info(ctx, "foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 3 {
+		t.Errorf("expect size 3, but got %d", info.Size())
+	}
+
+	// Walk
+	var keys []string
+	filter := storage.WalkFilter{To: math.MaxInt64}
+	store.Walk(ctx, &filter, func(key string, f os.FileInfo, err error) error {
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if len(keys) != 1 || keys[0] != "foo/bar" {
+		t.Errorf("expect keys [foo/bar], but got %v", keys)
+	}
+
+	// No temporary files are left behind
+	files, err := ioutil.ReadDir(filepath.Join(dir, "backups", "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("expect 1 file, but got %d", len(files))
+	}
+
+	// Delete
+	if err := store.Delete(ctx, "foo/bar"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Info(ctx, "foo/bar"); err != storage.ErrKeyNotFound {
+		t.Errorf("expect error %s, but got %v", storage.ErrKeyNotFound, err)
+	}
+}
+
+func TestUnknownHost(t *testing.T) {
+	dir := testutil.TempDir(t, "sftp")
+	defer os.RemoveAll(dir)
+	addr, _ := startServer(t, dir, "")
+
+	knownHosts := filepath.Join(dir, "known_hosts_empty")
+	if err := ioutil.WriteFile(knownHosts, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	store := &sftp.Store{
+		Host:       addr,
+		User:       user,
+		Password:   password,
+		KnownHosts: knownHosts,
+		Folder:     dir,
+	}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if _, err := store.Info(ctx, "foo"); err == nil {
+		t.Error("expect connection to an unknown host to fail")
+	}
+}
+
+func TestBadPassword(t *testing.T) {
+	dir := testutil.TempDir(t, "sftp")
+	defer os.RemoveAll(dir)
+	addr, knownHosts := startServer(t, dir, "")
+
+	store := &sftp.Store{
+		Host:       addr,
+		User:       user,
+		Password:   "wrong",
+		KnownHosts: knownHosts,
+		Folder:     dir,
+	}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if _, err := store.Info(ctx, "foo"); err == nil {
+		t.Error("expect connection with a wrong password to fail")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	dir := testutil.TempDir(t, "sftp")
+	defer os.RemoveAll(dir)
+	addr, knownHosts := startServer(t, dir, "")
+
+	var i int
+	storagetest.Run(t, func() storage.Storage {
+		i++
+		return &sftp.Store{
+			Host:       addr,
+			User:       user,
+			Password:   password,
+			KnownHosts: knownHosts,
+			Folder:     filepath.Join(dir, strconv.Itoa(i)),
+		}
+	})
+}
+
+func TestConformanceRoot(t *testing.T) {
+	dir := testutil.TempDir(t, "sftp")
+	defer os.RemoveAll(dir)
+
+	// Each storage has its own server, so that the root folder is not shared
+	var i int
+	storagetest.Run(t, func() storage.Storage {
+		i++
+		serverDir := filepath.Join(dir, strconv.Itoa(i))
+		root := filepath.Join(serverDir, "root")
+		if err := os.MkdirAll(root, 0700); err != nil {
+			t.Fatal(err)
+		}
+		addr, knownHosts := startServer(t, serverDir, root)
+		return &sftp.Store{
+			Host:       addr,
+			User:       user,
+			Password:   password,
+			KnownHosts: knownHosts,
+			Folder:     "/",
+		}
+	})
+}
+
+// startServer starts an in-process SFTP server, and returns its address along
+// with a known_hosts file containing its host key. The server serves the
+// local filesystem, or the directory root as "/" when it is set.
+func startServer(t *testing.T, dir, root string) (addr, knownHostsPath string) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == user && string(pass) == password {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn, config, root)
+		}
+	}()
+
+	knownHostsPath = filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{l.Addr().String()}, hostKey.PublicKey())
+	if err := ioutil.WriteFile(knownHostsPath, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return l.Addr().String(), knownHostsPath
+}
+
+func serve(conn net.Conn, config *ssh.ServerConfig, root string) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, reqs, err := newChan.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range reqs {
+				req.Reply(req.Type == "subsystem" && string(req.Payload[4:]) == "sftp", nil)
+			}
+		}()
+		go func() {
+			defer ch.Close()
+			var rwc io.ReadWriteCloser = ch
+			if root != "" {
+				rwc = &chroot{Channel: ch, root: root}
+			}
+			server, err := pkgsftp.NewServer(rwc)
+			if err != nil {
+				return
+			}
+			server.Serve()
+		}()
+	}
+}
+
+// chroot rewrites the paths of the SFTP requests read from the channel, so
+// that they resolve within root
+type chroot struct {
+	ssh.Channel
+	root string
+	buf  []byte
+}
+
+func (c *chroot) Read(p []byte) (int, error) {
+	if len(c.buf) == 0 {
+		var hdr [4]byte
+		if _, err := io.ReadFull(c.Channel, hdr[:]); err != nil {
+			return 0, err
+		}
+		pkt := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+		if _, err := io.ReadFull(c.Channel, pkt); err != nil {
+			return 0, err
+		}
+		pkt = c.rewrite(pkt)
+		c.buf = make([]byte, 4, 4+len(pkt))
+		binary.BigEndian.PutUint32(c.buf, uint32(len(pkt)))
+		c.buf = append(c.buf, pkt...)
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// rewrite returns pkt with its paths moved within root
+func (c *chroot) rewrite(pkt []byte) []byte {
+	const (
+		fxpOpen     = 3
+		fxpLstat    = 7
+		fxpSetstat  = 9
+		fxpOpendir  = 11
+		fxpRemove   = 13
+		fxpMkdir    = 14
+		fxpRmdir    = 15
+		fxpRealpath = 16
+		fxpStat     = 17
+		fxpRename   = 18
+		fxpReadlink = 19
+		fxpExtended = 200
+	)
+	if len(pkt) < 5 {
+		return pkt
+	}
+	var paths int
+	switch pkt[0] {
+	case fxpOpen, fxpLstat, fxpSetstat, fxpOpendir, fxpRemove, fxpMkdir,
+		fxpRmdir, fxpRealpath, fxpStat, fxpReadlink:
+		paths = 1
+	case fxpRename:
+		paths = 2
+	case fxpExtended:
+		name, _ := readString(pkt[5:])
+		if name != "posix-rename@openssh.com" {
+			return pkt
+		}
+		out := append([]byte{}, pkt[:5]...)
+		out = appendString(out, name)
+		return c.rewritePaths(out, pkt[5+4+len(name):], 2)
+	default:
+		return pkt
+	}
+	return c.rewritePaths(append([]byte{}, pkt[:5]...), pkt[5:], paths)
+}
+
+// rewritePaths appends the n paths at the start of b moved within root to out,
+// followed by the rest of b
+func (c *chroot) rewritePaths(out, b []byte, n int) []byte {
+	for i := 0; i < n; i++ {
+		p, rest := readString(b)
+		out = appendString(out, filepath.Join(c.root, p))
+		b = rest
+	}
+	return append(out, b...)
+}
+
+func readString(b []byte) (string, []byte) {
+	if len(b) < 4 {
+		return "", nil
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < n {
+		return "", nil
+	}
+	return string(b[4 : 4+n]), b[4+n:]
+}
+
+func appendString(b []byte, s string) []byte {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(s)))
+	return append(append(b, n[:]...), s...)
+}
@@ -0,0 +1,108 @@
+// Package storagetest provides conformance tests shared by storage plugins
+package storagetest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/plugin/storage"
+)
+
+// InvalidKeys contains keys which every storage must reject
+var InvalidKeys = []string{
+	"",
+	"/",
+	"..",
+	"../../etc/passwd",
+	"foo/../../bar",
+	"foo/./bar",
+	`foo\..\bar`,
+	"foo\x00bar",
+	"foo/.kargo-bar",
+	strings.Repeat("a", storage.MaxKeyLength+1),
+}
+
+// TestKeys checks that store rejects invalid keys, and that nested keys are
+// normalised the same way by Push, Pull, Info and Walk.
+func TestKeys(t *testing.T, store storage.Storage) {
+	ctx := context.Background()
+
+	for _, key := range InvalidKeys {
+		err := store.Push(ctx, key, bytes.NewReader([]byte("foo")))
+		if errors.Cause(err) != storage.ErrInvalidKey {
+			t.Errorf("%q: expect push error %s, but got %v", key, storage.ErrInvalidKey, err)
+		}
+		if _, _, err := store.Pull(ctx, key); errors.Cause(err) != storage.ErrInvalidKey {
+			t.Errorf("%q: expect pull error %s, but got %v", key, storage.ErrInvalidKey, err)
+		}
+		if _, err := store.Info(ctx, key); errors.Cause(err) != storage.ErrInvalidKey {
+			t.Errorf("%q: expect info error %s, but got %v", key, storage.ErrInvalidKey, err)
+		}
+		if d, ok := store.(storage.Deleter); ok {
+			if err := d.Delete(ctx, key); errors.Cause(err) != storage.ErrInvalidKey {
+				t.Errorf("%q: expect delete error %s, but got %v", key, storage.ErrInvalidKey, err)
+			}
+		}
+	}
+
+	// Nested keys
+	pushed := map[string]string{
+		"/nested//a/b/": "nested/a/b",
+		"nested/c":      "nested/c",
+		"nested-d":      "nested-d",
+	}
+	for key, clean := range pushed {
+		if err := store.Push(ctx, key, strings.NewReader(clean)); err != nil {
+			t.Fatalf("%q: cannot push data to storage: %s", key, err)
+		}
+		info, err := store.Info(ctx, clean)
+		if err != nil {
+			t.Fatalf("%q: cannot get info: %s", clean, err)
+		}
+		if info.Name() != clean || info.Size() != int64(len(clean)) {
+			t.Errorf("expect info %s (%d), but got %s (%d)",
+				clean, len(clean), info.Name(), info.Size(),
+			)
+		}
+		r, _, err := store.Pull(ctx, clean)
+		if err != nil {
+			t.Fatalf("%q: cannot pull data from storage: %s", clean, err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != clean {
+			t.Errorf("%q: expect data %s, but got %s", clean, clean, data)
+		}
+	}
+
+	var keys []string
+	filter := storage.WalkFilter{To: math.MaxInt64, Prefix: "nested/"}
+	store.Walk(ctx, &filter, func(key string, f os.FileInfo, err error) error {
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if len(keys) != 2 || !contains(keys, "nested/a/b") || !contains(keys, "nested/c") {
+		t.Errorf("expect keys [nested/a/b nested/c], but got %v", keys)
+	}
+}
+
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,584 @@
+package storagetest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/pkg/testutil"
+	"github.com/stairlin/kargo/pkg/unit"
+	"github.com/stairlin/kargo/plugin/storage"
+)
+
+const (
+	// largeSize is larger than the chunks/blocks buffered by storages
+	largeSize = int(unit.MB * 20)
+	// concurrency is the number of keys pushed and pulled concurrently
+	concurrency = 8
+	// clockResolution is the coarsest modification time resolution of
+	// storages (e.g. HTTP dates)
+	clockResolution = time.Second
+)
+
+// Run runs the conformance tests against storages returned by create.
+//
+// Each test initialises its own storage, therefore create must return a new
+// storage which has not been initialised yet, and which does not share keys
+// with the previous ones (e.g. a different directory or folder).
+func Run(t *testing.T, create storage.Creator) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, store storage.Storage)
+	}{
+		{name: "KeyNotFound", fn: testKeyNotFound},
+		{name: "Verbatim", fn: testVerbatim},
+		{name: "ZeroLength", fn: testZeroLength},
+		{name: "Large", fn: testLarge},
+		{name: "Overwrite", fn: testOverwrite},
+		{name: "Keys", fn: TestKeys},
+		{name: "Walk", fn: testWalk},
+		{name: "Concurrency", fn: testConcurrency},
+		{name: "Cancel", fn: testCancel},
+		{name: "PullRange", fn: testPullRange},
+		{name: "PullVersion", fn: testPullVersion},
+		{name: "Meta", fn: testMeta},
+		{name: "Checksum", fn: testChecksum},
+	}
+	for _, test := range tests {
+		fn := test.fn
+		t.Run(test.name, func(t *testing.T) {
+			store := create()
+			if err := store.Init(); err != nil {
+				t.Fatal("cannot initialise storage", err)
+			}
+			fn(t, store)
+		})
+	}
+}
+
+// testKeyNotFound checks that missing keys are reported with ErrKeyNotFound
+func testKeyNotFound(t *testing.T, store storage.Storage) {
+	ctx := context.Background()
+
+	checkNotFound(t, store, "foo")
+	checkNotFound(t, store, "foo/bar")
+	if d, ok := store.(storage.Deleter); ok {
+		if err := d.Delete(ctx, "foo"); errors.Cause(err) != storage.ErrKeyNotFound {
+			t.Errorf("expect delete error %s, but got %v", storage.ErrKeyNotFound, err)
+		}
+	}
+
+	// Deleted keys
+	push(t, store, "foo", []byte("bar"))
+	d, ok := store.(storage.Deleter)
+	if !ok {
+		return
+	}
+	if err := d.Delete(ctx, "foo"); err != nil {
+		t.Fatal("cannot delete key", err)
+	}
+	checkNotFound(t, store, "foo")
+	if keys := walk(t, store, &storage.WalkFilter{To: math.MaxInt64}); len(keys) > 0 {
+		t.Errorf("expect no keys, but got %v", keys)
+	}
+}
+
+func testVerbatim(t *testing.T, store storage.Storage) {
+	data := testutil.GenRandBytes(t, int(unit.MB))
+	push(t, store, "foo", data)
+	pull(t, store, "foo", data)
+}
+
+func testZeroLength(t *testing.T, store storage.Storage) {
+	push(t, store, "foo", nil)
+	pull(t, store, "foo", nil)
+}
+
+func testLarge(t *testing.T, store storage.Storage) {
+	data := testutil.GenRandBytes(t, largeSize)
+	push(t, store, "foo", data)
+	pull(t, store, "foo", data)
+}
+
+func testOverwrite(t *testing.T, store storage.Storage) {
+	push(t, store, "foo", testutil.GenRandBytes(t, int(unit.MB)))
+	push(t, store, "foo", []byte("bar"))
+	pull(t, store, "foo", []byte("bar"))
+
+	keys := walk(t, store, &storage.WalkFilter{To: math.MaxInt64})
+	if len(keys) != 1 || keys[0] != "foo" {
+		t.Errorf("expect keys [foo], but got %v", keys)
+	}
+}
+
+// testWalk checks the filters and the order of keys walked
+func testWalk(t *testing.T, store storage.Storage) {
+	ctx := context.Background()
+
+	// walk/a is older than the other keys, even with a coarse clock
+	push(t, store, "walk/a", []byte("a"))
+	time.Sleep(clockResolution + time.Millisecond*100)
+	push(t, store, "walk/b", []byte("b"))
+	push(t, store, "walk/c", []byte("c"))
+	push(t, store, "other/d", []byte("d"))
+
+	all := walk(t, store, &storage.WalkFilter{To: math.MaxInt64})
+	if len(all) != 4 || all[3] != "walk/a" {
+		t.Fatalf("expect 4 keys ending with walk/a, but got %v", all)
+	}
+	info, err := store.Info(ctx, "walk/a")
+	if err != nil {
+		t.Fatal("cannot get info", err)
+	}
+	oldest := info.ModTime().UnixNano()
+
+	tests := []struct {
+		filter storage.WalkFilter
+		expect []string
+	}{
+		{
+			filter: storage.WalkFilter{To: math.MaxInt64, Prefix: "walk/"},
+			expect: []string{"walk/a", "walk/b", "walk/c"},
+		},
+		{
+			filter: storage.WalkFilter{To: math.MaxInt64, Prefix: "nope"},
+		},
+		{
+			filter: storage.WalkFilter{
+				To: math.MaxInt64, Pattern: regexp.MustCompile(`[cd]$`),
+			},
+			expect: []string{"walk/c", "other/d"},
+		},
+		{
+			filter: storage.WalkFilter{
+				To:      math.MaxInt64,
+				Prefix:  "walk/",
+				Pattern: regexp.MustCompile(`^walk/[ab]$`),
+			},
+			expect: []string{"walk/a", "walk/b"},
+		},
+		{
+			filter: storage.WalkFilter{From: oldest, To: oldest},
+			expect: []string{"walk/a"},
+		},
+		{
+			filter: storage.WalkFilter{From: oldest + 1, To: math.MaxInt64},
+			expect: []string{"walk/b", "walk/c", "other/d"},
+		},
+		{
+			filter: storage.WalkFilter{
+				From: oldest + 1, To: math.MaxInt64, Prefix: "walk/",
+			},
+			expect: []string{"walk/b", "walk/c"},
+		},
+		{
+			filter: storage.WalkFilter{To: oldest - 1},
+		},
+		{
+			filter: storage.WalkFilter{To: math.MaxInt64, Prefix: "walk/", Limit: 2},
+			expect: []string{"walk/b", "walk/c"},
+		},
+		{
+			filter: storage.WalkFilter{To: math.MaxInt64, Prefix: "walk/", Limit: 5},
+			expect: []string{"walk/a", "walk/b", "walk/c"},
+		},
+		{
+			filter: storage.WalkFilter{To: oldest, Limit: 1},
+			expect: []string{"walk/a"},
+		},
+		{
+			filter: storage.WalkFilter{
+				To: math.MaxInt64, Pattern: regexp.MustCompile(`[ad]$`), Limit: 1,
+			},
+			expect: []string{"other/d"},
+		},
+	}
+	for i, test := range tests {
+		keys := walk(t, store, &test.filter)
+		sort.Strings(keys)
+		sort.Strings(test.expect)
+		if strings.Join(keys, ",") != strings.Join(test.expect, ",") {
+			t.Errorf("%d - expect keys %v, but got %v", i, test.expect, keys)
+		}
+	}
+
+	// Limit alone keeps the most recent keys
+	keys := walk(t, store, &storage.WalkFilter{To: math.MaxInt64, Limit: 3})
+	if len(keys) != 3 || contains(keys, "walk/a") {
+		t.Errorf("expect 3 keys without walk/a, but got %v", keys)
+	}
+
+	// Walk stops as soon as walkFn returns an error
+	var calls int
+	filter := storage.WalkFilter{To: math.MaxInt64}
+	store.Walk(ctx, &filter, func(key string, f os.FileInfo, err error) error {
+		calls++
+		return errors.New("stop")
+	})
+	if calls != 1 {
+		t.Errorf("expect walk to stop after 1 call, but got %d", calls)
+	}
+}
+
+// testConcurrency pushes and pulls distinct keys concurrently
+func testConcurrency(t *testing.T, store storage.Storage) {
+	ctx := context.Background()
+
+	data := make([][]byte, concurrency)
+	for i := range data {
+		data[i] = testutil.GenRandBytes(t, int(unit.KB*256))
+	}
+
+	var wg sync.WaitGroup
+	for i := range data {
+		wg.Add(1)
+		go func(key string, expect []byte) {
+			defer wg.Done()
+			if err := store.Push(ctx, key, stream(expect)); err != nil {
+				t.Errorf("%s: cannot push data to storage: %s", key, err)
+				return
+			}
+			r, _, err := store.Pull(ctx, key)
+			if err != nil {
+				t.Errorf("%s: cannot pull data from storage: %s", key, err)
+				return
+			}
+			got, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Errorf("%s: cannot read data: %s", key, err)
+				return
+			}
+			if !bytes.Equal(expect, got) {
+				t.Errorf("%s: expect data %s, but got %s", key,
+					testutil.Truncate(expect, 140), testutil.Truncate(got, 140),
+				)
+			}
+		}(fmt.Sprintf("concurrent/%d", i), data[i])
+	}
+	wg.Wait()
+
+	keys := walk(t, store, &storage.WalkFilter{To: math.MaxInt64})
+	if len(keys) != concurrency {
+		t.Errorf("expect %d keys, but got %v", concurrency, keys)
+	}
+}
+
+// testCancel checks that a push fails once its context is cancelled, and
+// that it does not leave a partial key behind
+func testCancel(t *testing.T, store storage.Storage) {
+	// Cancelled beforehand
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := store.Push(ctx, "foo", strings.NewReader("foo")); err == nil {
+		t.Error("expect push with a cancelled context to fail")
+	}
+	checkNotFound(t, store, "foo")
+
+	// Cancelled while data is being pushed
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	r := &cancelReader{
+		r:      bytes.NewReader(testutil.GenRandBytes(t, largeSize)),
+		left:   int(unit.MB),
+		cancel: cancel,
+	}
+	if err := store.Push(ctx, "bar", r); err == nil {
+		t.Error("expect push to fail once the context is cancelled")
+	}
+	checkNotFound(t, store, "bar")
+}
+
+// testMeta checks that storages which implement MetaPusher return the
+// creation time of backups
+func testMeta(t *testing.T, store storage.Storage) {
+	mp, ok := store.(storage.MetaPusher)
+	if !ok {
+		t.Skip("storage does not implement MetaPusher")
+	}
+	ctx := context.Background()
+	created := time.Date(2018, 6, 1, 12, 30, 0, 123456789, time.UTC)
+	if err := mp.PushMeta(ctx, "foo", stream([]byte("bar")), &storage.Meta{
+		CreatedAt: created,
+	}); err != nil {
+		t.Fatal("cannot push data to storage", err)
+	}
+	info, err := store.Info(ctx, "foo")
+	if err != nil {
+		t.Fatal("cannot get info", err)
+	}
+	checkCreatedAt(t, "info", info, created)
+	r, info, err := store.Pull(ctx, "foo")
+	if err != nil {
+		t.Fatal("cannot pull data from storage", err)
+	}
+	r.Close()
+	checkCreatedAt(t, "pull", info, created)
+
+	// Push records the current time
+	before := time.Now().Add(-time.Second)
+	push(t, store, "bar", []byte("baz"))
+	info, err = store.Info(ctx, "bar")
+	if err != nil {
+		t.Fatal("cannot get info", err)
+	}
+	if i, ok := info.(storage.TimeInfo); !ok || i.CreatedAt().Before(before) {
+		t.Errorf("expect push to record the current time, but got %v", info)
+	}
+}
+
+func checkCreatedAt(t *testing.T, op string, info os.FileInfo, expect time.Time) {
+	i, ok := info.(storage.TimeInfo)
+	if !ok {
+		t.Errorf("%s: expect info to implement TimeInfo", op)
+		return
+	}
+	if !i.CreatedAt().Equal(expect) {
+		t.Errorf("%s: expect creation time %s, but got %s", op, expect, i.CreatedAt())
+	}
+}
+
+// testPullRange checks ranged reads of storages which implement RangePuller
+func testPullRange(t *testing.T, store storage.Storage) {
+	rp, ok := store.(storage.RangePuller)
+	if !ok {
+		t.Skip("storage does not implement RangePuller")
+	}
+	ctx := context.Background()
+	data := testutil.GenRandBytes(t, int(unit.MB))
+	push(t, store, "foo", data)
+
+	size := int64(len(data))
+	tests := []struct {
+		offset int64
+		length int64
+		expect []byte
+	}{
+		{offset: 0, length: size, expect: data},
+		{offset: 0, length: 1, expect: data[:1]},
+		{offset: 1000, length: 5000, expect: data[1000:6000]},
+		{offset: size - 1, length: 1, expect: data[size-1:]},
+		{offset: 4096, length: -1, expect: data[4096:]},
+		{offset: 0, length: -1, expect: data},
+		{offset: 1000, length: 0, expect: nil},
+	}
+	for _, test := range tests {
+		r, err := rp.PullRange(ctx, "foo", "", test.offset, test.length)
+		if err != nil {
+			t.Errorf("%d-%d: cannot pull range: %s", test.offset, test.length, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Errorf("%d-%d: cannot read data: %s", test.offset, test.length, err)
+			continue
+		}
+		if !bytes.Equal(test.expect, got) {
+			t.Errorf("%d-%d: expect data (%d) %s, but got (%d) %s",
+				test.offset, test.length,
+				len(test.expect), testutil.Truncate(test.expect, 140),
+				len(got), testutil.Truncate(got, 140),
+			)
+		}
+	}
+
+	r, err := rp.PullRange(ctx, "bar", "", 0, 1)
+	if errors.Cause(err) != storage.ErrKeyNotFound {
+		t.Errorf("expect pull range error %s, but got %v", storage.ErrKeyNotFound, err)
+	}
+	if r != nil {
+		r.Close()
+	}
+}
+
+// testPullVersion checks that ranged reads of a version of a key fail once
+// the key has been overwritten, and so do downloads
+func testPullVersion(t *testing.T, store storage.Storage) {
+	rp, ok := store.(storage.RangePuller)
+	if !ok {
+		t.Skip("storage does not implement RangePuller")
+	}
+	ctx := context.Background()
+	data := testutil.GenRandBytes(t, 3*int(unit.KB))
+	push(t, store, "foo", data)
+	info, err := store.Info(ctx, "foo")
+	if err != nil {
+		t.Fatal("cannot get info", err)
+	}
+	vi, ok := info.(storage.VersionInfo)
+	if !ok {
+		t.Skip("storage does not expose versions")
+	}
+	version := vi.Version()
+
+	r, err := rp.PullRange(ctx, "foo", version, 0, 1)
+	if err != nil {
+		t.Fatal("cannot pull the current version", err)
+	}
+	r.Close()
+
+	// The download has read its first part when the key is overwritten
+	d := &storage.Downloader{PartSize: int64(unit.KB), Concurrency: 1}
+	dr, _, err := d.Pull(ctx, store, "foo")
+	if err != nil {
+		t.Fatal("cannot pull key", err)
+	}
+	defer dr.Close()
+	if _, err := io.ReadFull(dr, make([]byte, int(unit.KB))); err != nil {
+		t.Fatal("cannot read the first part", err)
+	}
+	push(t, store, "foo", testutil.GenRandBytes(t, 4*int(unit.KB)))
+
+	r, err = rp.PullRange(ctx, "foo", version, 0, 1)
+	if errors.Cause(err) != storage.ErrVersionChanged {
+		t.Errorf("expect pull range error %s, but got %v", storage.ErrVersionChanged, err)
+	}
+	if r != nil {
+		r.Close()
+	}
+	if _, err := ioutil.ReadAll(dr); errors.Cause(err) != storage.ErrVersionChanged {
+		t.Errorf("expect download error %s, but got %v", storage.ErrVersionChanged, err)
+	}
+}
+
+// push pushes data to key, and checks its info
+func push(t *testing.T, store storage.Storage, key string, data []byte) {
+	ctx := context.Background()
+	if err := store.Push(ctx, key, stream(data)); err != nil {
+		t.Fatalf("%s: cannot push data to storage: %s", key, err)
+	}
+	info, err := store.Info(ctx, key)
+	if err != nil {
+		t.Fatalf("%s: cannot get info: %s", key, err)
+	}
+	if info.Name() != key || info.Size() != int64(len(data)) {
+		t.Errorf("expect info %s (%d), but got %s (%d)",
+			key, len(data), info.Name(), info.Size(),
+		)
+	}
+}
+
+// pull pulls key, and checks that its data is equal to expect
+func pull(t *testing.T, store storage.Storage, key string, expect []byte) {
+	r, info, err := store.Pull(context.Background(), key)
+	if err != nil {
+		t.Fatalf("%s: cannot pull data from storage: %s", key, err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("%s: cannot read data: %s", key, err)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("%s: cannot close reader: %s", key, err)
+	}
+	if !bytes.Equal(expect, got) {
+		t.Errorf("%s: expect data (%d) %s, but got (%d) %s", key,
+			len(expect), testutil.Truncate(expect, 140),
+			len(got), testutil.Truncate(got, 140),
+		)
+	}
+	if info.Name() != key || info.Size() != int64(len(expect)) {
+		t.Errorf("expect info %s (%d), but got %s (%d)",
+			key, len(expect), info.Name(), info.Size(),
+		)
+	}
+}
+
+// walk returns the keys walked with filter, and checks their order
+func walk(t *testing.T, store storage.Storage, filter *storage.WalkFilter) []string {
+	var keys []string
+	var last time.Time
+	store.Walk(context.Background(), filter, func(key string, f os.FileInfo, err error) error {
+		if err != nil {
+			t.Fatal("walk error", err)
+		}
+		if f.Name() != key {
+			t.Errorf("expect info name %s, but got %s", key, f.Name())
+		}
+		if len(keys) > 0 && f.ModTime().After(last) {
+			t.Errorf("expect %s to be walked before %v", key, keys)
+		}
+		keys = append(keys, key)
+		last = f.ModTime()
+		return nil
+	})
+	return keys
+}
+
+func checkNotFound(t *testing.T, store storage.Storage, key string) {
+	ctx := context.Background()
+	if _, err := store.Info(ctx, key); errors.Cause(err) != storage.ErrKeyNotFound {
+		t.Errorf("%s: expect info error %s, but got %v", key, storage.ErrKeyNotFound, err)
+	}
+	r, _, err := store.Pull(ctx, key)
+	if errors.Cause(err) != storage.ErrKeyNotFound {
+		t.Errorf("%s: expect pull error %s, but got %v", key, storage.ErrKeyNotFound, err)
+	}
+	if r != nil {
+		r.Close()
+	}
+}
+
+// stream hides the type of the reader, so that storages cannot rely on its
+// size
+func stream(data []byte) io.Reader {
+	return struct{ io.Reader }{bytes.NewReader(data)}
+}
+
+// cancelReader cancels a context after a number of bytes have been read
+type cancelReader struct {
+	r      io.Reader
+	left   int
+	cancel func()
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.left -= n; r.left <= 0 {
+		r.cancel()
+	}
+	return n, err
+}
+
+// testChecksum checks that keys with the same content have the same checksum,
+// and that keys of the same size with a different content do not
+func testChecksum(t *testing.T, store storage.Storage) {
+	ctx := context.Background()
+	push(t, store, "foo", []byte("bar"))
+	push(t, store, "bar", []byte("bar"))
+	push(t, store, "baz", []byte("baz"))
+
+	checksum := func(key string) string {
+		info, err := store.Info(ctx, key)
+		if err != nil {
+			t.Fatal("cannot get info", err)
+		}
+		i, ok := info.(storage.ChecksumInfo)
+		if !ok {
+			t.Skip("storage does not expose checksums")
+		}
+		return i.Checksum()
+	}
+	foo, bar, baz := checksum("foo"), checksum("bar"), checksum("baz")
+	if foo == "" {
+		t.Fatal("expect a checksum")
+	}
+	if foo != bar {
+		t.Errorf("expect checksum %s for the same content, but got %s", foo, bar)
+	}
+	if foo == baz {
+		t.Errorf("expect different checksums for a different content, but got %s", baz)
+	}
+}
@@ -0,0 +1,639 @@
+// Package webdav stores backups on a WebDAV or a plain HTTP server
+package webdav
+
+import (
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/log"
+	"github.com/stairlin/kargo/plugin/storage"
+)
+
+const (
+	name  = "webdav"
+	slash = "/"
+
+	maxRetries = 5
+
+	depthInfinity = "infinity"
+	propfindBody  = `<?xml version="1.0" encoding="utf-8"?>` +
+		`<d:propfind xmlns:d="DAV:"><d:prop>` +
+		`<d:resourcetype/><d:getcontentlength/><d:getlastmodified/>` +
+		`</d:prop></d:propfind>`
+)
+
+func init() {
+	storage.Add(name, func() storage.Storage {
+		return &Store{}
+	})
+}
+
+// Store is a WebDAV store
+type Store struct {
+	URL      string            `toml:"url"`
+	Folder   string            `toml:"folder"`
+	Username string            `toml:"username"`
+	Password string            `toml:"password"`
+	Token    string            `toml:"token"`
+	Headers  map[string]string `toml:"headers"`
+
+	Client *http.Client
+
+	base *url.URL
+
+	mu   sync.Mutex
+	dirs map[string]bool // Collections known to exist
+	dav  *bool           // Whether the server supports WebDAV, once known
+}
+
+// multistatus is the body of a PROPFIND response
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength string `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+			} `xml:"DAV: prop"`
+			Status string `xml:"DAV: status"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+func (s *Store) Name() string {
+	return name
+}
+
+func (s *Store) Init() error {
+	if s.URL == "" {
+		return errors.New("missing url")
+	}
+	base, err := url.Parse(s.URL)
+	if err != nil {
+		return errors.Wrap(err, "invalid url")
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return errors.New("url scheme must be either http or https")
+	}
+	base.Path = path.Join(slash, base.Path, s.Folder)
+	base.RawPath = ""
+	base.RawQuery = ""
+	s.base = base
+
+	if s.Token != "" && (s.Username != "" || s.Password != "") {
+		return errors.New("token and username/password are mutually exclusive")
+	}
+	if s.Client == nil {
+		s.Client = http.DefaultClient
+	}
+	s.dirs = map[string]bool{}
+	return nil
+}
+
+func (s *Store) Info(ctx *context.Context, key string) (os.FileInfo, error) {
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.do(ctx, "HEAD", s.url(key), nil, nil)
+	if err != nil {
+		if err == storage.ErrKeyNotFound {
+			return nil, err
+		}
+		return nil, errors.Wrap(err, "cannot get file info")
+	}
+	res.Body.Close()
+	if res.ContentLength >= 0 && res.Header.Get("Last-Modified") != "" {
+		return responseInfo(key, res), nil
+	}
+
+	// Fallback on PROPFIND when HEAD does not return all metadata
+	infos, err := s.propfind(ctx, s.url(key), "0")
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get file info")
+	}
+	if len(infos) == 0 {
+		return nil, storage.ErrKeyNotFound
+	}
+	infos[0].name = key
+	return infos[0], nil
+}
+
+// Push streams data to the server with a single PUT request. Parent
+// collections are created beforehand, since WebDAV does not create them.
+//
+// On WebDAV servers, data is uploaded to a temporary file, which is then
+// moved to key. Therefore, an interrupted push never leaves a partial backup
+// behind. Plain HTTP servers do not support MOVE, so data is uploaded to key
+// directly.
+func (s *Store) Push(ctx *context.Context, key string, r io.Reader) error {
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return err
+	}
+	if err := s.mkcol(ctx, path.Dir(key)); err != nil {
+		return err
+	}
+	dav, err := s.isDAV(ctx)
+	if err != nil {
+		return err
+	}
+	if !dav {
+		if err := s.put(ctx, key, r); err != nil {
+			return errors.Wrap(err, "cannot upload file")
+		}
+		return nil
+	}
+
+	tmp := path.Join(path.Dir(key), storage.TempPrefix+uuid.New().String())
+	err = s.put(ctx, tmp, r)
+	if err == nil {
+		err = s.move(ctx, tmp, key)
+	}
+	if err != nil {
+		// The context of the push may be cancelled already
+		res, rerr := s.do(context.Background(), "DELETE", s.url(tmp), nil, nil)
+		switch {
+		case rerr == nil:
+			res.Body.Close()
+		case rerr != storage.ErrKeyNotFound:
+			ctx.Warn("webdav: cannot remove temporary file",
+				log.String("key", tmp), log.Error(rerr),
+			)
+		}
+		return errors.Wrap(err, "cannot upload file")
+	}
+	return nil
+}
+
+// put streams data from r to the file of key
+func (s *Store) put(ctx *context.Context, key string, r io.Reader) error {
+	// Hide the reader type, so that the request is always sent with a chunked
+	// transfer encoding
+	body := ioutil.NopCloser(r)
+	res, err := s.do(ctx, "PUT", s.url(key), nil, body)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// move renames the file of oldkey to newkey, which is overwritten
+func (s *Store) move(ctx *context.Context, oldkey, newkey string) error {
+	header := http.Header{}
+	header.Set("Destination", s.url(newkey))
+	header.Set("Overwrite", "T")
+	res, err := s.do(ctx, "MOVE", s.url(oldkey), header, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// isDAV returns whether the server supports WebDAV, according to the DAV
+// header of an OPTIONS response
+func (s *Store) isDAV(ctx *context.Context) (bool, error) {
+	s.mu.Lock()
+	dav := s.dav
+	s.mu.Unlock()
+	if dav != nil {
+		return *dav, nil
+	}
+
+	var ok bool
+	res, err := s.do(ctx, "OPTIONS", s.url("")+slash, nil, nil)
+	switch {
+	case err == nil:
+		ok = res.Header.Get("DAV") != ""
+		res.Body.Close()
+	case isStatus(err, http.StatusUnauthorized):
+		return false, errors.Wrap(err, "cannot get server options")
+	default:
+		// Plain HTTP servers may not implement OPTIONS at all
+	}
+
+	s.mu.Lock()
+	s.dav = &ok
+	s.mu.Unlock()
+	return ok, nil
+}
+
+// Pull downloads the file of key. When the connection drops, the download
+// resumes from the last byte received with a Range request.
+func (s *Store) Pull(
+	ctx *context.Context, key string,
+) (io.ReadCloser, os.FileInfo, error) {
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	res, err := s.do(ctx, "GET", s.url(key), nil, nil)
+	if err != nil {
+		if err == storage.ErrKeyNotFound {
+			return nil, nil, err
+		}
+		return nil, nil, errors.Wrap(err, "cannot download file")
+	}
+	r := &reader{
+		ctx:          ctx,
+		s:            s,
+		key:          key,
+		body:         res.Body,
+		size:         res.ContentLength,
+		etag:         res.Header.Get("ETag"),
+		lastModified: res.Header.Get("Last-Modified"),
+	}
+	return r, responseInfo(key, res), nil
+}
+
+func (s *Store) Delete(ctx *context.Context, key string) error {
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(ctx, "DELETE", s.url(key), nil, nil)
+	if err != nil {
+		if err == storage.ErrKeyNotFound {
+			return err
+		}
+		return errors.Wrap(err, "cannot delete file")
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *Store) Walk(
+	ctx *context.Context,
+	filter *storage.WalkFilter,
+	walkFn func(key string, f os.FileInfo, err error) error,
+) {
+	root := s.url("") + slash
+	files, err := s.propfind(ctx, root, depthInfinity)
+	if err == errFiniteDepth {
+		// Some servers (e.g. Nextcloud) refuse infinite depth PROPFIND, so the
+		// tree is walked one level at a time
+		files, err = s.propfindRecursive(ctx, root)
+	}
+	if err != nil && err != storage.ErrKeyNotFound {
+		walkFn("", nil, errors.Wrap(err, "webdav: walk error"))
+		return
+	}
+
+	var infos []*info
+	for _, f := range files {
+		if f.dir || strings.HasPrefix(path.Base(f.Name()), storage.TempPrefix) {
+			continue
+		}
+		if isBetween(filter, f.ModTime().UnixNano()) &&
+			matches(filter, f.Name()) {
+			infos = append(infos, f)
+		}
+	}
+
+	// Sort items, and keep the most recent ones
+	sort.Sort(byModTimeDesc(infos))
+	if filter.Limit > 0 && len(infos) > int(filter.Limit) {
+		infos = infos[:filter.Limit]
+	}
+
+	for _, info := range infos {
+		if err := walkFn(info.Name(), info, nil); err != nil {
+			return
+		}
+	}
+}
+
+var errFiniteDepth = errors.New("infinite depth PROPFIND is not supported")
+
+// propfind returns the files and the collections found under u up to depth.
+// Their name is relative to the store folder.
+func (s *Store) propfind(
+	ctx *context.Context, u, depth string,
+) ([]*info, error) {
+	header := http.Header{}
+	header.Set("Depth", depth)
+	header.Set("Content-Type", "application/xml; charset=utf-8")
+	body := ioutil.NopCloser(strings.NewReader(propfindBody))
+	res, err := s.do(ctx, "PROPFIND", u, header, body)
+	if err != nil {
+		if depth == depthInfinity && isStatus(err, http.StatusForbidden) {
+			return nil, errFiniteDepth
+		}
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var out multistatus
+	if err := xml.NewDecoder(res.Body).Decode(&out); err != nil {
+		return nil, errors.Wrap(err, "cannot decode PROPFIND response")
+	}
+
+	var infos []*info
+	for _, r := range out.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid href %s", r.Href)
+		}
+		info := &info{
+			name: strings.Trim(strings.TrimPrefix(href.Path, s.base.Path), slash),
+		}
+		for _, p := range r.Propstat {
+			if !strings.Contains(p.Status, " 200 ") {
+				continue
+			}
+			info.dir = p.Prop.ResourceType.Collection != nil
+			info.size, _ = strconv.ParseInt(p.Prop.ContentLength, 10, 64)
+			info.modTime, _ = http.ParseTime(p.Prop.LastModified)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// propfindRecursive walks the tree under u with PROPFIND requests of depth 1
+func (s *Store) propfindRecursive(ctx *context.Context, u string) ([]*info, error) {
+	infos, err := s.propfind(ctx, u, "1")
+	if err != nil {
+		return nil, err
+	}
+	self := strings.Trim(strings.TrimPrefix(mustPath(u), s.base.Path), slash)
+
+	var all []*info
+	for _, info := range infos {
+		if info.name == self {
+			continue
+		}
+		all = append(all, info)
+		if info.dir {
+			children, err := s.propfindRecursive(ctx, s.url(info.name)+slash)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, children...)
+		}
+	}
+	return all, nil
+}
+
+// mkcol creates the collection dir and all its parents
+func (s *Store) mkcol(ctx *context.Context, dir string) error {
+	if dir == "." || dir == slash {
+		dir = ""
+	}
+	s.mu.Lock()
+	ok := s.dirs[dir]
+	s.mu.Unlock()
+	if ok {
+		return nil
+	}
+	if dir != "" {
+		if err := s.mkcol(ctx, path.Dir(dir)); err != nil {
+			return err
+		}
+	}
+
+	res, err := s.do(ctx, "MKCOL", s.url(dir)+slash, nil, nil)
+	switch {
+	case err == nil:
+		res.Body.Close()
+	case isStatus(err, http.StatusUnauthorized):
+		return errors.Wrap(err, "cannot create collection")
+	default:
+		// The collection already exists (405), or the server does not support
+		// WebDAV. Either way, the PUT request reports the actual error.
+	}
+
+	s.mu.Lock()
+	s.dirs[dir] = true
+	s.mu.Unlock()
+	return nil
+}
+
+// statusError is returned when a request has an unexpected status code
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return e.status
+}
+
+func isStatus(err error, code int) bool {
+	e, ok := errors.Cause(err).(*statusError)
+	return ok && e.code == code
+}
+
+// do sends a request, and returns an error when its response is not successful
+func (s *Store) do(
+	ctx *context.Context,
+	method, u string,
+	header http.Header,
+	body io.ReadCloser,
+) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Body = body
+		req.ContentLength = -1
+	}
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	switch {
+	case s.Token != "":
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	case s.Username != "" || s.Password != "":
+		req.SetBasicAuth(s.Username, s.Password)
+	}
+
+	res, err := s.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+	res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, storage.ErrKeyNotFound
+	}
+	return nil, &statusError{code: res.StatusCode, status: res.Status}
+}
+
+// url returns the URL of key
+func (s *Store) url(key string) string {
+	u := *s.base
+	u.Path = path.Join(s.base.Path, key)
+	return u.String()
+}
+
+func mustPath(u string) string {
+	p, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	return p.Path
+}
+
+// reader resumes a download from where it stopped when the connection drops
+type reader struct {
+	ctx          *context.Context
+	s            *Store
+	key          string
+	body         io.ReadCloser
+	offset       int64
+	size         int64
+	etag         string
+	lastModified string
+	retries      int
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && (r.size < 0 || r.offset >= r.size) {
+		return n, io.EOF
+	}
+	if err == nil || r.retries >= maxRetries || r.ctx.Err() != nil {
+		return n, err
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	r.retries++
+	r.ctx.Warn("webdav: download interrupted, resuming...",
+		log.String("key", r.key), log.Error(err),
+	)
+	r.body.Close()
+	if rerr := r.resume(); rerr != nil {
+		r.body = ioutil.NopCloser(strings.NewReader(""))
+		return n, errors.Wrapf(rerr, "cannot resume download (%s)", err)
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return r.Read(p)
+}
+
+// resume requests the rest of the file from the current offset
+func (r *reader) resume() error {
+	validator := r.etag
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = r.lastModified
+	}
+	if validator == "" {
+		return errors.New("the server returned neither ETag nor Last-Modified")
+	}
+
+	time.Sleep(time.Duration(r.retries) * 100 * time.Millisecond)
+	header := http.Header{}
+	header.Set("Range", "bytes="+strconv.FormatInt(r.offset, 10)+"-")
+	header.Set("If-Range", validator)
+	res, err := r.s.do(r.ctx, "GET", r.s.url(r.key), header, nil)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return errors.New("the file has changed or the server does not support ranges")
+	}
+	r.body = res.Body
+	return nil
+}
+
+func (r *reader) Close() error {
+	return r.body.Close()
+}
+
+func responseInfo(key string, res *http.Response) *info {
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return &info{
+		name:    key,
+		size:    res.ContentLength,
+		modTime: modTime,
+	}
+}
+
+// info wraps a WebDAV resource to a struct that implements os.FileInfo
+type info struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+// base name of the file
+func (i *info) Name() string {
+	return i.name
+}
+
+// length in bytes for regular files; system-dependent for others
+func (i *info) Size() int64 {
+	return i.size
+}
+
+// file mode bits
+func (i *info) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | os.ModePerm
+	}
+	return os.ModePerm
+}
+
+// modification time
+func (i *info) ModTime() time.Time {
+	return i.modTime
+}
+
+// abbreviation for Mode().IsDir()
+func (i *info) IsDir() bool {
+	return i.dir
+}
+
+// underlying data source (can return nil)
+func (i *info) Sys() interface{} {
+	return nil
+}
+
+func isBetween(f *storage.WalkFilter, t int64) bool {
+	return t >= f.From && t <= f.To
+}
+
+func matches(f *storage.WalkFilter, name string) bool {
+	return strings.HasPrefix(name, f.Prefix) &&
+		(f.Pattern == nil || f.Pattern.MatchString(name))
+}
+
+type byModTimeDesc []*info
+
+func (l byModTimeDesc) Len() int      { return len(l) }
+func (l byModTimeDesc) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l byModTimeDesc) Less(i, j int) bool {
+	return l[i].modTime.UnixNano() > l[j].modTime.UnixNano()
+}
@@ -0,0 +1,308 @@
+package webdav_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/pkg/testutil"
+	"github.com/stairlin/kargo/pkg/unit"
+	"github.com/stairlin/kargo/plugin/storage"
+	"github.com/stairlin/kargo/plugin/storage/storagetest"
+	"github.com/stairlin/kargo/plugin/storage/webdav"
+	xwebdav "golang.org/x/net/webdav"
+)
+
+func TestVerbatim(t *testing.T) {
+	server := httptest.NewServer(newHandler(nil))
+	defer server.Close()
+	store := newStore(t, server.URL)
+
+	expect := testutil.GenRandBytes(t, int(unit.MB))
+	ctx := context.Background()
+
+	// Ensure the key does not exist
+	if _, _, err := store.Pull(ctx, "foo/bar/baz"); err != storage.ErrKeyNotFound {
+		t.Errorf("expect error %s, but got %v", storage.ErrKeyNotFound, err)
+	}
+
+	// Push/Pull
+	if err := store.Push(ctx, "foo/bar/baz", bytes.NewReader(expect)); err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+	out, info, err := store.Pull(ctx, "foo/bar/baz")
+	if err != nil {
+		t.Fatal("Error pulling data from storage", err)
+	}
+	got, err := ioutil.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	if !bytes.Equal(expect, got) {
+		t.Errorf("expect text %s, but got %s",
+			testutil.Truncate(expect, 140), testutil.Truncate(got, 140),
+		)
+	}
+	if info.Size() != int64(len(expect)) {
+		t.Errorf("expect size %d, but got %d", len(expect), info.Size())
+	}
+
+	// Overwrite
+	if err := store.Push(ctx, "foo/bar/baz", strings.NewReader("qux")); err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+	info, err = store.Info(ctx, "foo/bar/baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 3 {
+		t.Errorf("expect size 3, but got %d", info.Size())
+	}
+
+	// Delete
+	if err := store.Delete(ctx, "foo/bar/baz"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Info(ctx, "foo/bar/baz"); err != storage.ErrKeyNotFound {
+		t.Errorf("expect error %s, but got %v", storage.ErrKeyNotFound, err)
+	}
+}
+
+func TestResume(t *testing.T) {
+	var drops int
+	server := httptest.NewServer(newHandler(
+		func(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+			if r.Method == "GET" && drops < 3 {
+				drops++
+				return &dropWriter{ResponseWriter: w, left: 100 << 10}
+			}
+			return w
+		},
+	))
+	defer server.Close()
+	store := newStore(t, server.URL)
+
+	expect := testutil.GenRandBytes(t, int(unit.MB))
+	ctx := context.Background()
+	if err := store.Push(ctx, "foo", bytes.NewReader(expect)); err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+	out, _, err := store.Pull(ctx, "foo")
+	if err != nil {
+		t.Fatal("Error pulling data from storage", err)
+	}
+	got, err := ioutil.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	if !bytes.Equal(expect, got) {
+		t.Error("expect resumed download to return the whole data")
+	}
+	if drops != 3 {
+		t.Errorf("expect 3 dropped connections, but got %d", drops)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	table := []struct {
+		name  string
+		depth bool
+	}{
+		{name: "infinity", depth: true},
+		{name: "finite", depth: false},
+	}
+	for _, test := range table {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(newHandler(
+				func(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+					if !test.depth && r.Header.Get("Depth") == "infinity" {
+						w.WriteHeader(http.StatusForbidden)
+						return nil
+					}
+					return w
+				},
+			))
+			defer server.Close()
+			store := newStore(t, server.URL)
+
+			ctx := context.Background()
+			expect := []string{"a/b/c", "a/d", "e"}
+			for _, key := range expect {
+				if err := store.Push(ctx, key, strings.NewReader("foo")); err != nil {
+					t.Fatal("Error pushing data to storage", err)
+				}
+			}
+
+			var keys []string
+			filter := storage.WalkFilter{To: math.MaxInt64}
+			store.Walk(ctx, &filter, func(key string, f os.FileInfo, err error) error {
+				if err != nil {
+					t.Fatal(err)
+				}
+				keys = append(keys, key)
+				return nil
+			})
+			sort.Strings(keys)
+			if strings.Join(keys, ",") != strings.Join(expect, ",") {
+				t.Errorf("expect keys %v, but got %v", expect, keys)
+			}
+		})
+	}
+}
+
+// TestPlainHTTP ensures that files are pushed directly to servers which do
+// not support WebDAV
+func TestPlainHTTP(t *testing.T) {
+	server := httptest.NewServer(newHandler(
+		func(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+			switch r.Method {
+			case "OPTIONS", "MOVE", "MKCOL", "PROPFIND":
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return nil
+			}
+			return w
+		},
+	))
+	defer server.Close()
+
+	// Collections cannot be created on plain HTTP servers, so the file is
+	// pushed to the root
+	ctx := context.Background()
+	store := &webdav.Store{
+		URL:      server.URL + "/dav",
+		Username: "kargo",
+		Password: "secret",
+	}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Push(ctx, "foo", strings.NewReader("bar")); err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+	info, err := store.Info(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 3 {
+		t.Errorf("expect size 3, but got %d", info.Size())
+	}
+}
+
+func TestAuth(t *testing.T) {
+	server := httptest.NewServer(newHandler(
+		func(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+			if r.Header.Get("Authorization") != "Bearer secret" ||
+				r.Header.Get("X-Tenant") != "kargo" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return nil
+			}
+			return w
+		},
+	))
+	defer server.Close()
+
+	ctx := context.Background()
+	store := &webdav.Store{
+		URL:     server.URL + "/dav",
+		Token:   "secret",
+		Headers: map[string]string{"X-Tenant": "kargo"},
+	}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Push(ctx, "foo/bar", strings.NewReader("baz")); err != nil {
+		t.Fatal("Error pushing data to storage", err)
+	}
+
+	store = &webdav.Store{URL: server.URL + "/dav", Token: "wrong"}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Push(ctx, "foo/bar", strings.NewReader("baz")); err == nil {
+		t.Error("expect push with a wrong token to fail")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	server := httptest.NewServer(newHandler(nil))
+	defer server.Close()
+
+	var i int
+	storagetest.Run(t, func() storage.Storage {
+		i++
+		return &webdav.Store{
+			URL:      server.URL + "/dav",
+			Folder:   strconv.Itoa(i),
+			Username: "kargo",
+			Password: "secret",
+		}
+	})
+}
+
+func newStore(t *testing.T, u string) *webdav.Store {
+	store := &webdav.Store{
+		URL:      u + "/dav",
+		Folder:   "backups",
+		Username: "kargo",
+		Password: "secret",
+	}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// middleware intercepts requests before the WebDAV handler. It returns the
+// response writer to pass on, or nil when the request has been handled.
+type middleware func(w http.ResponseWriter, r *http.Request) http.ResponseWriter
+
+// newHandler returns a WebDAV handler backed by memory. Requests must be
+// authenticated either with basic auth or by the middleware.
+func newHandler(m middleware) http.Handler {
+	h := &xwebdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: xwebdav.NewMemFS(),
+		LockSystem: xwebdav.NewMemLS(),
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m != nil {
+			if w = m(w, r); w == nil {
+				return
+			}
+		}
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != "kargo" || pass != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// dropWriter aborts the connection after writing a number of bytes
+type dropWriter struct {
+	http.ResponseWriter
+	left int
+}
+
+func (w *dropWriter) Write(p []byte) (int, error) {
+	if len(p) <= w.left {
+		w.left -= len(p)
+		return w.ResponseWriter.Write(p)
+	}
+	w.ResponseWriter.Write(p[:w.left])
+	w.ResponseWriter.(http.Flusher).Flush()
+	panic(http.ErrAbortHandler)
+}
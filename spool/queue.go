@@ -0,0 +1,177 @@
+package spool
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/log"
+	"github.com/stairlin/kargo/plugin/storage"
+)
+
+const (
+	// DefaultRetries is the default number of retries of an upload
+	DefaultRetries = 5
+	// DefaultBackoff is the default delay before the first retry of an upload
+	DefaultBackoff = time.Second
+	// DefaultMaxBackoff is the default maximum delay between two retries
+	DefaultMaxBackoff = time.Minute
+)
+
+// Queue uploads the backups of a spool to a storage, oldest first, and
+// retries them with exponential backoff
+type Queue struct {
+	Spool   *Spool
+	Storage storage.Storage
+
+	// Retries is the number of times an upload is retried before giving up
+	Retries int
+	// Backoff is the delay before the first retry. It doubles on every retry,
+	// up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Throttle wraps the data uploaded (optional)
+	Throttle func(ctx *context.Context, r io.ReadCloser) io.ReadCloser
+}
+
+// Result is the outcome of an upload
+type Result struct {
+	Key  string
+	Size int64
+	Err  error
+	// Quarantined is set when the backup cannot be uploaded, regardless of
+	// retries (e.g. its key is locked). It has been moved out of the spool.
+	Quarantined bool
+}
+
+// NewQueue returns a queue with the default settings
+func NewQueue(s *Spool, store storage.Storage) *Queue {
+	return &Queue{
+		Spool:      s,
+		Storage:    store,
+		Retries:    DefaultRetries,
+		Backoff:    DefaultBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+	}
+}
+
+// Start uploads the pending backups in the background. A result is sent for
+// every upload, and the channel is closed once the spool is empty. Backups
+// which can never be uploaded are quarantined, and the queue moves on. When
+// an upload fails after all retries, the queue stops, and the remaining
+// backups stay pending until the next run.
+//
+// A single process uploads the backups of a spool at a time, so Start waits
+// for other processes to release the spool.
+func (q *Queue) Start(ctx *context.Context) <-chan Result {
+	results := make(chan Result)
+	go func() {
+		defer close(results)
+
+		unlock, err := q.Spool.Lock(ctx)
+		if err != nil {
+			results <- Result{Err: err}
+			return
+		}
+		defer unlock()
+
+		entries, err := q.Spool.Entries()
+		if err != nil {
+			results <- Result{Err: err}
+			return
+		}
+		for _, e := range entries {
+			res := Result{Key: e.Key, Size: e.Size}
+			res.Err = q.upload(ctx, e)
+			if res.Err != nil && isPermanent(res.Err) {
+				if err := q.Spool.Quarantine(e.Key); err != nil {
+					res.Err = errors.Wrapf(err, "cannot quarantine %s", e.Key)
+				} else {
+					res.Quarantined = true
+				}
+			}
+			results <- res
+			if res.Err != nil && !res.Quarantined {
+				return
+			}
+		}
+	}()
+	return results
+}
+
+// Flush uploads the pending backups, and waits for them. It returns the
+// uploaded backups, along with the first error.
+func (q *Queue) Flush(ctx *context.Context) ([]Result, error) {
+	var uploaded []Result
+	var err error
+	for res := range q.Start(ctx) {
+		if res.Err != nil {
+			if err == nil {
+				err = res.Err
+			}
+			continue
+		}
+		uploaded = append(uploaded, res)
+	}
+	return uploaded, err
+}
+
+// isPermanent returns whether retrying the upload which failed with err
+// cannot succeed
+func isPermanent(err error) bool {
+	switch errors.Cause(err) {
+	case storage.ErrLocked, storage.ErrInvalidKey:
+		return true
+	}
+	return false
+}
+
+// upload uploads e, and removes it from the spool
+func (q *Queue) upload(ctx *context.Context, e Entry) error {
+	backoff := q.Backoff
+	for retry := 0; ; retry++ {
+		err := q.push(ctx, e.Key)
+		switch {
+		case err == nil:
+			return q.Spool.Remove(e.Key)
+		case os.IsNotExist(errors.Cause(err)):
+			// Uploaded or evicted by another process
+			return nil
+		case isPermanent(err):
+			return errors.Wrapf(err, "cannot upload %s", e.Key)
+		}
+		if retry >= q.Retries || ctx.Err() != nil {
+			return errors.Wrapf(err, "cannot upload %s", e.Key)
+		}
+
+		ctx.Warn("Upload failed. Retrying...",
+			log.String("key", e.Key),
+			log.Int("retry", retry+1),
+			log.String("backoff", backoff.String()),
+			log.Error(err),
+		)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "cannot upload %s", e.Key)
+		}
+		if backoff *= 2; q.MaxBackoff > 0 && backoff > q.MaxBackoff {
+			backoff = q.MaxBackoff
+		}
+	}
+}
+
+func (q *Queue) push(ctx *context.Context, key string) error {
+	data, info, err := q.Spool.Open(key)
+	if err != nil {
+		return err
+	}
+	if q.Throttle != nil {
+		data = q.Throttle(ctx, data)
+	}
+	defer data.Close()
+	meta := &storage.Meta{CreatedAt: info.ModTime()}
+	return storage.PushMeta(ctx, q.Storage, key, data, meta)
+}
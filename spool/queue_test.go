@@ -0,0 +1,171 @@
+package spool_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/pkg/testutil"
+	"github.com/stairlin/kargo/plugin/storage"
+	"github.com/stairlin/kargo/plugin/storage/memory"
+	"github.com/stairlin/kargo/spool"
+)
+
+func TestFlush(t *testing.T) {
+	dir := testutil.TempDir(t, "spool")
+	defer os.RemoveAll(dir)
+	s := open(t, dir, 0)
+	add(t, s, "a", []byte("aaaa"))
+	add(t, s, "b", []byte("bbbb"))
+
+	store := &flakyStore{Store: &memory.Store{Bucket: "spool-flush"}, failures: 2}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	q := newQueue(s, store)
+	uploaded, err := q.Flush(context.Background())
+	if err != nil {
+		t.Fatal("cannot flush spool", err)
+	}
+	if len(uploaded) != 2 || uploaded[0].Key != "a" || uploaded[1].Key != "b" {
+		t.Errorf("expect a and b to be uploaded, but got %v", uploaded)
+	}
+	checkEntries(t, s)
+
+	for _, key := range []string{"a", "b"} {
+		r, _, err := store.Pull(context.Background(), key)
+		if err != nil {
+			t.Fatalf("%s: cannot pull key: %s", key, err)
+		}
+		data, _ := ioutil.ReadAll(r)
+		if string(data) != key+key+key+key {
+			t.Errorf("%s: unexpected data %s", key, data)
+		}
+	}
+}
+
+func TestFlushFailure(t *testing.T) {
+	dir := testutil.TempDir(t, "spool")
+	defer os.RemoveAll(dir)
+	s := open(t, dir, 0)
+	add(t, s, "a", []byte("aaaa"))
+	add(t, s, "b", []byte("bbbb"))
+
+	store := &flakyStore{Store: &memory.Store{Bucket: "spool-failure"}, failures: 100}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	q := newQueue(s, store)
+	uploaded, err := q.Flush(context.Background())
+	if err == nil {
+		t.Error("expect flush to fail")
+	}
+	if len(uploaded) > 0 {
+		t.Errorf("expect no uploads, but got %v", uploaded)
+	}
+	// The queue stops at the first backup which cannot be uploaded
+	if store.calls != q.Retries+1 {
+		t.Errorf("expect %d pushes, but got %d", q.Retries+1, store.calls)
+	}
+	checkEntries(t, s, "a", "b")
+}
+
+func TestFlushQuarantine(t *testing.T) {
+	dir := testutil.TempDir(t, "spool")
+	defer os.RemoveAll(dir)
+	s := open(t, dir, 0)
+	add(t, s, "a", []byte("aaaa"))
+	add(t, s, "b", []byte("bbbb"))
+
+	// a can never be uploaded, but must not block b
+	store := &flakyStore{
+		Store:  &memory.Store{Bucket: "spool-quarantine"},
+		locked: map[string]bool{"a": true},
+	}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	q := newQueue(s, store)
+	uploaded, err := q.Flush(context.Background())
+	if errors.Cause(err) != storage.ErrLocked {
+		t.Errorf("expect error %s, but got %v", storage.ErrLocked, err)
+	}
+	if len(uploaded) != 1 || uploaded[0].Key != "b" {
+		t.Errorf("expect b to be uploaded, but got %v", uploaded)
+	}
+	// Locked keys are not retried
+	if store.calls != 2 {
+		t.Errorf("expect 2 pushes, but got %d", store.calls)
+	}
+	checkEntries(t, s)
+	if _, err := os.Stat(filepath.Join(dir, "failed", "a")); err != nil {
+		t.Errorf("expect a to be quarantined: %s", err)
+	}
+}
+
+func TestFlushLock(t *testing.T) {
+	dir := testutil.TempDir(t, "spool")
+	defer os.RemoveAll(dir)
+	s := open(t, dir, 0)
+	add(t, s, "a", []byte("aaaa"))
+
+	store := &flakyStore{Store: &memory.Store{Bucket: "spool-lock"}}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process is uploading the spool
+	unlock, err := open(t, dir, 0).Lock(context.Background())
+	if err != nil {
+		t.Fatal("cannot lock spool", err)
+	}
+	ctx := context.WithDeadline(context.Background(), time.Now().Add(50*time.Millisecond))
+	if _, err := newQueue(s, store).Flush(ctx); err == nil {
+		t.Error("expect flush to wait for the lock")
+	}
+	if store.calls != 0 {
+		t.Errorf("expect no pushes while the spool is locked, but got %d", store.calls)
+	}
+
+	unlock()
+	uploaded, err := newQueue(s, store).Flush(context.Background())
+	if err != nil {
+		t.Fatal("cannot flush spool", err)
+	}
+	if len(uploaded) != 1 {
+		t.Errorf("expect a to be uploaded, but got %v", uploaded)
+	}
+}
+
+func newQueue(s *spool.Spool, store *flakyStore) *spool.Queue {
+	q := spool.NewQueue(s, store)
+	q.Retries = 3
+	q.Backoff = time.Millisecond
+	return q
+}
+
+// flakyStore fails a number of pushes, and all pushes of locked keys
+type flakyStore struct {
+	*memory.Store
+
+	failures int
+	locked   map[string]bool
+	calls    int
+}
+
+func (s *flakyStore) Push(ctx *context.Context, key string, r io.Reader) error {
+	s.calls++
+	if s.locked[key] {
+		return storage.ErrLocked
+	}
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("storage unavailable")
+	}
+	return s.Store.Push(ctx, key, r)
+}
@@ -0,0 +1,255 @@
+// Package spool keeps processed backups on the local disk until they are
+// uploaded to the storage. Spooled backups survive process restarts, so
+// a backup taken while the storage is unavailable is uploaded later.
+package spool
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/log"
+)
+
+const (
+	// tempPrefix is the prefix of backups which are being spooled
+	tempPrefix = ".spool-"
+	// failedDir is the directory of backups which cannot be uploaded
+	failedDir = "failed"
+	// lockRetry is the delay between two attempts to lock the spool
+	lockRetry = time.Second
+	// staleAge is the age after which a temporary file is considered abandoned
+	staleAge = time.Hour * 24
+)
+
+// Spool is a directory of backups pending upload. When MaxSize is exceeded,
+// the oldest backups are evicted.
+type Spool struct {
+	Dir string
+	// MaxSize is the maximum size of the spool in bytes. Zero is unlimited.
+	MaxSize int64
+
+	mu sync.Mutex
+}
+
+// Entry is a backup pending upload
+type Entry struct {
+	Key  string
+	Size int64
+	// ModTime is the creation time of the backup
+	ModTime time.Time
+}
+
+// Open opens the spool dir, and creates it when it does not exist
+func Open(dir string, maxSize int64) (*Spool, error) {
+	dir = filepath.Clean(dir)
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return nil, errors.Wrapf(err, "cannot create spool dir '%s'", dir)
+	}
+	s := &Spool{Dir: dir, MaxSize: maxSize}
+	s.sweep()
+	return s, nil
+}
+
+// Add spools data from r under key. It replaces a pending backup with the
+// same key, and evicts the oldest backups when the spool exceeds its size.
+// The modification time of the spool file is the start time of ctx, which
+// is the creation time of the backup.
+func (s *Spool) Add(ctx *context.Context, key string, r io.Reader) error {
+	f, err := ioutil.TempFile(s.Dir, tempPrefix)
+	if err != nil {
+		return errors.Wrap(err, "cannot create spool file")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	buf := bufio.NewWriter(f)
+	if _, err := io.Copy(buf, ctx.Reader(r)); err != nil {
+		return errors.Wrap(err, "cannot copy data to spool file")
+	}
+	if err := buf.Flush(); err != nil {
+		return errors.Wrap(err, "cannot flush buffer to spool file")
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Wrap(err, "cannot sync data to the disk")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "cannot close spool file")
+	}
+	if err := os.Chtimes(f.Name(), time.Now(), ctx.StartTime); err != nil {
+		return errors.Wrap(err, "cannot set spool file time")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Rename(f.Name(), s.path(key)); err != nil {
+		return errors.Wrap(err, "cannot rename spool file")
+	}
+	return s.evict(ctx, key)
+}
+
+// Open opens the data of key
+func (s *Spool) Open(key string) (io.ReadCloser, os.FileInfo, error) {
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot open spool file")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, errors.Wrap(err, "cannot stat spool file")
+	}
+	return f, info, nil
+}
+
+// Remove removes key from the spool. Removing a missing key is not an error,
+// since another process may have uploaded it.
+func (s *Spool) Remove(key string) error {
+	err := os.Remove(s.path(key))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "cannot remove spool file")
+	}
+	return nil
+}
+
+// Quarantine moves key out of the spool to the failed directory, where it is
+// kept for manual recovery. It is no longer uploaded nor evicted.
+func (s *Spool) Quarantine(key string) error {
+	dir := filepath.Join(s.Dir, failedDir)
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return errors.Wrap(err, "cannot create failed dir")
+	}
+	err := os.Rename(s.path(key), filepath.Join(dir, url.PathEscape(key)))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "cannot quarantine spool file")
+	}
+	return nil
+}
+
+// Lock locks the spool dir, so that a single process uploads its backups at
+// a time. It waits until the lock is released by other processes, and
+// returns a function which releases it.
+func (s *Spool) Lock(ctx *context.Context) (func(), error) {
+	f, err := os.Open(s.Dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open spool dir")
+	}
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, errors.Wrap(err, "cannot lock spool dir")
+		}
+		select {
+		case <-time.After(lockRetry):
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		}
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// Entries returns the backups pending upload, oldest first
+func (s *Spool) Entries() ([]Entry, error) {
+	infos, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read spool dir")
+	}
+	var entries []Entry
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), tempPrefix) {
+			continue
+		}
+		key, err := url.PathUnescape(info.Name())
+		if err != nil {
+			continue
+		}
+		entries = append(entries, Entry{
+			Key:     key,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].ModTime.Equal(entries[j].ModTime) {
+			return entries[i].Key < entries[j].Key
+		}
+		return entries[i].ModTime.Before(entries[j].ModTime)
+	})
+	return entries, nil
+}
+
+// evict removes the oldest backups until the spool fits within its size.
+// The backup which has just been spooled is never evicted, therefore a backup
+// larger than the spool is rejected.
+func (s *Spool) evict(ctx *context.Context, key string) error {
+	if s.MaxSize <= 0 {
+		return nil
+	}
+	entries, err := s.Entries()
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, e := range entries {
+		size += e.Size
+	}
+	for _, e := range entries {
+		if size <= s.MaxSize {
+			return nil
+		}
+		if e.Key == key {
+			continue
+		}
+		if err := s.Remove(e.Key); err != nil {
+			return err
+		}
+		size -= e.Size
+		ctx.Warn("Spool is full. Evicted pending backup",
+			log.String("key", e.Key),
+			log.Int64("size", e.Size),
+		)
+	}
+	if size > s.MaxSize {
+		s.Remove(key)
+		return errors.Errorf("backup is larger than the spool (%d bytes)", s.MaxSize)
+	}
+	return nil
+}
+
+// sweep removes temporary files left behind by a crash
+func (s *Spool) sweep() {
+	infos, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), tempPrefix) &&
+			time.Since(info.ModTime()) > staleAge {
+			os.Remove(filepath.Join(s.Dir, info.Name()))
+		}
+	}
+}
+
+// path returns the path of key. Keys are escaped, so that nested keys are
+// stored flat.
+func (s *Spool) path(key string) string {
+	return filepath.Join(s.Dir, url.PathEscape(key))
+}
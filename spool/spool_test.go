@@ -0,0 +1,128 @@
+package spool_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stairlin/kargo/context"
+	"github.com/stairlin/kargo/pkg/testutil"
+	"github.com/stairlin/kargo/spool"
+)
+
+func TestAdd(t *testing.T) {
+	dir := testutil.TempDir(t, "spool")
+	defer os.RemoveAll(dir)
+	s := open(t, dir, 0)
+
+	add(t, s, "db/foo", []byte("foo"))
+	add(t, s, "bar", []byte("bar"))
+	checkEntries(t, s, "db/foo", "bar")
+
+	r, info, err := s.Open("db/foo")
+	if err != nil {
+		t.Fatal("cannot open key", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "foo" || info.Size() != 3 {
+		t.Errorf("expect data foo (3), but got %s (%d)", data, info.Size())
+	}
+
+	// Pending backups survive restarts
+	checkEntries(t, open(t, dir, 0), "db/foo", "bar")
+
+	if err := s.Remove("db/foo"); err != nil {
+		t.Fatal("cannot remove key", err)
+	}
+	if err := s.Remove("db/foo"); err != nil {
+		t.Error("expect removing a missing key to succeed, but got", err)
+	}
+	checkEntries(t, s, "bar")
+}
+
+// TestAddTime ensures that entries keep the creation time of backups, which
+// is the start time of their context
+func TestAddTime(t *testing.T) {
+	dir := testutil.TempDir(t, "spool")
+	defer os.RemoveAll(dir)
+	s := open(t, dir, 0)
+
+	ctx := context.Background()
+	ctx.StartTime = time.Date(2018, 6, 1, 12, 30, 0, 0, time.UTC)
+	if err := s.Add(ctx, "foo", bytes.NewReader([]byte("foo"))); err != nil {
+		t.Fatal("cannot add key", err)
+	}
+	entries, err := s.Entries()
+	if err != nil {
+		t.Fatal("cannot list entries", err)
+	}
+	if len(entries) != 1 || !entries[0].ModTime.Equal(ctx.StartTime) {
+		t.Errorf("expect entry created at %s, but got %v", ctx.StartTime, entries)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	dir := testutil.TempDir(t, "spool")
+	defer os.RemoveAll(dir)
+	s := open(t, dir, 10)
+
+	add(t, s, "a", []byte("aaaa"))
+	add(t, s, "b", []byte("bbbb"))
+	checkEntries(t, s, "a", "b")
+
+	// Oldest backups are evicted first
+	add(t, s, "c", []byte("cccc"))
+	checkEntries(t, s, "b", "c")
+	add(t, s, "d", []byte("dddddddd"))
+	checkEntries(t, s, "d")
+
+	// Backups larger than the spool are rejected
+	err := s.Add(context.Background(), "e", bytes.NewReader(make([]byte, 11)))
+	if err == nil {
+		t.Error("expect a backup larger than the spool to be rejected")
+	}
+	checkEntries(t, s)
+}
+
+func open(t *testing.T, dir string, maxSize int64) *spool.Spool {
+	s, err := spool.Open(dir, maxSize)
+	if err != nil {
+		t.Fatal("cannot open spool", err)
+	}
+	return s
+}
+
+func add(t *testing.T, s *spool.Spool, key string, data []byte) {
+	if err := s.Add(context.Background(), key, bytes.NewReader(data)); err != nil {
+		t.Fatalf("%s: cannot add key: %s", key, err)
+	}
+	// Entries are sorted by modification time
+	time.Sleep(10 * time.Millisecond)
+}
+
+func checkEntries(t *testing.T, s *spool.Spool, keys ...string) {
+	entries, err := s.Entries()
+	if err != nil {
+		t.Fatal("cannot list entries", err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Key)
+	}
+	if len(got) != len(keys) {
+		t.Errorf("expect entries %v, but got %v", keys, got)
+		return
+	}
+	for i := range keys {
+		if got[i] != keys[i] {
+			t.Errorf("expect entries %v, but got %v", keys, got)
+			return
+		}
+	}
+}